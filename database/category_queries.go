@@ -0,0 +1,354 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// CategoryDraft holds the editable fields of a category. A ParentID of 0
+// makes it a top-level category; an empty TopicRole means anyone may open
+// topics in it.
+type CategoryDraft struct {
+	Name        string
+	Description string
+	Color       string
+	ParentID    int
+	Position    int
+	TopicRole   string
+}
+
+// Normalize trims the name, fills in the default TopicRole and checks the
+// colour and role.
+func (d *CategoryDraft) Normalize() error {
+	d.Name = strings.TrimSpace(d.Name)
+	if d.TopicRole == "" {
+		d.TopicRole = models.RoleUser
+	}
+	if !models.ValidRole(d.TopicRole) {
+		return ErrInvalidRole
+	}
+	if !models.ValidColor(d.Color) {
+		return ErrInvalidColor
+	}
+	return nil
+}
+
+const categoryColumns = "id, name, description, color, parent_id, position, topic_role, topic_count, created_at"
+
+func scanCategory(row scanner) (*models.Category, error) {
+	var category models.Category
+	var parentID sql.NullInt64
+
+	err := row.Scan(&category.ID, &category.Name, &category.Description, &category.Color, &parentID,
+		&category.Position, &category.TopicRole, &category.Topics, &category.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	category.ParentID = int(parentID.Int64)
+	return &category, nil
+}
+
+// AddCategory creates a category and returns it.
+func (s *SQLiteStore) AddCategory(ctx context.Context, draft CategoryDraft) (*models.Category, error) {
+	if err := draft.Normalize(); err != nil {
+		return nil, err
+	}
+
+	var category *models.Category
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := checkCategoryName(ctx, tx, 0, draft.Name); err != nil {
+			return err
+		}
+		if err := checkCategoryParent(ctx, tx, 0, draft.ParentID); err != nil {
+			return err
+		}
+
+		parent := sql.NullInt64{Int64: int64(draft.ParentID), Valid: draft.ParentID != 0}
+		res, err := tx.ExecContext(ctx, `INSERT INTO categories (name, description, color, parent_id, position, topic_role)
+						VALUES (?, ?, ?, ?, ?, ?)`,
+			draft.Name, draft.Description, draft.Color, parent, draft.Position, draft.TopicRole)
+		if err != nil {
+			log.Printf("error inserting category '%s': %v", draft.Name, err)
+			return fmt.Errorf("could not insert category: %w", err)
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			log.Printf("error retrieving last insert ID: %v", err)
+			return fmt.Errorf("could not retrieve category ID: %w", err)
+		}
+
+		category, err = getCategory(ctx, tx, int(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("category added successfully:", category.Name)
+	return category, nil
+}
+
+// UpdateCategory replaces the editable fields of a category and returns it.
+func (s *SQLiteStore) UpdateCategory(ctx context.Context, id int, draft CategoryDraft) (*models.Category, error) {
+	if err := draft.Normalize(); err != nil {
+		return nil, err
+	}
+
+	var category *models.Category
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := getCategory(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := checkCategoryName(ctx, tx, id, draft.Name); err != nil {
+			return err
+		}
+		if err := checkCategoryParent(ctx, tx, id, draft.ParentID); err != nil {
+			return err
+		}
+
+		parent := sql.NullInt64{Int64: int64(draft.ParentID), Valid: draft.ParentID != 0}
+		_, err := tx.ExecContext(ctx, `UPDATE categories SET name = ?, description = ?, color = ?, parent_id = ?, position = ?, topic_role = ?
+						WHERE id = ?`,
+			draft.Name, draft.Description, draft.Color, parent, draft.Position, draft.TopicRole, id)
+		if err != nil {
+			log.Printf("error updating category ID %d: %v", id, err)
+			return fmt.Errorf("could not update category: %w", err)
+		}
+
+		category, err = getCategory(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("category updated successfully:", category.Name)
+	return category, nil
+}
+
+// RemoveCategory deletes an empty category. Its topics and sub-categories
+// have to be moved elsewhere first, and the default category cannot be
+// removed at all.
+func (s *SQLiteStore) RemoveCategory(ctx context.Context, id int) error {
+	if id == models.DefaultCategoryID {
+		return ErrDefaultCategory
+	}
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := getCategory(ctx, tx, id); err != nil {
+			return err
+		}
+
+		var contents int
+		err := tx.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM topics WHERE category_id = ?)
+						+ (SELECT COUNT(*) FROM categories WHERE parent_id = ?)`, id, id).Scan(&contents)
+		if err != nil {
+			log.Printf("error checking contents of category ID %d: %v", id, err)
+			return fmt.Errorf("could not check category contents: %w", err)
+		}
+		if contents > 0 {
+			return ErrCategoryNotEmpty
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM categories WHERE id = ?", id)
+		if err != nil {
+			log.Printf("error deleting category ID %d: %v", id, err)
+			return fmt.Errorf("could not delete category: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("category ID %d removed successfully", id)
+	return nil
+}
+
+// GetCategory returns a category along with its sub-categories.
+func (s *SQLiteStore) GetCategory(ctx context.Context, id int) (*models.Category, error) {
+	category, err := getCategory(ctx, s.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := s.queryCategories(ctx, "WHERE parent_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	category.Children = children
+	return category, nil
+}
+
+// GetCategories returns the top-level categories in order, each with its
+// sub-categories in order.
+func (s *SQLiteStore) GetCategories(ctx context.Context) ([]models.Category, error) {
+	all, err := s.queryCategories(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return categoryTree(all), nil
+}
+
+func (s *SQLiteStore) queryCategories(ctx context.Context, where string, args ...any) ([]models.Category, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+categoryColumns+" FROM categories "+where+" ORDER BY position, name", args...)
+	if err != nil {
+		log.Printf("error fetching categories: %v", err)
+		return nil, fmt.Errorf("could not fetch categories: %w", err)
+	}
+	defer rows.Close()
+
+	categories := []models.Category{}
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			log.Printf("error scanning category row: %v", err)
+			return nil, fmt.Errorf("could not scan category row: %w", err)
+		}
+		categories = append(categories, *category)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading category rows: %v", err)
+		return nil, fmt.Errorf("could not read categories: %w", err)
+	}
+
+	return categories, nil
+}
+
+// categoryTree nests each sub-category in ordered under its parent, keeping
+// the order of both levels.
+func categoryTree(ordered []models.Category) []models.Category {
+	children := make(map[int][]models.Category)
+	for _, c := range ordered {
+		if c.ParentID != 0 {
+			children[c.ParentID] = append(children[c.ParentID], c)
+		}
+	}
+
+	tree := []models.Category{}
+	for _, c := range ordered {
+		if c.ParentID == 0 {
+			c.Children = children[c.ID]
+			tree = append(tree, c)
+		}
+	}
+	return tree
+}
+
+func getCategory(ctx context.Context, q querier, id int) (*models.Category, error) {
+	category, err := scanCategory(q.QueryRowContext(ctx, "SELECT "+categoryColumns+" FROM categories WHERE id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrCategoryNotFound
+		}
+		log.Printf("error fetching category ID %d: %v", id, err)
+		return nil, fmt.Errorf("could not fetch category: %w", err)
+	}
+	return category, nil
+}
+
+// checkCategoryName makes sure no category other than id is called name.
+func checkCategoryName(ctx context.Context, tx *sql.Tx, id int, name string) error {
+	var existingID int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name = ?", name).Scan(&existingID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Printf("error checking if category exists: %v", err)
+		return fmt.Errorf("could not check if category exists: %w", err)
+	}
+	if existingID != id {
+		return ErrCategoryExists
+	}
+	return nil
+}
+
+// checkCategoryParent makes sure category id (0 for a new one) may be
+// placed under parentID: the parent must be another top-level category, and
+// a category with sub-categories of its own must stay top-level.
+func checkCategoryParent(ctx context.Context, tx *sql.Tx, id, parentID int) error {
+	if parentID == 0 {
+		return nil
+	}
+	if parentID == id {
+		return ErrInvalidParent
+	}
+
+	var grandparentID sql.NullInt64
+	err := tx.QueryRowContext(ctx, "SELECT parent_id FROM categories WHERE id = ?", parentID).Scan(&grandparentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidParent
+		}
+		log.Printf("error fetching parent category ID %d: %v", parentID, err)
+		return fmt.Errorf("could not fetch parent category: %w", err)
+	}
+	if grandparentID.Valid {
+		return ErrCategoryTooDeep
+	}
+
+	if id != 0 {
+		var children int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM categories WHERE parent_id = ?", id).Scan(&children)
+		if err != nil {
+			log.Printf("error counting sub-categories of category ID %d: %v", id, err)
+			return fmt.Errorf("could not count sub-categories: %w", err)
+		}
+		if children > 0 {
+			return ErrCategoryTooDeep
+		}
+	}
+	return nil
+}
+
+// recountCategories recomputes topic_count for the given categories.
+func recountCategories(ctx context.Context, tx *sql.Tx, categoryIDs ...int) error {
+	ids, args := inList(categoryIDs)
+	_, err := tx.ExecContext(ctx, "UPDATE categories SET topic_count = (SELECT COUNT(*) FROM topics WHERE category_id = categories.id) WHERE id IN "+ids, args...)
+	if err != nil {
+		log.Printf("error recounting categories: %v", err)
+		return fmt.Errorf("could not recount categories: %w", err)
+	}
+	return nil
+}
+
+// MoveTopic files a topic under another category.
+func (s *SQLiteStore) MoveTopic(ctx context.Context, topicID, categoryID int) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var fromID int
+		err := tx.QueryRowContext(ctx, "SELECT category_id FROM topics WHERE id = ?", topicID).Scan(&fromID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrTopicNotFound
+			}
+			log.Printf("error fetching topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not fetch topic: %w", err)
+		}
+
+		if _, err := getCategory(ctx, tx, categoryID); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET category_id = ? WHERE id = ?", categoryID, topicID)
+		if err != nil {
+			log.Printf("error moving topic ID %d to category ID %d: %v", topicID, categoryID, err)
+			return fmt.Errorf("could not move topic: %w", err)
+		}
+
+		return recountCategories(ctx, tx, fromID, categoryID)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("topic ID %d moved to category ID %d", topicID, categoryID)
+	return nil
+}
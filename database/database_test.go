@@ -1,80 +1,49 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/totp"
 	_ "modernc.org/sqlite"
 )
 
-var testDB *sql.DB
+var (
+	testDB    *sql.DB
+	testStore *SQLiteStore
+	ctx       = context.Background()
+)
 
 func TestMain(m *testing.M) {
 	var err error
 
-	testDB, err = sql.Open("sqlite", ":memory:")
+	testDB, err = sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
 	if err != nil {
 		log.Fatalf("failed to open in-memory database: %v", err)
 	}
+	// Every connection to :memory: is a separate database.
+	testDB.SetMaxOpenConns(1)
 
-	err = SetupTables(testDB)
+	_, err = MigrateUp(testDB)
 	if err != nil {
-		log.Fatalf("failed to setup tables: %v", err)
+		log.Fatalf("failed to migrate test database: %v", err)
 	}
+	testStore = NewSQLiteStore(testDB)
 
 	code := m.Run()
 	testDB.Close()
 	os.Exit(code)
 }
 
-func SetupTables(db *sql.DB) error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-    		id INTEGER PRIMARY KEY AUTOINCREMENT,
-    		username TEXT UNIQUE NOT NULL,
-    		password TEXT NOT NULL,
-			email TEXT NOT NULL,
-			reset_code TEXT DEFAULT NULL,
-    		topics_opened INTEGER DEFAULT 0,
-    		messages_sent INTEGER DEFAULT 0,
-    		creation_date DATETIME DEFAULT CURRENT_TIMESTAMP
-		);`,
-		`CREATE TABLE IF NOT EXISTS topics (
-    		id INTEGER PRIMARY KEY AUTOINCREMENT,
-    		title TEXT UNIQUE NOT NULL,
-    		messages INTEGER DEFAULT 0,
-			upvotes INTEGER DEFAULT 0,
-    		creation_date DATETIME DEFAULT CURRENT_TIMESTAMP,
-    		creator_id INTEGER,
-    		FOREIGN KEY (creator_id) REFERENCES users(id)
-		);`,
-		`CREATE TABLE IF NOT EXISTS messages (
-    		id INTEGER PRIMARY KEY AUTOINCREMENT,
-    		message TEXT,
-    		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-			likes INTEGER DEFAULT 0,
-    		user_id INTEGER,
-    		parent_id INTEGER DEFAULT NULL,
-    		topic_id INTEGER NOT NULL,
-    		FOREIGN KEY (user_id) REFERENCES users(id),
-    		FOREIGN KEY (parent_id) REFERENCES messages(id),
-    		FOREIGN KEY (topic_id) REFERENCES topics(id) ON DELETE CASCADE
-		);`,
-	}
-
-	for _, query := range queries {
-		_, err := db.Exec(query)
-		if err != nil {
-			log.Printf("error executing query: %s\nError: %v", query, err)
-			return err
-		}
-	}
-	return nil
-}
-
 func PrintTableContents(db *sql.DB, tableName string) {
 	query := "SELECT * FROM " + tableName
 	rows, err := db.Query(query)
@@ -117,7 +86,7 @@ func TestAddUser(t *testing.T) {
 	email := "test@mail.com"
 	password := "password"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
@@ -140,7 +109,7 @@ func TestRemoveUser(t *testing.T) {
 	email := "removal@mail.com"
 	password := "removal"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
@@ -157,7 +126,7 @@ func TestRemoveUser(t *testing.T) {
 		t.Errorf("expected username %s, got %s", username, storedUsername)
 	}
 
-	err = RemoveUser(testDB, username)
+	err = testStore.RemoveUser(ctx, username)
 	if err != nil {
 		t.Fatalf("RemoveUser failed: %v", err)
 	}
@@ -172,9 +141,9 @@ func TestRemoveUser(t *testing.T) {
 		t.Fatalf("unexpected error while checking for removed user: %v", err)
 	}
 
-	err = RemoveUser(testDB, "nonexistentUser")
-	if err == nil {
-		t.Error("expected RemoveUser to fail for nonexistent user, but it succeeded")
+	err = testStore.RemoveUser(ctx, "nonexistentUser")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound for nonexistent user, got %v", err)
 	}
 }
 
@@ -183,12 +152,12 @@ func TestCheckPassword(t *testing.T) {
 	email := "password@mail.com"
 	password := "securepassword"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	valid, err := CheckPassword(testDB, username, password)
+	valid, err := testStore.CheckPassword(ctx, username, password)
 	if err != nil {
 		t.Fatalf("CheckPassword failed: %v", err)
 	}
@@ -197,7 +166,7 @@ func TestCheckPassword(t *testing.T) {
 		t.Errorf("expected password to be valid for user %s", username)
 	}
 
-	valid, err = CheckPassword(testDB, username, "wrongpassword")
+	valid, err = testStore.CheckPassword(ctx, username, "wrongpassword")
 	if err != nil {
 		t.Fatalf("CheckPassword failed: %v", err)
 	}
@@ -213,21 +182,21 @@ func TestChangePassword(t *testing.T) {
 	password := "oldpassword"
 	newPassword := "newpassword"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "users")
 
-	err = ChangePassword(testDB, username, password, newPassword)
+	err = testStore.ChangePassword(ctx, username, password, newPassword)
 	if err != nil {
 		t.Fatalf("ChangePassword failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "users")
 
-	valid, err := CheckPassword(testDB, username, newPassword)
+	valid, err := testStore.CheckPassword(ctx, username, newPassword)
 	if err != nil {
 		t.Fatalf("CheckPassword failed: %v", err)
 	}
@@ -236,7 +205,7 @@ func TestChangePassword(t *testing.T) {
 		t.Errorf("expected new password to be valid for user %s", username)
 	}
 
-	valid, err = CheckPassword(testDB, username, password)
+	valid, err = testStore.CheckPassword(ctx, username, password)
 	if err != nil {
 		t.Fatalf("CheckPassword failed: %v", err)
 	}
@@ -252,21 +221,33 @@ func TestChangeEmail(t *testing.T) {
 	newEmail := "newemail@mail.com"
 	password := "password"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "users")
 
-	err = ChangeEmail(testDB, username, newEmail)
+	token, err := testStore.ChangeEmail(ctx, username, newEmail)
 	if err != nil {
 		t.Fatalf("ChangeEmail failed: %v", err)
 	}
 
+	var updatedEmail string
+	err = testDB.QueryRow("SELECT email FROM users WHERE username = ?", username).Scan(&updatedEmail)
+	if err != nil {
+		t.Fatalf("failed to fetch email: %v", err)
+	}
+	if updatedEmail != email {
+		t.Errorf("expected email to stay %s until verified, got %s", email, updatedEmail)
+	}
+
+	if _, err := testStore.VerifyEmail(ctx, token); err != nil {
+		t.Fatalf("VerifyEmail failed: %v", err)
+	}
+
 	PrintTableContents(testDB, "users")
 
-	var updatedEmail string
 	err = testDB.QueryRow("SELECT email FROM users WHERE username = ?", username).Scan(&updatedEmail)
 	if err != nil {
 		t.Fatalf("failed to fetch updated email: %v", err)
@@ -276,9 +257,105 @@ func TestChangeEmail(t *testing.T) {
 		t.Errorf("expected email %s, got %s", newEmail, updatedEmail)
 	}
 
-	err = ChangeEmail(testDB, username, newEmail)
-	if err == nil {
-		t.Error("expected ChangeEmail to fail for duplicate email, but it succeeded")
+	_, err = testStore.ChangeEmail(ctx, username, newEmail)
+	if !errors.Is(err, ErrEmailInUse) {
+		t.Errorf("expected ErrEmailInUse for duplicate email, got %v", err)
+	}
+
+	_, err = testStore.ChangeEmail(ctx, username, "not an email")
+	if !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("expected ErrInvalidEmail for a malformed email, got %v", err)
+	}
+}
+
+func TestIsValidEmail(t *testing.T) {
+	valid := []string{"alice@example.com", "a.b+tag@mail.example.org", "x@localhost"}
+	for _, email := range valid {
+		if !IsValidEmail(email) {
+			t.Errorf("expected %q to be valid", email)
+		}
+	}
+
+	invalid := []string{"", "alice", "alice@", "@example.com", "Alice <alice@example.com>", "<alice@example.com>",
+		"alice@example.com\r\nBcc: eve@example.com", "alice@[127.0.0.1]", strings.Repeat("a", MaxEmailLength) + "@example.com"}
+	for _, email := range invalid {
+		if IsValidEmail(email) {
+			t.Errorf("expected %q to be invalid", email)
+		}
+	}
+
+	if err := testStore.AddUser(ctx, "badEmailUser", "not an email", "password"); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("expected ErrInvalidEmail from AddUser, got %v", err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	db, store := openTestStore(t)
+
+	if err := store.AddUser(ctx, "verifyUser", "verify@mail.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	user, err := store.GetUser(ctx, "verifyUser")
+	if err != nil {
+		t.Fatalf("GetUser failed: %v", err)
+	}
+	if user.EmailVerified {
+		t.Error("expected a new user's email to be unverified")
+	}
+
+	email, first, err := store.CreateEmailVerification(ctx, "verifyUser")
+	if err != nil || email != "verify@mail.com" {
+		t.Fatalf("CreateEmailVerification failed: %s, %v", email, err)
+	}
+	_, second, err := store.CreateEmailVerification(ctx, "verifyUser")
+	if err != nil {
+		t.Fatalf("second CreateEmailVerification failed: %v", err)
+	}
+
+	if _, err := store.VerifyEmail(ctx, first); !errors.Is(err, ErrInvalidVerification) {
+		t.Errorf("expected a replaced token to be refused, got %v", err)
+	}
+	username, err := store.VerifyEmail(ctx, second)
+	if err != nil || username != "verifyUser" {
+		t.Fatalf("VerifyEmail failed: %s, %v", username, err)
+	}
+	if _, err := store.VerifyEmail(ctx, second); !errors.Is(err, ErrInvalidVerification) {
+		t.Errorf("expected a used token to be refused, got %v", err)
+	}
+
+	users, _, err := store.GetAllUsers(ctx, ListOptions{})
+	if err != nil || len(users) != 1 || !users[0].EmailVerified {
+		t.Errorf("expected the listed user to be verified, got %+v, %v", users, err)
+	}
+	if _, _, err := store.CreateEmailVerification(ctx, "verifyUser"); !errors.Is(err, ErrEmailVerified) {
+		t.Errorf("expected ErrEmailVerified, got %v", err)
+	}
+
+	// An address taken while a change is pending cannot be verified.
+	token, err := store.ChangeEmail(ctx, "verifyUser", "taken@mail.com")
+	if err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	if err := store.AddUser(ctx, "quickUser", "taken@mail.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	if _, err := store.VerifyEmail(ctx, token); !errors.Is(err, ErrEmailInUse) {
+		t.Errorf("expected ErrEmailInUse, got %v", err)
+	}
+
+	token, err = store.ChangeEmail(ctx, "verifyUser", "later@mail.com")
+	if err != nil {
+		t.Fatalf("ChangeEmail failed: %v", err)
+	}
+	if _, err := db.Exec("UPDATE email_verifications SET expires_at = datetime('now', '-1 minute')"); err != nil {
+		t.Fatalf("failed to expire token: %v", err)
+	}
+	if _, err := store.VerifyEmail(ctx, token); !errors.Is(err, ErrInvalidVerification) {
+		t.Errorf("expected an expired token to be refused, got %v", err)
+	}
+
+	if _, err := store.ChangeEmail(ctx, "nobody", "nobody@mail.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
 	}
 }
 
@@ -288,14 +365,14 @@ func TestChangeUsername(t *testing.T) {
 	email := "username@mail.com"
 	password := "password"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "users")
 
-	err = ChangeUsername(testDB, username, newUsername)
+	err = testStore.ChangeUsername(ctx, username, newUsername)
 	if err != nil {
 		t.Fatalf("ChangeUsername failed: %v", err)
 	}
@@ -312,14 +389,14 @@ func TestChangeUsername(t *testing.T) {
 		t.Errorf("expected username %s, got %s", newUsername, updatedUsername)
 	}
 
-	err = ChangeUsername(testDB, newUsername, newUsername)
-	if err == nil {
-		t.Error("expected ChangeUsername to fail for duplicate username, but it succeeded")
+	err = testStore.ChangeUsername(ctx, newUsername, newUsername)
+	if !errors.Is(err, ErrUsernameInUse) {
+		t.Errorf("expected ErrUsernameInUse for duplicate username, got %v", err)
 	}
 
-	err = ChangeUsername(testDB, newUsername, "in valid!")
-	if err == nil {
-		t.Error("expected ChangeUsername to fail for invalid username, but it succeeded")
+	err = testStore.ChangeUsername(ctx, newUsername, "in valid!")
+	if !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("expected ErrInvalidUsername for invalid username, got %v", err)
 	}
 }
 
@@ -328,30 +405,51 @@ func TestGeneratePasswordResetCode(t *testing.T) {
 	email := "resetuser@test.com"
 	password := "testpassword"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	resetCode, err := GeneratePasswordResetCode(testDB, email)
+	resetCode, err := testStore.GeneratePasswordResetCode(ctx, email)
 	if err != nil {
 		t.Fatalf("GeneratePasswordResetCode failed: %v", err)
 	}
 
-	if resetCode == "" {
-		t.Error("expected a reset code to be generated, got an empty string")
+	if len(resetCode) < 40 {
+		t.Errorf("expected a long random token, got %q", resetCode)
 	}
 
-	PrintTableContents(testDB, "users")
+	PrintTableContents(testDB, "password_resets")
+
+	var storedHash string
+	var fresh bool
+	err = testDB.QueryRow(`SELECT token_hash, expires_at > datetime('now', '+59 minutes') FROM password_resets
+				WHERE user_id = (SELECT id FROM users WHERE email = ?)`, email).Scan(&storedHash, &fresh)
+	if err != nil {
+		t.Fatalf("failed to fetch reset token: %v", err)
+	}
+
+	if storedHash == resetCode || storedHash != hashToken(resetCode) {
+		t.Errorf("expected only the hash of the token to be stored, got %s", storedHash)
+	}
+	if !fresh {
+		t.Error("expected the token to expire in an hour")
+	}
 
-	var storedResetCode string
-	err = testDB.QueryRow("SELECT reset_code FROM users WHERE email = ?", email).Scan(&storedResetCode)
+	again, err := testStore.GeneratePasswordResetCode(ctx, email)
 	if err != nil {
-		t.Fatalf("failed to fetch reset code: %v", err)
+		t.Fatalf("GeneratePasswordResetCode failed: %v", err)
+	}
+	if again == resetCode {
+		t.Error("expected a new token each time")
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM password_resets WHERE token_hash = ?", hashToken(resetCode)); n != 0 {
+		t.Errorf("expected the new token to replace the old one, found %d", n)
 	}
 
-	if storedResetCode != resetCode {
-		t.Errorf("expected reset code %s, got %s", resetCode, storedResetCode)
+	_, err = testStore.GeneratePasswordResetCode(ctx, "nobody@test.com")
+	if !errors.Is(err, ErrEmailNotFound) {
+		t.Errorf("expected ErrEmailNotFound for an unknown email, got %v", err)
 	}
 }
 
@@ -361,46 +459,103 @@ func TestResetPassword(t *testing.T) {
 	password := "oldpassword"
 	newPassword := "newpassword"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
+	if err := testStore.AddUser(ctx, "resetBystander", "resetbystander@test.com", password); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
 
-	PrintTableContents(testDB, "users")
-
-	resetCode, err := GeneratePasswordResetCode(testDB, email)
+	resetCode, err := testStore.GeneratePasswordResetCode(ctx, email)
 	if err != nil {
 		t.Fatalf("GeneratePasswordResetCode failed: %v", err)
 	}
+	session, err := testStore.CreateSession(ctx, username, "test")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
 
-	PrintTableContents(testDB, "users")
+	PrintTableContents(testDB, "password_resets")
+
+	// The token only works for the email it was sent to.
+	err = testStore.ResetPassword(ctx, "resetbystander@test.com", resetCode, newPassword)
+	if !errors.Is(err, ErrInvalidResetCode) {
+		t.Errorf("expected ErrInvalidResetCode for another user's email, got %v", err)
+	}
 
-	err = ResetPassword(testDB, email, resetCode, newPassword)
+	err = testStore.ResetPassword(ctx, email, "wrong", newPassword)
+	if !errors.Is(err, ErrInvalidResetCode) {
+		t.Errorf("expected ErrInvalidResetCode for a wrong token, got %v", err)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM password_resets WHERE token_hash = ? AND attempts = 1", hashToken(resetCode)); n != 1 {
+		t.Errorf("expected the wrong guess to be counted")
+	}
+
+	err = testStore.ResetPassword(ctx, email, resetCode, newPassword)
 	if err != nil {
 		t.Fatalf("ResetPassword failed: %v", err)
 	}
 
-	valid, err := CheckPassword(testDB, username, newPassword)
+	valid, err := testStore.CheckPassword(ctx, username, newPassword)
 	if err != nil {
 		t.Fatalf("CheckPassword failed: %v", err)
 	}
 
-	PrintTableContents(testDB, "users")
-
 	if !valid {
 		t.Errorf("expected new password to be valid for user %s", username)
 	}
 
-	var storedResetCode sql.NullString
-	err = testDB.QueryRow("SELECT reset_code FROM users WHERE email = ?", email).Scan(&storedResetCode)
-	if err != nil {
-		t.Fatalf("failed to fetch reset_code: %v", err)
+	if n := countRows(t, "SELECT COUNT(*) FROM password_resets WHERE token_hash = ?", hashToken(resetCode)); n != 0 {
+		t.Errorf("expected the token to be used up, found %d", n)
+	}
+	if _, err := testStore.GetSessionUser(ctx, session); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("expected the user's sessions to end, got %v", err)
 	}
 
-	if storedResetCode.Valid {
-		t.Errorf("expected reset code to be cleared, but found: %s", storedResetCode.String)
+	err = testStore.ResetPassword(ctx, email, resetCode, "thirdpassword")
+	if !errors.Is(err, ErrInvalidResetCode) {
+		t.Errorf("expected ErrInvalidResetCode for a used token, got %v", err)
 	}
 
+	t.Run("Expired", func(t *testing.T) {
+		resetCode, err := testStore.GeneratePasswordResetCode(ctx, email)
+		if err != nil {
+			t.Fatalf("GeneratePasswordResetCode failed: %v", err)
+		}
+		_, err = testDB.Exec("UPDATE password_resets SET expires_at = datetime('now', '-1 minute') WHERE token_hash = ?", hashToken(resetCode))
+		if err != nil {
+			t.Fatalf("failed to expire token: %v", err)
+		}
+
+		err = testStore.ResetPassword(ctx, email, resetCode, "thirdpassword")
+		if !errors.Is(err, ErrInvalidResetCode) {
+			t.Errorf("expected ErrInvalidResetCode for an expired token, got %v", err)
+		}
+		if n := countRows(t, "SELECT COUNT(*) FROM password_resets WHERE token_hash = ?", hashToken(resetCode)); n != 0 {
+			t.Errorf("expected the expired token to be deleted, found %d", n)
+		}
+	})
+
+	t.Run("Too_many_attempts", func(t *testing.T) {
+		resetCode, err := testStore.GeneratePasswordResetCode(ctx, email)
+		if err != nil {
+			t.Fatalf("GeneratePasswordResetCode failed: %v", err)
+		}
+
+		for i := 0; i < MaxResetAttempts; i++ {
+			err = testStore.ResetPassword(ctx, email, "wrong", "thirdpassword")
+			if !errors.Is(err, ErrInvalidResetCode) {
+				t.Fatalf("expected ErrInvalidResetCode for a wrong token, got %v", err)
+			}
+		}
+
+		err = testStore.ResetPassword(ctx, email, resetCode, "thirdpassword")
+		if !errors.Is(err, ErrInvalidResetCode) {
+			t.Errorf("expected the token to stop working after %d wrong guesses, got %v", MaxResetAttempts, err)
+		}
+	})
+
 	PrintTableContents(testDB, "users")
 }
 
@@ -416,7 +571,7 @@ func TestGetAllUsers(t *testing.T) {
 	}
 
 	for _, user := range users {
-		err := AddUser(testDB, user.username, user.email, user.password)
+		err := testStore.AddUser(ctx, user.username, user.email, user.password)
 		if err != nil {
 			t.Fatalf("AddUser failed: %v", err)
 		}
@@ -424,7 +579,7 @@ func TestGetAllUsers(t *testing.T) {
 
 	PrintTableContents(testDB, "users")
 
-	allUsers, err := GetAllUsers(testDB)
+	allUsers, _, err := testStore.GetAllUsers(ctx, ListOptions{})
 	if err != nil {
 		t.Fatalf("GetAllUsers failed: %v", err)
 	}
@@ -436,7 +591,7 @@ func TestGetAllUsers(t *testing.T) {
 	for _, user := range users {
 		found := false
 		for _, u := range allUsers {
-			if u["username"] == user.username {
+			if u.Username == user.username {
 				found = true
 				break
 			}
@@ -447,18 +602,78 @@ func TestGetAllUsers(t *testing.T) {
 	}
 }
 
+func TestSetRole(t *testing.T) {
+	_, store := openTestStore(t)
+
+	for _, name := range []string{"roleAlice", "roleBob"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+
+	user, err := store.GetUser(ctx, "roleAlice")
+	if err != nil {
+		t.Fatalf("GetUser failed: %v", err)
+	}
+	if user.Role != models.RoleUser {
+		t.Errorf("expected new users to have role %q, got %q", models.RoleUser, user.Role)
+	}
+
+	if err := store.SetRole(ctx, "roleAlice", models.RoleAdmin); err != nil {
+		t.Fatalf("SetRole failed: %v", err)
+	}
+
+	token, err := store.CreateSession(ctx, "roleAlice", "test")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	sessionUser, err := store.GetSessionUser(ctx, token)
+	if err != nil {
+		t.Fatalf("GetSessionUser failed: %v", err)
+	}
+	if sessionUser.Role != models.RoleAdmin {
+		t.Errorf("expected the session user to be an admin, got %q", sessionUser.Role)
+	}
+
+	if err := store.SetRole(ctx, "roleAlice", models.RoleModerator); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("expected ErrLastAdmin, got %v", err)
+	}
+	if err := store.SetRole(ctx, "roleBob", "owner"); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("expected ErrInvalidRole, got %v", err)
+	}
+	if err := store.SetRole(ctx, "nobody", models.RoleAdmin); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// With a second admin around, the first one can step down.
+	if err := store.SetRole(ctx, "roleBob", models.RoleAdmin); err != nil {
+		t.Fatalf("SetRole failed: %v", err)
+	}
+	if err := store.SetRole(ctx, "roleAlice", models.RoleModerator); err != nil {
+		t.Fatalf("SetRole failed: %v", err)
+	}
+
+	users, _, err := store.GetAllUsers(ctx, ListOptions{Sort: SortOldest})
+	if err != nil {
+		t.Fatalf("GetAllUsers failed: %v", err)
+	}
+	if len(users) != 2 || users[0].Role != models.RoleModerator || users[1].Role != models.RoleAdmin {
+		t.Errorf("unexpected roles in listing: %+v", users)
+	}
+}
+
 func TestAddTopic(t *testing.T) {
 	username := "topicUser"
 	email := "topicuser@test.com"
 	password := "password"
 	topicTitle := "Test Topic"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	_, err = testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
@@ -486,7 +701,7 @@ func TestAddTopic(t *testing.T) {
 		t.Errorf("expected topics_opened to be 1, got %d", topicsOpened)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	_, err = testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err == nil {
 		t.Error("expected AddTopic to fail for duplicate title, but it succeeded")
 	}
@@ -498,19 +713,19 @@ func TestRemoveTopic(t *testing.T) {
 	password := "password"
 	topicTitle := "Removable Topic"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "topics")
 
-	err = RemoveTopic(testDB, topicTitle)
+	err = testStore.RemoveTopic(ctx, topic.ID)
 	if err != nil {
 		t.Fatalf("RemoveTopic failed: %v", err)
 	}
@@ -525,9 +740,9 @@ func TestRemoveTopic(t *testing.T) {
 		t.Fatalf("unexpected error while checking topic removal: %v", err)
 	}
 
-	err = RemoveTopic(testDB, "Nonexistent Topic")
-	if err == nil {
-		t.Error("expected RemoveTopic to fail for nonexistent topic, but it succeeded")
+	err = testStore.RemoveTopic(ctx, 999999)
+	if !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound for nonexistent topic, got %v", err)
 	}
 }
 
@@ -537,12 +752,12 @@ func TestUpVoteAndDownVoteTopic(t *testing.T) {
 	password := "password"
 	topicTitle := "Votable Topic"
 
-	err := AddUser(testDB, username, email, password)
+	err := testStore.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
@@ -555,7 +770,7 @@ func TestUpVoteAndDownVoteTopic(t *testing.T) {
 		t.Fatalf("failed to fetch initial upvotes for topic: %v", err)
 	}
 
-	err = UpVoteTopic(testDB, topicTitle, username)
+	err = testStore.UpVoteTopic(ctx, topic.ID, username)
 	if err != nil {
 		t.Fatalf("UpVoteTopic failed: %v", err)
 	}
@@ -565,15 +780,84 @@ func TestUpVoteAndDownVoteTopic(t *testing.T) {
 	var updatedUpvotes int
 	err = testDB.QueryRow("SELECT upvotes FROM topics WHERE title = ?", topicTitle).Scan(&updatedUpvotes)
 	if err != nil {
-		t.Fatalf("expected upvotes to be %d, got %d", initialUpvotes+1, updatedUpvotes)
+		t.Fatalf("failed to fetch updated upvotes for topic: %v", err)
+	}
+
+	if updatedUpvotes != initialUpvotes+1 {
+		t.Errorf("expected upvotes to be %d, got %d", initialUpvotes+1, updatedUpvotes)
+	}
+
+	err = testStore.UpVoteTopic(ctx, topic.ID, username)
+	if !errors.Is(err, ErrVoteExists) {
+		t.Errorf("expected second upvote to be rejected, got %v", err)
 	}
 
-	err = DownVoteTopic(testDB, topicTitle, username)
+	err = testStore.DownVoteTopic(ctx, topic.ID, username)
 	if err != nil {
 		t.Fatalf("DownVoteTopic failed: %v", err)
 	}
 
-	PrintTableContents(testDB, "topics")
+	PrintTableContents(testDB, "topic_votes")
+
+	err = testDB.QueryRow("SELECT upvotes FROM topics WHERE title = ?", topicTitle).Scan(&updatedUpvotes)
+	if err != nil {
+		t.Fatalf("failed to fetch updated upvotes for topic: %v", err)
+	}
+
+	if updatedUpvotes != initialUpvotes-1 {
+		t.Errorf("expected switched vote to leave upvotes at %d, got %d", initialUpvotes-1, updatedUpvotes)
+	}
+
+	err = testStore.DownVoteTopic(ctx, topic.ID, username)
+	if !errors.Is(err, ErrVoteExists) {
+		t.Errorf("expected second downvote to be rejected, got %v", err)
+	}
+
+	vote, err := testStore.GetTopicVote(ctx, topic.ID, username)
+	if err != nil {
+		t.Fatalf("GetTopicVote failed: %v", err)
+	}
+	if vote != -1 {
+		t.Errorf("expected vote -1, got %d", vote)
+	}
+
+	otherUser := "voteUser2"
+	err = testStore.AddUser(ctx, otherUser, "voteuser2@test.com", password)
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	err = testStore.UpVoteTopic(ctx, topic.ID, otherUser)
+	if err != nil {
+		t.Fatalf("UpVoteTopic failed for second user: %v", err)
+	}
+
+	err = testStore.RetractTopicVote(ctx, topic.ID, username)
+	if err != nil {
+		t.Fatalf("RetractTopicVote failed: %v", err)
+	}
+
+	err = testDB.QueryRow("SELECT upvotes FROM topics WHERE title = ?", topicTitle).Scan(&updatedUpvotes)
+	if err != nil {
+		t.Fatalf("failed to fetch updated upvotes for topic: %v", err)
+	}
+
+	if updatedUpvotes != initialUpvotes+1 {
+		t.Errorf("expected upvotes to be %d after retracting, got %d", initialUpvotes+1, updatedUpvotes)
+	}
+
+	vote, err = testStore.GetTopicVote(ctx, topic.ID, username)
+	if err != nil {
+		t.Fatalf("GetTopicVote failed: %v", err)
+	}
+	if vote != 0 {
+		t.Errorf("expected no vote after retracting, got %d", vote)
+	}
+
+	err = testStore.RemoveUser(ctx, otherUser)
+	if err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
 
 	err = testDB.QueryRow("SELECT upvotes FROM topics WHERE title = ?", topicTitle).Scan(&updatedUpvotes)
 	if err != nil {
@@ -581,7 +865,12 @@ func TestUpVoteAndDownVoteTopic(t *testing.T) {
 	}
 
 	if updatedUpvotes != initialUpvotes {
-		t.Errorf("expected upvotes to be %d, got %d", initialUpvotes, updatedUpvotes)
+		t.Errorf("expected removed user's vote to be dropped, got %d upvotes", updatedUpvotes)
+	}
+
+	err = testStore.UpVoteTopic(ctx, 999999, username)
+	if !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected 'topic not found', got %v", err)
 	}
 }
 
@@ -596,12 +885,12 @@ func TestGetAllTopics(t *testing.T) {
 	}
 
 	for _, topic := range topics {
-		err := AddUser(testDB, topic.username, fmt.Sprintf("%s@test.com", topic.username), "password")
+		err := testStore.AddUser(ctx, topic.username, fmt.Sprintf("%s@test.com", topic.username), "password")
 		if err != nil {
 			t.Fatalf("AddUser failed: %v", err)
 		}
 
-		err = AddTopic(testDB, topic.title, topic.username)
+		_, err = testStore.AddTopic(ctx, TopicDraft{Title: topic.title}, topic.username)
 		if err != nil {
 			t.Fatalf("AddTopic failed: %v", err)
 		}
@@ -609,7 +898,7 @@ func TestGetAllTopics(t *testing.T) {
 
 	PrintTableContents(testDB, "topics")
 
-	allTopics, err := GetAllTopics(testDB)
+	allTopics, _, err := testStore.GetAllTopics(ctx, ListOptions{})
 	if err != nil {
 		t.Fatalf("GetAllTopics failed: %v", err)
 	}
@@ -621,7 +910,7 @@ func TestGetAllTopics(t *testing.T) {
 	for _, topic := range topics {
 		found := false
 		for _, t := range allTopics {
-			if t["title"] == topic.title {
+			if t.Title == topic.title {
 				found = true
 				break
 			}
@@ -632,43 +921,60 @@ func TestGetAllTopics(t *testing.T) {
 	}
 }
 
-func TestGetTopicsByTitle(t *testing.T) {
+func TestGetTopic(t *testing.T) {
 	username := "userTopicByTitle"
 	topicTitle := "Unique Topic"
 
-	err := AddUser(testDB, username, fmt.Sprintf("%s@test.com", username), "password")
+	err := testStore.AddUser(ctx, username, fmt.Sprintf("%s@test.com", username), "password")
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	added, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "topics")
 
-	topic, err := GetTopicByTitle(testDB, topicTitle)
+	topic, err := testStore.GetTopic(ctx, added.ID)
 	if err != nil {
-		t.Fatalf("GetTopicByTitle failed: %v", err)
+		t.Fatalf("GetTopic failed: %v", err)
 	}
 
-	if topic["title"] != topicTitle {
-		t.Errorf("expected title %s, got %s", topicTitle, topic["title"])
+	if topic.Title != topicTitle {
+		t.Errorf("expected title %s, got %s", topicTitle, topic.Title)
 	}
 
-	if topic["creator_id"] == nil {
-		t.Errorf("expected a creator_id for topic %s, but got nil", topicTitle)
+	if topic.CreatorID == 0 {
+		t.Errorf("expected a creator_id for topic %s, but got none", topicTitle)
 	}
 
-	_, err = GetTopicByTitle(testDB, "Nonexsitent Topic")
-	if err == nil {
-		t.Errorf("expected error for nonexistent topic, but got nil")
+	if topic.Slug != "unique-topic" {
+		t.Errorf("expected slug unique-topic, got %s", topic.Slug)
+	}
+
+	bySlug, err := testStore.GetTopicBySlug(ctx, topic.Slug)
+	if err != nil {
+		t.Fatalf("GetTopicBySlug failed: %v", err)
+	}
+	if bySlug.ID != topic.ID {
+		t.Errorf("expected topic ID %d by slug, got %d", topic.ID, bySlug.ID)
+	}
+
+	_, err = testStore.GetTopic(ctx, 999999)
+	if !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound for nonexistent topic, got %v", err)
+	}
+
+	_, err = testStore.GetTopicBySlug(ctx, "nonexistent-topic")
+	if !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound for nonexistent slug, got %v", err)
 	}
 }
 
 func TestCountTopics(t *testing.T) {
-	initialCount, err := CountTopics(testDB)
+	initialCount, err := testStore.CountTopics(ctx)
 	if err != nil {
 		t.Fatalf("CountTopics failed initially: %v", err)
 	}
@@ -676,19 +982,19 @@ func TestCountTopics(t *testing.T) {
 	username := "countUser"
 	topicTitle := "Countable Topic"
 
-	err = AddUser(testDB, username, fmt.Sprintf("%s@test.com", username), "password")
+	err = testStore.AddUser(ctx, username, fmt.Sprintf("%s@test.com", username), "password")
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "topics")
 
-	currentCount, err := CountTopics(testDB)
+	currentCount, err := testStore.CountTopics(ctx)
 	if err != nil {
 		t.Fatalf("CountTopics failed after adding a topic: %v", err)
 	}
@@ -697,14 +1003,14 @@ func TestCountTopics(t *testing.T) {
 		t.Errorf("expected topic count to be %d, but got %d", initialCount+1, currentCount)
 	}
 
-	err = RemoveTopic(testDB, topicTitle)
+	err = testStore.RemoveTopic(ctx, topic.ID)
 	if err != nil {
 		t.Fatalf("Removetopic failed: %v", err)
 	}
 
 	PrintTableContents(testDB, "topics")
 
-	finalCount, err := CountTopics(testDB)
+	finalCount, err := testStore.CountTopics(ctx)
 	if err != nil {
 		t.Fatalf("CountTopics failed after removing a topic: %v", err)
 	}
@@ -714,284 +1020,3110 @@ func TestCountTopics(t *testing.T) {
 	}
 }
 
-func TestAddMessage(t *testing.T) {
-	username := "messageUser"
-	topic := "messageTopic"
-	message := "This is a test message."
+func TestTopicTags(t *testing.T) {
+	_, store := openTestStore(t)
 
-	err := AddUser(testDB, username, fmt.Sprintf("%s@test.com", username), "password")
-	if err != nil {
+	if err := store.AddUser(ctx, "tagger", "tagger@test.com", "password"); err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topic, username)
-	if err != nil {
-		t.Fatalf("AddTopic failed: %v", err)
+	drafts := []TopicDraft{
+		{Title: "Go and SQLite", Description: "Embedding a database", Body: "Which driver?", Tags: []string{" Go ", "sqlite", "go"}},
+		{Title: "Go generics", Tags: []string{"go", "generics"}},
+		{Title: "Postgres tuning", Tags: []string{"postgres", "sql"}},
+	}
+	var added []*models.Topic
+	for _, draft := range drafts {
+		topic, err := store.AddTopic(ctx, draft, "tagger")
+		if err != nil {
+			t.Fatalf("AddTopic(%q) failed: %v", draft.Title, err)
+		}
+		added = append(added, topic)
 	}
 
-	PrintTableContents(testDB, "users")
-	PrintTableContents(testDB, "topics")
-
-	err = AddMessage(testDB, topic, message, username)
+	topic, err := store.GetTopic(ctx, added[0].ID)
 	if err != nil {
-		t.Fatalf("AddMessage failed: %v", err)
+		t.Fatalf("GetTopic failed: %v", err)
+	}
+	if topic.Description != "Embedding a database" || topic.Body != "Which driver?" || fmt.Sprint(topic.Tags) != "[go sqlite]" {
+		t.Errorf("unexpected topic: %+v", topic)
 	}
 
-	PrintTableContents(testDB, "messages")
+	titles := func(opts ListOptions) string {
+		t.Helper()
+		topics, _, err := store.GetAllTopics(ctx, opts)
+		if err != nil {
+			t.Fatalf("GetAllTopics(%+v) failed: %v", opts, err)
+		}
+		var got []string
+		for _, topic := range topics {
+			got = append(got, topic.Title)
+		}
+		return strings.Join(got, ", ")
+	}
 
-	var storedMessage string
-	var storedUserID, storedTopicID int
-	err = testDB.QueryRow("SELECT message, user_id, topic_id FROM messages WHERE message = ?", message).
-		Scan(&storedMessage, &storedUserID, &storedTopicID)
-	if err != nil {
-		t.Fatalf("failed to fetch message: %v", err)
+	tests := []struct {
+		tags []string
+		all  bool
+		want string
+	}{
+		{[]string{"go"}, false, "Go generics, Go and SQLite"},
+		{[]string{"GO", "sqlite"}, true, "Go and SQLite"},
+		{[]string{"sqlite", "postgres"}, false, "Postgres tuning, Go and SQLite"},
+		{[]string{"sqlite", "postgres"}, true, ""},
+		{[]string{"rust"}, false, ""},
+	}
+	for _, tt := range tests {
+		if got := titles(ListOptions{Tags: tt.tags, AllTags: tt.all}); got != tt.want {
+			t.Errorf("tags %v (all=%v): expected %q, got %q", tt.tags, tt.all, tt.want, got)
+		}
 	}
 
-	if storedMessage != message {
-		t.Errorf("expected message %s, got %s", message, storedMessage)
+	if _, _, err := store.GetAllTopics(ctx, ListOptions{Tags: []string{"no spaces"}}); !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("expected ErrInvalidTag, got %v", err)
+	}
+	if _, err := store.AddTopic(ctx, TopicDraft{Title: "Too many", Tags: []string{"a", "b", "c", "d", "e", "f"}}, "tagger"); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("expected ErrTooManyTags, got %v", err)
 	}
 
-	var messagesSent, messagesInTopic int
-	err = testDB.QueryRow("SELECT messages_sent FROM users WHERE username = ?", username).Scan(&messagesSent)
-	if err != nil {
-		t.Fatalf("failed to fetch messages_sent for user: %v", err)
+	tagList := func(prefix string) string {
+		t.Helper()
+		tags, err := store.ListTags(ctx, prefix, 0)
+		if err != nil {
+			t.Fatalf("ListTags failed: %v", err)
+		}
+		var got []string
+		for _, tag := range tags {
+			got = append(got, fmt.Sprintf("%s:%d", tag.Name, tag.Topics))
+		}
+		return strings.Join(got, " ")
 	}
 
-	if messagesSent != 1 {
-		t.Errorf("expected messages_sent to be 1, got %d", messagesSent)
+	if got := tagList(""); got != "go:2 generics:1 postgres:1 sql:1 sqlite:1" {
+		t.Errorf("unexpected tags: %s", got)
+	}
+	if got := tagList("S"); got != "sql:1 sqlite:1" {
+		t.Errorf("unexpected tags for prefix s: %s", got)
+	}
+	if got := tagList("%"); got != "" {
+		t.Errorf("expected a wildcard prefix to match nothing, got %s", got)
 	}
 
-	err = testDB.QueryRow("SELECT messages FROM topics WHERE title = ?", topic).Scan(&messagesInTopic)
+	tags, err := store.SetTopicTags(ctx, added[1].ID, []string{"golang"})
 	if err != nil {
-		t.Fatalf("failed to fetch messages count for topic: %v", err)
+		t.Fatalf("SetTopicTags failed: %v", err)
+	}
+	if fmt.Sprint(tags) != "[golang]" {
+		t.Errorf("expected [golang], got %v", tags)
+	}
+	if _, err := store.SetTopicTags(ctx, 999999, nil); !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound, got %v", err)
 	}
 
-	if messagesInTopic != 1 {
-		t.Errorf("expected messages in topic to be 1, got %d", messagesInTopic)
+	// Renaming onto a free name keeps the tag; onto a taken one merges it.
+	tag, err := store.RenameTag(ctx, "sql", "databases")
+	if err != nil {
+		t.Fatalf("RenameTag failed: %v", err)
+	}
+	if tag.Name != "databases" || tag.Topics != 1 {
+		t.Errorf("unexpected renamed tag: %+v", tag)
+	}
+	tag, err = store.RenameTag(ctx, "golang", "go")
+	if err != nil {
+		t.Fatalf("RenameTag failed: %v", err)
+	}
+	if tag.Name != "go" || tag.Topics != 2 {
+		t.Errorf("unexpected merged tag: %+v", tag)
+	}
+	if _, err := store.RenameTag(ctx, "golang", "go"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("expected ErrTagNotFound, got %v", err)
+	}
+	if _, err := store.RenameTag(ctx, "go", "Go Lang"); !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("expected ErrInvalidTag, got %v", err)
 	}
 
-	PrintTableContents(testDB, "users")
+	if err := store.RemoveTopic(ctx, added[2].ID); err != nil {
+		t.Fatalf("RemoveTopic failed: %v", err)
+	}
+	if got := tagList(""); got != "go:2 sqlite:1" {
+		t.Errorf("expected removing a topic to update tag counts, got %s", got)
+	}
 }
 
-func TestSetParent(t *testing.T) {
-	username := "parentUser"
-	topic := "parentTopic"
-	parentMessage := "This is the parent message."
-	childMessage := "This is the child message."
+func TestCategories(t *testing.T) {
+	_, store := openTestStore(t)
 
-	err := AddUser(testDB, username, fmt.Sprintf("%s@test.com", username), "password")
-	if err != nil {
+	if err := store.AddUser(ctx, "boardUser", "board@test.com", "password"); err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topic, username)
+	news, err := store.AddCategory(ctx, CategoryDraft{Name: " News ", Color: "#FF8800", Position: 1, TopicRole: models.RoleModerator})
 	if err != nil {
-		t.Fatalf("AddTopic failed: %v", err)
+		t.Fatalf("AddCategory failed: %v", err)
 	}
-
-	err = AddMessage(testDB, topic, parentMessage, username)
+	if news.Name != "News" || news.TopicRole != models.RoleModerator || news.ParentID != 0 {
+		t.Errorf("unexpected category: %+v", news)
+	}
+	releases, err := store.AddCategory(ctx, CategoryDraft{Name: "Releases", ParentID: news.ID})
+	if err != nil {
+		t.Fatalf("AddCategory failed: %v", err)
+	}
+	if releases.TopicRole != models.RoleUser || releases.ParentID != news.ID {
+		t.Errorf("unexpected sub-category: %+v", releases)
+	}
+
+	errorTests := []struct {
+		draft CategoryDraft
+		want  error
+	}{
+		{CategoryDraft{Name: "News"}, ErrCategoryExists},
+		{CategoryDraft{Name: "Nested", ParentID: releases.ID}, ErrCategoryTooDeep},
+		{CategoryDraft{Name: "Orphan", ParentID: 999}, ErrInvalidParent},
+		{CategoryDraft{Name: "Loud", Color: "red"}, ErrInvalidColor},
+		{CategoryDraft{Name: "Secret", TopicRole: "owner"}, ErrInvalidRole},
+	}
+	for _, tt := range errorTests {
+		if _, err := store.AddCategory(ctx, tt.draft); !errors.Is(err, tt.want) {
+			t.Errorf("AddCategory(%+v): expected %v, got %v", tt.draft, tt.want, err)
+		}
+	}
+	if _, err := store.UpdateCategory(ctx, news.ID, CategoryDraft{Name: "News", ParentID: models.DefaultCategoryID}); !errors.Is(err, ErrCategoryTooDeep) {
+		t.Errorf("expected a category with sub-categories to stay top-level, got %v", err)
+	}
+
+	var added []*models.Topic
+	for _, draft := range []TopicDraft{
+		{Title: "Welcome"},
+		{Title: "Version 2", CategoryID: releases.ID},
+		{Title: "Roadmap", CategoryID: news.ID},
+	} {
+		topic, err := store.AddTopic(ctx, draft, "boardUser")
+		if err != nil {
+			t.Fatalf("AddTopic(%q) failed: %v", draft.Title, err)
+		}
+		added = append(added, topic)
+	}
+	if _, err := store.AddTopic(ctx, TopicDraft{Title: "Lost", CategoryID: 999}, "boardUser"); !errors.Is(err, ErrCategoryNotFound) {
+		t.Errorf("expected ErrCategoryNotFound, got %v", err)
+	}
+
+	topic, err := store.GetTopic(ctx, added[0].ID)
+	if err != nil {
+		t.Fatalf("GetTopic failed: %v", err)
+	}
+	if topic.CategoryID != models.DefaultCategoryID {
+		t.Errorf("expected the default category, got %d", topic.CategoryID)
+	}
+
+	categories, err := store.GetCategories(ctx)
+	if err != nil {
+		t.Fatalf("GetCategories failed: %v", err)
+	}
+	var tree []string
+	for _, c := range categories {
+		tree = append(tree, fmt.Sprintf("%s:%d", c.Name, c.Topics))
+		for _, child := range c.Children {
+			tree = append(tree, fmt.Sprintf("-%s:%d", child.Name, child.Topics))
+		}
+	}
+	if got := strings.Join(tree, " "); got != "General:1 News:1 -Releases:1" {
+		t.Errorf("unexpected category tree: %s", got)
+	}
+
+	titles := func(categoryID int) string {
+		t.Helper()
+		topics, _, err := store.GetAllTopics(ctx, ListOptions{CategoryID: categoryID})
+		if err != nil {
+			t.Fatalf("GetAllTopics failed: %v", err)
+		}
+		var got []string
+		for _, topic := range topics {
+			got = append(got, topic.Title)
+		}
+		return strings.Join(got, ", ")
+	}
+	if got := titles(news.ID); got != "Roadmap, Version 2" {
+		t.Errorf("expected a category to list its sub-categories' topics, got %q", got)
+	}
+	if got := titles(releases.ID); got != "Version 2" {
+		t.Errorf("unexpected topics in sub-category: %q", got)
+	}
+	if _, _, err := store.GetAllTopics(ctx, ListOptions{CategoryID: 999}); !errors.Is(err, ErrCategoryNotFound) {
+		t.Errorf("expected ErrCategoryNotFound, got %v", err)
+	}
+
+	if err := store.MoveTopic(ctx, added[2].ID, models.DefaultCategoryID); err != nil {
+		t.Fatalf("MoveTopic failed: %v", err)
+	}
+	if err := store.MoveTopic(ctx, added[2].ID, 999); !errors.Is(err, ErrCategoryNotFound) {
+		t.Errorf("expected ErrCategoryNotFound, got %v", err)
+	}
+	general, err := store.GetCategory(ctx, models.DefaultCategoryID)
+	if err != nil {
+		t.Fatalf("GetCategory failed: %v", err)
+	}
+	if general.Topics != 2 {
+		t.Errorf("expected General to count 2 topics after the move, got %d", general.Topics)
+	}
+	news, err = store.GetCategory(ctx, news.ID)
+	if err != nil {
+		t.Fatalf("GetCategory failed: %v", err)
+	}
+	if news.Topics != 0 || len(news.Children) != 1 {
+		t.Errorf("unexpected category after the move: %+v", news)
+	}
+
+	if err := store.RemoveCategory(ctx, news.ID); !errors.Is(err, ErrCategoryNotEmpty) {
+		t.Errorf("expected ErrCategoryNotEmpty for a category with sub-categories, got %v", err)
+	}
+	if err := store.RemoveCategory(ctx, releases.ID); !errors.Is(err, ErrCategoryNotEmpty) {
+		t.Errorf("expected ErrCategoryNotEmpty for a category with topics, got %v", err)
+	}
+	if err := store.RemoveCategory(ctx, models.DefaultCategoryID); !errors.Is(err, ErrDefaultCategory) {
+		t.Errorf("expected ErrDefaultCategory, got %v", err)
+	}
+	if err := store.RemoveTopic(ctx, added[1].ID); err != nil {
+		t.Fatalf("RemoveTopic failed: %v", err)
+	}
+	if err := store.RemoveCategory(ctx, releases.ID); err != nil {
+		t.Fatalf("RemoveCategory failed: %v", err)
+	}
+	if _, err := store.GetCategory(ctx, releases.ID); !errors.Is(err, ErrCategoryNotFound) {
+		t.Errorf("expected ErrCategoryNotFound, got %v", err)
+	}
+}
+
+func TestTopicSlugs(t *testing.T) {
+	db, store := openTestStore(t)
+
+	if err := store.AddUser(ctx, "slugger", "slugger@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	var added []*models.Topic
+	for _, title := range []string{"Crème Brûlée!", "Creme brulee", "Привет, мир"} {
+		topic, err := store.AddTopic(ctx, TopicDraft{Title: title}, "slugger")
+		if err != nil {
+			t.Fatalf("AddTopic(%q) failed: %v", title, err)
+		}
+		added = append(added, topic)
+	}
+	if got := added[0].Slug + " " + added[1].Slug + " " + added[2].Slug; got != "creme-brulee creme-brulee-2 privet-mir" {
+		t.Errorf("unexpected slugs: %s", got)
+	}
+	if ref := added[2].Ref(); ref != fmt.Sprintf("%d-privet-mir", added[2].ID) {
+		t.Errorf("unexpected ref %s", ref)
+	}
+
+	renamed, err := store.RenameTopic(ctx, added[0].ID, "Tarte Tatin")
+	if err != nil {
+		t.Fatalf("RenameTopic failed: %v", err)
+	}
+	if renamed.Title != "Tarte Tatin" || renamed.Slug != "tarte-tatin" {
+		t.Errorf("unexpected renamed topic: %+v", renamed)
+	}
+
+	// The old slug still leads to the topic and stays reserved for it.
+	topic, err := store.GetTopicBySlug(ctx, "creme-brulee")
+	if err != nil {
+		t.Fatalf("GetTopicBySlug failed: %v", err)
+	}
+	if topic.ID != added[0].ID || topic.Slug != "tarte-tatin" {
+		t.Errorf("expected the old slug to find the renamed topic, got %+v", topic)
+	}
+	other, err := store.AddTopic(ctx, TopicDraft{Title: "Crème brûlée, again"}, "slugger")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	if other.Slug != "creme-brulee-again" {
+		t.Errorf("unexpected slug %s", other.Slug)
+	}
+	if _, err := store.RenameTopic(ctx, other.ID, "Crème brûlée"); err != nil {
+		t.Fatalf("RenameTopic failed: %v", err)
+	}
+	if topic, err := store.GetTopic(ctx, other.ID); err != nil || topic.Slug != "creme-brulee-3" {
+		t.Errorf("expected an old slug to stay taken, got %+v (%v)", topic, err)
+	}
+
+	// Renaming back reclaims the topic's own old slug.
+	renamed, err = store.RenameTopic(ctx, added[0].ID, "Crème Brûlée!")
+	if err != nil {
+		t.Fatalf("RenameTopic failed: %v", err)
+	}
+	if renamed.Slug != "creme-brulee" {
+		t.Errorf("expected the old slug back, got %s", renamed.Slug)
+	}
+	if topic, err := store.GetTopicBySlug(ctx, "tarte-tatin"); err != nil || topic.ID != added[0].ID {
+		t.Errorf("expected tarte-tatin to redirect to the topic, got %+v (%v)", topic, err)
+	}
+
+	if _, err := store.RenameTopic(ctx, added[0].ID, "Creme brulee"); !errors.Is(err, ErrTopicExists) {
+		t.Errorf("expected ErrTopicExists, got %v", err)
+	}
+	if _, err := store.RenameTopic(ctx, 999999, "Anything"); !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound, got %v", err)
+	}
+
+	// Topics from before slugs existed get one on the next backfill.
+	_, err = db.Exec("UPDATE topics SET slug = NULL WHERE id = ?", added[2].ID)
+	if err != nil {
+		t.Fatalf("failed to clear slug: %v", err)
+	}
+	if err := store.BackfillTopicSlugs(ctx); err != nil {
+		t.Fatalf("BackfillTopicSlugs failed: %v", err)
+	}
+	if topic, err := store.GetTopic(ctx, added[2].ID); err != nil || topic.Slug != "privet-mir" {
+		t.Errorf("expected the slug to be backfilled, got %+v (%v)", topic, err)
+	}
+
+	if err := store.RemoveTopic(ctx, added[0].ID); err != nil {
+		t.Fatalf("RemoveTopic failed: %v", err)
+	}
+	if _, err := store.GetTopicBySlug(ctx, "tarte-tatin"); !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected old slugs to go with the topic, got %v", err)
+	}
+}
+
+func TestTopicStates(t *testing.T) {
+	db, store := openTestStore(t)
+
+	if err := store.AddUser(ctx, "stater", "stater@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	var topics []*models.Topic
+	for _, title := range []string{"Old news", "Announcements", "Chatter"} {
+		topic, err := store.AddTopic(ctx, TopicDraft{Title: title}, "stater")
+		if err != nil {
+			t.Fatalf("AddTopic(%q) failed: %v", title, err)
+		}
+		topics = append(topics, topic)
+	}
+	oldNews, announcements, chatter := topics[0], topics[1], topics[2]
+
+	msg, err := store.AddMessage(ctx, chatter.ID, "hello", "stater", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	t.Run("Lock", func(t *testing.T) {
+		locked, err := store.SetTopicState(ctx, chatter.ID, models.TopicLocked, true)
+		if err != nil {
+			t.Fatalf("SetTopicState failed: %v", err)
+		}
+		if locked.LockedAt == nil || !locked.Closed() {
+			t.Errorf("expected the topic to be locked, got %+v", locked)
+		}
+
+		if _, err := store.AddMessage(ctx, chatter.ID, "anyone there?", "stater", 0); !errors.Is(err, ErrTopicLocked) {
+			t.Errorf("expected ErrTopicLocked, got %v", err)
+		}
+		if _, err := store.EditMessage(ctx, msg.ID, "stater", "hello there"); err != nil {
+			t.Errorf("expected messages in a locked topic to stay editable, got %v", err)
+		}
+		if err := store.UpVoteTopic(ctx, chatter.ID, "stater"); err != nil {
+			t.Errorf("expected locked topics to take votes, got %v", err)
+		}
+
+		again, err := store.SetTopicState(ctx, chatter.ID, models.TopicLocked, true)
+		if err != nil || !again.LockedAt.Equal(*locked.LockedAt) {
+			t.Errorf("expected locking twice to keep the original time, got %v, %v", again.LockedAt, err)
+		}
+
+		unlocked, err := store.SetTopicState(ctx, chatter.ID, models.TopicLocked, false)
+		if err != nil || unlocked.LockedAt != nil {
+			t.Fatalf("expected the topic to be unlocked, got %+v, %v", unlocked, err)
+		}
+		if _, err := store.AddMessage(ctx, chatter.ID, "back again", "stater", 0); err != nil {
+			t.Errorf("AddMessage after unlocking failed: %v", err)
+		}
+	})
+
+	t.Run("Pin", func(t *testing.T) {
+		if _, err := store.SetTopicState(ctx, announcements.ID, models.TopicPinned, true); err != nil {
+			t.Fatalf("SetTopicState failed: %v", err)
+		}
+
+		listed, next, err := store.GetAllTopics(ctx, ListOptions{Sort: SortOldest, Limit: 1})
+		if err != nil {
+			t.Fatalf("GetAllTopics failed: %v", err)
+		}
+		if len(listed) != 2 || listed[0].ID != announcements.ID || listed[0].PinnedAt == nil || listed[1].ID != oldNews.ID {
+			t.Fatalf("expected the pinned topic ahead of the first page, got %+v", listed)
+		}
+
+		listed, _, err = store.GetAllTopics(ctx, ListOptions{Cursor: next, Limit: 1})
+		if err != nil {
+			t.Fatalf("GetAllTopics failed: %v", err)
+		}
+		if len(listed) != 1 || listed[0].ID != chatter.ID {
+			t.Errorf("expected only the unpinned chatter on the second page, got %+v", listed)
+		}
+
+		listed, _, err = store.GetAllTopics(ctx, ListOptions{Tags: []string{"nothing"}})
+		if err != nil {
+			t.Fatalf("GetAllTopics failed: %v", err)
+		}
+		if len(listed) != 0 {
+			t.Errorf("expected filters to apply to pinned topics too, got %+v", listed)
+		}
+	})
+
+	t.Run("Archive", func(t *testing.T) {
+		reply, err := store.AddMessage(ctx, chatter.ID, "a reply", "stater", 0)
+		if err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+		if err := store.LikeMessage(ctx, reply.ID, "stater"); err != nil {
+			t.Fatalf("LikeMessage failed: %v", err)
+		}
+
+		archived, err := store.SetTopicState(ctx, chatter.ID, models.TopicArchived, true)
+		if err != nil {
+			t.Fatalf("SetTopicState failed: %v", err)
+		}
+		if archived.ArchivedAt == nil || !archived.Closed() {
+			t.Errorf("expected the topic to be archived, got %+v", archived)
+		}
+
+		if _, err := store.AddMessage(ctx, chatter.ID, "late reply", "stater", 0); !errors.Is(err, ErrTopicArchived) {
+			t.Errorf("expected AddMessage to fail with ErrTopicArchived, got %v", err)
+		}
+		if _, err := store.EditMessage(ctx, msg.ID, "stater", "edited late"); !errors.Is(err, ErrTopicArchived) {
+			t.Errorf("expected EditMessage to fail with ErrTopicArchived, got %v", err)
+		}
+		if err := store.RetractTopicVote(ctx, chatter.ID, "stater"); !errors.Is(err, ErrTopicArchived) {
+			t.Errorf("expected voting to fail with ErrTopicArchived, got %v", err)
+		}
+
+		writes := map[string]func() error{
+			"LikeMessage":    func() error { return store.LikeMessage(ctx, msg.ID, "stater") },
+			"DislikeMessage": func() error { return store.DislikeMessage(ctx, msg.ID, "stater") },
+			"AddReaction":    func() error { return store.AddReaction(ctx, msg.ID, "stater", "heart") },
+			"RemoveReaction": func() error { return store.RemoveReaction(ctx, reply.ID, "stater", ReactionLike) },
+			"DeleteMessage":  func() error { return store.DeleteMessage(ctx, reply.ID) },
+			"SetParent":      func() error { return store.SetParent(ctx, msg.ID, reply.ID) },
+			"RenameTopic": func() error {
+				_, err := store.RenameTopic(ctx, chatter.ID, "Old chatter")
+				return err
+			},
+			"SetTopicTags": func() error {
+				_, err := store.SetTopicTags(ctx, chatter.ID, []string{"history"})
+				return err
+			},
+			"SplitTopic": func() error {
+				_, err := store.SplitTopic(ctx, reply.ID, TopicDraft{Title: "Split chatter"}, "stater")
+				return err
+			},
+		}
+		for name, write := range writes {
+			if err := write(); !errors.Is(err, ErrTopicArchived) {
+				t.Errorf("expected %s to fail with ErrTopicArchived, got %v", name, err)
+			}
+		}
+		if kept, err := store.GetMessage(ctx, reply.ID); err != nil || kept.DeletedAt != nil || kept.ParentID != nil || kept.TopicID != chatter.ID || kept.Likes != 1 {
+			t.Errorf("expected the refused writes to leave the reply alone, got %+v, %v", kept, err)
+		}
+
+		if _, err := store.SetTopicState(ctx, chatter.ID, models.TopicArchived, false); err != nil {
+			t.Fatalf("SetTopicState failed: %v", err)
+		}
+		if err := store.RetractTopicVote(ctx, chatter.ID, "stater"); err != nil {
+			t.Errorf("RetractTopicVote after unarchiving failed: %v", err)
+		}
+	})
+
+	t.Run("Archive_inactive", func(t *testing.T) {
+		_, err := db.Exec("UPDATE topics SET creation_date = '2000-01-01 00:00:00'")
+		if err != nil {
+			t.Fatalf("failed to age topics: %v", err)
+		}
+		_, err = db.Exec("UPDATE messages SET timestamp = '2000-01-01 00:00:00' WHERE topic_id = ?", chatter.ID)
+		if err != nil {
+			t.Fatalf("failed to age messages: %v", err)
+		}
+
+		cutoff := time.Now().AddDate(0, 0, -30)
+		count, err := store.ArchiveInactiveTopics(ctx, cutoff)
+		if err != nil {
+			t.Fatalf("ArchiveInactiveTopics failed: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("expected only the old news to be archived, got %d topics", count)
+		}
+
+		topic, err := store.GetTopic(ctx, oldNews.ID)
+		if err != nil || topic.ArchivedAt == nil {
+			t.Errorf("expected the old news to be archived, got %+v, %v", topic, err)
+		}
+		topic, err = store.GetTopic(ctx, announcements.ID)
+		if err != nil || topic.ArchivedAt != nil {
+			t.Errorf("expected the pinned topic to be left alone, got %+v, %v", topic, err)
+		}
+		topic, err = store.GetTopic(ctx, chatter.ID)
+		if err != nil || topic.ArchivedAt != nil {
+			t.Errorf("expected the recently unarchived topic to be left alone, got %+v, %v", topic, err)
+		}
+
+		if count, err := store.ArchiveInactiveTopics(ctx, cutoff); err != nil || count != 0 {
+			t.Errorf("expected nothing left to archive, got %d, %v", count, err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := store.SetTopicState(ctx, chatter.ID, "hidden", true); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("expected ErrInvalidState, got %v", err)
+		}
+		if _, err := store.SetTopicState(ctx, 999999, models.TopicLocked, true); !errors.Is(err, ErrTopicNotFound) {
+			t.Errorf("expected ErrTopicNotFound, got %v", err)
+		}
+	})
+}
+
+func TestMergeTopic(t *testing.T) {
+	db, store := openTestStore(t)
+
+	for _, name := range []string{"merger", "voter1", "voter2"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser(%q) failed: %v", name, err)
+		}
+	}
+
+	source, err := store.AddTopic(ctx, TopicDraft{Title: "Generics question", Body: "How do generics work?", Tags: []string{"go"}}, "merger")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	if _, err := store.RenameTopic(ctx, source.ID, "Go generics"); err != nil {
+		t.Fatalf("RenameTopic failed: %v", err)
+	}
+	target, err := store.AddTopic(ctx, TopicDraft{Title: "Generics in Go", Tags: []string{"go", "generics"}}, "merger")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	root, err := store.AddMessage(ctx, source.ID, "Type parameters", "merger", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	reply, err := store.AddMessage(ctx, source.ID, "And constraints", "merger", root.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	gone, err := store.AddMessage(ctx, source.ID, "Never mind", "merger", reply.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if err := store.DeleteMessage(ctx, gone.ID); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	if _, err := store.AddMessage(ctx, target.ID, "Generics landed in 1.18", "merger", 0); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	if err := store.UpVoteTopic(ctx, source.ID, "voter1"); err != nil {
+		t.Fatalf("UpVoteTopic failed: %v", err)
+	}
+	if err := store.UpVoteTopic(ctx, source.ID, "voter2"); err != nil {
+		t.Fatalf("UpVoteTopic failed: %v", err)
+	}
+	if err := store.DownVoteTopic(ctx, target.ID, "voter2"); err != nil {
+		t.Fatalf("DownVoteTopic failed: %v", err)
+	}
+
+	publisher := &recordingPublisher{}
+	store.SetPublisher(publisher)
+
+	merged, err := store.MergeTopic(ctx, source.ID, target.ID)
+	if err != nil {
+		t.Fatalf("MergeTopic failed: %v", err)
+	}
+	store.SetPublisher(nil)
+
+	t.Run("Messages", func(t *testing.T) {
+		if merged.ID != target.ID || merged.Title != "Generics in Go" {
+			t.Fatalf("expected the target back, got %+v", merged)
+		}
+		// Its own message, the opening post, the root and its reply; the
+		// tombstone does not count.
+		if merged.Messages != 4 {
+			t.Errorf("expected 4 messages, got %d", merged.Messages)
+		}
+
+		moved, err := store.GetMessage(ctx, reply.ID)
+		if err != nil {
+			t.Fatalf("GetMessage failed: %v", err)
+		}
+		if moved.TopicID != target.ID || moved.ParentID == nil || *moved.ParentID != root.ID {
+			t.Errorf("expected the reply to keep its parent in the target, got %+v", moved)
+		}
+		tombstone, err := store.GetMessage(ctx, gone.ID)
+		if err != nil || tombstone.TopicID != target.ID || tombstone.DeletedAt == nil {
+			t.Errorf("expected the tombstone to move along, got %+v, %v", tombstone, err)
+		}
+
+		var posts int
+		err = db.QueryRow("SELECT COUNT(*) FROM messages WHERE topic_id = ? AND message = ? AND parent_id IS NULL", target.ID, "How do generics work?").Scan(&posts)
+		if err != nil || posts != 1 {
+			t.Errorf("expected the opening post to become a top-level message, got %d, %v", posts, err)
+		}
+
+		user, err := store.GetUser(ctx, "merger")
+		if err != nil || user.MessagesSent != 4 {
+			t.Errorf("expected the opening post to count as a sent message, got %+v, %v", user, err)
+		}
+	})
+
+	t.Run("Votes", func(t *testing.T) {
+		if merged.Upvotes != 0 {
+			t.Errorf("expected voter1's upvote and voter2's downvote to cancel out, got %d", merged.Upvotes)
+		}
+		if vote, err := store.GetTopicVote(ctx, target.ID, "voter1"); err != nil || vote != 1 {
+			t.Errorf("expected voter1's upvote to carry over, got %d, %v", vote, err)
+		}
+		if vote, err := store.GetTopicVote(ctx, target.ID, "voter2"); err != nil || vote != -1 {
+			t.Errorf("expected voter2 to keep their vote on the target, got %d, %v", vote, err)
+		}
+	})
+
+	t.Run("Redirects", func(t *testing.T) {
+		if _, err := store.GetTopic(ctx, source.ID); !errors.Is(err, ErrTopicNotFound) {
+			t.Errorf("expected the merged topic to be gone, got %v", err)
+		}
+		if found, err := store.GetMergedTopic(ctx, source.ID); err != nil || found.ID != target.ID {
+			t.Errorf("expected the merged topic to redirect to the target, got %+v, %v", found, err)
+		}
+		for _, old := range []string{"go-generics", "generics-question"} {
+			if found, err := store.GetTopicBySlug(ctx, old); err != nil || found.ID != target.ID {
+				t.Errorf("expected slug %q to lead to the target, got %+v, %v", old, found, err)
+			}
+		}
+		if _, err := store.GetMergedTopic(ctx, target.ID); !errors.Is(err, ErrTopicNotFound) {
+			t.Errorf("expected ErrTopicNotFound for a topic that was not merged, got %v", err)
+		}
+	})
+
+	t.Run("Counts", func(t *testing.T) {
+		tags, err := store.ListTags(ctx, "go", 0)
+		if err != nil || len(tags) != 1 || tags[0].Topics != 1 {
+			t.Errorf("expected the go tag to count only the target, got %+v, %v", tags, err)
+		}
+		category, err := store.GetCategory(ctx, models.DefaultCategoryID)
+		if err != nil || category.Topics != 1 {
+			t.Errorf("expected the category to count one topic, got %+v, %v", category, err)
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		want := []publishedEvent{
+			{source.ID, EventTopicMerged, models.TopicMerged{TopicID: source.ID, Into: merged}},
+			{target.ID, EventTopicUpdated, merged},
+		}
+		if !reflect.DeepEqual(publisher.events, want) {
+			t.Errorf("expected %+v, got %+v", want, publisher.events)
+		}
+	})
+
+	t.Run("Chained", func(t *testing.T) {
+		final, err := store.AddTopic(ctx, TopicDraft{Title: "Generics FAQ"}, "merger")
+		if err != nil {
+			t.Fatalf("AddTopic failed: %v", err)
+		}
+		if _, err := store.MergeTopic(ctx, target.ID, final.ID); err != nil {
+			t.Fatalf("MergeTopic failed: %v", err)
+		}
+		for _, id := range []int{source.ID, target.ID} {
+			if found, err := store.GetMergedTopic(ctx, id); err != nil || found.ID != final.ID {
+				t.Errorf("expected topic %d to redirect to the final topic, got %+v, %v", id, found, err)
+			}
+		}
+		if found, err := store.GetTopicBySlug(ctx, "generics-question"); err != nil || found.ID != final.ID {
+			t.Errorf("expected old slugs to follow along, got %+v, %v", found, err)
+		}
+
+		if err := store.RemoveTopic(ctx, final.ID); err != nil {
+			t.Fatalf("RemoveTopic failed: %v", err)
+		}
+		if _, err := store.GetMergedTopic(ctx, source.ID); !errors.Is(err, ErrTopicNotFound) {
+			t.Errorf("expected redirects to go away with their target, got %v", err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		a, err := store.AddTopic(ctx, TopicDraft{Title: "Topic A"}, "merger")
+		if err != nil {
+			t.Fatalf("AddTopic failed: %v", err)
+		}
+		b, err := store.AddTopic(ctx, TopicDraft{Title: "Topic B"}, "merger")
+		if err != nil {
+			t.Fatalf("AddTopic failed: %v", err)
+		}
+
+		if _, err := store.MergeTopic(ctx, a.ID, a.ID); !errors.Is(err, ErrSameTopic) {
+			t.Errorf("expected ErrSameTopic, got %v", err)
+		}
+		if _, err := store.MergeTopic(ctx, a.ID, 999999); !errors.Is(err, ErrTopicNotFound) {
+			t.Errorf("expected ErrTopicNotFound for an unknown target, got %v", err)
+		}
+		if _, err := store.MergeTopic(ctx, 999999, a.ID); !errors.Is(err, ErrTopicNotFound) {
+			t.Errorf("expected ErrTopicNotFound for an unknown topic, got %v", err)
+		}
+
+		if _, err := store.SetTopicState(ctx, b.ID, models.TopicArchived, true); err != nil {
+			t.Fatalf("SetTopicState failed: %v", err)
+		}
+		if _, err := store.MergeTopic(ctx, a.ID, b.ID); !errors.Is(err, ErrTopicArchived) {
+			t.Errorf("expected ErrTopicArchived, got %v", err)
+		}
+		if _, err := store.GetTopic(ctx, a.ID); err != nil {
+			t.Errorf("expected a failed merge to leave the topic alone, got %v", err)
+		}
+	})
+}
+
+func TestSplitTopic(t *testing.T) {
+	_, store := openTestStore(t)
+
+	if err := store.AddUser(ctx, "splitter", "splitter@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	category, err := store.AddCategory(ctx, CategoryDraft{Name: "Drinks"})
+	if err != nil {
+		t.Fatalf("AddCategory failed: %v", err)
+	}
+	source, err := store.AddTopic(ctx, TopicDraft{Title: "Coffee", CategoryID: category.ID}, "splitter")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	root, err := store.AddMessage(ctx, source.ID, "Espresso or filter?", "splitter", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	branch, err := store.AddMessage(ctx, source.ID, "What about cold brew?", "splitter", root.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	leaf, err := store.AddMessage(ctx, source.ID, "Twelve hours in the fridge", "splitter", branch.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	sibling, err := store.AddMessage(ctx, source.ID, "Filter, always", "splitter", root.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	publisher := &recordingPublisher{}
+	store.SetPublisher(publisher)
+
+	split, err := store.SplitTopic(ctx, branch.ID, TopicDraft{Title: "Cold brew", Tags: []string{"coffee"}}, "splitter")
+	if err != nil {
+		t.Fatalf("SplitTopic failed: %v", err)
+	}
+	store.SetPublisher(nil)
+
+	t.Run("New_topic", func(t *testing.T) {
+		if split.Title != "Cold brew" || split.Slug != "cold-brew" || split.Messages != 2 {
+			t.Errorf("unexpected split topic: %+v", split)
+		}
+		if split.CategoryID != category.ID {
+			t.Errorf("expected the split topic to stay in category %d, got %d", category.ID, split.CategoryID)
+		}
+		if !reflect.DeepEqual(split.Tags, []string{"coffee"}) {
+			t.Errorf("expected the draft's tags, got %v", split.Tags)
+		}
+
+		splitter, err := store.GetUser(ctx, "splitter")
+		if err != nil || splitter.TopicsOpened != 1 {
+			t.Errorf("expected the split not to count as a topic opened, got %+v, %v", splitter, err)
+		}
+
+		moved, err := store.GetMessage(ctx, branch.ID)
+		if err != nil || moved.TopicID != split.ID || moved.ParentID != nil {
+			t.Errorf("expected the split message to be top-level in the new topic, got %+v, %v", moved, err)
+		}
+		moved, err = store.GetMessage(ctx, leaf.ID)
+		if err != nil || moved.TopicID != split.ID || moved.ParentID == nil || *moved.ParentID != branch.ID {
+			t.Errorf("expected the reply to follow its parent, got %+v, %v", moved, err)
+		}
+	})
+
+	t.Run("Old_topic", func(t *testing.T) {
+		topic, err := store.GetTopic(ctx, source.ID)
+		if err != nil || topic.Messages != 2 {
+			t.Errorf("expected 2 messages left behind, got %+v, %v", topic, err)
+		}
+		kept, err := store.GetMessage(ctx, sibling.ID)
+		if err != nil || kept.TopicID != source.ID {
+			t.Errorf("expected the sibling to stay, got %+v, %v", kept, err)
+		}
+
+		category, err := store.GetCategory(ctx, category.ID)
+		if err != nil || category.Topics != 2 {
+			t.Errorf("expected the category to count both topics, got %+v, %v", category, err)
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		want := []publishedEvent{
+			{source.ID, EventTopicSplit, models.TopicSplit{MessageIDs: []int{branch.ID, leaf.ID}, Topic: split}},
+		}
+		if !reflect.DeepEqual(publisher.events, want) {
+			t.Errorf("expected %+v, got %+v", want, publisher.events)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := store.SplitTopic(ctx, 999999, TopicDraft{Title: "Nowhere"}, "splitter"); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("expected ErrMessageNotFound, got %v", err)
+		}
+		if _, err := store.SplitTopic(ctx, sibling.ID, TopicDraft{Title: "Coffee"}, "splitter"); !errors.Is(err, ErrTopicExists) {
+			t.Errorf("expected ErrTopicExists, got %v", err)
+		}
+		if _, err := store.SplitTopic(ctx, sibling.ID, TopicDraft{Title: "Filter", Tags: []string{"no tags!"}}, "splitter"); !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("expected ErrInvalidTag, got %v", err)
+		}
+
+		kept, err := store.GetMessage(ctx, sibling.ID)
+		if err != nil || kept.TopicID != source.ID {
+			t.Errorf("expected failed splits to leave the message alone, got %+v, %v", kept, err)
+		}
+	})
+}
+
+func TestSplitTopicCycle(t *testing.T) {
+	db, store := openTestStore(t)
+
+	if err := store.AddUser(ctx, "cycleSplitter", "cyclesplit@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	source, err := store.AddTopic(ctx, TopicDraft{Title: "Tangled"}, "cycleSplitter")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	first, second := replyCycle(t, db, store, source.ID, "cycleSplitter")
+
+	timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	split, err := store.SplitTopic(timeout, second.ID, TopicDraft{Title: "Untangled"}, "cycleSplitter")
+	if err != nil {
+		t.Fatalf("SplitTopic failed: %v", err)
+	}
+	if split.Messages != 2 {
+		t.Errorf("expected both messages of the cycle to move, got %+v", split)
+	}
+
+	moved, err := store.GetMessage(ctx, second.ID)
+	if err != nil || moved.TopicID != split.ID || moved.ParentID != nil {
+		t.Errorf("expected the split message to be top-level in the new topic, got %+v, %v", moved, err)
+	}
+	moved, err = store.GetMessage(ctx, first.ID)
+	if err != nil || moved.TopicID != split.ID || moved.ParentID == nil || *moved.ParentID != second.ID {
+		t.Errorf("expected the rest of the cycle to follow, got %+v, %v", moved, err)
+	}
+}
+
+func TestAddMessage(t *testing.T) {
+	username := "messageUser"
+	topic := "messageTopic"
+	message := "This is a test message."
+
+	err := testStore.AddUser(ctx, username, fmt.Sprintf("%s@test.com", username), "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	added, err := testStore.AddTopic(ctx, TopicDraft{Title: topic}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "users")
+	PrintTableContents(testDB, "topics")
+
+	_, err = testStore.AddMessage(ctx, added.ID, message, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	var storedMessage string
+	var storedUserID, storedTopicID int
+	err = testDB.QueryRow("SELECT message, user_id, topic_id FROM messages WHERE message = ?", message).
+		Scan(&storedMessage, &storedUserID, &storedTopicID)
+	if err != nil {
+		t.Fatalf("failed to fetch message: %v", err)
+	}
+
+	if storedMessage != message {
+		t.Errorf("expected message %s, got %s", message, storedMessage)
+	}
+
+	var messagesSent, messagesInTopic int
+	err = testDB.QueryRow("SELECT messages_sent FROM users WHERE username = ?", username).Scan(&messagesSent)
+	if err != nil {
+		t.Fatalf("failed to fetch messages_sent for user: %v", err)
+	}
+
+	if messagesSent != 1 {
+		t.Errorf("expected messages_sent to be 1, got %d", messagesSent)
+	}
+
+	err = testDB.QueryRow("SELECT messages FROM topics WHERE title = ?", topic).Scan(&messagesInTopic)
+	if err != nil {
+		t.Fatalf("failed to fetch messages count for topic: %v", err)
+	}
+
+	if messagesInTopic != 1 {
+		t.Errorf("expected messages in topic to be 1, got %d", messagesInTopic)
+	}
+
+	PrintTableContents(testDB, "users")
+}
+
+func TestSetParent(t *testing.T) {
+	username := "parentUser"
+	topic := "parentTopic"
+	parentMessage := "This is the parent message."
+	childMessage := "This is the child message."
+
+	err := testStore.AddUser(ctx, username, fmt.Sprintf("%s@test.com", username), "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	added, err := testStore.AddTopic(ctx, TopicDraft{Title: topic}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, added.ID, parentMessage, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed for parentMessage: %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, added.ID, childMessage, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed for childMessage: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	var parentID, childID int
+	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", parentMessage).Scan(&parentID)
+	if err != nil {
+		t.Fatalf("failed to fetch parentID: %v", err)
+	}
+
+	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", childMessage).Scan(&childID)
+	if err != nil {
+		t.Fatalf("failed to fetch childID: %v", err)
+	}
+
+	err = testStore.SetParent(ctx, parentID, childID)
+	if err != nil {
+		t.Fatalf("SetParent failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	var storedParentID int
+	err = testDB.QueryRow("SELECT parent_id FROM messages WHERE id = ?", childID).Scan(&storedParentID)
+	if err != nil {
+		t.Fatalf("failed to fetch parent_id for child message: %v", err)
+	}
+
+	if storedParentID != parentID {
+		t.Errorf("expected parent_id %d, got %d", parentID, storedParentID)
+	}
+
+	err = testStore.SetParent(ctx, parentID, childID+1)
+	if err == nil {
+		t.Errorf("expected error for mismatched topics, but got nil")
+	}
+}
+
+func TestThreadedReplies(t *testing.T) {
+	username := "threadUser"
+	topic := "Thread Topic"
+	otherTopic := "Other Thread Topic"
+
+	err := testStore.AddUser(ctx, username, "threaduser@test.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	var topicIDs []int
+	for _, title := range []string{topic, otherTopic} {
+		added, err := testStore.AddTopic(ctx, TopicDraft{Title: title}, username)
+		if err != nil {
+			t.Fatalf("AddTopic failed: %v", err)
+		}
+		topicIDs = append(topicIDs, added.ID)
+	}
+
+	root, err := testStore.AddMessage(ctx, topicIDs[0], "root", username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if root.ID == 0 || root.ParentID != nil || root.Message != "root" {
+		t.Errorf("unexpected root message: %+v", root)
+	}
+
+	// Build a chain root -> 1 -> 2 -> ... down to MaxThreadDepth.
+	chain := []*models.Message{root}
+	for depth := 1; depth <= MaxThreadDepth; depth++ {
+		reply, err := testStore.AddMessage(ctx, topicIDs[0], fmt.Sprintf("reply %d", depth), username, chain[len(chain)-1].ID)
+		if err != nil {
+			t.Fatalf("AddMessage failed at depth %d: %v", depth, err)
+		}
+		if reply.ParentID == nil || *reply.ParentID != chain[len(chain)-1].ID {
+			t.Fatalf("expected reply at depth %d to point at its parent, got %v", depth, reply.ParentID)
+		}
+		chain = append(chain, reply)
+	}
+
+	_, err = testStore.AddMessage(ctx, topicIDs[0], "too deep", username, chain[len(chain)-1].ID)
+	if !errors.Is(err, ErrThreadTooDeep) {
+		t.Errorf("expected ErrThreadTooDeep, got %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topicIDs[1], "wrong topic", username, root.ID)
+	if !errors.Is(err, ErrDifferentTopics) {
+		t.Errorf("expected ErrDifferentTopics, got %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topicIDs[0], "orphan", username, 999999)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing parent, got %v", err)
+	}
+
+	err = testStore.SetParent(ctx, root.ID, root.ID)
+	if !errors.Is(err, ErrThreadCycle) {
+		t.Errorf("expected ErrThreadCycle for a self parent, got %v", err)
+	}
+
+	err = testStore.SetParent(ctx, chain[3].ID, root.ID)
+	if !errors.Is(err, ErrThreadCycle) {
+		t.Errorf("expected ErrThreadCycle when moving a message under its own reply, got %v", err)
+	}
+
+	// Moving a two-level subtree under a message two levels from the
+	// bottom would push its leaf past MaxThreadDepth.
+	subtree, err := testStore.AddMessage(ctx, topicIDs[0], "subtree", username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	leaf, err := testStore.AddMessage(ctx, topicIDs[0], "subtree leaf", username, subtree.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	_, err = testStore.AddMessage(ctx, topicIDs[0], "subtree leaf reply", username, leaf.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	err = testStore.SetParent(ctx, chain[MaxThreadDepth-2].ID, subtree.ID)
+	if !errors.Is(err, ErrThreadTooDeep) {
+		t.Errorf("expected ErrThreadTooDeep, got %v", err)
+	}
+
+	err = testStore.SetParent(ctx, chain[MaxThreadDepth-3].ID, subtree.ID)
+	if err != nil {
+		t.Errorf("expected the subtree to fit exactly, got %v", err)
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	username := "threadReader"
+	liker := "threadLiker"
+	topic := "Thread Reading Topic"
+
+	for _, name := range []string{username, liker} {
+		err := testStore.AddUser(ctx, name, name+"@test.com", "password")
+		if err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	topicRow, err := testStore.AddTopic(ctx, TopicDraft{Title: topic}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	add := func(message string, parentID int) *models.Message {
+		t.Helper()
+		msg, err := testStore.AddMessage(ctx, topicRow.ID, message, username, parentID)
+		if err != nil {
+			t.Fatalf("AddMessage failed for %q: %v", message, err)
+		}
+		return msg
+	}
+
+	first := add("first", 0)
+	second := add("second", 0)
+	third := add("third", 0)
+	early := add("early reply", first.ID)
+	popular := add("popular reply", first.ID)
+	nested := add("nested reply", early.ID)
+	add("deeply nested reply", nested.ID)
+
+	for _, name := range []string{username, liker} {
+		err = testStore.LikeMessage(ctx, popular.ID, name)
+		if err != nil {
+			t.Fatalf("LikeMessage failed: %v", err)
+		}
+	}
+	err = testStore.LikeMessage(ctx, third.ID, liker)
+	if err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+
+	thread, err := testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Depth: 1})
+	if err != nil {
+		t.Fatalf("GetThread failed: %v", err)
+	}
+
+	if len(thread.Messages) != 3 || thread.Messages[0].ID != first.ID || thread.NextCursor != "" {
+		t.Fatalf("expected the three top-level messages oldest first, got %+v", thread.Messages)
+	}
+	replies := thread.Messages[0].Replies
+	if len(replies) != 2 || replies[0].ID != early.ID || replies[1].ID != popular.ID {
+		t.Fatalf("expected two replies oldest first, got %+v", replies)
+	}
+	if replies[0].Depth != 1 || replies[0].ReplyCount != 1 || len(replies[0].Replies) != 0 || replies[0].MoreReplies == "" {
+		t.Errorf("expected the unloaded reply to carry a cursor, got %+v", replies[0])
+	}
+	if replies[1].Likes != 2 || replies[1].Reactions["like"] != 2 {
+		t.Errorf("expected 2 likes on the popular reply, got %+v", replies[1])
+	}
+
+	more, err := testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Depth: 1, Cursor: replies[0].MoreReplies})
+	if err != nil {
+		t.Fatalf("GetThread with reply cursor failed: %v", err)
+	}
+	if more.ParentID == nil || *more.ParentID != early.ID {
+		t.Errorf("expected the thread to be rooted at %d, got %v", early.ID, more.ParentID)
+	}
+	if len(more.Messages) != 1 || more.Messages[0].ID != nested.ID || more.Messages[0].Depth != 2 {
+		t.Fatalf("expected the nested reply at depth 2, got %+v", more.Messages)
+	}
+	if len(more.Messages[0].Replies) != 1 || more.Messages[0].Replies[0].Depth != 3 {
+		t.Errorf("expected one reply beneath the nested reply, got %+v", more.Messages[0].Replies)
+	}
+
+	byLikes, err := testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Depth: 1, Sort: ThreadSortLikes})
+	if err != nil {
+		t.Fatalf("GetThread sorted by likes failed: %v", err)
+	}
+	if byLikes.Messages[0].ID != third.ID {
+		t.Errorf("expected the liked top-level message first, got %d", byLikes.Messages[0].ID)
+	}
+	firstByLikes := byLikes.Messages[1]
+	if firstByLikes.ID != first.ID || firstByLikes.Replies[0].ID != popular.ID {
+		t.Errorf("expected the popular reply first, got %+v", firstByLikes.Replies)
+	}
+
+	page, err := testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetThread with limit failed: %v", err)
+	}
+	if len(page.Messages) != 2 || page.Messages[1].ID != second.ID || page.NextCursor == "" {
+		t.Fatalf("expected the first page to stop after two messages, got %+v", page)
+	}
+	page, err = testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Limit: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("GetThread with cursor failed: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != third.ID || page.NextCursor != "" {
+		t.Errorf("expected the last page to hold only the third message, got %+v", page)
+	}
+
+	// The limit applies to every level, and a cursor sorted by likes keeps
+	// its order.
+	page, err = testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Depth: 1, Limit: 1, Sort: ThreadSortLikes})
+	if err != nil {
+		t.Fatalf("GetThread sorted by likes with limit failed: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != third.ID || page.NextCursor == "" {
+		t.Fatalf("expected the liked message alone on the first page, got %+v", page)
+	}
+	page, err = testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Depth: 1, Limit: 1, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("GetThread with likes cursor failed: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != first.ID {
+		t.Fatalf("expected the first message on the second page, got %+v", page.Messages)
+	}
+	limited := page.Messages[0]
+	if len(limited.Replies) != 1 || limited.Replies[0].ID != popular.ID || limited.MoreReplies == "" {
+		t.Fatalf("expected only the popular reply and a cursor for the rest, got %+v", limited)
+	}
+	page, err = testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Limit: 1, Cursor: limited.MoreReplies})
+	if err != nil {
+		t.Fatalf("GetThread with reply cursor failed: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != early.ID || page.NextCursor != "" {
+		t.Errorf("expected the remaining reply alone, got %+v", page)
+	}
+
+	_, err = testStore.GetThread(ctx, topicRow.ID, ThreadOptions{Cursor: "not a cursor"})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+
+	_, err = testStore.GetThread(ctx, 999999, ThreadOptions{})
+	if !errors.Is(err, ErrTopicNotFound) {
+		t.Errorf("expected ErrTopicNotFound, got %v", err)
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	_, store := openTestStore(t)
+	publisher := &recordingPublisher{}
+	store.SetPublisher(publisher)
+
+	for _, name := range []string{"editAuthor", "editModerator"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	topic, err := store.AddTopic(ctx, TopicDraft{Title: "Edit Topic"}, "editAuthor")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	msg, err := store.AddMessage(ctx, topic.ID, "first draft", "editAuthor", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if msg.EditedAt != nil {
+		t.Errorf("expected a new message to have no edited_at, got %v", msg.EditedAt)
+	}
+
+	edited, err := store.EditMessage(ctx, msg.ID, "editAuthor", "second draft")
+	if err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+	if edited.Message != "second draft" || edited.EditedAt == nil {
+		t.Errorf("unexpected edited message: %+v", edited)
+	}
+	if _, err := store.EditMessage(ctx, msg.ID, "editModerator", "final text"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+
+	// Saving the same text again is not a new revision.
+	if _, err := store.EditMessage(ctx, msg.ID, "editModerator", "final text"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+
+	got, err := store.GetMessage(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage failed: %v", err)
+	}
+	if got.Message != "final text" || got.EditedAt == nil {
+		t.Errorf("unexpected message after edits: %+v", got)
+	}
+
+	revisions, err := store.GetMessageRevisions(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessageRevisions failed: %v", err)
+	}
+	author, _ := store.GetUser(ctx, "editAuthor")
+	moderator, _ := store.GetUser(ctx, "editModerator")
+	wantRevisions := []struct {
+		message  string
+		editorID int
+	}{
+		{"first draft", author.ID},
+		{"second draft", author.ID},
+		{"final text", moderator.ID},
+	}
+	if len(revisions) != len(wantRevisions) {
+		t.Fatalf("expected %d revisions, got %+v", len(wantRevisions), revisions)
+	}
+	for i, want := range wantRevisions {
+		if revisions[i].Version != i+1 || revisions[i].Message != want.message || revisions[i].EditorID != want.editorID {
+			t.Errorf("revision %d: expected %+v, got %+v", i+1, want, revisions[i])
+		}
+	}
+
+	hits, err := store.Search(ctx, SearchQuery{Text: "final"})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(hits) != 1 || hits[0].ID != msg.ID {
+		t.Errorf("expected the search index to follow the edit, got %+v", hits)
+	}
+
+	var kinds []string
+	for _, event := range publisher.events {
+		kinds = append(kinds, event.kind)
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint([]string{EventMessageCreated, EventMessageEdited, EventMessageEdited}) {
+		t.Errorf("unexpected events: %v", kinds)
+	}
+
+	if err := store.RemoveUser(ctx, "editModerator"); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	revisions, err = store.GetMessageRevisions(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessageRevisions failed: %v", err)
+	}
+	if revisions[2].EditorID != 0 {
+		t.Errorf("expected the removed editor to be cleared, got %d", revisions[2].EditorID)
+	}
+
+	if _, err := store.EditMessage(ctx, 9999, "editAuthor", "nothing"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+	if _, err := store.GetMessage(ctx, 9999); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+	if _, err := store.GetMessageRevisions(ctx, 9999); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestDeleteAndPurgeMessage(t *testing.T) {
+	db, store := openTestStore(t)
+	publisher := &recordingPublisher{}
+	store.SetPublisher(publisher)
+
+	for _, name := range []string{"deleteAlice", "deleteBob"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	topic, err := store.AddTopic(ctx, TopicDraft{Title: "Delete Topic"}, "deleteAlice")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	add := func(message, username string, parentID int) *models.Message {
+		t.Helper()
+		msg, err := store.AddMessage(ctx, topic.ID, message, username, parentID)
+		if err != nil {
+			t.Fatalf("AddMessage failed for %q: %v", message, err)
+		}
+		return msg
+	}
+	root := add("root", "deleteAlice", 0)
+	middle := add("secret middle", "deleteBob", root.ID)
+	leaf := add("leaf", "deleteAlice", middle.ID)
+	sibling := add("sibling", "deleteBob", 0)
+
+	if _, err := store.EditMessage(ctx, middle.ID, "deleteBob", "secret middle, edited"); err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+	if err := store.LikeMessage(ctx, leaf.ID, "deleteBob"); err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+
+	counts := func() (topicMessages, alice, bob int) {
+		t.Helper()
+		current, err := store.GetTopic(ctx, topic.ID)
+		if err != nil {
+			t.Fatalf("GetTopic failed: %v", err)
+		}
+		a, _ := store.GetUser(ctx, "deleteAlice")
+		b, _ := store.GetUser(ctx, "deleteBob")
+		return current.Messages, a.MessagesSent, b.MessagesSent
+	}
+
+	if err := store.DeleteMessage(ctx, middle.ID); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	if topicMessages, alice, bob := counts(); topicMessages != 3 || alice != 2 || bob != 1 {
+		t.Errorf("expected counts 3/2/1 after deleting, got %d/%d/%d", topicMessages, alice, bob)
+	}
+
+	thread, err := store.GetThread(ctx, root.TopicID, ThreadOptions{Depth: 2})
+	if err != nil {
+		t.Fatalf("GetThread failed: %v", err)
+	}
+	tombstone := thread.Messages[0].Replies[0]
+	if tombstone.ID != middle.ID || tombstone.Message.Message != models.MessageTombstone || tombstone.DeletedAt == nil {
+		t.Errorf("expected a tombstone in the middle of the thread, got %+v", tombstone.Message)
+	}
+	if len(tombstone.Replies) != 1 || tombstone.Replies[0].ID != leaf.ID {
+		t.Errorf("expected the leaf to stay beneath the tombstone, got %+v", tombstone.Replies)
+	}
+
+	revisions, err := store.GetMessageRevisions(ctx, middle.ID)
+	if err != nil {
+		t.Fatalf("GetMessageRevisions failed: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Message != models.MessageTombstone {
+		t.Errorf("expected the deleted message's history to be gone, got %+v", revisions)
+	}
+	if hits, err := store.Search(ctx, SearchQuery{Text: "secret"}); err != nil || len(hits) != 0 {
+		t.Errorf("expected the deleted text to leave the search index, got %+v (%v)", hits, err)
+	}
+
+	if err := store.DeleteMessage(ctx, middle.ID); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("expected ErrMessageDeleted, got %v", err)
+	}
+	if _, err := store.EditMessage(ctx, middle.ID, "deleteBob", "back again"); !errors.Is(err, ErrMessageDeleted) {
+		t.Errorf("expected ErrMessageDeleted, got %v", err)
+	}
+	if err := store.DeleteMessage(ctx, 9999); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	purged, err := store.PurgeMessage(ctx, root.ID)
+	if err != nil {
+		t.Fatalf("PurgeMessage failed: %v", err)
+	}
+	if fmt.Sprint(purged) != fmt.Sprint([]int{root.ID, middle.ID, leaf.ID}) {
+		t.Errorf("expected the whole subtree to be purged, got %v", purged)
+	}
+	// The tombstone was already uncounted, so only root and leaf come off.
+	if topicMessages, alice, bob := counts(); topicMessages != 1 || alice != 0 || bob != 1 {
+		t.Errorf("expected counts 1/0/1 after purging, got %d/%d/%d", topicMessages, alice, bob)
+	}
+	var reactions int
+	if err := db.QueryRow("SELECT COUNT(*) FROM message_reactions").Scan(&reactions); err != nil || reactions != 0 {
+		t.Errorf("expected the purged reactions to be gone, got %d (%v)", reactions, err)
+	}
+	if _, err := store.GetMessage(ctx, sibling.ID); err != nil {
+		t.Errorf("expected the sibling to survive, got %v", err)
+	}
+	if _, err := store.PurgeMessage(ctx, root.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound, got %v", err)
+	}
+
+	last := publisher.events[len(publisher.events)-1]
+	if last.kind != EventMessagesPurged || !reflect.DeepEqual(last.data, models.MessagesPurged{MessageIDs: purged}) {
+		t.Errorf("expected a purge event, got %+v", last)
+	}
+}
+
+// replyCycle adds two messages to topicID and then makes the first a reply
+// to the second, as SetParent used to allow.
+func replyCycle(t *testing.T, db *sql.DB, store *SQLiteStore, topicID int, username string) (*models.Message, *models.Message) {
+	t.Helper()
+
+	first, err := store.AddMessage(ctx, topicID, "first", username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	second, err := store.AddMessage(ctx, topicID, "second", username, first.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if _, err := db.Exec("UPDATE messages SET parent_id = ? WHERE id = ?", second.ID, first.ID); err != nil {
+		t.Fatalf("failed to build reply cycle: %v", err)
+	}
+	return first, second
+}
+
+func TestPurgeMessageCycle(t *testing.T) {
+	db, store := openTestStore(t)
+
+	if err := store.AddUser(ctx, "cycleUser", "cycle@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, TopicDraft{Title: "Cycle Topic"}, "cycleUser")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	first, second := replyCycle(t, db, store, topic.ID, "cycleUser")
+
+	timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	purged, err := store.PurgeMessage(timeout, first.ID)
+	if err != nil {
+		t.Fatalf("PurgeMessage failed: %v", err)
+	}
+	if fmt.Sprint(purged) != fmt.Sprint([]int{first.ID, second.ID}) {
+		t.Errorf("expected both messages of the cycle to be purged, got %v", purged)
+	}
+
+	var left int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE topic_id = ?", topic.ID).Scan(&left); err != nil || left != 0 {
+		t.Errorf("expected no messages left, got %d (%v)", left, err)
+	}
+}
+
+func TestGetMessagesByTopic(t *testing.T) {
+	topicTitle := "testTopicGet"
+	username := "testUser"
+	message1 := "This is the first test message"
+	message2 := "This is the second test message"
+
+	err := testStore.AddUser(ctx, username, "testuser@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	var topicID int
+	err = testDB.QueryRow("SELECT id FROM topics WHERE title = ?", topicTitle).Scan(&topicID)
+	if err != nil {
+		t.Fatalf("failed to fetch topic ID: %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topic.ID, message1, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topic.ID, message2, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	messages, _, err := testStore.GetMessagesByTopic(ctx, topicID, ListOptions{})
+	if err != nil {
+		t.Fatalf("GetMessagesByTopic failed: %v", err)
+	}
+
+	if len(messages) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(messages))
+	}
+
+	foundMessage1 := false
+	foundMessage2 := false
+	for _, msg := range messages {
+		if msg.Message == message1 {
+			foundMessage1 = true
+		} else if msg.Message == message2 {
+			foundMessage2 = true
+		}
+	}
+
+	if !foundMessage1 {
+		t.Errorf("message 1 not found in results")
+	}
+
+	if !foundMessage2 {
+		t.Errorf("message 2 not found in results")
+	}
+}
+
+// openTestStore returns a store on a fresh, fully migrated database for
+// tests that need to know exactly which rows exist.
+func openTestStore(t *testing.T) (*sql.DB, *SQLiteStore) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	_, err = MigrateUp(db)
+	if err != nil {
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	return db, NewSQLiteStore(db)
+}
+
+func TestForeignKeyCascades(t *testing.T) {
+	db, store := openTestStore(t)
+
+	count := func(query string, args ...any) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatalf("failed to count rows: %v", err)
+		}
+		return n
+	}
+
+	if count("PRAGMA foreign_keys") != 1 {
+		t.Fatal("expected foreign keys to be enforced")
+	}
+
+	for _, name := range []string{"cascadeAlice", "cascadeBob"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	bob, err := store.GetUser(ctx, "cascadeBob")
+	if err != nil {
+		t.Fatalf("GetUser failed: %v", err)
+	}
+
+	t.Run("Remove_topic", func(t *testing.T) {
+		topic, err := store.AddTopic(ctx, TopicDraft{Title: "Cascade Topic"}, "cascadeAlice")
+		if err != nil {
+			t.Fatalf("AddTopic failed: %v", err)
+		}
+		if _, err := store.RenameTopic(ctx, topic.ID, "Renamed Cascade Topic"); err != nil {
+			t.Fatalf("RenameTopic failed: %v", err)
+		}
+		message, err := store.AddMessage(ctx, topic.ID, "hello", "cascadeAlice", 0)
+		if err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+		if err := store.UpVoteTopic(ctx, topic.ID, "cascadeBob"); err != nil {
+			t.Fatalf("UpVoteTopic failed: %v", err)
+		}
+		if err := store.LikeMessage(ctx, message.ID, "cascadeBob"); err != nil {
+			t.Fatalf("LikeMessage failed: %v", err)
+		}
+
+		if err := store.RemoveTopic(ctx, topic.ID); err != nil {
+			t.Fatalf("RemoveTopic failed: %v", err)
+		}
+		if n := count("SELECT COUNT(*) FROM messages WHERE topic_id = ?", topic.ID); n != 0 {
+			t.Errorf("expected the topic's messages to be gone, got %d", n)
+		}
+		if n := count("SELECT COUNT(*) FROM message_reactions WHERE message_id = ?", message.ID); n != 0 {
+			t.Errorf("expected the messages' reactions to be gone, got %d", n)
+		}
+		if n := count("SELECT COUNT(*) FROM topic_votes WHERE topic_id = ?", topic.ID); n != 0 {
+			t.Errorf("expected the topic's votes to be gone, got %d", n)
+		}
+		if n := count("SELECT COUNT(*) FROM topic_slugs WHERE topic_id = ?", topic.ID); n != 0 {
+			t.Errorf("expected the topic's old slugs to be gone, got %d", n)
+		}
+	})
+
+	t.Run("Remove_user", func(t *testing.T) {
+		if _, err := store.BeginTwoFactor(ctx, "cascadeBob"); err != nil {
+			t.Fatalf("BeginTwoFactor failed: %v", err)
+		}
+		if _, err := store.CreateLoginChallenge(ctx, "cascadeBob"); err != nil {
+			t.Fatalf("CreateLoginChallenge failed: %v", err)
+		}
+		if _, err := store.GeneratePasswordResetCode(ctx, "cascadeBob@test.com"); err != nil {
+			t.Fatalf("GeneratePasswordResetCode failed: %v", err)
+		}
+		if _, _, err := store.CreateEmailVerification(ctx, "cascadeBob"); err != nil {
+			t.Fatalf("CreateEmailVerification failed: %v", err)
+		}
+
+		if err := store.RemoveUser(ctx, "cascadeBob"); err != nil {
+			t.Fatalf("RemoveUser failed: %v", err)
+		}
+		for _, table := range []string{"user_totp", "login_challenges", "password_resets", "email_verifications"} {
+			if n := count("SELECT COUNT(*) FROM "+table+" WHERE user_id = ?", bob.ID); n != 0 {
+				t.Errorf("expected the user's %s to be gone, got %d", table, n)
+			}
+		}
+	})
+}
+
+func TestListingPagination(t *testing.T) {
+	db, store := openTestStore(t)
+
+	for _, name := range []string{"pageAlice", "pageBob", "pageCarol"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	pages := make(map[string]int)
+	for _, title := range []string{"Page 1", "Page 2", "Page 3"} {
+		topic, err := store.AddTopic(ctx, TopicDraft{Title: title}, "pageBob")
+		if err != nil {
+			t.Fatalf("AddTopic failed: %v", err)
+		}
+		pages[title] = topic.ID
+	}
+
+	topicTitles := func(topics []models.Topic) []string {
+		titles := []string{}
+		for _, topic := range topics {
+			titles = append(titles, topic.Title)
+		}
+		return titles
+	}
+
+	topics, next, err := store.GetAllTopics(ctx, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("GetAllTopics failed: %v", err)
+	}
+	if got := fmt.Sprint(topicTitles(topics)); got != "[Page 3 Page 2]" || next == "" {
+		t.Fatalf("unexpected first page %s with cursor %q", got, next)
+	}
+
+	// A topic created between pages must not shift the second page.
+	if _, err := store.AddTopic(ctx, TopicDraft{Title: "Page 4"}, "pageBob"); err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	topics, next, err = store.GetAllTopics(ctx, ListOptions{Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatalf("GetAllTopics failed: %v", err)
+	}
+	if got := fmt.Sprint(topicTitles(topics)); got != "[Page 1]" || next != "" {
+		t.Fatalf("unexpected second page %s with cursor %q", got, next)
+	}
+
+	if err := store.UpVoteTopic(ctx, pages["Page 2"], "pageAlice"); err != nil {
+		t.Fatalf("UpVoteTopic failed: %v", err)
+	}
+	topics, _, err = store.GetAllTopics(ctx, ListOptions{Sort: SortTop})
+	if err != nil {
+		t.Fatalf("GetAllTopics failed: %v", err)
+	}
+	if got := fmt.Sprint(topicTitles(topics)); got != "[Page 2 Page 4 Page 3 Page 1]" {
+		t.Errorf("unexpected top topics %s", got)
+	}
+
+	root, err := store.AddMessage(ctx, pages["Page 1"], "first", "pageAlice", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	liked, err := store.AddMessage(ctx, pages["Page 1"], "second", "pageAlice", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	reply, err := store.AddMessage(ctx, pages["Page 1"], "reply", "pageCarol", root.ID)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if err := store.LikeMessage(ctx, liked.ID, "pageBob"); err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+	_, err = db.Exec("UPDATE messages SET timestamp = '2099-01-01 00:00:00' WHERE id = ?", reply.ID)
+	if err != nil {
+		t.Fatalf("failed to move reply timestamp: %v", err)
+	}
+
+	topics, _, err = store.GetAllTopics(ctx, ListOptions{Sort: SortActive, Limit: 1})
+	if err != nil {
+		t.Fatalf("GetAllTopics failed: %v", err)
+	}
+	if got := fmt.Sprint(topicTitles(topics)); got != "[Page 1]" {
+		t.Errorf("expected the topic with the latest message to be most active, got %s", got)
+	}
+
+	messageIDs := func(opts ListOptions) []int {
+		t.Helper()
+		messages, _, err := store.GetMessagesByTopic(ctx, root.TopicID, opts)
+		if err != nil {
+			t.Fatalf("GetMessagesByTopic failed: %v", err)
+		}
+		ids := []int{}
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		sort string
+		want []int
+	}{
+		{SortOldest, []int{root.ID, liked.ID, reply.ID}},
+		{SortRecent, []int{reply.ID, liked.ID, root.ID}},
+		{SortTop, []int{liked.ID, reply.ID, root.ID}},
+		{SortActive, []int{reply.ID, root.ID, liked.ID}},
+	}
+	for _, tt := range tests {
+		if got := messageIDs(ListOptions{Sort: tt.sort}); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("sort %s: expected messages %v, got %v", tt.sort, tt.want, got)
+		}
+	}
+
+	users, next, err := store.GetAllUsers(ctx, ListOptions{Sort: SortTop, Limit: 1})
+	if err != nil {
+		t.Fatalf("GetAllUsers failed: %v", err)
+	}
+	if len(users) != 1 || users[0].Username != "pageAlice" || next == "" {
+		t.Fatalf("expected pageAlice to top the user list, got %+v with cursor %q", users, next)
+	}
+	users, _, err = store.GetAllUsers(ctx, ListOptions{Cursor: next})
+	if err != nil {
+		t.Fatalf("GetAllUsers failed: %v", err)
+	}
+	if len(users) != 2 || users[0].Username != "pageCarol" || users[1].Username != "pageBob" {
+		t.Errorf("unexpected rest of the user list: %+v", users)
+	}
+
+	_, _, err = store.GetAllUsers(ctx, ListOptions{Cursor: "bm90LWEtY3Vyc29y"})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, store := openTestStore(t)
+
+	for _, name := range []string{"gardener", "cook"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	gardening, err := store.AddTopic(ctx, TopicDraft{Title: "Gardening tips"}, "gardener")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	cooking, err := store.AddTopic(ctx, TopicDraft{Title: "Cooking"}, "cook")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	posts := []struct {
+		topicID         int
+		message, author string
+	}{
+		{gardening.ID, "Tomatoes need <lots> of sun", "gardener"},
+		{gardening.ID, "My tomato plants wilted", "cook"},
+		{cooking.ID, "A quick tomato soup recipe", "cook"},
+	}
+	var sun *models.Message
+	for _, post := range posts {
+		msg, err := store.AddMessage(ctx, post.topicID, post.message, post.author, 0)
+		if err != nil {
+			t.Fatalf("AddMessage failed: %v", err)
+		}
+		if sun == nil {
+			sun = msg
+		}
+	}
+
+	search := func(q SearchQuery) []models.SearchHit {
+		t.Helper()
+		hits, err := store.Search(ctx, q)
+		if err != nil {
+			t.Fatalf("Search(%+v) failed: %v", q, err)
+		}
+		return hits
+	}
+
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  int
+	}{
+		{"word", SearchQuery{Text: "tomato"}, 2},
+		{"prefix", SearchQuery{Text: "tomato*"}, 3},
+		{"phrase", SearchQuery{Text: `"tomato soup"`}, 1},
+		{"phrase out of order", SearchQuery{Text: `"soup tomato"`}, 0},
+		{"all words", SearchQuery{Text: "tomato wilted"}, 1},
+		{"author", SearchQuery{Text: "tomato*", Author: "gardener"}, 1},
+		{"topic", SearchQuery{Text: "tomato*", TopicID: cooking.ID}, 1},
+		{"topics only", SearchQuery{Text: "garden* tomato*", Type: SearchTypeTopic}, 0},
+		{"before", SearchQuery{Text: "tomato*", Until: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}, 0},
+		{"after", SearchQuery{Text: "tomato*", Since: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}, 3},
+		{"operators are words", SearchQuery{Text: "NEAR(tomato soup) title:cooking"}, 0},
+		{"limit", SearchQuery{Text: "tomato*", Limit: 2}, 2},
+	}
+	for _, tt := range tests {
+		if got := len(search(tt.query)); got != tt.want {
+			t.Errorf("%s: expected %d hits, got %d", tt.name, tt.want, got)
+		}
+	}
+
+	hits := search(SearchQuery{Text: "garden*"})
+	if len(hits) != 1 || hits[0].Type != SearchTypeTopic || hits[0].Author != "gardener" {
+		t.Fatalf("expected the gardening topic, got %+v", hits)
+	}
+	if hits[0].Snippet != "<mark>Gardening</mark> tips" {
+		t.Errorf("unexpected topic snippet %q", hits[0].Snippet)
+	}
+
+	hits = search(SearchQuery{Text: "sun"})
+	if len(hits) != 1 || hits[0].ID != sun.ID || hits[0].TopicTitle != "Gardening tips" || hits[0].TopicSlug != "gardening-tips" {
+		t.Fatalf("expected the sun message, got %+v", hits)
+	}
+	if hits[0].Snippet != "Tomatoes need &lt;lots&gt; of <mark>sun</mark>" {
+		t.Errorf("expected an escaped, highlighted snippet, got %q", hits[0].Snippet)
+	}
+
+	_, err = store.Search(ctx, SearchQuery{Text: ` "" * `})
+	if !errors.Is(err, ErrEmptySearch) {
+		t.Errorf("expected ErrEmptySearch, got %v", err)
+	}
+
+	_, err = db.Exec("UPDATE messages SET message = 'Cucumbers need water' WHERE id = ?", sun.ID)
+	if err != nil {
+		t.Fatalf("failed to edit message: %v", err)
+	}
+	if len(search(SearchQuery{Text: "sun"})) != 0 || len(search(SearchQuery{Text: "cucumber*"})) != 1 {
+		t.Error("expected the index to follow an edited message")
+	}
+
+	if err := store.RemoveTopic(ctx, cooking.ID); err != nil {
+		t.Fatalf("RemoveTopic failed: %v", err)
+	}
+	if len(search(SearchQuery{Text: "cooking"})) != 0 {
+		t.Error("expected a removed topic to drop out of the index")
+	}
+
+	_, err = db.Exec("INSERT INTO messages_fts (messages_fts) VALUES ('delete-all')")
+	if err != nil {
+		t.Fatalf("failed to empty the message index: %v", err)
+	}
+	if len(search(SearchQuery{Text: "wilted"})) != 0 {
+		t.Fatal("expected the emptied index to find nothing")
+	}
+	if err := store.RebuildSearchIndex(ctx); err != nil {
+		t.Fatalf("RebuildSearchIndex failed: %v", err)
+	}
+	if len(search(SearchQuery{Text: "wilted"})) != 1 {
+		t.Error("expected RebuildSearchIndex to restore the message index")
+	}
+}
+
+type publishedEvent struct {
+	topicID int
+	kind    string
+	data    any
+}
+
+type recordingPublisher struct {
+	events []publishedEvent
+}
+
+func (p *recordingPublisher) Publish(topicID int, kind string, data any) {
+	p.events = append(p.events, publishedEvent{topicID, kind, data})
+}
+
+func TestStorePublishesEvents(t *testing.T) {
+	_, store := openTestStore(t)
+	publisher := &recordingPublisher{}
+	store.SetPublisher(publisher)
+
+	if err := store.AddUser(ctx, "eventUser", "eventUser@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, TopicDraft{Title: "Event Topic"}, "eventUser")
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	root, err := store.AddMessage(ctx, topic.ID, "root", "eventUser", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	reply, err := store.AddMessage(ctx, topic.ID, "reply", "eventUser", 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	if err := store.LikeMessage(ctx, root.ID, "eventUser"); err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+	if err := store.RemoveReaction(ctx, root.ID, "eventUser", ReactionLike); err != nil {
+		t.Fatalf("RemoveReaction failed: %v", err)
+	}
+	if err := store.SetParent(ctx, root.ID, reply.ID); err != nil {
+		t.Fatalf("SetParent failed: %v", err)
+	}
+	if err := store.UpVoteTopic(ctx, topic.ID, "eventUser"); err != nil {
+		t.Fatalf("UpVoteTopic failed: %v", err)
+	}
+
+	// Failed changes publish nothing.
+	if err := store.LikeMessage(ctx, 9999, "eventUser"); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected ErrMessageNotFound, got %v", err)
+	}
+	if err := store.UpVoteTopic(ctx, topic.ID, "eventUser"); !errors.Is(err, ErrVoteExists) {
+		t.Fatalf("expected ErrVoteExists, got %v", err)
+	}
+
+	want := []publishedEvent{
+		{root.TopicID, EventMessageCreated, root},
+		{root.TopicID, EventMessageCreated, reply},
+		{root.TopicID, EventMessageReactions, &models.MessageReactions{MessageID: root.ID, Likes: 1, Reactions: map[string]int{ReactionLike: 1}}},
+		{root.TopicID, EventMessageReactions, &models.MessageReactions{MessageID: root.ID, Likes: 0, Reactions: map[string]int{}}},
+		{root.TopicID, EventMessageMoved, models.MessageMoved{MessageID: reply.ID, ParentID: root.ID}},
+		{root.TopicID, EventTopicVoted, models.TopicScore{TopicID: root.TopicID, Upvotes: 1}},
+	}
+	if len(publisher.events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(publisher.events), publisher.events)
+	}
+	for i, event := range publisher.events {
+		if !reflect.DeepEqual(event, want[i]) {
+			t.Errorf("event %d: expected %+v, got %+v", i, want[i], event)
+		}
+	}
+}
+
+func TestLikeMessage(t *testing.T) {
+	topicTitle := "likeTopic"
+	username := "likeUser"
+	message := "This is a message to like"
+
+	err := testStore.AddUser(ctx, username, "likeuser@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topic.ID, message, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	var messageID int
+	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", message).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("failed to fetch message ID: %v", err)
+	}
+
+	err = testStore.LikeMessage(ctx, messageID, username)
+	if err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	err = testStore.LikeMessage(ctx, messageID, username)
+	if !errors.Is(err, ErrReactionExists) {
+		t.Errorf("expected second like to be rejected, got %v", err)
+	}
+
+	err = testStore.LikeMessage(ctx, 999999, username)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected 'message not found' for unknown message, got %v", err)
+	}
+
+	var likes int
+	err = testDB.QueryRow("SELECT likes FROM messages WHERE id = ?", messageID).Scan(&likes)
+	if err != nil {
+		t.Fatalf("failed to fetch likes: %v", err)
+	}
+
+	if likes != 1 {
+		t.Errorf("expected 1 like, got %d", likes)
+	}
+}
+
+func TestDislikeMessage(t *testing.T) {
+	topicTitle := "dislikeTopic"
+	username := "dislikeUser"
+	message := "This is a message to dislike"
+
+	err := testStore.AddUser(ctx, username, "dislikeuser@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topic.ID, message, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	var messageID int
+	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", message).Scan(&messageID)
+	if err != nil {
+		t.Fatalf("failed to fetch message ID: %v", err)
+	}
+
+	err = testStore.LikeMessage(ctx, messageID, username)
+	if err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	err = testStore.DislikeMessage(ctx, messageID, username)
+	if err != nil {
+		t.Fatalf("DislikeMessage failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "messages")
+
+	var likes int
+	err = testDB.QueryRow("SELECT likes FROM messages WHERE id = ?", messageID).Scan(&likes)
+	if err != nil {
+		t.Fatalf("failed to fetch likes: %v", err)
+	}
+
+	if likes != -1 {
+		t.Errorf("expected dislike to replace the like and leave -1, got %d", likes)
+	}
+
+	var reactions int
+	err = testDB.QueryRow("SELECT COUNT(*) FROM message_reactions WHERE message_id = ?", messageID).Scan(&reactions)
+	if err != nil {
+		t.Fatalf("failed to count reactions: %v", err)
+	}
+
+	if reactions != 1 {
+		t.Errorf("expected like and dislike to be mutually exclusive, got %d reactions", reactions)
+	}
+}
+
+func TestMessageReactions(t *testing.T) {
+	topicTitle := "reactionTopic"
+	username := "reactionUser"
+	otherUser := "reactionUser2"
+	message := "This is a message to react to"
+
+	err := testStore.AddUser(ctx, username, "reactionuser@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	err = testStore.AddUser(ctx, otherUser, "reactionuser2@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+
+	_, err = testStore.AddMessage(ctx, topic.ID, message, username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+
+	var messageID, topicID int
+	err = testDB.QueryRow("SELECT id, topic_id FROM messages WHERE message = ?", message).Scan(&messageID, &topicID)
+	if err != nil {
+		t.Fatalf("failed to fetch message ID: %v", err)
+	}
+
+	err = testStore.AddReaction(ctx, messageID, username, "heart")
+	if err != nil {
+		t.Fatalf("AddReaction failed: %v", err)
+	}
+
+	err = testStore.AddReaction(ctx, messageID, otherUser, "heart")
+	if err != nil {
+		t.Fatalf("AddReaction failed: %v", err)
+	}
+
+	err = testStore.LikeMessage(ctx, messageID, otherUser)
+	if err != nil {
+		t.Fatalf("LikeMessage failed: %v", err)
+	}
+
+	err = testStore.AddReaction(ctx, messageID, username, "shrug")
+	if !errors.Is(err, ErrUnknownReaction) {
+		t.Errorf("expected 'unknown reaction', got %v", err)
+	}
+
+	PrintTableContents(testDB, "message_reactions")
+
+	messages, _, err := testStore.GetMessagesByTopic(ctx, topicID, ListOptions{})
+	if err != nil {
+		t.Fatalf("GetMessagesByTopic failed: %v", err)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+
+	counts := messages[0].Reactions
+	if counts["heart"] != 2 || counts["like"] != 1 || len(counts) != 2 {
+		t.Errorf("expected 2 hearts and 1 like, got %v", counts)
+	}
+
+	reactors, err := testStore.GetMessageReactions(ctx, messageID)
+	if err != nil {
+		t.Fatalf("GetMessageReactions failed: %v", err)
+	}
+
+	if len(reactors) != 3 {
+		t.Errorf("expected 3 reactions, got %d", len(reactors))
+	}
+
+	err = testStore.RemoveReaction(ctx, messageID, username, "heart")
+	if err != nil {
+		t.Fatalf("RemoveReaction failed: %v", err)
+	}
+
+	err = testStore.RemoveReaction(ctx, messageID, username, "heart")
+	if !errors.Is(err, ErrReactionNotFound) {
+		t.Errorf("expected 'reaction not found', got %v", err)
+	}
+
+	err = testStore.RemoveUser(ctx, otherUser)
+	if err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+
+	var likes int
+	err = testDB.QueryRow("SELECT likes FROM messages WHERE id = ?", messageID).Scan(&likes)
+	if err != nil {
+		t.Fatalf("failed to fetch likes: %v", err)
+	}
+
+	if likes != 0 {
+		t.Errorf("expected removed user's like to be dropped, got %d likes", likes)
+	}
+
+	_, err = testStore.GetMessageReactions(ctx, 999999)
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected 'message not found', got %v", err)
+	}
+}
+
+func TestCreateSession(t *testing.T) {
+	username := "sessionUser"
+
+	err := testStore.AddUser(ctx, username, "sessionuser@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	token, err := testStore.CreateSession(ctx, username, "test-agent")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "sessions")
+
+	if token == "" {
+		t.Fatal("expected a session token, got an empty string")
+	}
+
+	var storedHash string
+	err = testDB.QueryRow("SELECT token_hash FROM sessions WHERE user_agent = ?", "test-agent").Scan(&storedHash)
+	if err != nil {
+		t.Fatalf("failed to fetch session: %v", err)
+	}
+
+	if storedHash == token {
+		t.Error("expected the token to be stored hashed, found it in plaintext")
+	}
+
+	user, err := testStore.GetSessionUser(ctx, token)
+	if err != nil {
+		t.Fatalf("GetSessionUser failed: %v", err)
+	}
+
+	if user.Username != username {
+		t.Errorf("expected username %s, got %s", username, user.Username)
+	}
+
+	_, err = testStore.GetSessionUser(ctx, "not-a-token")
+	if err == nil {
+		t.Error("expected GetSessionUser to fail for an unknown token, but it succeeded")
+	}
+
+	_, err = testDB.Exec("UPDATE sessions SET expires_at = datetime('now', '-1 second') WHERE token_hash = ?", storedHash)
+	if err != nil {
+		t.Fatalf("failed to expire session: %v", err)
+	}
+
+	_, err = testStore.GetSessionUser(ctx, token)
+	if err == nil {
+		t.Error("expected GetSessionUser to fail for an expired token, but it succeeded")
+	}
+
+	_, err = testStore.CreateSession(ctx, "nonexistentSessionUser", "test-agent")
+	if err == nil {
+		t.Error("expected CreateSession to fail for nonexistent user, but it succeeded")
+	}
+}
+
+func TestDeleteSessions(t *testing.T) {
+	username := "logoutUser"
+
+	err := testStore.AddUser(ctx, username, "logoutuser@mail.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	first, err := testStore.CreateSession(ctx, username, "first")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	second, err := testStore.CreateSession(ctx, username, "second")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	err = testStore.DeleteSession(ctx, first)
+	if err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+
+	_, err = testStore.GetSessionUser(ctx, first)
+	if err == nil {
+		t.Error("expected deleted session to be invalid")
+	}
+
+	user, err := testStore.GetSessionUser(ctx, second)
+	if err != nil {
+		t.Fatalf("expected second session to stay valid: %v", err)
+	}
+
+	_, err = testStore.CreateSession(ctx, username, "third")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	err = testStore.DeleteUserSessions(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("DeleteUserSessions failed: %v", err)
+	}
+
+	PrintTableContents(testDB, "sessions")
+
+	var remaining int
+	err = testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ?", user.ID).Scan(&remaining)
+	if err != nil {
+		t.Fatalf("failed to count sessions: %v", err)
+	}
+
+	if remaining != 0 {
+		t.Errorf("expected 0 sessions after DeleteUserSessions, got %d", remaining)
+	}
+}
+
+func TestLoginPolicyLockout(t *testing.T) {
+	policy := LoginPolicy{BaseLockout: time.Minute, MaxLockout: 10 * time.Minute}
+
+	tests := []struct {
+		failures, threshold int
+		want                time.Duration
+	}{
+		{4, 5, 0},
+		{5, 5, time.Minute},
+		{6, 5, 2 * time.Minute},
+		{8, 5, 8 * time.Minute},
+		{9, 5, 10 * time.Minute},
+		{500, 5, 10 * time.Minute},
+		{500, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := policy.Lockout(tt.failures, tt.threshold); got != tt.want {
+			t.Errorf("Lockout(%d, %d) = %v, want %v", tt.failures, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	db, store := openTestStore(t)
+	store.SetLoginPolicy(LoginPolicy{
+		UserThreshold: 2,
+		IPThreshold:   3,
+		BaseLockout:   time.Minute,
+		MaxLockout:    time.Hour,
+		FailureWindow: 15 * time.Minute,
+	})
+
+	if err := store.AddUser(ctx, "lockedUser", "lockeduser@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	fail := func(username, ip string) {
+		t.Helper()
+		err := store.RecordLogin(ctx, models.LoginAttempt{Username: username, IP: ip, UserAgent: "test"})
+		if err != nil {
+			t.Fatalf("RecordLogin failed: %v", err)
+		}
+	}
+	lockedFor := func(username, ip string) time.Duration {
+		t.Helper()
+		until, err := store.LoginLockedUntil(ctx, username, ip)
+		if err != nil {
+			t.Fatalf("LoginLockedUntil failed: %v", err)
+		}
+		if until.IsZero() {
+			return 0
+		}
+		return time.Until(until).Round(time.Minute)
+	}
+
+	fail("lockedUser", "10.0.0.1")
+	if d := lockedFor("lockedUser", "10.0.0.2"); d != 0 {
+		t.Fatalf("expected no lockout below the threshold, got %v", d)
+	}
+
+	fail("lockedUser", "10.0.0.2")
+	if d := lockedFor("lockedUser", "10.0.0.3"); d != time.Minute {
+		t.Fatalf("expected the username to be locked out for a minute from any IP, got %v", d)
+	}
+	if d := lockedFor("someoneElse", "10.0.0.3"); d != 0 {
+		t.Errorf("expected other usernames to be unaffected, got %v", d)
+	}
+
+	fail("lockedUser", "10.0.0.3")
+	if d := lockedFor("lockedUser", "10.0.0.3"); d != 2*time.Minute {
+		t.Errorf("expected the lockout to double, got %v", d)
+	}
+
+	// Once the lockout and the failure window have passed, counting starts
+	// over.
+	_, err := db.Exec(`UPDATE login_throttles SET last_failure_at = datetime('now', '-1 hour'), locked_until = datetime('now', '-20 minutes')
+				WHERE scope = 'user'`)
+	if err != nil {
+		t.Fatalf("failed to age failures: %v", err)
+	}
+	if d := lockedFor("lockedUser", "10.0.0.4"); d != 0 {
+		t.Errorf("expected the lockout to have run out, got %v", d)
+	}
+	fail("lockedUser", "10.0.0.4")
+	if d := lockedFor("lockedUser", "10.0.0.4"); d != 0 {
+		t.Errorf("expected old failures to be forgotten, got %v", d)
+	}
+
+	// A successful login forgets the username's failures.
+	err = store.RecordLogin(ctx, models.LoginAttempt{Username: "lockedUser", Success: true, IP: "10.0.0.4", UserAgent: "test"})
+	if err != nil {
+		t.Fatalf("RecordLogin failed: %v", err)
+	}
+	fail("lockedUser", "10.0.0.4")
+	if d := lockedFor("lockedUser", "10.0.0.4"); d != 0 {
+		t.Errorf("expected failures before a successful login to be forgotten, got %v", d)
+	}
+
+	// Guessing many usernames from one IP locks out the IP.
+	for _, username := range []string{"guess1", "guess2", "guess3"} {
+		fail(username, "10.0.0.9")
+	}
+	if d := lockedFor("lockedUser", "10.0.0.9"); d != time.Minute {
+		t.Errorf("expected the IP to be locked out for a minute, got %v", d)
+	}
+
+	fail("lockedUser", "10.0.0.5")
+	if d := lockedFor("lockedUser", "10.0.0.5"); d != time.Minute {
+		t.Fatalf("expected the username to be locked out again, got %v", d)
+	}
+	if err := store.UnlockLogin(ctx, "lockedUser"); err != nil {
+		t.Fatalf("UnlockLogin failed: %v", err)
+	}
+	if d := lockedFor("lockedUser", "10.0.0.5"); d != 0 {
+		t.Errorf("expected UnlockLogin to lift the lockout, got %v", d)
+	}
+	if err := store.UnlockLogin(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	attempts, err := store.GetLoginAttempts(ctx, "lockedUser", 3)
+	if err != nil {
+		t.Fatalf("GetLoginAttempts failed: %v", err)
+	}
+	if len(attempts) != 3 || attempts[0].IP != "10.0.0.5" || attempts[1].Success || !attempts[2].Success {
+		t.Errorf("expected the newest 3 attempts first, got %+v", attempts)
+	}
+	if attempts[0].UserAgent != "test" || attempts[0].CreatedAt.IsZero() {
+		t.Errorf("expected the user agent and time to be recorded, got %+v", attempts[0])
+	}
+
+	// Attempts follow the user through a rename.
+	if err := store.ChangeUsername(ctx, "lockedUser", "renamedLockedUser"); err != nil {
+		t.Fatalf("ChangeUsername failed: %v", err)
+	}
+	attempts, err = store.GetLoginAttempts(ctx, "renamedLockedUser", 0)
+	if err != nil || len(attempts) != 7 {
+		t.Errorf("expected all 7 attempts under the new name, got %d, %v", len(attempts), err)
+	}
+
+	if _, err := store.GetLoginAttempts(ctx, "nobody", 0); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	db, store := openTestStore(t)
+	count := func(query string, args ...any) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatalf("failed to count rows: %v", err)
+		}
+		return n
+	}
+
+	if err := store.AddUser(ctx, "totpUser", "totpuser@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	if _, err := store.ConfirmTwoFactor(ctx, "totpUser", "123456"); !errors.Is(err, ErrTwoFactorNotPending) {
+		t.Errorf("expected ErrTwoFactorNotPending before enrolment, got %v", err)
+	}
+	if _, err := store.BeginTwoFactor(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// Starting again replaces a secret that was never confirmed.
+	first, err := store.BeginTwoFactor(ctx, "totpUser")
 	if err != nil {
-		t.Fatalf("AddMessage failed for parentMessage: %v", err)
+		t.Fatalf("BeginTwoFactor failed: %v", err)
+	}
+	secret, err := store.BeginTwoFactor(ctx, "totpUser")
+	if err != nil || secret == first {
+		t.Fatalf("expected a new secret, got %q, %v", secret, err)
+	}
+	if enabled, err := store.TwoFactorEnabled(ctx, "totpUser"); err != nil || enabled {
+		t.Errorf("expected two-factor to stay off until confirmed, got %v, %v", enabled, err)
 	}
 
-	err = AddMessage(testDB, topic, childMessage, username)
+	now := time.Now()
+	stale, _ := totp.Code(first, now)
+	if _, err := store.ConfirmTwoFactor(ctx, "totpUser", stale); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected a code from the replaced secret to be refused, got %v", err)
+	}
+
+	code, _ := totp.Code(secret, now)
+	codes, err := store.ConfirmTwoFactor(ctx, "totpUser", code)
 	if err != nil {
-		t.Fatalf("AddMessage failed for childMessage: %v", err)
+		t.Fatalf("ConfirmTwoFactor failed: %v", err)
+	}
+	if len(codes) != RecoveryCodeCount || len(codes[0]) != 11 {
+		t.Fatalf("expected %d recovery codes, got %v", RecoveryCodeCount, codes)
+	}
+	if enabled, err := store.TwoFactorEnabled(ctx, "totpUser"); err != nil || !enabled {
+		t.Errorf("expected two-factor to be on, got %v, %v", enabled, err)
+	}
+	if _, err := store.BeginTwoFactor(ctx, "totpUser"); !errors.Is(err, ErrTwoFactorEnabled) {
+		t.Errorf("expected ErrTwoFactorEnabled, got %v", err)
+	}
+	if n := count("SELECT COUNT(*) FROM recovery_codes WHERE code_hash = ?", codes[0]); n != 0 {
+		t.Error("expected recovery codes to be stored hashed")
 	}
 
-	PrintTableContents(testDB, "messages")
+	// The code used to confirm cannot be used again, but the next one can.
+	if err := store.VerifyTwoFactor(ctx, "totpUser", code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected a used code to be refused, got %v", err)
+	}
+	next, _ := totp.Code(secret, now.Add(totp.Period))
+	if err := store.VerifyTwoFactor(ctx, "totpUser", next); err != nil {
+		t.Errorf("expected the next code to be accepted, got %v", err)
+	}
+	if err := store.VerifyTwoFactor(ctx, "totpUser", code); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected an earlier code to be refused, got %v", err)
+	}
 
-	var parentID, childID int
-	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", parentMessage).Scan(&parentID)
+	// Recovery codes work once, in any case and with or without the dash.
+	recovery := strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))
+	if err := store.VerifyTwoFactor(ctx, "totpUser", recovery); err != nil {
+		t.Errorf("expected the recovery code to be accepted, got %v", err)
+	}
+	if err := store.VerifyTwoFactor(ctx, "totpUser", codes[1]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected a used recovery code to be refused, got %v", err)
+	}
+
+	fresh, err := store.RegenerateRecoveryCodes(ctx, "totpUser")
+	if err != nil || len(fresh) != RecoveryCodeCount {
+		t.Fatalf("RegenerateRecoveryCodes failed: %v, %v", fresh, err)
+	}
+	if err := store.VerifyTwoFactor(ctx, "totpUser", codes[2]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("expected old recovery codes to be replaced, got %v", err)
+	}
+	if err := store.VerifyTwoFactor(ctx, "totpUser", fresh[0]); err != nil {
+		t.Errorf("expected a new recovery code to be accepted, got %v", err)
+	}
+
+	if _, err := store.CreateLoginChallenge(ctx, "totpUser"); err != nil {
+		t.Fatalf("CreateLoginChallenge failed: %v", err)
+	}
+	if err := store.DisableTwoFactor(ctx, "totpUser"); err != nil {
+		t.Fatalf("DisableTwoFactor failed: %v", err)
+	}
+	for _, table := range []string{"user_totp", "recovery_codes", "login_challenges"} {
+		if n := count("SELECT COUNT(*) FROM " + table); n != 0 {
+			t.Errorf("expected %s to be emptied, got %d rows", table, n)
+		}
+	}
+	if err := store.DisableTwoFactor(ctx, "totpUser"); !errors.Is(err, ErrTwoFactorNotEnabled) {
+		t.Errorf("expected ErrTwoFactorNotEnabled, got %v", err)
+	}
+	if err := store.VerifyTwoFactor(ctx, "totpUser", next); !errors.Is(err, ErrTwoFactorNotEnabled) {
+		t.Errorf("expected ErrTwoFactorNotEnabled, got %v", err)
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	db, store := openTestStore(t)
+	count := func(query string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("failed to count rows: %v", err)
+		}
+		return n
+	}
+
+	if err := store.AddUser(ctx, "challengeUser", "challengeuser@test.com", "password"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	token, err := store.CreateLoginChallenge(ctx, "challengeUser")
 	if err != nil {
-		t.Fatalf("failed to fetch parentID: %v", err)
+		t.Fatalf("CreateLoginChallenge failed: %v", err)
+	}
+	if _, err := store.CreateLoginChallenge(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
 	}
 
-	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", childMessage).Scan(&childID)
+	// Challenges follow the user through a rename.
+	if err := store.ChangeUsername(ctx, "challengeUser", "renamedChallengeUser"); err != nil {
+		t.Fatalf("ChangeUsername failed: %v", err)
+	}
+	if username, err := store.GetLoginChallenge(ctx, token); err != nil || username != "renamedChallengeUser" {
+		t.Errorf("expected the challenge to belong to renamedChallengeUser, got %q, %v", username, err)
+	}
+	if _, err := store.GetLoginChallenge(ctx, "bogus"); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expected ErrInvalidChallenge, got %v", err)
+	}
+
+	if _, err := db.Exec("UPDATE login_challenges SET expires_at = datetime('now', '-1 second')"); err != nil {
+		t.Fatalf("failed to expire challenge: %v", err)
+	}
+	if _, err := store.GetLoginChallenge(ctx, token); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expected an expired challenge to be invalid, got %v", err)
+	}
+
+	// Creating a challenge clears out expired ones.
+	token, err = store.CreateLoginChallenge(ctx, "renamedChallengeUser")
 	if err != nil {
-		t.Fatalf("failed to fetch childID: %v", err)
+		t.Fatalf("CreateLoginChallenge failed: %v", err)
+	}
+	if n := count("SELECT COUNT(*) FROM login_challenges"); n != 1 {
+		t.Errorf("expected the expired challenge to be deleted, got %d challenges", n)
+	}
+
+	if err := store.DeleteLoginChallenge(ctx, token); err != nil {
+		t.Fatalf("DeleteLoginChallenge failed: %v", err)
+	}
+	if _, err := store.GetLoginChallenge(ctx, token); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expected a deleted challenge to be invalid, got %v", err)
+	}
+}
+
+func TestTwoFactorRole(t *testing.T) {
+	_, store := openTestStore(t)
+
+	if role, err := store.GetTwoFactorRole(ctx); err != nil || role != "" {
+		t.Fatalf("expected no required role by default, got %q, %v", role, err)
+	}
+
+	for _, role := range []string{models.RoleModerator, models.RoleAdmin, ""} {
+		if err := store.SetTwoFactorRole(ctx, role); err != nil {
+			t.Fatalf("SetTwoFactorRole(%q) failed: %v", role, err)
+		}
+		if got, err := store.GetTwoFactorRole(ctx); err != nil || got != role {
+			t.Errorf("expected %q, got %q, %v", role, got, err)
+		}
+	}
+
+	for _, role := range []string{models.RoleUser, "owner"} {
+		if err := store.SetTwoFactorRole(ctx, role); !errors.Is(err, ErrInvalidTwoFactorRole) {
+			t.Errorf("expected ErrInvalidTwoFactorRole for %q, got %v", role, err)
+		}
 	}
+}
 
-	err = SetParent(testDB, parentID, childID)
+// failNext installs a trigger that aborts the statement matching event, so a
+// test can make a multi-step write fail part way through. The trigger is
+// dropped when the test ends.
+func failNext(t *testing.T, name, event string) {
+	t.Helper()
+
+	_, err := testDB.Exec("CREATE TRIGGER " + name + " " + event + " BEGIN SELECT RAISE(ABORT, 'injected failure'); END")
 	if err != nil {
-		t.Fatalf("SetParent failed: %v", err)
+		t.Fatalf("failed to create trigger %s: %v", name, err)
 	}
+	t.Cleanup(func() {
+		testDB.Exec("DROP TRIGGER IF EXISTS " + name)
+	})
+}
 
-	PrintTableContents(testDB, "messages")
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
 
-	var storedParentID int
-	err = testDB.QueryRow("SELECT parent_id FROM messages WHERE id = ?", childID).Scan(&storedParentID)
+	var count int
+	err := testDB.QueryRow(query, args...).Scan(&count)
 	if err != nil {
-		t.Fatalf("failed to fetch parent_id for child message: %v", err)
+		t.Fatalf("failed to count rows: %v", err)
 	}
+	return count
+}
 
-	if storedParentID != parentID {
-		t.Errorf("expected parent_id %d, got %d", parentID, storedParentID)
+func TestAddMessageRollsBack(t *testing.T) {
+	username := "txMessageUser"
+	topicTitle := "Tx Message Topic"
+
+	err := testStore.AddUser(ctx, username, "txmessage@test.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	topic, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
 	}
 
-	err = SetParent(testDB, parentID, childID+1)
+	failNext(t, "fail_topic_message_count", "BEFORE UPDATE OF messages ON topics")
+
+	_, err = testStore.AddMessage(ctx, topic.ID, "never stored", username, 0)
 	if err == nil {
-		t.Errorf("expected error for mismatched topics, but got nil")
+		t.Fatal("expected AddMessage to fail, but it succeeded")
+	}
+
+	if n := countRows(t, "SELECT COUNT(*) FROM messages WHERE message = ?", "never stored"); n != 0 {
+		t.Errorf("expected the message insert to be rolled back, found %d rows", n)
+	}
+	if n := countRows(t, "SELECT messages_sent FROM users WHERE username = ?", username); n != 0 {
+		t.Errorf("expected messages_sent to stay 0, got %d", n)
 	}
 }
 
-func TestGetMessagesByTopic(t *testing.T) {
-	topicTitle := "testTopicGet"
-	username := "testUser"
-	message1 := "This is the first test message"
-	message2 := "This is the second test message"
+func TestAddTopicRollsBack(t *testing.T) {
+	username := "txTopicUser"
+	topicTitle := "Tx Topic"
 
-	err := AddUser(testDB, username, "testuser@mail.com", "password")
+	err := testStore.AddUser(ctx, username, "txtopic@test.com", "password")
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	failNext(t, "fail_topics_opened", "BEFORE UPDATE OF topics_opened ON users")
+
+	_, err = testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
+	if err == nil {
+		t.Fatal("expected AddTopic to fail, but it succeeded")
+	}
+
+	if n := countRows(t, "SELECT COUNT(*) FROM topics WHERE title = ?", topicTitle); n != 0 {
+		t.Errorf("expected the topic insert to be rolled back, found %d rows", n)
+	}
+}
+
+func TestRemoveUserRollsBack(t *testing.T) {
+	username := "txRemoveUser"
+	topicTitle := "Tx Remove Topic"
+
+	err := testStore.AddUser(ctx, username, "txremove@test.com", "password")
+	if err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	added, err := testStore.AddTopic(ctx, TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
-
-	var topicID int
-	err = testDB.QueryRow("SELECT id FROM topics WHERE title = ?", topicTitle).Scan(&topicID)
+	err = testStore.UpVoteTopic(ctx, added.ID, username)
 	if err != nil {
-		t.Fatalf("failed to fetch topic ID: %v", err)
+		t.Fatalf("UpVoteTopic failed: %v", err)
+	}
+	_, err = testStore.CreateSession(ctx, username, "tx-test")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	failNext(t, "fail_user_delete", "BEFORE DELETE ON users")
+
+	err = testStore.RemoveUser(ctx, username)
+	if err == nil {
+		t.Fatal("expected RemoveUser to fail, but it succeeded")
 	}
 
-	err = AddMessage(testDB, topicTitle, message1, username)
+	user, err := testStore.GetUser(ctx, username)
 	if err != nil {
-		t.Fatalf("AddMessage failed %v", err)
+		t.Fatalf("expected user to still exist: %v", err)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM topic_votes WHERE user_id = ?", user.ID); n != 1 {
+		t.Errorf("expected the vote to survive, found %d", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM sessions WHERE user_id = ?", user.ID); n != 1 {
+		t.Errorf("expected the session to survive, found %d", n)
 	}
 
-	err = AddMessage(testDB, topicTitle, message2, username)
+	topic, err := testStore.GetTopic(ctx, added.ID)
 	if err != nil {
-		t.Fatalf("AddMessage failed %v", err)
+		t.Fatalf("GetTopic failed: %v", err)
 	}
+	if topic.Upvotes != 1 || topic.CreatorID != user.ID {
+		t.Errorf("expected topic to be untouched, got upvotes %d and creator %d", topic.Upvotes, topic.CreatorID)
+	}
+}
 
-	PrintTableContents(testDB, "messages")
+func TestMergeTopicRollsBack(t *testing.T) {
+	username := "txMergeUser"
 
-	messages, err := GetMessagesByTopic(testDB, topicID)
+	err := testStore.AddUser(ctx, username, "txmerge@test.com", "password")
 	if err != nil {
-		t.Fatalf("GetMessagesByTopic failed: %v", err)
+		t.Fatalf("AddUser failed: %v", err)
 	}
-
-	if len(messages) != 2 {
-		t.Errorf("expected 2 messages, got %d", len(messages))
+	source, err := testStore.AddTopic(ctx, TopicDraft{Title: "Tx Merge Source"}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
 	}
-
-	foundMessage1 := false
-	foundMessage2 := false
-	for _, msg := range messages {
-		if msg["message"] == message1 {
-			foundMessage1 = true
-		} else if msg["message"] == message2 {
-			foundMessage2 = true
-		}
+	target, err := testStore.AddTopic(ctx, TopicDraft{Title: "Tx Merge Target"}, username)
+	if err != nil {
+		t.Fatalf("AddTopic failed: %v", err)
+	}
+	if _, err := testStore.AddMessage(ctx, source.ID, "stays put", username, 0); err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
 	}
 
-	if !foundMessage1 {
-		t.Errorf("message 1 not found in results")
+	failNext(t, "fail_topic_delete", "BEFORE DELETE ON topics")
+
+	_, err = testStore.MergeTopic(ctx, source.ID, target.ID)
+	if err == nil {
+		t.Fatal("expected MergeTopic to fail, but it succeeded")
 	}
 
-	if !foundMessage2 {
-		t.Errorf("message 2 not found in results")
+	if n := countRows(t, "SELECT COUNT(*) FROM messages WHERE topic_id = ?", source.ID); n != 1 {
+		t.Errorf("expected the message move to be rolled back, found %d messages in the source", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM topic_redirects WHERE topic_id = ?", source.ID); n != 0 {
+		t.Errorf("expected the redirect to be rolled back, found %d rows", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM topic_slugs WHERE topic_id = ?", target.ID); n != 0 {
+		t.Errorf("expected the slug move to be rolled back, found %d rows", n)
 	}
 }
 
-func TestLikeMessage(t *testing.T) {
-	topicTitle := "likeTopic"
-	username := "likeUser"
-	message := "This is a message to like"
+func TestSplitTopicRollsBack(t *testing.T) {
+	username := "txSplitUser"
+	topicTitle := "Tx Split Topic"
 
-	err := AddUser(testDB, username, "likeuser@mail.com", "password")
+	err := testStore.AddUser(ctx, username, "txsplit@test.com", "password")
 	if err != nil {
 		t.Fatalf("AddUser failed: %v", err)
 	}
-
-	err = AddTopic(testDB, topicTitle, username)
+	source, err := testStore.AddTopic(ctx, TopicDraft{Title: "Tx Split Source"}, username)
 	if err != nil {
 		t.Fatalf("AddTopic failed: %v", err)
 	}
-
-	err = AddMessage(testDB, topicTitle, message, username)
+	root, err := testStore.AddMessage(ctx, source.ID, "root", username, 0)
+	if err != nil {
+		t.Fatalf("AddMessage failed: %v", err)
+	}
+	reply, err := testStore.AddMessage(ctx, source.ID, "reply", username, root.ID)
 	if err != nil {
 		t.Fatalf("AddMessage failed: %v", err)
 	}
 
-	PrintTableContents(testDB, "messages")
+	failNext(t, "fail_message_detach", "BEFORE UPDATE OF parent_id ON messages")
 
-	var messageID int
-	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", message).Scan(&messageID)
-	if err != nil {
-		t.Fatalf("failed to fetch message ID: %v", err)
+	_, err = testStore.SplitTopic(ctx, reply.ID, TopicDraft{Title: topicTitle}, username)
+	if err == nil {
+		t.Fatal("expected SplitTopic to fail, but it succeeded")
 	}
 
-	err = LikeMessage(testDB, messageID)
-	if err != nil {
-		t.Fatalf("LikeMessage failed: %v", err)
+	if n := countRows(t, "SELECT COUNT(*) FROM topics WHERE title = ?", topicTitle); n != 0 {
+		t.Errorf("expected the new topic to be rolled back, found %d rows", n)
 	}
+	if n := countRows(t, "SELECT COUNT(*) FROM messages WHERE topic_id = ?", source.ID); n != 2 {
+		t.Errorf("expected both messages to stay in the source, found %d", n)
+	}
+}
 
-	PrintTableContents(testDB, "messages")
+type busyError struct{}
 
-	var likes int
-	err = testDB.QueryRow("SELECT likes FROM messages WHERE id = ?", messageID).Scan(&likes)
+func (busyError) Error() string { return "database is locked" }
+func (busyError) Code() int     { return sqliteBusy }
+
+func TestWithTxRetriesBusy(t *testing.T) {
+	calls := 0
+	err := testStore.withTx(ctx, func(tx *sql.Tx) error {
+		calls++
+		if calls == 1 {
+			return fmt.Errorf("could not record vote: %w", busyError{})
+		}
+		return nil
+	})
 	if err != nil {
-		t.Fatalf("failed to fetch likes: %v", err)
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 attempts, got %d", calls)
 	}
 
-	if likes != 1 {
-		t.Errorf("expected 1 like, got %d", likes)
+	calls = 0
+	err = testStore.withTx(ctx, func(tx *sql.Tx) error {
+		calls++
+		return busyError{}
+	})
+	if !isBusyError(err) {
+		t.Errorf("expected the busy error after giving up, got %v", err)
+	}
+	if calls != maxTxAttempts {
+		t.Errorf("expected %d attempts, got %d", maxTxAttempts, calls)
+	}
+
+	calls = 0
+	err = testStore.withTx(ctx, func(tx *sql.Tx) error {
+		calls++
+		return ErrVoteExists
+	})
+	if !errors.Is(err, ErrVoteExists) || calls != 1 {
+		t.Errorf("expected other errors to be returned without retrying, got %v after %d attempts", err, calls)
 	}
 }
 
-func TestDislikeMessage(t *testing.T) {
-	topicTitle := "dislikeTopic"
-	username := "dislikeUser"
-	message := "This is a message to dislike"
+func TestMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
 
-	err := AddUser(testDB, username, "dislikeuser@mail.com", "password")
+	migrations, err := Migrations()
 	if err != nil {
-		t.Fatalf("AddUser failed: %v", err)
+		t.Fatalf("Migrations failed: %v", err)
+	}
+
+	tableExists := func(name string) bool {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+		if err != nil {
+			t.Fatalf("failed to check for table %s: %v", name, err)
+		}
+		return count == 1
+	}
+	indexExists := func(name string) bool {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", name).Scan(&count)
+		if err != nil {
+			t.Fatalf("failed to check for index %s: %v", name, err)
+		}
+		return count == 1
 	}
 
-	err = AddTopic(testDB, topicTitle, username)
+	columnExists := func(table, column string) bool {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+		if err != nil {
+			t.Fatalf("failed to check for column %s.%s: %v", table, column, err)
+		}
+		return count == 1
+	}
+
+	applied, err := MigrateUp(db)
 	if err != nil {
-		t.Fatalf("AddTopic failed: %v", err)
+		t.Fatalf("MigrateUp failed: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("expected %d migrations to be applied, got %d", len(migrations), applied)
 	}
 
-	err = AddMessage(testDB, topicTitle, message, username)
+	applied, err = MigrateUp(db)
 	if err != nil {
-		t.Fatalf("AddMessage failed: %v", err)
+		t.Fatalf("second MigrateUp failed: %v", err)
+	}
+	if applied != 0 {
+		t.Errorf("expected no pending migrations, got %d applied", applied)
 	}
 
-	PrintTableContents(testDB, "messages")
+	if !tableExists("sessions") {
+		t.Error("expected sessions table to exist after migrating up")
+	}
+	if !tableExists("topic_redirects") || !indexExists("idx_topic_redirects_target") {
+		t.Error("expected topic_redirects table to exist after migrating up")
+	}
+	if !tableExists("password_resets") || columnExists("users", "reset_code") {
+		t.Error("expected password_resets to replace users.reset_code after migrating up")
+	}
+	if !tableExists("login_attempts") || !tableExists("login_throttles") || !indexExists("idx_login_attempts_user") {
+		t.Error("expected login_attempts and login_throttles tables to exist after migrating up")
+	}
+	if !tableExists("user_totp") || !tableExists("recovery_codes") || !tableExists("login_challenges") || !tableExists("settings") {
+		t.Error("expected two-factor tables to exist after migrating up")
+	}
+	if !tableExists("email_verifications") || !columnExists("users", "email_verified_at") {
+		t.Error("expected email verification to exist after migrating up")
+	}
 
-	var messageID int
-	err = testDB.QueryRow("SELECT id FROM messages WHERE message = ?", message).Scan(&messageID)
+	reverted, err := MigrateDown(db, 1)
 	if err != nil {
-		t.Fatalf("failed to fetch message ID: %v", err)
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	if reverted != 1 {
+		t.Errorf("expected 1 migration to be reverted, got %d", reverted)
+	}
+
+	if tableExists("email_verifications") || columnExists("users", "email_verified_at") {
+		t.Error("expected email verification to be dropped after migrating down")
+	}
+	if !tableExists("user_totp") || !tableExists("settings") || !tableExists("login_attempts") || !tableExists("password_resets") || !tableExists("topic_redirects") || !columnExists("topics", "locked_at") || !indexExists("idx_topics_pinned") || !tableExists("topic_slugs") || !columnExists("topics", "slug") || !tableExists("categories") || !tableExists("topic_tags") || !columnExists("messages", "deleted_at") || !tableExists("message_revisions") || !columnExists("users", "role") || !tableExists("topics_fts") || !indexExists("idx_topics_upvotes") {
+		t.Error("expected earlier migrations to survive reverting one migration")
 	}
 
-	err = LikeMessage(testDB, messageID)
+	statuses, err := GetMigrationStatus(db)
 	if err != nil {
-		t.Fatalf("LikeMessage failed: %v", err)
+		t.Fatalf("GetMigrationStatus failed: %v", err)
+	}
+	last := statuses[len(statuses)-1]
+	if latest := migrations[len(migrations)-1].Name; last.Applied || last.Name != latest {
+		t.Errorf("expected %s to be pending, got %+v", latest, last)
+	}
+	if !statuses[0].Applied {
+		t.Errorf("expected %s to stay applied", statuses[0].Name)
 	}
 
-	PrintTableContents(testDB, "messages")
+	broken := append(migrations, Migration{
+		Version: len(migrations) + 1,
+		Name:    "broken",
+		Up:      "CREATE TABLE half_done (id INTEGER); SELECT * FROM no_such_table;",
+		Down:    "DROP TABLE half_done;",
+	})
+
+	applied, err = migrateUp(db, broken)
+	if err == nil {
+		t.Fatal("expected broken migration to fail")
+	}
+	if applied != 1 {
+		t.Errorf("expected the pending good migration to be applied first, got %d", applied)
+	}
+
+	if tableExists("half_done") {
+		t.Error("expected failed migration to be rolled back")
+	}
 
-	err = DislikeMessage(testDB, messageID)
+	reverted, err = MigrateDown(db, len(migrations))
 	if err != nil {
-		t.Fatalf("DislikeMessage failed: %v", err)
+		t.Fatalf("MigrateDown failed: %v", err)
+	}
+	if reverted != len(migrations) {
+		t.Errorf("expected %d migrations to be reverted, got %d", len(migrations), reverted)
 	}
 
-	PrintTableContents(testDB, "messages")
+	if tableExists("users") {
+		t.Error("expected users table to be dropped after reverting everything")
+	}
+}
 
-	var likes int
-	err = testDB.QueryRow("SELECT likes FROM messages WHERE id = ?", messageID).Scan(&likes)
+func TestMigrateExistingDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
 	if err != nil {
-		t.Fatalf("failed to fetch likes: %v", err)
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// A database created before migrations existed already has the core tables.
+	_, err = db.Exec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password TEXT NOT NULL,
+		email TEXT NOT NULL,
+		reset_code TEXT DEFAULT NULL,
+		topics_opened INTEGER DEFAULT 0,
+		messages_sent INTEGER DEFAULT 0,
+		creation_date DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO users (username, password, email) VALUES ('legacy', 'x', 'legacy@test.com');`)
+	if err != nil {
+		t.Fatalf("failed to create legacy schema: %v", err)
 	}
 
-	if likes != 0 {
-		t.Errorf("expected 1 like, got %d", likes)
+	_, err = MigrateUp(db)
+	if err != nil {
+		t.Fatalf("MigrateUp failed on existing database: %v", err)
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'legacy'").Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to fetch legacy user: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected existing rows to survive migrating, got %d", count)
 	}
 }
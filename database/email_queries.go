@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+)
+
+// EmailVerificationTTL is how long an email verification token stays valid.
+const EmailVerificationTTL = 24 * time.Hour
+
+// issueEmailVerification creates a token proving email belongs to the user
+// with the given ID and returns it, replacing any token issued to them
+// before.
+func (s *SQLiteStore) issueEmailVerification(ctx context.Context, userID int, email string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("error generating email verification token: %v", err)
+		return "", fmt.Errorf("could not generate email verification token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	expiry := fmt.Sprintf("+%d seconds", int(EmailVerificationTTL.Seconds()))
+	_, err := s.db.ExecContext(ctx, `INSERT INTO email_verifications (user_id, email, token_hash, expires_at) VALUES (?, ?, ?, datetime('now', ?))
+					ON CONFLICT(user_id) DO UPDATE SET email = excluded.email, token_hash = excluded.token_hash,
+					created_at = CURRENT_TIMESTAMP, expires_at = excluded.expires_at`,
+		userID, email, hashToken(token), expiry)
+	if err != nil {
+		log.Printf("error creating email verification token for user ID %d: %v", userID, err)
+		return "", fmt.Errorf("could not create email verification token: %w", err)
+	}
+
+	return token, nil
+}
+
+// CreateEmailVerification issues a token proving the user's current email
+// address is theirs and returns the address along with the token. It
+// replaces any pending email change, and fails with ErrEmailVerified if the
+// address has been verified already.
+func (s *SQLiteStore) CreateEmailVerification(ctx context.Context, username string) (string, string, error) {
+	var userID int
+	var email string
+	var verified bool
+	err := s.db.QueryRowContext(ctx, "SELECT id, email, email_verified_at IS NOT NULL FROM users WHERE username = ?", username).
+		Scan(&userID, &email, &verified)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", ErrUserNotFound
+		}
+		log.Printf("error fetching user %s: %v", username, err)
+		return "", "", fmt.Errorf("could not fetch user: %w", err)
+	}
+	if verified {
+		return "", "", ErrEmailVerified
+	}
+
+	token, err := s.issueEmailVerification(ctx, userID, email)
+	if err != nil {
+		return "", "", err
+	}
+	return email, token, nil
+}
+
+// VerifyEmail uses up token and marks the address it was issued for as
+// verified, making it the user's email address if it was a change, and
+// returns the user's name. It fails with ErrEmailInUse if someone else has
+// taken the address since the token was issued.
+func (s *SQLiteStore) VerifyEmail(ctx context.Context, token string) (string, error) {
+	var username string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var userID int
+		var email string
+		err := tx.QueryRowContext(ctx, `SELECT users.id, users.username, email_verifications.email
+						FROM email_verifications JOIN users ON users.id = email_verifications.user_id
+						WHERE email_verifications.token_hash = ? AND email_verifications.expires_at > datetime('now')`,
+			hashToken(token)).Scan(&userID, &username, &email)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidVerification
+			}
+			log.Printf("error fetching email verification token: %v", err)
+			return fmt.Errorf("could not fetch email verification token: %w", err)
+		}
+
+		var taken bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE email = ? AND id != ?)", email, userID).Scan(&taken)
+		if err != nil {
+			log.Printf("error checking for existing email %s: %v", email, err)
+			return fmt.Errorf("could not check for existing email: %w", err)
+		}
+		if taken {
+			return ErrEmailInUse
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET email = ?, email_verified_at = CURRENT_TIMESTAMP WHERE id = ?", email, userID)
+		if err != nil {
+			log.Printf("error verifying email for user %s: %v", username, err)
+			return fmt.Errorf("could not verify email: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id = ?", userID)
+		if err != nil {
+			log.Printf("error deleting email verification token for user %s: %v", username, err)
+			return fmt.Errorf("could not delete email verification token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("email verified for user:", username)
+	return username, nil
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SortRecent lists the newest rows first.
+	SortRecent = "recent"
+	// SortOldest lists the oldest rows first.
+	SortOldest = "oldest"
+	// SortTop lists the highest scoring rows first: topics by upvotes,
+	// messages by likes and users by messages sent.
+	SortTop = "top"
+	// SortActive lists the rows with the latest activity first: topics by
+	// their newest message, messages by their newest reply and users by the
+	// last message they posted.
+	SortActive = "active"
+
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+// ListOptions selects one page of a topic, message or user listing.
+type ListOptions struct {
+	// Sort is one of SortRecent (the default), SortOldest, SortTop or
+	// SortActive.
+	Sort string
+	// Limit caps how many rows are returned.
+	Limit int
+	// Cursor continues a listing from the cursor returned with the previous
+	// page. It carries its own sort order, which wins over Sort.
+	Cursor string
+	// CategoryID restricts a topic listing to that category and its
+	// sub-categories. Other listings ignore it.
+	CategoryID int
+	// Tags restricts a topic listing to topics carrying any of these tags,
+	// or all of them if AllTags is set. Other listings ignore both.
+	Tags    []string
+	AllTags bool
+}
+
+// ValidListSort reports whether s is one of the listing sort orders.
+func ValidListSort(s string) bool {
+	switch s {
+	case SortRecent, SortOldest, SortTop, SortActive:
+		return true
+	}
+	return false
+}
+
+// ListCursor is a position in a listing: the sort key and ID of the last row
+// handed out. Rows are ordered by key and then by ID, both descending except
+// under SortOldest, so the position stays put while new rows are inserted.
+// An ID of 0 means the start of the listing.
+type ListCursor struct {
+	Sort string
+	Key  int64
+	ID   int
+}
+
+func (c ListCursor) Encode() string {
+	raw := fmt.Sprintf("%s.%d.%d", c.Sort, c.Key, c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// Follows reports whether the row with the given sort key and ID comes after
+// the cursor.
+func (c ListCursor) Follows(key int64, id int) bool {
+	if c.ID == 0 {
+		return true
+	}
+	if c.Sort == SortOldest {
+		return key > c.Key || key == c.Key && id > c.ID
+	}
+	return key < c.Key || key == c.Key && id < c.ID
+}
+
+func decodeListCursor(cursor string) (ListCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ListCursor{}, ErrInvalidCursor
+	}
+
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 3 || !ValidListSort(parts[0]) {
+		return ListCursor{}, ErrInvalidCursor
+	}
+
+	key, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ListCursor{}, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil || id < 0 {
+		return ListCursor{}, ErrInvalidCursor
+	}
+
+	return ListCursor{Sort: parts[0], Key: key, ID: id}, nil
+}
+
+// Start resolves the options into the cursor a page begins after and the
+// number of rows it may hold.
+func (o ListOptions) Start() (ListCursor, int, error) {
+	start := ListCursor{Sort: o.Sort}
+	if o.Cursor != "" {
+		var err error
+		start, err = decodeListCursor(o.Cursor)
+		if err != nil {
+			return ListCursor{}, 0, err
+		}
+	}
+	if start.Sort == "" {
+		start.Sort = SortRecent
+	}
+	if !ValidListSort(start.Sort) {
+		return ListCursor{}, 0, fmt.Errorf("unknown sort %q", start.Sort)
+	}
+
+	limit := o.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	return start, min(limit, MaxListLimit), nil
+}
+
+// keyedScanner reads a row whose last column is its sort key, so the usual
+// scan helpers can fill in the rest.
+type keyedScanner struct {
+	scanner
+	key *int64
+}
+
+func (k keyedScanner) Scan(dest ...any) error {
+	return k.scanner.Scan(append(dest, k.key)...)
+}
+
+// pageQuery wraps base, which must select an id column followed by a
+// sort_key column, so that it returns the limit+1 rows following start. The
+// extra row tells the caller whether there is another page.
+func pageQuery(base string, start ListCursor, limit int, args ...any) (string, []any) {
+	cmp, dir := "<", "DESC"
+	if start.Sort == SortOldest {
+		cmp, dir = ">", "ASC"
+	}
+
+	query := "SELECT * FROM (" + base + ")"
+	if start.ID != 0 {
+		query += fmt.Sprintf(" WHERE sort_key %s ? OR (sort_key = ? AND id %s ?)", cmp, cmp)
+		args = append(args, start.Key, start.Key, start.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY sort_key %s, id %s LIMIT ?", dir, dir)
+	return query, append(args, limit+1)
+}
@@ -0,0 +1,223 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+const (
+	DefaultLoginLimit = 50
+	MaxLoginLimit     = 200
+)
+
+// Scopes failed logins are counted in.
+const (
+	loginScopeUser = "user"
+	loginScopeIP   = "ip"
+)
+
+// LoginPolicy decides when failed logins lock out a username or a client
+// IP. Once failures reach a threshold the username or IP is locked out for
+// BaseLockout, and every further failure doubles that, up to MaxLockout.
+// Failures are forgotten once FailureWindow has passed since the last one
+// and since any lockout ended, and a successful login forgets those of its
+// username.
+type LoginPolicy struct {
+	UserThreshold int
+	IPThreshold   int
+	BaseLockout   time.Duration
+	MaxLockout    time.Duration
+	FailureWindow time.Duration
+}
+
+// DefaultLoginPolicy is the policy a new SQLiteStore starts with. IPs get a
+// higher threshold than usernames since many users can share one address.
+var DefaultLoginPolicy = LoginPolicy{
+	UserThreshold: 5,
+	IPThreshold:   20,
+	BaseLockout:   time.Minute,
+	MaxLockout:    time.Hour,
+	FailureWindow: 15 * time.Minute,
+}
+
+// Lockout returns how long to lock out a username or IP that has failed
+// failures times in a row against threshold, or 0 if it should not be.
+func (p LoginPolicy) Lockout(failures, threshold int) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+
+	lockout := p.BaseLockout
+	for i := threshold; i < failures && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, p.MaxLockout)
+}
+
+// SetLoginPolicy replaces the policy failed logins are judged by. Call it
+// before the store starts serving requests.
+func (s *SQLiteStore) SetLoginPolicy(p LoginPolicy) {
+	s.loginPolicy = p
+}
+
+// LoginLockedUntil returns when the later of the lockouts on username and on
+// ip ends, or the zero time if neither is locked out.
+func (s *SQLiteStore) LoginLockedUntil(ctx context.Context, username, ip string) (time.Time, error) {
+	var until time.Time
+	err := s.db.QueryRowContext(ctx, `SELECT locked_until FROM login_throttles
+					WHERE ((scope = ? AND key = ?) OR (scope = ? AND key = ?)) AND locked_until > datetime('now')
+					ORDER BY locked_until DESC LIMIT 1`, loginScopeUser, username, loginScopeIP, ip).Scan(&until)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, nil
+		}
+		log.Printf("error fetching login lockout for %s from %s: %v", username, ip, err)
+		return time.Time{}, fmt.Errorf("could not fetch login lockout: %w", err)
+	}
+	return until, nil
+}
+
+// RecordLogin adds attempt to the audit trail and counts it towards or
+// against the lockouts of its username and IP.
+func (s *SQLiteStore) RecordLogin(ctx context.Context, attempt models.LoginAttempt) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO login_attempts (user_id, username, success, ip, user_agent)
+						VALUES ((SELECT id FROM users WHERE username = ?), ?, ?, ?, ?)`,
+			attempt.Username, attempt.Username, attempt.Success, attempt.IP, attempt.UserAgent)
+		if err != nil {
+			log.Printf("error recording login attempt for %s: %v", attempt.Username, err)
+			return fmt.Errorf("could not record login attempt: %w", err)
+		}
+
+		if attempt.Success {
+			return clearLoginFailures(ctx, tx, loginScopeUser, attempt.Username)
+		}
+
+		if err := s.countLoginFailure(ctx, tx, loginScopeUser, attempt.Username, s.loginPolicy.UserThreshold); err != nil {
+			return err
+		}
+		return s.countLoginFailure(ctx, tx, loginScopeIP, attempt.IP, s.loginPolicy.IPThreshold)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !attempt.Success {
+		log.Printf("failed login for %s from %s", attempt.Username, attempt.IP)
+	}
+	return nil
+}
+
+// countLoginFailure adds a failure to key in scope, starting the count over
+// if the earlier ones have been forgotten, and locks key out as the policy
+// says.
+func (s *SQLiteStore) countLoginFailure(ctx context.Context, tx *sql.Tx, scope, key string, threshold int) error {
+	window := fmt.Sprintf("-%d seconds", int(s.loginPolicy.FailureWindow.Seconds()))
+	var failures int
+	err := tx.QueryRowContext(ctx, `SELECT failures FROM login_throttles WHERE scope = ? AND key = ?
+					AND MAX(last_failure_at, COALESCE(locked_until, last_failure_at)) > datetime('now', ?)`,
+		scope, key, window).Scan(&failures)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("error fetching failed logins for %s %s: %v", scope, key, err)
+		return fmt.Errorf("could not fetch failed logins: %w", err)
+	}
+	failures++
+
+	var lockedUntil any
+	if lockout := s.loginPolicy.Lockout(failures, threshold); lockout > 0 {
+		lockedUntil = fmt.Sprintf("+%d seconds", int(lockout.Seconds()))
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO login_throttles (scope, key, failures, last_failure_at, locked_until)
+					VALUES (?, ?, ?, datetime('now'), datetime('now', ?))
+					ON CONFLICT(scope, key) DO UPDATE SET failures = excluded.failures,
+					last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+		scope, key, failures, lockedUntil)
+	if err != nil {
+		log.Printf("error counting failed login for %s %s: %v", scope, key, err)
+		return fmt.Errorf("could not count failed login: %w", err)
+	}
+	return nil
+}
+
+func clearLoginFailures(ctx context.Context, tx *sql.Tx, scope, key string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM login_throttles WHERE scope = ? AND key = ?", scope, key)
+	if err != nil {
+		log.Printf("error clearing failed logins for %s %s: %v", scope, key, err)
+		return fmt.Errorf("could not clear failed logins: %w", err)
+	}
+	return nil
+}
+
+// UnlockLogin lifts the lockout on a username and forgets its failed
+// logins. Lockouts on IPs are left to run out by themselves.
+func (s *SQLiteStore) UnlockLogin(ctx context.Context, username string) error {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		log.Printf("error fetching user ID for %s: %v", username, err)
+		return fmt.Errorf("could not fetch user ID: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM login_throttles WHERE scope = ? AND key = ?", loginScopeUser, username)
+	if err != nil {
+		log.Printf("error unlocking login for user %s: %v", username, err)
+		return fmt.Errorf("could not unlock login: %w", err)
+	}
+
+	log.Println("login unlocked for user:", username)
+	return nil
+}
+
+// GetLoginAttempts returns up to limit of a user's login attempts, newest
+// first. Attempts made under a username the user has since given up stay
+// with them.
+func (s *SQLiteStore) GetLoginAttempts(ctx context.Context, username string, limit int) ([]models.LoginAttempt, error) {
+	if limit <= 0 {
+		limit = DefaultLoginLimit
+	}
+	limit = min(limit, MaxLoginLimit)
+
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		log.Printf("error fetching user ID for %s: %v", username, err)
+		return nil, fmt.Errorf("could not fetch user ID: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, username, success, ip, user_agent, created_at FROM login_attempts
+					WHERE user_id = ? ORDER BY id DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		log.Printf("error fetching login attempts for %s: %v", username, err)
+		return nil, fmt.Errorf("could not fetch login attempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []models.LoginAttempt{}
+	for rows.Next() {
+		var attempt models.LoginAttempt
+		err := rows.Scan(&attempt.ID, &attempt.Username, &attempt.Success, &attempt.IP, &attempt.UserAgent, &attempt.CreatedAt)
+		if err != nil {
+			log.Printf("error scanning login attempt row: %v", err)
+			return nil, fmt.Errorf("could not scan login attempt row: %w", err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading login attempt rows: %v", err)
+		return nil, fmt.Errorf("could not read login attempts: %w", err)
+	}
+
+	return attempts, nil
+}
@@ -0,0 +1,2392 @@
+// Package memstore is an in-memory implementation of database.Store for
+// handler tests. It follows the SQLite store's rules and returns the same
+// sentinel errors, but keeps everything in maps guarded by a mutex.
+package memstore
+
+import (
+	"cmp"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/slug"
+	"github.com/dDogge/Brainwave/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrClosed is returned by every method once Close has been called, so tests
+// can exercise a handler's internal-error path.
+var ErrClosed = errors.New("memstore: store is closed")
+
+var (
+	_ database.UserStore      = (*Store)(nil)
+	_ database.TopicStore     = (*Store)(nil)
+	_ database.TagStore       = (*Store)(nil)
+	_ database.CategoryStore  = (*Store)(nil)
+	_ database.MessageStore   = (*Store)(nil)
+	_ database.SessionStore   = (*Store)(nil)
+	_ database.LoginStore     = (*Store)(nil)
+	_ database.TwoFactorStore = (*Store)(nil)
+)
+
+type user struct {
+	models.User
+	password []byte
+	reset    *passwordReset
+	verify   *emailVerification
+	totp     *totpSecret
+	recovery map[string]bool
+}
+
+// emailVerification is the outstanding email verification token of a
+// user, for either their own address or one they asked to change to.
+type emailVerification struct {
+	email     string
+	token     string
+	expiresAt time.Time
+}
+
+// totpSecret is a user's TOTP secret, with the counter of the last code
+// accepted.
+type totpSecret struct {
+	secret      string
+	lastCounter int64
+	confirmed   bool
+}
+
+// passwordReset is the outstanding password reset token of a user.
+type passwordReset struct {
+	token     string
+	expiresAt time.Time
+	attempts  int
+}
+
+type voteKey struct {
+	userID, topicID int
+}
+
+type reaction struct {
+	userID    int
+	messageID int
+	reaction  string
+	createdAt time.Time
+}
+
+// revision is the text an edit replaced, with who made the edit and when.
+type revision struct {
+	messageID int
+	message   string
+	editorID  int
+	editedAt  time.Time
+}
+
+type session struct {
+	userID    int
+	expiresAt time.Time
+}
+
+// loginAttempt is an entry in the login audit trail, with the ID of the
+// user it was made against (0 if none).
+type loginAttempt struct {
+	models.LoginAttempt
+	userID int
+}
+
+// challenge is a login waiting for its second factor.
+type challenge struct {
+	userID    int
+	expiresAt time.Time
+}
+
+type throttleKey struct {
+	scope, key string
+}
+
+// throttle counts the recent failed logins of a username or IP.
+type throttle struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   time.Time
+}
+
+type Store struct {
+	mu     sync.Mutex
+	closed bool
+
+	nextUserID     int
+	nextTopicID    int
+	nextMessageID  int
+	nextTagID      int
+	nextCategoryID int
+
+	users      []*user
+	topics     []*models.Topic
+	tags       []*models.Tag
+	categories []*models.Category
+	messages   []*models.Message
+	oldSlugs   map[string]int
+	merged     map[int]int
+	votes      map[voteKey]int
+	reactions  []reaction
+	revisions  []revision
+	sessions   map[string]session
+
+	loginPolicy   database.LoginPolicy
+	nextAttemptID int
+	logins        []loginAttempt
+	throttles     map[throttleKey]*throttle
+
+	challenges    map[string]challenge
+	twoFactorRole string
+}
+
+func New() *Store {
+	return &Store{
+		nextCategoryID: models.DefaultCategoryID,
+		categories: []*models.Category{{
+			ID:          models.DefaultCategoryID,
+			Name:        "General",
+			Description: "Everything else",
+			TopicRole:   models.RoleUser,
+			CreatedAt:   time.Now().UTC(),
+		}},
+		oldSlugs: make(map[string]int),
+		merged:   make(map[int]int),
+		votes:    make(map[voteKey]int),
+		sessions: make(map[string]session),
+
+		loginPolicy: database.DefaultLoginPolicy,
+		throttles:   make(map[throttleKey]*throttle),
+		challenges:  make(map[string]challenge),
+	}
+}
+
+// Close makes every later call fail with ErrClosed.
+func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func (s *Store) lock() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+func (s *Store) userByName(username string) *user {
+	for _, u := range s.users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Store) userByEmail(email string) *user {
+	for _, u := range s.users {
+		if u.Email == email {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Store) userByID(id int) *user {
+	for _, u := range s.users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Store) topicByTitle(title string) *models.Topic {
+	for _, t := range s.topics {
+		if t.Title == title {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Store) topicBySlug(slug string) *models.Topic {
+	for _, t := range s.topics {
+		if t.Slug == slug {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Store) topicByID(id int) *models.Topic {
+	for _, t := range s.topics {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Store) messageByID(id int) *models.Message {
+	for _, m := range s.messages {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Store) AddUser(ctx context.Context, username, email, password string) error {
+	if !database.IsValidEmail(email) {
+		return database.ErrInvalidEmail
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return fmt.Errorf("could not hash password: %w", err)
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if s.userByName(username) != nil {
+		return database.ErrUserExists
+	}
+
+	s.nextUserID++
+	s.users = append(s.users, &user{
+		User: models.User{
+			ID:           s.nextUserID,
+			Username:     username,
+			Email:        email,
+			Role:         models.RoleUser,
+			CreationDate: time.Now().UTC(),
+		},
+		password: hashedPassword,
+	})
+	return nil
+}
+
+func (s *Store) GetUser(ctx context.Context, username string) (*models.User, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	found := u.User
+	return &found, nil
+}
+
+func (s *Store) GetAllUsers(ctx context.Context, opts database.ListOptions) ([]models.User, string, error) {
+	start, limit, err := opts.Start()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, "", err
+	}
+	defer s.mu.Unlock()
+
+	rows := make([]keyed[models.User], 0, len(s.users))
+	for _, u := range s.users {
+		key := int64(u.ID)
+		switch start.Sort {
+		case database.SortTop:
+			key = int64(u.MessagesSent)
+		case database.SortActive:
+			last := u.CreationDate
+			for _, m := range s.messages {
+				if m.UserID == u.ID && m.Timestamp.After(last) {
+					last = m.Timestamp
+				}
+			}
+			key = last.Unix()
+		}
+		rows = append(rows, keyed[models.User]{u.User, key, u.ID})
+	}
+
+	users, next := page(rows, start, limit)
+	return users, next, nil
+}
+
+func (s *Store) CheckPassword(ctx context.Context, username, password string) (bool, error) {
+	if err := s.lock(); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return false, nil
+	}
+	return bcrypt.CompareHashAndPassword(u.password, []byte(password)) == nil, nil
+}
+
+func (s *Store) ChangePassword(ctx context.Context, username, currentPassword, newPassword string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return database.ErrUserNotFound
+	}
+	if bcrypt.CompareHashAndPassword(u.password, []byte(currentPassword)) != nil {
+		return database.ErrIncorrectPassword
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
+	if err != nil {
+		return fmt.Errorf("could not hash new password: %w", err)
+	}
+	u.password = hashedPassword
+	return nil
+}
+
+func (s *Store) ChangeEmail(ctx context.Context, username, newEmail string) (string, error) {
+	if !database.IsValidEmail(newEmail) {
+		return "", database.ErrInvalidEmail
+	}
+
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	if s.userByEmail(newEmail) != nil {
+		return "", database.ErrEmailInUse
+	}
+	u := s.userByName(username)
+	if u == nil {
+		return "", database.ErrUserNotFound
+	}
+	return issueEmailVerification(u, newEmail)
+}
+
+func issueEmailVerification(u *user, email string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not generate email verification token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	u.verify = &emailVerification{email: email, token: token, expiresAt: time.Now().Add(database.EmailVerificationTTL)}
+	return token, nil
+}
+
+func (s *Store) CreateEmailVerification(ctx context.Context, username string) (string, string, error) {
+	if err := s.lock(); err != nil {
+		return "", "", err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return "", "", database.ErrUserNotFound
+	}
+	if u.EmailVerified {
+		return "", "", database.ErrEmailVerified
+	}
+
+	token, err := issueEmailVerification(u, u.Email)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Email, token, nil
+}
+
+func (s *Store) VerifyEmail(ctx context.Context, token string) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.verify == nil || u.verify.token != token {
+			continue
+		}
+		if time.Now().After(u.verify.expiresAt) {
+			break
+		}
+		if other := s.userByEmail(u.verify.email); other != nil && other != u {
+			return "", database.ErrEmailInUse
+		}
+		u.Email = u.verify.email
+		u.EmailVerified = true
+		u.verify = nil
+		return u.Username, nil
+	}
+	return "", database.ErrInvalidVerification
+}
+
+func (s *Store) ChangeUsername(ctx context.Context, username, newUsername string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if s.userByName(newUsername) != nil {
+		return database.ErrUsernameInUse
+	}
+	if !database.IsValidUsername(newUsername) {
+		return database.ErrInvalidUsername
+	}
+	if u := s.userByName(username); u != nil {
+		u.Username = newUsername
+	}
+	return nil
+}
+
+func (s *Store) RemoveUser(ctx context.Context, username string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return database.ErrUserNotFound
+	}
+
+	for _, t := range s.topics {
+		if t.CreatorID == u.ID {
+			t.CreatorID = 0
+		}
+	}
+	for _, m := range s.messages {
+		if m.UserID == u.ID {
+			m.UserID = 0
+		}
+	}
+	for i := range s.revisions {
+		if s.revisions[i].editorID == u.ID {
+			s.revisions[i].editorID = 0
+		}
+	}
+	for key, value := range s.votes {
+		if key.userID == u.ID {
+			delete(s.votes, key)
+			if t := s.topicByID(key.topicID); t != nil {
+				t.Upvotes -= value
+			}
+		}
+	}
+
+	kept := s.reactions[:0]
+	touched := make(map[int]bool)
+	for _, r := range s.reactions {
+		if r.userID == u.ID {
+			touched[r.messageID] = true
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.reactions = kept
+	for messageID := range touched {
+		s.updateMessageLikes(messageID)
+	}
+
+	for token, sess := range s.sessions {
+		if sess.userID == u.ID {
+			delete(s.sessions, token)
+		}
+	}
+	for token, c := range s.challenges {
+		if c.userID == u.ID {
+			delete(s.challenges, token)
+		}
+	}
+
+	for i, candidate := range s.users {
+		if candidate == u {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Store) SetRole(ctx context.Context, username, role string) error {
+	if !models.ValidRole(role) {
+		return database.ErrInvalidRole
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return database.ErrUserNotFound
+	}
+
+	if u.Role == models.RoleAdmin && role != models.RoleAdmin {
+		admins := 0
+		for _, candidate := range s.users {
+			if candidate.Role == models.RoleAdmin {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return database.ErrLastAdmin
+		}
+	}
+
+	u.Role = role
+	return nil
+}
+
+func (s *Store) GeneratePasswordResetCode(ctx context.Context, email string) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByEmail(email)
+	if u == nil {
+		return "", database.ErrEmailNotFound
+	}
+
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not generate password reset token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	u.reset = &passwordReset{token: token, expiresAt: time.Now().Add(database.PasswordResetTTL)}
+	return token, nil
+}
+
+func (s *Store) ResetPassword(ctx context.Context, email, token, newPassword string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByEmail(email)
+	if u == nil || u.reset == nil {
+		return database.ErrInvalidResetCode
+	}
+	if time.Now().After(u.reset.expiresAt) {
+		u.reset = nil
+		return database.ErrInvalidResetCode
+	}
+	if u.reset.token != token {
+		u.reset.attempts++
+		if u.reset.attempts >= database.MaxResetAttempts {
+			u.reset = nil
+		}
+		return database.ErrInvalidResetCode
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
+	if err != nil {
+		return fmt.Errorf("could not hash new password: %w", err)
+	}
+	u.password = hashedPassword
+	u.reset = nil
+	for token, sess := range s.sessions {
+		if sess.userID == u.ID {
+			delete(s.sessions, token)
+		}
+	}
+	return nil
+}
+
+func (s *Store) AddTopic(ctx context.Context, draft database.TopicDraft, username string) (*models.Topic, error) {
+	tags, err := topicTags(draft.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if draft.CategoryID == 0 {
+		draft.CategoryID = models.DefaultCategoryID
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t, err := s.addTopic(draft, tags, username)
+	if err != nil {
+		return nil, err
+	}
+	s.userByName(username).TopicsOpened++
+
+	added := copyTopic(t)
+	return &added, nil
+}
+
+// addTopic opens a topic as AddTopic does, without bumping the creator's
+// TopicsOpened, with tags already normalized and draft.CategoryID filled in.
+func (s *Store) addTopic(draft database.TopicDraft, tags []string, username string) (*models.Topic, error) {
+	u := s.userByName(username)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	if s.topicByTitle(draft.Title) != nil {
+		return nil, database.ErrTopicExists
+	}
+	if s.categoryByID(draft.CategoryID) == nil {
+		return nil, database.ErrCategoryNotFound
+	}
+
+	s.nextTopicID++
+	t := &models.Topic{
+		ID:           s.nextTopicID,
+		Title:        draft.Title,
+		Slug:         s.uniqueSlug(s.nextTopicID, draft.Title),
+		Description:  draft.Description,
+		Body:         draft.Body,
+		CategoryID:   draft.CategoryID,
+		CreatorID:    u.ID,
+		CreationDate: time.Now().UTC(),
+	}
+	s.topics = append(s.topics, t)
+	s.fileTopic(t, tags)
+	s.recountCategories()
+	return t, nil
+}
+
+func (s *Store) RenameTopic(ctx context.Context, topicID int, title string) (*models.Topic, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(topicID)
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	if t.ArchivedAt != nil {
+		return nil, database.ErrTopicArchived
+	}
+	if other := s.topicByTitle(title); other != nil && other != t {
+		return nil, database.ErrTopicExists
+	}
+
+	topicSlug := s.uniqueSlug(t.ID, title)
+	if topicSlug != t.Slug {
+		s.oldSlugs[t.Slug] = t.ID
+	}
+	delete(s.oldSlugs, topicSlug)
+	t.Title = title
+	t.Slug = topicSlug
+
+	renamed := copyTopic(t)
+	return &renamed, nil
+}
+
+// uniqueSlug mirrors the SQLite store: the slug of title, suffixed until no
+// topic other than topicID uses it, now or as an old slug.
+func (s *Store) uniqueSlug(topicID int, title string) string {
+	base := slug.Make(title)
+	for n := 1; ; n++ {
+		candidate := slug.WithSuffix(base, n)
+		t := s.topicBySlug(candidate)
+		oldID, old := s.oldSlugs[candidate]
+		if (t == nil || t.ID == topicID) && (!old || oldID == topicID) {
+			return candidate
+		}
+	}
+}
+
+func (s *Store) SetTopicState(ctx context.Context, topicID int, state string, on bool) (*models.Topic, error) {
+	if !models.ValidTopicState(state) {
+		return nil, database.ErrInvalidState
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(topicID)
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+
+	field := map[string]**time.Time{
+		models.TopicLocked:   &t.LockedAt,
+		models.TopicPinned:   &t.PinnedAt,
+		models.TopicArchived: &t.ArchivedAt,
+	}[state]
+	switch {
+	case !on:
+		*field = nil
+	case *field == nil:
+		now := time.Now().UTC()
+		*field = &now
+	}
+
+	updated := copyTopic(t)
+	return &updated, nil
+}
+
+func (s *Store) RemoveTopic(ctx context.Context, topicID int) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(topicID)
+	if t == nil {
+		return database.ErrTopicNotFound
+	}
+
+	for i, candidate := range s.topics {
+		if candidate == t {
+			s.topics = append(s.topics[:i], s.topics[i+1:]...)
+			break
+		}
+	}
+	s.recountTags()
+	s.recountCategories()
+	for key := range s.votes {
+		if key.topicID == t.ID {
+			delete(s.votes, key)
+		}
+	}
+	for old, id := range s.oldSlugs {
+		if id == t.ID {
+			delete(s.oldSlugs, old)
+		}
+	}
+	for merged, id := range s.merged {
+		if id == t.ID {
+			delete(s.merged, merged)
+		}
+	}
+
+	removed := make(map[int]bool)
+	keptMessages := s.messages[:0]
+	for _, m := range s.messages {
+		if m.TopicID == t.ID {
+			removed[m.ID] = true
+			continue
+		}
+		keptMessages = append(keptMessages, m)
+	}
+	s.messages = keptMessages
+
+	keptReactions := s.reactions[:0]
+	for _, r := range s.reactions {
+		if !removed[r.messageID] {
+			keptReactions = append(keptReactions, r)
+		}
+	}
+	s.reactions = keptReactions
+
+	s.dropRevisions(removed)
+	return nil
+}
+
+func (s *Store) GetAllTopics(ctx context.Context, opts database.ListOptions) ([]models.Topic, string, error) {
+	start, limit, err := opts.Start()
+	if err != nil {
+		return nil, "", err
+	}
+
+	filter, err := database.NormalizeTags(opts.Tags)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, "", err
+	}
+	defer s.mu.Unlock()
+
+	if opts.CategoryID != 0 && s.categoryByID(opts.CategoryID) == nil {
+		return nil, "", database.ErrCategoryNotFound
+	}
+
+	var pinned []models.Topic
+	rows := make([]keyed[models.Topic], 0, len(s.topics))
+	for _, t := range s.topics {
+		if opts.CategoryID != 0 && t.CategoryID != opts.CategoryID && s.categoryByID(t.CategoryID).ParentID != opts.CategoryID {
+			continue
+		}
+		if !matchesTags(t, filter, opts.AllTags) {
+			continue
+		}
+		if t.PinnedAt != nil {
+			pinned = append(pinned, copyTopic(t))
+			continue
+		}
+
+		key := int64(t.ID)
+		switch start.Sort {
+		case database.SortTop:
+			key = int64(t.Upvotes)
+		case database.SortActive:
+			last := t.CreationDate
+			for _, m := range s.messages {
+				if m.TopicID == t.ID && m.Timestamp.After(last) {
+					last = m.Timestamp
+				}
+			}
+			key = last.Unix()
+		}
+		rows = append(rows, keyed[models.Topic]{copyTopic(t), key, t.ID})
+	}
+
+	topics, next := page(rows, start, limit)
+	if start.ID != 0 {
+		return topics, next, nil
+	}
+
+	slices.SortFunc(pinned, func(a, b models.Topic) int {
+		if c := b.PinnedAt.Compare(*a.PinnedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return append(pinned, topics...), next, nil
+}
+
+func (s *Store) GetTopic(ctx context.Context, topicID int) (*models.Topic, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(topicID)
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	found := copyTopic(t)
+	return &found, nil
+}
+
+func (s *Store) GetTopicBySlug(ctx context.Context, slug string) (*models.Topic, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicBySlug(slug)
+	if t == nil {
+		t = s.topicByID(s.oldSlugs[slug])
+	}
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	found := copyTopic(t)
+	return &found, nil
+}
+
+func (s *Store) GetMergedTopic(ctx context.Context, topicID int) (*models.Topic, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(s.merged[topicID])
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	found := copyTopic(t)
+	return &found, nil
+}
+
+// copyTopic returns a copy of t that shares nothing with the store.
+func copyTopic(t *models.Topic) models.Topic {
+	c := *t
+	c.Tags = slices.Clone(t.Tags)
+	return c
+}
+
+// matchesTags reports whether t carries any of tags, or all of them if all
+// is set. An empty filter matches every topic.
+func matchesTags(t *models.Topic, tags []string, all bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		if slices.Contains(t.Tags, tag) != all {
+			return !all
+		}
+	}
+	return all
+}
+
+func (s *Store) CountTopics(ctx context.Context) (int, error) {
+	if err := s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	return len(s.topics), nil
+}
+
+func (s *Store) UpVoteTopic(ctx context.Context, topicID int, username string) error {
+	return s.voteTopic(topicID, username, 1)
+}
+
+func (s *Store) DownVoteTopic(ctx context.Context, topicID int, username string) error {
+	return s.voteTopic(topicID, username, -1)
+}
+
+func (s *Store) RetractTopicVote(ctx context.Context, topicID int, username string) error {
+	return s.voteTopic(topicID, username, 0)
+}
+
+func (s *Store) GetTopicVote(ctx context.Context, topicID int, username string) (int, error) {
+	if err := s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	key, err := s.voteKey(topicID, username)
+	if err != nil {
+		return 0, err
+	}
+	return s.votes[key], nil
+}
+
+func (s *Store) voteKey(topicID int, username string) (voteKey, error) {
+	u := s.userByName(username)
+	if u == nil {
+		return voteKey{}, database.ErrUserNotFound
+	}
+	if s.topicByID(topicID) == nil {
+		return voteKey{}, database.ErrTopicNotFound
+	}
+	return voteKey{userID: u.ID, topicID: topicID}, nil
+}
+
+func (s *Store) voteTopic(topicID int, username string, value int) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	key, err := s.voteKey(topicID, username)
+	if err != nil {
+		return err
+	}
+
+	if s.topicByID(topicID).ArchivedAt != nil {
+		return database.ErrTopicArchived
+	}
+
+	current := s.votes[key]
+	if value != 0 && current == value {
+		return database.ErrVoteExists
+	}
+
+	if value == 0 {
+		delete(s.votes, key)
+	} else {
+		s.votes[key] = value
+	}
+	s.topicByID(key.topicID).Upvotes += value - current
+	return nil
+}
+
+// topicTags normalizes the tags a topic is to be filed under.
+func topicTags(tags []string) ([]string, error) {
+	normalized, err := database.NormalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if len(normalized) > models.MaxTopicTags {
+		return nil, database.ErrTooManyTags
+	}
+	return normalized, nil
+}
+
+func (s *Store) tagByName(name string) *models.Tag {
+	for _, tag := range s.tags {
+		if tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+// fileTopic files t under exactly the given normalized tags, creating any
+// that do not exist yet.
+func (s *Store) fileTopic(t *models.Topic, tags []string) {
+	for _, name := range tags {
+		if s.tagByName(name) == nil {
+			s.nextTagID++
+			s.tags = append(s.tags, &models.Tag{ID: s.nextTagID, Name: name})
+		}
+	}
+	t.Tags = tags
+	s.recountTags()
+}
+
+// recountTags recomputes how many topics carry each tag.
+func (s *Store) recountTags() {
+	for _, tag := range s.tags {
+		tag.Topics = 0
+		for _, t := range s.topics {
+			if slices.Contains(t.Tags, tag.Name) {
+				tag.Topics++
+			}
+		}
+	}
+}
+
+func (s *Store) SetTopicTags(ctx context.Context, topicID int, tags []string) ([]string, error) {
+	tags, err := topicTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(topicID)
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	if t.ArchivedAt != nil {
+		return nil, database.ErrTopicArchived
+	}
+	s.fileTopic(t, tags)
+	return slices.Clone(tags), nil
+}
+
+func (s *Store) ListTags(ctx context.Context, prefix string, limit int) ([]models.Tag, error) {
+	if limit <= 0 {
+		limit = database.DefaultTagLimit
+	}
+	limit = min(limit, database.MaxTagLimit)
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	tags := []models.Tag{}
+	for _, tag := range s.tags {
+		if tag.Topics > 0 && strings.HasPrefix(tag.Name, prefix) {
+			tags = append(tags, *tag)
+		}
+	}
+	slices.SortFunc(tags, func(a, b models.Tag) int {
+		if a.Topics != b.Topics {
+			return cmp.Compare(b.Topics, a.Topics)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	return tags, nil
+}
+
+func (s *Store) RenameTag(ctx context.Context, name, newName string) (*models.Tag, error) {
+	name, ok := models.NormalizeTag(name)
+	if !ok {
+		return nil, database.ErrTagNotFound
+	}
+	newName, ok = models.NormalizeTag(newName)
+	if !ok {
+		return nil, database.ErrInvalidTag
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	tag := s.tagByName(name)
+	if tag == nil {
+		return nil, database.ErrTagNotFound
+	}
+
+	target := s.tagByName(newName)
+	switch {
+	case target == nil:
+		tag.Name = newName
+		target = tag
+	case target != tag:
+		s.tags = slices.DeleteFunc(s.tags, func(candidate *models.Tag) bool { return candidate == tag })
+	}
+
+	for _, t := range s.topics {
+		if i := slices.Index(t.Tags, name); i >= 0 {
+			tags := slices.Delete(slices.Clone(t.Tags), i, i+1)
+			if !slices.Contains(tags, newName) {
+				tags = append(tags, newName)
+			}
+			slices.Sort(tags)
+			t.Tags = tags
+		}
+	}
+	s.recountTags()
+
+	renamed := *target
+	return &renamed, nil
+}
+
+func (s *Store) categoryByID(id int) *models.Category {
+	for _, c := range s.categories {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// recountCategories recomputes how many topics each category holds.
+func (s *Store) recountCategories() {
+	for _, c := range s.categories {
+		c.Topics = 0
+		for _, t := range s.topics {
+			if t.CategoryID == c.ID {
+				c.Topics++
+			}
+		}
+	}
+}
+
+// checkCategory applies the SQLite store's rules to a category draft for
+// category id, 0 for a new one.
+func (s *Store) checkCategory(id int, draft database.CategoryDraft) error {
+	for _, c := range s.categories {
+		if c.Name == draft.Name && c.ID != id {
+			return database.ErrCategoryExists
+		}
+	}
+
+	if draft.ParentID == 0 {
+		return nil
+	}
+	parent := s.categoryByID(draft.ParentID)
+	if parent == nil || parent.ID == id {
+		return database.ErrInvalidParent
+	}
+	if parent.ParentID != 0 {
+		return database.ErrCategoryTooDeep
+	}
+	for _, c := range s.categories {
+		if id != 0 && c.ParentID == id {
+			return database.ErrCategoryTooDeep
+		}
+	}
+	return nil
+}
+
+// categoryWithChildren returns a copy of c with its sub-categories in order.
+func (s *Store) categoryWithChildren(c *models.Category) models.Category {
+	found := *c
+	found.Children = nil
+	for _, child := range s.orderedCategories() {
+		if child.ParentID == c.ID {
+			found.Children = append(found.Children, *child)
+		}
+	}
+	return found
+}
+
+func (s *Store) orderedCategories() []*models.Category {
+	ordered := slices.Clone(s.categories)
+	slices.SortFunc(ordered, func(a, b *models.Category) int {
+		if a.Position != b.Position {
+			return cmp.Compare(a.Position, b.Position)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return ordered
+}
+
+func (s *Store) AddCategory(ctx context.Context, draft database.CategoryDraft) (*models.Category, error) {
+	if err := draft.Normalize(); err != nil {
+		return nil, err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	if err := s.checkCategory(0, draft); err != nil {
+		return nil, err
+	}
+
+	s.nextCategoryID++
+	c := &models.Category{ID: s.nextCategoryID, CreatedAt: time.Now().UTC()}
+	setCategory(c, draft)
+	s.categories = append(s.categories, c)
+
+	added := *c
+	return &added, nil
+}
+
+func (s *Store) UpdateCategory(ctx context.Context, id int, draft database.CategoryDraft) (*models.Category, error) {
+	if err := draft.Normalize(); err != nil {
+		return nil, err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	c := s.categoryByID(id)
+	if c == nil {
+		return nil, database.ErrCategoryNotFound
+	}
+	if err := s.checkCategory(id, draft); err != nil {
+		return nil, err
+	}
+
+	setCategory(c, draft)
+	updated := *c
+	return &updated, nil
+}
+
+func setCategory(c *models.Category, draft database.CategoryDraft) {
+	c.Name = draft.Name
+	c.Description = draft.Description
+	c.Color = draft.Color
+	c.ParentID = draft.ParentID
+	c.Position = draft.Position
+	c.TopicRole = draft.TopicRole
+}
+
+func (s *Store) RemoveCategory(ctx context.Context, id int) error {
+	if id == models.DefaultCategoryID {
+		return database.ErrDefaultCategory
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	c := s.categoryByID(id)
+	if c == nil {
+		return database.ErrCategoryNotFound
+	}
+	for _, other := range s.categories {
+		if other.ParentID == id {
+			return database.ErrCategoryNotEmpty
+		}
+	}
+	if c.Topics > 0 {
+		return database.ErrCategoryNotEmpty
+	}
+
+	s.categories = slices.DeleteFunc(s.categories, func(candidate *models.Category) bool { return candidate == c })
+	return nil
+}
+
+func (s *Store) GetCategory(ctx context.Context, id int) (*models.Category, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	c := s.categoryByID(id)
+	if c == nil {
+		return nil, database.ErrCategoryNotFound
+	}
+	found := s.categoryWithChildren(c)
+	return &found, nil
+}
+
+func (s *Store) GetCategories(ctx context.Context) ([]models.Category, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	tree := []models.Category{}
+	for _, c := range s.orderedCategories() {
+		if c.ParentID == 0 {
+			tree = append(tree, s.categoryWithChildren(c))
+		}
+	}
+	return tree, nil
+}
+
+func (s *Store) MoveTopic(ctx context.Context, topicID, categoryID int) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	t := s.topicByID(topicID)
+	if t == nil {
+		return database.ErrTopicNotFound
+	}
+	if s.categoryByID(categoryID) == nil {
+		return database.ErrCategoryNotFound
+	}
+
+	t.CategoryID = categoryID
+	s.recountCategories()
+	return nil
+}
+
+func (s *Store) MergeTopic(ctx context.Context, topicID, targetID int) (*models.Topic, error) {
+	if topicID == targetID {
+		return nil, database.ErrSameTopic
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	source := s.topicByID(topicID)
+	target := s.topicByID(targetID)
+	if source == nil || target == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	if target.ArchivedAt != nil {
+		return nil, database.ErrTopicArchived
+	}
+
+	if source.Body != "" {
+		s.nextMessageID++
+		s.messages = append(s.messages, &models.Message{
+			ID:        s.nextMessageID,
+			Message:   source.Body,
+			UserID:    source.CreatorID,
+			TopicID:   target.ID,
+			Timestamp: source.CreationDate,
+		})
+		if u := s.userByID(source.CreatorID); u != nil {
+			u.MessagesSent++
+		}
+	}
+	for _, m := range s.messages {
+		if m.TopicID == source.ID {
+			m.TopicID = target.ID
+		}
+	}
+
+	for key, value := range s.votes {
+		if key.topicID != source.ID {
+			continue
+		}
+		moved := voteKey{userID: key.userID, topicID: target.ID}
+		if _, voted := s.votes[moved]; !voted {
+			s.votes[moved] = value
+			target.Upvotes += value
+		}
+		delete(s.votes, key)
+	}
+
+	for old, id := range s.oldSlugs {
+		if id == source.ID {
+			s.oldSlugs[old] = target.ID
+		}
+	}
+	s.oldSlugs[source.Slug] = target.ID
+	for merged, id := range s.merged {
+		if id == source.ID {
+			s.merged[merged] = target.ID
+		}
+	}
+	s.merged[source.ID] = target.ID
+
+	for i, candidate := range s.topics {
+		if candidate == source {
+			s.topics = append(s.topics[:i], s.topics[i+1:]...)
+			break
+		}
+	}
+	s.recountTags()
+	s.recountCategories()
+	s.recountMessages(target)
+
+	merged := copyTopic(target)
+	return &merged, nil
+}
+
+func (s *Store) SplitTopic(ctx context.Context, messageID int, draft database.TopicDraft, username string) (*models.Topic, error) {
+	tags, err := topicTags(draft.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	root := s.messageByID(messageID)
+	if root == nil {
+		return nil, database.ErrMessageNotFound
+	}
+	from := s.topicByID(root.TopicID)
+	if from.ArchivedAt != nil {
+		return nil, database.ErrTopicArchived
+	}
+	if draft.CategoryID == 0 {
+		draft.CategoryID = from.CategoryID
+	}
+
+	t, err := s.addTopic(draft, tags, username)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := []*models.Message{root}
+	for i := 0; i < len(moved); i++ {
+		for _, m := range s.messages {
+			if m.ParentID != nil && *m.ParentID == moved[i].ID {
+				moved = append(moved, m)
+			}
+		}
+	}
+	for _, m := range moved {
+		m.TopicID = t.ID
+	}
+	root.ParentID = nil
+	s.recountMessages(from)
+	s.recountMessages(t)
+
+	split := copyTopic(t)
+	return &split, nil
+}
+
+// recountMessages recomputes t.Messages, leaving out tombstones.
+func (s *Store) recountMessages(t *models.Topic) {
+	t.Messages = 0
+	for _, m := range s.messages {
+		if m.TopicID == t.ID && m.DeletedAt == nil {
+			t.Messages++
+		}
+	}
+}
+
+func (s *Store) AddMessage(ctx context.Context, topicID int, message, username string, parentID int) (*models.Message, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	t := s.topicByID(topicID)
+	if t == nil {
+		return nil, database.ErrTopicNotFound
+	}
+	if t.ArchivedAt != nil {
+		return nil, database.ErrTopicArchived
+	}
+	if t.LockedAt != nil {
+		return nil, database.ErrTopicLocked
+	}
+
+	var parent *int
+	if parentID != 0 {
+		p := s.messageByID(parentID)
+		if p == nil {
+			return nil, fmt.Errorf("parent message with ID %d %w", parentID, database.ErrNotFound)
+		}
+		if p.TopicID != t.ID {
+			return nil, fmt.Errorf("%w: parentID=%d, topicID=%d", database.ErrDifferentTopics, parentID, topicID)
+		}
+		if s.depth(p)+1 > database.MaxThreadDepth {
+			return nil, database.ErrThreadTooDeep
+		}
+		parent = &parentID
+	}
+
+	s.nextMessageID++
+	m := &models.Message{
+		ID:        s.nextMessageID,
+		Message:   message,
+		UserID:    u.ID,
+		TopicID:   t.ID,
+		ParentID:  parent,
+		Timestamp: time.Now().UTC(),
+	}
+	s.messages = append(s.messages, m)
+	u.MessagesSent++
+	t.Messages++
+
+	created := *m
+	created.Reactions = map[string]int{}
+	return &created, nil
+}
+
+func (s *Store) SetParent(ctx context.Context, parentID, childID int) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	parent := s.messageByID(parentID)
+	if parent == nil {
+		return fmt.Errorf("parent message with ID %d %w", parentID, database.ErrNotFound)
+	}
+	child := s.messageByID(childID)
+	if child == nil {
+		return fmt.Errorf("child message with ID %d %w", childID, database.ErrNotFound)
+	}
+	if parent.TopicID != child.TopicID {
+		return fmt.Errorf("%w: parentID=%d, childID=%d", database.ErrDifferentTopics, parentID, childID)
+	}
+	if s.topicByID(parent.TopicID).ArchivedAt != nil {
+		return database.ErrTopicArchived
+	}
+	for m := parent; m != nil; {
+		if m.ID == childID {
+			return database.ErrThreadCycle
+		}
+		if m.ParentID == nil {
+			break
+		}
+		m = s.messageByID(*m.ParentID)
+	}
+	if s.depth(parent)+1+s.height(child) > database.MaxThreadDepth {
+		return database.ErrThreadTooDeep
+	}
+
+	id := parentID
+	child.ParentID = &id
+	return nil
+}
+
+// depth counts m's ancestors.
+func (s *Store) depth(m *models.Message) int {
+	depth := 0
+	for m.ParentID != nil && depth <= database.MaxThreadDepth {
+		m = s.messageByID(*m.ParentID)
+		if m == nil {
+			break
+		}
+		depth++
+	}
+	return depth
+}
+
+// height counts the levels of replies beneath m.
+func (s *Store) height(m *models.Message) int {
+	height := 0
+	for _, reply := range s.messages {
+		if reply.ParentID != nil && *reply.ParentID == m.ID {
+			height = max(height, s.height(reply)+1)
+		}
+	}
+	return height
+}
+
+func (s *Store) GetMessagesByTopic(ctx context.Context, topicID int, opts database.ListOptions) ([]models.Message, string, error) {
+	start, limit, err := opts.Start()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.lock(); err != nil {
+		return nil, "", err
+	}
+	defer s.mu.Unlock()
+
+	rows := []keyed[models.Message]{}
+	for _, m := range s.messages {
+		if m.TopicID != topicID {
+			continue
+		}
+		msg := *s.withReactions(m)
+
+		key := int64(m.ID)
+		switch start.Sort {
+		case database.SortTop:
+			key = int64(m.Likes)
+		case database.SortActive:
+			last := m.Timestamp
+			for _, reply := range s.messages {
+				if reply.ParentID != nil && *reply.ParentID == m.ID && reply.Timestamp.After(last) {
+					last = reply.Timestamp
+				}
+			}
+			key = last.Unix()
+		}
+		rows = append(rows, keyed[models.Message]{msg, key, m.ID})
+	}
+
+	messages, next := page(rows, start, limit)
+	return messages, next, nil
+}
+
+func (s *Store) LikeMessage(ctx context.Context, messageID int, username string) error {
+	return s.AddReaction(ctx, messageID, username, database.ReactionLike)
+}
+
+func (s *Store) DislikeMessage(ctx context.Context, messageID int, username string) error {
+	return s.AddReaction(ctx, messageID, username, database.ReactionDislike)
+}
+
+func (s *Store) AddReaction(ctx context.Context, messageID int, username, kind string) error {
+	if !database.IsAllowedReaction(kind) {
+		return database.ErrUnknownReaction
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	userID, err := s.lookupReactor(messageID, username)
+	if err != nil {
+		return err
+	}
+	if s.topicByID(s.messageByID(messageID).TopicID).ArchivedAt != nil {
+		return database.ErrTopicArchived
+	}
+
+	var opposite string
+	switch kind {
+	case database.ReactionLike:
+		opposite = database.ReactionDislike
+	case database.ReactionDislike:
+		opposite = database.ReactionLike
+	}
+
+	kept := s.reactions[:0]
+	for _, r := range s.reactions {
+		if r.userID == userID && r.messageID == messageID {
+			if r.reaction == kind {
+				return database.ErrReactionExists
+			}
+			if r.reaction == opposite {
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	s.reactions = append(kept, reaction{
+		userID:    userID,
+		messageID: messageID,
+		reaction:  kind,
+		createdAt: time.Now().UTC(),
+	})
+	s.updateMessageLikes(messageID)
+	return nil
+}
+
+func (s *Store) RemoveReaction(ctx context.Context, messageID int, username, kind string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	userID, err := s.lookupReactor(messageID, username)
+	if err != nil {
+		return err
+	}
+	if s.topicByID(s.messageByID(messageID).TopicID).ArchivedAt != nil {
+		return database.ErrTopicArchived
+	}
+
+	for i, r := range s.reactions {
+		if r.userID == userID && r.messageID == messageID && r.reaction == kind {
+			s.reactions = append(s.reactions[:i], s.reactions[i+1:]...)
+			s.updateMessageLikes(messageID)
+			return nil
+		}
+	}
+	return database.ErrReactionNotFound
+}
+
+func (s *Store) GetMessageReactions(ctx context.Context, messageID int) ([]models.Reaction, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	if s.messageByID(messageID) == nil {
+		return nil, database.ErrMessageNotFound
+	}
+
+	reactions := []models.Reaction{}
+	for _, r := range s.reactions {
+		if r.messageID != messageID {
+			continue
+		}
+		var username string
+		if u := s.userByID(r.userID); u != nil {
+			username = u.Username
+		}
+		reactions = append(reactions, models.Reaction{
+			UserID:    r.userID,
+			Username:  username,
+			Reaction:  r.reaction,
+			CreatedAt: r.createdAt,
+		})
+	}
+	return reactions, nil
+}
+
+func (s *Store) GetMessage(ctx context.Context, messageID int) (*models.Message, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	m := s.messageByID(messageID)
+	if m == nil {
+		return nil, database.ErrMessageNotFound
+	}
+	return s.withReactions(m), nil
+}
+
+func (s *Store) EditMessage(ctx context.Context, messageID int, editor, message string) (*models.Message, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(editor)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	m := s.messageByID(messageID)
+	if m == nil {
+		return nil, database.ErrMessageNotFound
+	}
+	if m.DeletedAt != nil {
+		return nil, database.ErrMessageDeleted
+	}
+	if s.topicByID(m.TopicID).ArchivedAt != nil {
+		return nil, database.ErrTopicArchived
+	}
+
+	if m.Message != message {
+		now := time.Now().UTC()
+		s.revisions = append(s.revisions, revision{
+			messageID: messageID,
+			message:   m.Message,
+			editorID:  u.ID,
+			editedAt:  now,
+		})
+		m.Message = message
+		m.EditedAt = &now
+	}
+	return s.withReactions(m), nil
+}
+
+func (s *Store) GetMessageRevisions(ctx context.Context, messageID int) ([]models.MessageRevision, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	m := s.messageByID(messageID)
+	if m == nil {
+		return nil, database.ErrMessageNotFound
+	}
+
+	revisions := []models.MessageRevision{{Version: 1, EditorID: m.UserID, EditedAt: m.Timestamp}}
+	for _, r := range s.revisions {
+		if r.messageID != messageID {
+			continue
+		}
+		last := &revisions[len(revisions)-1]
+		last.Message = r.message
+		revisions = append(revisions, models.MessageRevision{
+			Version:  last.Version + 1,
+			EditorID: r.editorID,
+			EditedAt: r.editedAt,
+		})
+	}
+	revisions[len(revisions)-1].Message = m.Message
+	return revisions, nil
+}
+
+func (s *Store) DeleteMessage(ctx context.Context, messageID int) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	m := s.messageByID(messageID)
+	if m == nil {
+		return database.ErrMessageNotFound
+	}
+	if m.DeletedAt != nil {
+		return database.ErrMessageDeleted
+	}
+	if s.topicByID(m.TopicID).ArchivedAt != nil {
+		return database.ErrTopicArchived
+	}
+
+	now := time.Now().UTC()
+	m.Message = models.MessageTombstone
+	m.DeletedAt = &now
+	s.dropRevisions(map[int]bool{messageID: true})
+	s.uncount(m)
+	return nil
+}
+
+func (s *Store) PurgeMessage(ctx context.Context, messageID int) ([]int, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	root := s.messageByID(messageID)
+	if root == nil {
+		return nil, database.ErrMessageNotFound
+	}
+
+	purged := []int{root.ID}
+	removed := map[int]bool{root.ID: true}
+	for i := 0; i < len(purged); i++ {
+		for _, m := range s.messages {
+			if m.ParentID != nil && *m.ParentID == purged[i] {
+				purged = append(purged, m.ID)
+				removed[m.ID] = true
+			}
+		}
+	}
+
+	kept := s.messages[:0]
+	for _, m := range s.messages {
+		if !removed[m.ID] {
+			kept = append(kept, m)
+			continue
+		}
+		if m.DeletedAt == nil {
+			s.uncount(m)
+		}
+	}
+	s.messages = kept
+
+	keptReactions := s.reactions[:0]
+	for _, r := range s.reactions {
+		if !removed[r.messageID] {
+			keptReactions = append(keptReactions, r)
+		}
+	}
+	s.reactions = keptReactions
+	s.dropRevisions(removed)
+	return purged, nil
+}
+
+// uncount takes m back out of its topic's and author's message counts.
+func (s *Store) uncount(m *models.Message) {
+	if t := s.topicByID(m.TopicID); t != nil {
+		t.Messages--
+	}
+	if u := s.userByID(m.UserID); u != nil {
+		u.MessagesSent--
+	}
+}
+
+// dropRevisions forgets the revisions of the given messages.
+func (s *Store) dropRevisions(messageIDs map[int]bool) {
+	kept := s.revisions[:0]
+	for _, r := range s.revisions {
+		if !messageIDs[r.messageID] {
+			kept = append(kept, r)
+		}
+	}
+	s.revisions = kept
+}
+
+// withReactions returns a copy of m with its reaction counts filled in.
+func (s *Store) withReactions(m *models.Message) *models.Message {
+	msg := *m
+	msg.Reactions = map[string]int{}
+	for _, r := range s.reactions {
+		if r.messageID == m.ID {
+			msg.Reactions[r.reaction]++
+		}
+	}
+	return &msg
+}
+
+func (s *Store) lookupReactor(messageID int, username string) (int, error) {
+	u := s.userByName(username)
+	if u == nil {
+		return 0, database.ErrUserNotFound
+	}
+	if s.messageByID(messageID) == nil {
+		return 0, database.ErrMessageNotFound
+	}
+	return u.ID, nil
+}
+
+func (s *Store) updateMessageLikes(messageID int) {
+	m := s.messageByID(messageID)
+	if m == nil {
+		return
+	}
+	m.Likes = 0
+	for _, r := range s.reactions {
+		if r.messageID != messageID {
+			continue
+		}
+		switch r.reaction {
+		case database.ReactionLike:
+			m.Likes++
+		case database.ReactionDislike:
+			m.Likes--
+		}
+	}
+}
+
+func (s *Store) CreateSession(ctx context.Context, username, userAgent string) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return "", database.ErrUserNotFound
+	}
+
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not generate session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.sessions[token] = session{userID: u.ID, expiresAt: time.Now().Add(database.SessionTTL)}
+	return token, nil
+}
+
+func (s *Store) GetSessionUser(ctx context.Context, token string) (*models.User, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok || time.Now().After(sess.expiresAt) {
+		return nil, database.ErrInvalidSession
+	}
+	u := s.userByID(sess.userID)
+	if u == nil {
+		return nil, database.ErrInvalidSession
+	}
+	return &models.User{ID: u.ID, Username: u.Username, EmailVerified: u.EmailVerified, Role: u.Role, CreationDate: u.CreationDate}, nil
+}
+
+func (s *Store) DeleteSession(ctx context.Context, token string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	delete(s.sessions, token)
+	return nil
+}
+
+func (s *Store) DeleteUserSessions(ctx context.Context, userID int) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for token, sess := range s.sessions {
+		if sess.userID == userID {
+			delete(s.sessions, token)
+		}
+	}
+	return nil
+}
+
+// SetLoginPolicy replaces the policy failed logins are judged by.
+func (s *Store) SetLoginPolicy(p database.LoginPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginPolicy = p
+}
+
+func (s *Store) LoginLockedUntil(ctx context.Context, username, ip string) (time.Time, error) {
+	if err := s.lock(); err != nil {
+		return time.Time{}, err
+	}
+	defer s.mu.Unlock()
+
+	var until time.Time
+	for _, key := range []throttleKey{{"user", username}, {"ip", ip}} {
+		if t, ok := s.throttles[key]; ok && t.lockedUntil.After(until) {
+			until = t.lockedUntil
+		}
+	}
+	if !until.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+func (s *Store) RecordLogin(ctx context.Context, attempt models.LoginAttempt) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.nextAttemptID++
+	attempt.ID = s.nextAttemptID
+	attempt.CreatedAt = now.UTC()
+	entry := loginAttempt{LoginAttempt: attempt}
+	if u := s.userByName(attempt.Username); u != nil {
+		entry.userID = u.ID
+	}
+	s.logins = append(s.logins, entry)
+
+	if attempt.Success {
+		delete(s.throttles, throttleKey{"user", attempt.Username})
+		return nil
+	}
+
+	s.countLoginFailure(throttleKey{"user", attempt.Username}, s.loginPolicy.UserThreshold, now)
+	s.countLoginFailure(throttleKey{"ip", attempt.IP}, s.loginPolicy.IPThreshold, now)
+	return nil
+}
+
+func (s *Store) countLoginFailure(key throttleKey, threshold int, now time.Time) {
+	t, ok := s.throttles[key]
+	if !ok {
+		t = &throttle{}
+		s.throttles[key] = t
+	}
+
+	last := t.lastFailureAt
+	if t.lockedUntil.After(last) {
+		last = t.lockedUntil
+	}
+	if !last.Add(s.loginPolicy.FailureWindow).After(now) {
+		t.failures = 0
+	}
+
+	t.failures++
+	t.lastFailureAt = now
+	t.lockedUntil = time.Time{}
+	if lockout := s.loginPolicy.Lockout(t.failures, threshold); lockout > 0 {
+		t.lockedUntil = now.Add(lockout)
+	}
+}
+
+func (s *Store) UnlockLogin(ctx context.Context, username string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if s.userByName(username) == nil {
+		return database.ErrUserNotFound
+	}
+	delete(s.throttles, throttleKey{"user", username})
+	return nil
+}
+
+func (s *Store) GetLoginAttempts(ctx context.Context, username string, limit int) ([]models.LoginAttempt, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	if limit <= 0 {
+		limit = database.DefaultLoginLimit
+	}
+	limit = min(limit, database.MaxLoginLimit)
+
+	attempts := []models.LoginAttempt{}
+	for i := len(s.logins) - 1; i >= 0 && len(attempts) < limit; i-- {
+		if s.logins[i].userID == u.ID {
+			attempts = append(attempts, s.logins[i].LoginAttempt)
+		}
+	}
+	return attempts, nil
+}
+
+func (s *Store) BeginTwoFactor(ctx context.Context, username string) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return "", database.ErrUserNotFound
+	}
+	if u.totp != nil && u.totp.confirmed {
+		return "", database.ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	u.totp = &totpSecret{secret: secret}
+	return secret, nil
+}
+
+func (s *Store) ConfirmTwoFactor(ctx context.Context, username, code string) ([]string, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	if u.totp == nil {
+		return nil, database.ErrTwoFactorNotPending
+	}
+	if u.totp.confirmed {
+		return nil, database.ErrTwoFactorEnabled
+	}
+
+	counter, ok := totp.Validate(u.totp.secret, code, time.Now())
+	if !ok {
+		return nil, database.ErrInvalidTwoFactorCode
+	}
+
+	codes, err := s.replaceRecoveryCodes(u)
+	if err != nil {
+		return nil, err
+	}
+	u.totp.confirmed = true
+	u.totp.lastCounter = counter
+	return codes, nil
+}
+
+func (s *Store) TwoFactorEnabled(ctx context.Context, username string) (bool, error) {
+	if err := s.lock(); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	return u != nil && u.totp != nil && u.totp.confirmed, nil
+}
+
+func (s *Store) VerifyTwoFactor(ctx context.Context, username, code string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u, err := s.confirmedUser(username)
+	if err != nil {
+		return err
+	}
+
+	if database.IsTOTPCode(code) {
+		counter, ok := totp.Validate(u.totp.secret, code, time.Now())
+		if !ok || counter <= u.totp.lastCounter {
+			return database.ErrInvalidTwoFactorCode
+		}
+		u.totp.lastCounter = counter
+		return nil
+	}
+
+	code = database.NormalizeRecoveryCode(code)
+	if used, ok := u.recovery[code]; !ok || used {
+		return database.ErrInvalidTwoFactorCode
+	}
+	u.recovery[code] = true
+	return nil
+}
+
+func (s *Store) RegenerateRecoveryCodes(ctx context.Context, username string) ([]string, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	u, err := s.confirmedUser(username)
+	if err != nil {
+		return nil, err
+	}
+	return s.replaceRecoveryCodes(u)
+}
+
+func (s *Store) DisableTwoFactor(ctx context.Context, username string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	u, err := s.confirmedUser(username)
+	if err != nil {
+		return err
+	}
+
+	u.totp = nil
+	u.recovery = nil
+	for token, c := range s.challenges {
+		if c.userID == u.ID {
+			delete(s.challenges, token)
+		}
+	}
+	return nil
+}
+
+// confirmedUser returns the user called username if they have two-factor
+// authentication turned on.
+func (s *Store) confirmedUser(username string) (*user, error) {
+	u := s.userByName(username)
+	if u == nil {
+		return nil, database.ErrUserNotFound
+	}
+	if u.totp == nil || !u.totp.confirmed {
+		return nil, database.ErrTwoFactorNotEnabled
+	}
+	return u, nil
+}
+
+func (s *Store) replaceRecoveryCodes(u *user) ([]string, error) {
+	codes, err := database.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.recovery = make(map[string]bool, len(codes))
+	for _, code := range codes {
+		u.recovery[database.NormalizeRecoveryCode(code)] = false
+	}
+	return codes, nil
+}
+
+func (s *Store) CreateLoginChallenge(ctx context.Context, username string) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	u := s.userByName(username)
+	if u == nil {
+		return "", database.ErrUserNotFound
+	}
+
+	raw := make([]byte, 32)
+	if _, err := crand.Read(raw); err != nil {
+		return "", fmt.Errorf("could not generate login challenge: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.challenges[token] = challenge{userID: u.ID, expiresAt: time.Now().Add(database.LoginChallengeTTL)}
+	return token, nil
+}
+
+func (s *Store) GetLoginChallenge(ctx context.Context, token string) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	c, ok := s.challenges[token]
+	if !ok || time.Now().After(c.expiresAt) {
+		return "", database.ErrInvalidChallenge
+	}
+	u := s.userByID(c.userID)
+	if u == nil {
+		return "", database.ErrInvalidChallenge
+	}
+	return u.Username, nil
+}
+
+func (s *Store) DeleteLoginChallenge(ctx context.Context, token string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	delete(s.challenges, token)
+	return nil
+}
+
+func (s *Store) GetTwoFactorRole(ctx context.Context) (string, error) {
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+
+	return s.twoFactorRole, nil
+}
+
+func (s *Store) SetTwoFactorRole(ctx context.Context, role string) error {
+	if role != "" && role != models.RoleModerator && role != models.RoleAdmin {
+		return database.ErrInvalidTwoFactorRole
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	s.twoFactorRole = role
+	return nil
+}
+
+// keyed pairs a listed row with its sort key and ID.
+type keyed[T any] struct {
+	row T
+	key int64
+	id  int
+}
+
+// page orders rows the way the SQLite store does and returns the limit rows
+// following start, with the cursor for the rest if any were left out.
+func page[T any](rows []keyed[T], start database.ListCursor, limit int) ([]T, string) {
+	slices.SortFunc(rows, func(a, b keyed[T]) int {
+		if start.Sort == database.SortOldest {
+			a, b = b, a
+		}
+		if a.key != b.key {
+			return cmp.Compare(b.key, a.key)
+		}
+		return cmp.Compare(b.id, a.id)
+	})
+
+	following := rows[:0]
+	for _, r := range rows {
+		if start.Follows(r.key, r.id) {
+			following = append(following, r)
+		}
+	}
+
+	var next string
+	if len(following) > limit {
+		following = following[:limit]
+		last := following[limit-1]
+		next = database.ListCursor{Sort: start.Sort, Key: last.key, ID: last.id}.Encode()
+	}
+
+	out := make([]T, 0, len(following))
+	for _, r := range following {
+		out = append(out, r.row)
+	}
+	return out, next
+}
@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// MergeTopic merges topicID into targetID, deletes topicID and returns the
+// target. The merged topic's messages move over with their reply trees
+// intact and its opening post, if it has one, becomes a message of its own.
+// Votes carry over unless the voter has already voted on the target, and
+// links to the merged topic, by ID or by any slug it used, lead to the
+// target from then on. The target keeps its own title, tags, category and
+// states, and must not be archived.
+func (s *SQLiteStore) MergeTopic(ctx context.Context, topicID, targetID int) (*models.Topic, error) {
+	if topicID == targetID {
+		return nil, ErrSameTopic
+	}
+
+	var target *models.Topic
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		source, err := getTopic(ctx, tx, "id = ?", topicID)
+		if err != nil {
+			return err
+		}
+		target, err = getTopic(ctx, tx, "id = ?", targetID)
+		if err != nil {
+			return err
+		}
+		if target.ArchivedAt != nil {
+			return ErrTopicArchived
+		}
+
+		if source.Body != "" {
+			_, err = tx.ExecContext(ctx, `INSERT INTO messages (message, timestamp, user_id, topic_id)
+							SELECT body, creation_date, creator_id, ? FROM topics WHERE id = ?`, targetID, topicID)
+			if err != nil {
+				log.Printf("error keeping opening post of topic ID %d: %v", topicID, err)
+				return fmt.Errorf("could not keep opening post: %w", err)
+			}
+
+			_, err = tx.ExecContext(ctx, "UPDATE users SET messages_sent = messages_sent + 1 WHERE id = ?", source.CreatorID)
+			if err != nil {
+				log.Printf("error incrementing messages_sent for user ID %d: %v", source.CreatorID, err)
+				return fmt.Errorf("could not increment messages_sent: %w", err)
+			}
+		}
+
+		// parent_id is left alone, so every reply still answers the same
+		// message.
+		_, err = tx.ExecContext(ctx, "UPDATE messages SET topic_id = ? WHERE topic_id = ?", targetID, topicID)
+		if err != nil {
+			log.Printf("error moving messages of topic ID %d to topic ID %d: %v", topicID, targetID, err)
+			return fmt.Errorf("could not move messages: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO topic_votes (user_id, topic_id, value, created_at)
+						SELECT user_id, ?, value, created_at FROM topic_votes WHERE topic_id = ?`, targetID, topicID)
+		if err != nil {
+			log.Printf("error moving votes of topic ID %d to topic ID %d: %v", topicID, targetID, err)
+			return fmt.Errorf("could not move votes: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET upvotes = (SELECT COALESCE(SUM(value), 0) FROM topic_votes WHERE topic_id = ?) WHERE id = ?", targetID, targetID)
+		if err != nil {
+			log.Printf("error recalculating upvotes for topic ID %d: %v", targetID, err)
+			return fmt.Errorf("could not recalculate upvotes: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE topic_slugs SET topic_id = ? WHERE topic_id = ?", targetID, topicID)
+		if err != nil {
+			log.Printf("error moving old slugs of topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not move old slugs: %w", err)
+		}
+		if source.Slug != "" {
+			_, err = tx.ExecContext(ctx, "INSERT INTO topic_slugs (slug, topic_id) VALUES (?, ?)", source.Slug, targetID)
+			if err != nil {
+				log.Printf("error keeping slug of topic ID %d: %v", topicID, err)
+				return fmt.Errorf("could not keep slug: %w", err)
+			}
+		}
+
+		// Topics merged into this one earlier follow it to the target, so
+		// redirects never chain.
+		_, err = tx.ExecContext(ctx, "UPDATE topic_redirects SET target_id = ? WHERE target_id = ?", targetID, topicID)
+		if err != nil {
+			log.Printf("error moving redirects to topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not move redirects: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO topic_redirects (topic_id, target_id) VALUES (?, ?)", topicID, targetID)
+		if err != nil {
+			log.Printf("error redirecting topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not redirect topic: %w", err)
+		}
+
+		if err := replaceTopicTags(ctx, tx, topicID, nil); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM topics WHERE id = ?", topicID)
+		if err != nil {
+			log.Printf("error deleting merged topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not delete merged topic: %w", err)
+		}
+
+		if err := recountCategories(ctx, tx, source.CategoryID); err != nil {
+			return err
+		}
+		if err := recountTopicMessages(ctx, tx, targetID); err != nil {
+			return err
+		}
+
+		target, err = getTopic(ctx, tx, "id = ?", targetID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("topic ID %d merged into topic ID %d", topicID, targetID)
+	s.publish(topicID, EventTopicMerged, models.TopicMerged{TopicID: topicID, Into: target})
+	s.publish(targetID, EventTopicUpdated, target)
+	return target, nil
+}
+
+// SplitTopic moves a message and every reply beneath it out of their topic
+// into a new one, opened by username from draft as AddTopic would, and
+// returns the new topic. The new topic does not count towards username's
+// topics_opened. The message becomes a top-level message there and
+// its replies keep their place beneath it. A draft without a category opens
+// the new topic in the category of the old one.
+func (s *SQLiteStore) SplitTopic(ctx context.Context, messageID int, draft TopicDraft, username string) (*models.Topic, error) {
+	tags, err := topicTags(draft.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	var fromID int
+	var moved []int
+	var topic *models.Topic
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		var categoryID int
+		var archived bool
+		err := tx.QueryRowContext(ctx, `SELECT m.topic_id, t.category_id, t.archived_at IS NOT NULL
+						FROM messages m JOIN topics t ON t.id = m.topic_id WHERE m.id = ?`,
+			messageID).Scan(&fromID, &categoryID, &archived)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMessageNotFound
+			}
+			log.Printf("error fetching message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not fetch message: %w", err)
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+		if draft.CategoryID == 0 {
+			draft.CategoryID = categoryID
+		}
+
+		topicID, err := insertTopic(ctx, tx, draft, tags, username)
+		if err != nil {
+			return err
+		}
+
+		moved, err = subtreeIDs(ctx, tx, messageID)
+		if err != nil {
+			return err
+		}
+
+		ids, args := inList(moved)
+		_, err = tx.ExecContext(ctx, "UPDATE messages SET topic_id = ? WHERE id IN "+ids, append([]any{topicID}, args...)...)
+		if err != nil {
+			log.Printf("error moving messages beneath message ID %d to topic ID %d: %v", messageID, topicID, err)
+			return fmt.Errorf("could not move messages: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE messages SET parent_id = NULL WHERE id = ?", messageID)
+		if err != nil {
+			log.Printf("error detaching message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not detach message: %w", err)
+		}
+
+		if err := recountTopicMessages(ctx, tx, fromID, topicID); err != nil {
+			return err
+		}
+
+		topic, err = getTopic(ctx, tx, "id = ?", topicID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("split %d message(s) beneath message ID %d out of topic ID %d into topic ID %d", len(moved), messageID, fromID, topic.ID)
+	s.publish(fromID, EventTopicSplit, models.TopicSplit{MessageIDs: moved, Topic: topic})
+	return topic, nil
+}
+
+// recountTopicMessages recomputes messages for the given topics, leaving
+// out tombstones.
+func recountTopicMessages(ctx context.Context, tx *sql.Tx, topicIDs ...int) error {
+	ids, args := inList(topicIDs)
+	_, err := tx.ExecContext(ctx, `UPDATE topics SET messages = (SELECT COUNT(*) FROM messages WHERE topic_id = topics.id AND deleted_at IS NULL)
+					WHERE id IN `+ids, args...)
+	if err != nil {
+		log.Printf("error recounting topic messages: %v", err)
+		return fmt.Errorf("could not recount topic messages: %w", err)
+	}
+	return nil
+}
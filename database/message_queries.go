@@ -1,177 +1,458 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"log"
+	"strings"
+
+	"github.com/dDogge/Brainwave/models"
 )
 
-func CreateMessageTable(db *sql.DB) error {
-	query := `CREATE TABLE IF NOT EXISTS messages (
-    			id INTEGER PRIMARY KEY AUTOINCREMENT,
-    			message TEXT,
-    			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-				likes INTEGER DEFAULT 0,
-    			user_id INTEGER,
-    			parent_id INTEGER DEFAULT NULL,
-    			topic_id INTEGER NOT NULL,
-    			FOREIGN KEY (user_id) REFERENCES users(id),
-    			FOREIGN KEY (parent_id) REFERENCES messages(id),
-    			FOREIGN KEY (topic_id) REFERENCES topics(id) ON DELETE CASCADE
-			);`
-	_, err := db.Exec(query)
+// AddMessage posts message to the topic as username and returns it. Locked
+// and archived topics take no new messages. A non-zero parentID makes it a
+// reply to that message, which must be in the same topic and not already at
+// MaxThreadDepth. The insert and the messages_sent and topic message
+// counters are updated in one transaction.
+func (s *SQLiteStore) AddMessage(ctx context.Context, topicID int, message, username string, parentID int) (*models.Message, error) {
+	var created *models.Message
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var creatorID int
+
+		err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&creatorID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			log.Printf("error fetching creator_id: %v", err)
+			return fmt.Errorf("could not fetch creator_id: %w", err)
+		}
+
+		locked, archived, err := topicState(ctx, tx, topicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+		if locked {
+			return ErrTopicLocked
+		}
+
+		var parent sql.NullInt64
+		if parentID != 0 {
+			var parentTopicID int
+			err = tx.QueryRowContext(ctx, "SELECT topic_id FROM messages WHERE id = ?", parentID).Scan(&parentTopicID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return fmt.Errorf("parent message with ID %d %w", parentID, ErrNotFound)
+				}
+				log.Printf("error fetching topic_id for parentID %d: %v", parentID, err)
+				return fmt.Errorf("could not fetch topic_id for parent message: %w", err)
+			}
+			if parentTopicID != topicID {
+				return fmt.Errorf("%w: parentID=%d, topicID=%d", ErrDifferentTopics, parentID, topicID)
+			}
+
+			depth, err := messageDepth(ctx, tx, parentID)
+			if err != nil {
+				return err
+			}
+			if depth+1 > MaxThreadDepth {
+				return ErrThreadTooDeep
+			}
+			parent = sql.NullInt64{Int64: int64(parentID), Valid: true}
+		}
+
+		res, err := tx.ExecContext(ctx, "INSERT INTO messages (message, user_id, topic_id, parent_id) VALUES (?, ?, ?, ?)", message, creatorID, topicID, parent)
+		if err != nil {
+			log.Printf("error executing statement: %v", err)
+			return fmt.Errorf("could not execute statement: %w", err)
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			log.Printf("error fetching new message ID: %v", err)
+			return fmt.Errorf("could not fetch new message ID: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET messages_sent = messages_sent + 1 WHERE id = ?", creatorID)
+		if err != nil {
+			log.Printf("error incrementing messages_sent for user ID %d: %v", creatorID, err)
+			return fmt.Errorf("could not increment messages_sent: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET messages = messages + 1 WHERE id = ?", topicID)
+		if err != nil {
+			log.Printf("error incrementing messages for topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not increment messages: %w", err)
+		}
+
+		row := tx.QueryRowContext(ctx, "SELECT "+messageColumns+" FROM messages WHERE id = ?", id)
+		created, err = scanMessage(row)
+		if err != nil {
+			log.Printf("error fetching new message ID %d: %v", id, err)
+			return fmt.Errorf("could not fetch new message: %w", err)
+		}
+		created.Reactions = map[string]int{}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("message added successfully:", message)
+	s.publish(created.TopicID, EventMessageCreated, created)
+	return created, nil
+}
+
+// SetParent makes childID a reply to parentID. Both must be in the same
+// topic, the move must not turn the child into its own ancestor, and the
+// child's deepest reply must still end up within MaxThreadDepth.
+func (s *SQLiteStore) SetParent(ctx context.Context, parentID, childID int) error {
+	var parentTopicID int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var childTopicID int
+
+		err := tx.QueryRowContext(ctx, "SELECT topic_id FROM messages WHERE id = ?", parentID).Scan(&parentTopicID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("parent message with ID %d %w", parentID, ErrNotFound)
+			}
+			log.Printf("error fetching topic_id for parentID %d: %v", parentID, err)
+			return fmt.Errorf("could not fetch topic_id for parent message: %w", err)
+		}
+
+		err = tx.QueryRowContext(ctx, "SELECT topic_id FROM messages WHERE id = ?", childID).Scan(&childTopicID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("child message with ID %d %w", childID, ErrNotFound)
+			}
+			log.Printf("error fetching topic_id for childID %d: %v", childID, err)
+			return fmt.Errorf("could not fetch topic_id for child message: %w", err)
+		}
+
+		if parentTopicID != childTopicID {
+			return fmt.Errorf("%w: parentID=%d, childID=%d", ErrDifferentTopics, parentID, childID)
+		}
+
+		_, archived, err := topicState(ctx, tx, parentTopicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		ancestor, err := isAncestor(ctx, tx, childID, parentID)
+		if err != nil {
+			return err
+		}
+		if ancestor {
+			return ErrThreadCycle
+		}
+
+		depth, err := messageDepth(ctx, tx, parentID)
+		if err != nil {
+			return err
+		}
+		height, err := threadHeight(ctx, tx, childID)
+		if err != nil {
+			return err
+		}
+		if depth+1+height > MaxThreadDepth {
+			return ErrThreadTooDeep
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE messages SET parent_id = ? WHERE id = ?", parentID, childID)
+		if err != nil {
+			log.Printf("error setting parent_id for message ID %d: %v", childID, err)
+			return fmt.Errorf("could not set parent_id: %w", err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		log.Fatal("error creating message table: ", err)
 		return err
 	}
+
+	log.Printf("Parent for message set successfully: parentID=%d, childID=%d", parentID, childID)
+	s.publish(parentTopicID, EventMessageMoved, models.MessageMoved{MessageID: childID, ParentID: parentID})
 	return nil
 }
 
-func AddMessage(db *sql.DB, topic, message, username string) error {
-	var creatorID int
+// DeleteMessage replaces a message with a tombstone. It keeps its place in
+// the reply tree so its replies stay where they are, but its text and
+// revisions are gone and it no longer counts towards the topic's messages or
+// its author's messages_sent.
+func (s *SQLiteStore) DeleteMessage(ctx context.Context, messageID int) error {
 	var topicID int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var userID sql.NullInt64
+		var deletedAt sql.NullTime
+		err := tx.QueryRowContext(ctx, "SELECT topic_id, user_id, deleted_at FROM messages WHERE id = ?", messageID).Scan(&topicID, &userID, &deletedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMessageNotFound
+			}
+			log.Printf("error fetching message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not fetch message: %w", err)
+		}
+		if deletedAt.Valid {
+			return ErrMessageDeleted
+		}
 
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&creatorID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return errors.New("user not found")
+		_, archived, err := topicState(ctx, tx, topicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
 		}
-		log.Printf("error fetching creator_id: %v", err)
-		return fmt.Errorf("could not fetch creator_id: %w", err)
-	}
 
-	err = db.QueryRow("SELECT id FROM topics WHERE title = ?", topic).Scan(&topicID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return errors.New("topic not found")
+		_, err = tx.ExecContext(ctx, "UPDATE messages SET message = NULL, deleted_at = CURRENT_TIMESTAMP WHERE id = ?", messageID)
+		if err != nil {
+			log.Printf("error deleting message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not delete message: %w", err)
 		}
-		log.Printf("error fetching creator_id: %v", err)
-		return fmt.Errorf("could not fetch creator_id: %w", err)
-	}
 
-	stmt, err := db.Prepare("INSERT INTO messages (message, user_id, topic_id) VALUES (?, ?, ?)")
-	if err != nil {
-		log.Printf("error preparing statement: %v", err)
-		return fmt.Errorf("could not prepare statement: %w", err)
-	}
-	defer stmt.Close()
+		_, err = tx.ExecContext(ctx, "DELETE FROM message_revisions WHERE message_id = ?", messageID)
+		if err != nil {
+			log.Printf("error deleting revisions of message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not delete revisions: %w", err)
+		}
 
-	_, err = stmt.Exec(message, creatorID, topicID)
-	if err != nil {
-		log.Printf("error executing statement: %v", err)
-		return fmt.Errorf("could not execute statement: %w", err)
-	}
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET messages = messages - 1 WHERE id = ?", topicID)
+		if err != nil {
+			log.Printf("error decrementing messages for topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not decrement messages: %w", err)
+		}
 
-	_, err = db.Exec("UPDATE users SET messages_sent = messages_sent + 1 WHERE id = ?", creatorID)
-	if err != nil {
-		log.Printf("error incrementing messages_sent for user ID %d: %v", creatorID, err)
-		return fmt.Errorf("could not increment messages_sent: %w", err)
-	}
+		if userID.Valid {
+			_, err = tx.ExecContext(ctx, "UPDATE users SET messages_sent = messages_sent - 1 WHERE id = ?", userID.Int64)
+			if err != nil {
+				log.Printf("error decrementing messages_sent for user ID %d: %v", userID.Int64, err)
+				return fmt.Errorf("could not decrement messages_sent: %w", err)
+			}
+		}
 
-	_, err = db.Exec("UPDATE topics SET messages = messages + 1 WHERE id = ?", topicID)
+		return nil
+	})
 	if err != nil {
-		log.Printf("error incrementing messages for topic ID %d: %v", topicID, err)
-		return fmt.Errorf("could not increment messages: %w", err)
+		return err
 	}
 
-	log.Println("message added successfully:", message)
+	log.Printf("message ID %d deleted", messageID)
+	s.publish(topicID, EventMessageDeleted, models.MessageDeleted{MessageID: messageID})
 	return nil
 }
 
-func SetParent(db *sql.DB, parentID, childID int) error {
-	var parentTopicID, childTopicID int
+// PurgeMessage hard-deletes a message and every reply beneath it, along
+// with their reactions and revisions, and returns the removed IDs with the
+// root first. Counters only drop for messages that were not already
+// tombstones.
+func (s *SQLiteStore) PurgeMessage(ctx context.Context, messageID int) ([]int, error) {
+	var topicID int
+	var purged []int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "SELECT topic_id FROM messages WHERE id = ?", messageID).Scan(&topicID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMessageNotFound
+			}
+			log.Printf("error fetching message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not fetch message: %w", err)
+		}
 
-	err := db.QueryRow("SELECT topic_id FROM messages WHERE id = ?", parentID).Scan(&parentTopicID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("parent message with ID %d not found", parentID)
+		purged, err = subtreeIDs(ctx, tx, messageID)
+		if err != nil {
+			return err
 		}
-		log.Printf("error fetching topic_id for parentID %d: %v", parentID, err)
-		return fmt.Errorf("could not fetch topic_id for parent message: %w", err)
+
+		ids, args := inList(purged)
+
+		_, err = tx.ExecContext(ctx, `UPDATE users SET messages_sent = messages_sent - (
+							SELECT COUNT(*) FROM messages m
+							WHERE m.user_id = users.id AND m.deleted_at IS NULL AND m.id IN `+ids+`)
+						WHERE id IN (SELECT user_id FROM messages WHERE id IN `+ids+`)`, append(args, args...)...)
+		if err != nil {
+			log.Printf("error decrementing messages_sent for purged messages: %v", err)
+			return fmt.Errorf("could not decrement messages_sent: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE topics SET messages = messages - (
+							SELECT COUNT(*) FROM messages WHERE deleted_at IS NULL AND id IN `+ids+`)
+						WHERE id = ?`, append(args, topicID)...)
+		if err != nil {
+			log.Printf("error decrementing messages for topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not decrement messages: %w", err)
+		}
+
+		for _, table := range []string{"message_reactions", "message_revisions"} {
+			_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE message_id IN "+ids, args...)
+			if err != nil {
+				log.Printf("error deleting %s of purged messages: %v", table, err)
+				return fmt.Errorf("could not delete %s: %w", table, err)
+			}
+		}
+
+		// One statement, so the replies' parent_id references are only
+		// checked once they are all gone.
+		_, err = tx.ExecContext(ctx, "DELETE FROM messages WHERE id IN "+ids, args...)
+		if err != nil {
+			log.Printf("error purging messages: %v", err)
+			return fmt.Errorf("could not purge messages: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	err = db.QueryRow("SELECT topic_id FROM messages WHERE id = ?", childID).Scan(&childTopicID)
+	log.Printf("purged %d message(s) beneath message ID %d", len(purged), messageID)
+	s.publish(topicID, EventMessagesPurged, models.MessagesPurged{MessageIDs: purged})
+	return purged, nil
+}
+
+// subtreeIDs returns the ID of messageID and of every reply beneath it, with
+// the root first and the replies in the order they were posted. The walk
+// uses UNION so a reply cycle left by older data cannot loop forever.
+func subtreeIDs(ctx context.Context, q querier, messageID int) ([]int, error) {
+	rows, err := q.QueryContext(ctx, `WITH RECURSIVE subtree(id) AS (
+					SELECT id FROM messages WHERE id = ?
+					UNION
+					SELECT m.id FROM messages m JOIN subtree s ON m.parent_id = s.id
+				)
+				SELECT id FROM subtree ORDER BY id != ?, id`, messageID, messageID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("child message with ID %d not found", childID)
+		log.Printf("error fetching replies beneath message ID %d: %v", messageID, err)
+		return nil, fmt.Errorf("could not fetch replies: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("error scanning reply row: %v", err)
+			return nil, fmt.Errorf("could not scan reply row: %w", err)
 		}
-		log.Printf("error fetching topic_id for childID %d: %v", childID, err)
-		return fmt.Errorf("could not fetch topic_id for child message: %w", err)
+		ids = append(ids, id)
 	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading reply rows: %v", err)
+		return nil, fmt.Errorf("could not read replies: %w", err)
+	}
+	return ids, nil
+}
 
-	if parentTopicID != childTopicID {
-		return fmt.Errorf("messages are not in the same topic: parentID=%d, childID=%d", parentID, childID)
+// inList returns a parenthesised placeholder list for ids and the matching
+// arguments.
+func inList(ids []int) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
 	}
+	return "(?" + strings.Repeat(", ?", len(ids)-1) + ")", args
+}
 
-	_, err = db.Exec("UPDATE messages SET parent_id = ? WHERE id = ?", parentID, childID)
+// messageSortKeys holds the sort_key expression for each message listing
+// order.
+var messageSortKeys = map[string]string{
+	SortRecent: "m.id",
+	SortOldest: "m.id",
+	SortTop:    "COALESCE(m.likes, 0)",
+	SortActive: "CAST(strftime('%s', COALESCE((SELECT MAX(r.timestamp) FROM messages r WHERE r.parent_id = m.id), m.timestamp)) AS INTEGER)",
+}
+
+// GetMessagesByTopic returns one page of a topic's messages, replies
+// included, in the order opts asks for, along with the cursor for the next
+// page or "" if this is the last one.
+func (s *SQLiteStore) GetMessagesByTopic(ctx context.Context, topicID int, opts ListOptions) ([]models.Message, string, error) {
+	start, limit, err := opts.Start()
 	if err != nil {
-		log.Printf("error setting parent_id for user ID %d: %v", childID, err)
-		return fmt.Errorf("could not set parent_id: %w", err)
+		return nil, "", err
 	}
 
-	log.Printf("Parent for message set successfully: parentID=%d, childID=%d", parentID, childID)
-	return nil
-}
+	reactions, err := s.reactionCountsByTopic(ctx, topicID)
+	if err != nil {
+		return nil, "", err
+	}
 
-func GetMessagesByTopic(db *sql.DB, topicID int) ([]map[string]interface{}, error) {
-	rows, err := db.Query("SELECT id, message, timestamp, likes, user_id, parent_id FROM messages WHERE topic_id = ?", topicID)
+	query, args := pageQuery("SELECT "+messageColumnsAs("m")+", "+messageSortKeys[start.Sort]+" AS sort_key FROM messages m WHERE m.topic_id = ?", start, limit, topicID)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Printf("error fetching messages for topic ID %d: %v", topicID, err)
-		return nil, fmt.Errorf("could not fetch messages: %w", err)
+		return nil, "", fmt.Errorf("could not fetch messages: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []map[string]interface{}
+	messages := []models.Message{}
+	var keys []int64
 	for rows.Next() {
-		var id, likes, userID sql.NullInt64
-		var parentID sql.NullInt64
-		var message, timestamp string
-
-		if err := rows.Scan(&id, &message, &timestamp, &likes, &userID, &parentID); err != nil {
+		var key int64
+		msg, err := scanMessage(keyedScanner{rows, &key})
+		if err != nil {
 			log.Printf("error scanning message row: %v", err)
-			return nil, fmt.Errorf("could not scan message row: %w", err)
-		}
-
-		var parentIDValue interface{}
-		if parentID.Valid {
-			parentIDValue = parentID.Int64
-		} else {
-			parentIDValue = nil
+			return nil, "", fmt.Errorf("could not scan message row: %w", err)
 		}
 
-		msg := map[string]interface{}{
-			"id":        id.Int64,
-			"message":   message,
-			"timestamp": timestamp,
-			"likes":     likes.Int64,
-			"user_id":   userID.Int64,
-			"parent_id": parentIDValue,
+		msg.Reactions = reactions[msg.ID]
+		if msg.Reactions == nil {
+			msg.Reactions = map[string]int{}
 		}
-		messages = append(messages, msg)
+		messages = append(messages, *msg)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading message rows: %v", err)
+		return nil, "", fmt.Errorf("could not read messages: %w", err)
 	}
 
-	return messages, nil
+	var next string
+	if len(messages) > limit {
+		messages = messages[:limit]
+		next = ListCursor{Sort: start.Sort, Key: keys[limit-1], ID: messages[limit-1].ID}.Encode()
+	}
+	return messages, next, nil
 }
 
-func LikeMessage(db *sql.DB, messageID int) error {
-	_, err := db.Exec("UPDATE messages SET likes = likes + 1 WHERE id = ?", messageID)
-	if err != nil {
-		log.Printf("error incrementing likes for message ID %d: %v", messageID, err)
-		return fmt.Errorf("could not increment likes: %w", err)
-	}
+// messageColumns lists the columns scanMessage expects, in order.
+const messageColumns = "id, message, timestamp, likes, user_id, parent_id, topic_id, edited_at, deleted_at"
 
-	log.Printf("likes incremented successfully for message ID %d", messageID)
-	return nil
+// messageColumnsAs is messageColumns qualified with a table alias.
+func messageColumnsAs(alias string) string {
+	return alias + "." + strings.ReplaceAll(messageColumns, ", ", ", "+alias+".")
 }
 
-func DislikeMessage(db *sql.DB, messageID int) error {
-	_, err := db.Exec("UPDATE messages SET likes = likes - 1 WHERE id = ?", messageID)
+// scanMessage reads a row holding messageColumns.
+func scanMessage(row scanner) (*models.Message, error) {
+	var msg models.Message
+	var message sql.NullString
+	var likes, userID, parentID sql.NullInt64
+	var editedAt, deletedAt sql.NullTime
+
+	err := row.Scan(&msg.ID, &message, &msg.Timestamp, &likes, &userID, &parentID, &msg.TopicID, &editedAt, &deletedAt)
 	if err != nil {
-		log.Printf("error decrementing likes for message ID %d: %v", messageID, err)
-		return fmt.Errorf("could not decrement likes: %w", err)
+		return nil, err
 	}
 
-	log.Printf("likes decremented successfully for message ID %d", messageID)
-	return nil
+	msg.Message = message.String
+	msg.Likes = int(likes.Int64)
+	msg.UserID = int(userID.Int64)
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		msg.ParentID = &id
+	}
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	if deletedAt.Valid {
+		msg.DeletedAt = &deletedAt.Time
+		msg.Message = models.MessageTombstone
+	}
+	return &msg, nil
 }
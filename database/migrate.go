@@ -0,0 +1,267 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is one versioned schema change, read from a pair of
+// NNNN_name.up.sql and NNNN_name.down.sql files in migrations/.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		prefix, rest, ok := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %s is not named NNNN_name.%s.sql", name, direction)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file %s has an invalid version", name)
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %w", name, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: rest}
+			byVersion[version] = m
+		} else if m.Name != rest {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, rest)
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func createMigrationTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`
+	_, err := db.Exec(query)
+	if err != nil {
+		log.Printf("error creating schema_migrations table: %v", err)
+		return fmt.Errorf("could not create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+func appliedMigrations(db *sql.DB) (map[int]string, error) {
+	err := createMigrationTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		log.Printf("error fetching applied migrations: %v", err)
+		return nil, fmt.Errorf("could not fetch applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			log.Printf("error scanning migration row: %v", err)
+			return nil, fmt.Errorf("could not scan migration row: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// MigrateUp applies every pending migration in order and returns how many
+// were applied. Each migration runs in its own transaction, so a failure
+// leaves the database at the last migration that succeeded.
+func MigrateUp(db *sql.DB) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	return migrateUp(db, migrations)
+}
+
+func migrateUp(db *sql.DB, migrations []Migration) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := runMigration(db, m, m.Up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		if err != nil {
+			return count, err
+		}
+
+		log.Printf("applied migration %04d_%s", m.Version, m.Name)
+		count++
+	}
+
+	return count, nil
+}
+
+// MigrateDown reverts the most recently applied migrations, at most steps of
+// them, and returns how many were reverted.
+func MigrateDown(db *sql.DB, steps int) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	return migrateDown(db, migrations, steps)
+}
+
+func migrateDown(db *sql.DB, migrations []Migration, steps int) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		err := runMigration(db, m, m.Down, "DELETE FROM schema_migrations WHERE version = ?", m.Version)
+		if err != nil {
+			return count, err
+		}
+
+		log.Printf("reverted migration %04d_%s", m.Version, m.Name)
+		count++
+	}
+
+	return count, nil
+}
+
+func runMigration(db *sql.DB, m Migration, script, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("error starting transaction: %v", err)
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(script)
+	if err != nil {
+		log.Printf("error running migration %04d_%s: %v", m.Version, m.Name, err)
+		return fmt.Errorf("could not run migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+
+	_, err = tx.Exec(record, args...)
+	if err != nil {
+		log.Printf("error recording migration %04d_%s: %v", m.Version, m.Name, err)
+		return fmt.Errorf("could not record migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("error committing migration %04d_%s: %v", m.Version, m.Name, err)
+		return fmt.Errorf("could not commit migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+
+	return nil
+}
+
+// GetMigrationStatus reports every known migration and whether it has been
+// applied to db.
+func GetMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
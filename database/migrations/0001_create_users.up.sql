@@ -7,4 +7,4 @@ CREATE TABLE IF NOT EXISTS users (
     topics_opened INTEGER DEFAULT 0,
     messages_sent INTEGER DEFAULT 0,
     creation_date DATETIME DEFAULT CURRENT_TIMESTAMP
-);
\ No newline at end of file
+);
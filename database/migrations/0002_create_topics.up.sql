@@ -2,8 +2,8 @@ CREATE TABLE IF NOT EXISTS topics (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     title TEXT UNIQUE NOT NULL,
     messages INTEGER DEFAULT 0,
-    upvotes INTEGER DEFUALT 0,
+    upvotes INTEGER DEFAULT 0,
     creation_date DATETIME DEFAULT CURRENT_TIMESTAMP,
     creator_id INTEGER,
-    FOREIGN KEY (creator) REFERENCES users(id)
-);
\ No newline at end of file
+    FOREIGN KEY (creator_id) REFERENCES users(id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS message_reactions (
+    user_id INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    reaction TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id, reaction),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
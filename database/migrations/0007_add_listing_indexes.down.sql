@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_users_messages_sent;
+DROP INDEX IF EXISTS idx_messages_user;
+DROP INDEX IF EXISTS idx_messages_parent;
+DROP INDEX IF EXISTS idx_messages_topic_timestamp;
+DROP INDEX IF EXISTS idx_messages_topic_likes;
+DROP INDEX IF EXISTS idx_messages_topic;
+DROP INDEX IF EXISTS idx_topics_upvotes;
@@ -0,0 +1,7 @@
+CREATE INDEX IF NOT EXISTS idx_topics_upvotes ON topics (upvotes, id);
+CREATE INDEX IF NOT EXISTS idx_messages_topic ON messages (topic_id, id);
+CREATE INDEX IF NOT EXISTS idx_messages_topic_likes ON messages (topic_id, likes, id);
+CREATE INDEX IF NOT EXISTS idx_messages_topic_timestamp ON messages (topic_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_messages_parent ON messages (parent_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_messages_user ON messages (user_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_users_messages_sent ON users (messages_sent, id);
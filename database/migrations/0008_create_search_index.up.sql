@@ -0,0 +1,42 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS topics_fts USING fts5(
+    title,
+    content = 'topics',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+    message,
+    content = 'messages',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS topics_fts_insert AFTER INSERT ON topics BEGIN
+    INSERT INTO topics_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS topics_fts_delete AFTER DELETE ON topics BEGIN
+    INSERT INTO topics_fts (topics_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS topics_fts_update AFTER UPDATE OF title ON topics BEGIN
+    INSERT INTO topics_fts (topics_fts, rowid, title) VALUES ('delete', old.id, old.title);
+    INSERT INTO topics_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+    INSERT INTO messages_fts (rowid, message) VALUES (new.id, new.message);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+    INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.id, old.message);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF message ON messages BEGIN
+    INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.id, old.message);
+    INSERT INTO messages_fts (rowid, message) VALUES (new.id, new.message);
+END;
+
+INSERT INTO topics_fts (topics_fts) VALUES ('rebuild');
+INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
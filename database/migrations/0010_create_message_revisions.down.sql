@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_message_revisions_message;
+DROP TABLE IF EXISTS message_revisions;
+ALTER TABLE messages DROP COLUMN edited_at;
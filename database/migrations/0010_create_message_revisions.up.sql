@@ -0,0 +1,13 @@
+ALTER TABLE messages ADD COLUMN edited_at DATETIME DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    message TEXT,
+    editor_id INTEGER,
+    edited_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (editor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message ON message_revisions(message_id, id);
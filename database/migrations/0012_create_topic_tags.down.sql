@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_topic_tags_tag;
+DROP TABLE IF EXISTS topic_tags;
+DROP TABLE IF EXISTS tags;
+ALTER TABLE topics DROP COLUMN body;
+ALTER TABLE topics DROP COLUMN description;
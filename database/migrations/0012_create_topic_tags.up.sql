@@ -0,0 +1,19 @@
+ALTER TABLE topics ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE topics ADD COLUMN body TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    topic_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS topic_tags (
+    topic_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (topic_id, tag_id),
+    FOREIGN KEY (topic_id) REFERENCES topics(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topic_tags_tag ON topic_tags(tag_id, topic_id);
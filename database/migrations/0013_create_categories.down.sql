@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_topics_category;
+ALTER TABLE topics DROP COLUMN category_id;
+DROP INDEX IF EXISTS idx_categories_parent;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    color TEXT NOT NULL DEFAULT '',
+    parent_id INTEGER DEFAULT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    topic_role TEXT NOT NULL DEFAULT 'user' CHECK (topic_role IN ('user', 'moderator', 'admin')),
+    topic_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (parent_id) REFERENCES categories(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_categories_parent ON categories(parent_id, position);
+
+-- Every existing topic starts out in the default category. SQLite will not
+-- add a REFERENCES column with a non-NULL default while foreign keys are
+-- enforced, so the link to categories is kept by the store instead.
+INSERT INTO categories (id, name, description) VALUES (1, 'General', 'Everything else');
+
+ALTER TABLE topics ADD COLUMN category_id INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS idx_topics_category ON topics(category_id, id);
+
+UPDATE categories SET topic_count = (SELECT COUNT(*) FROM topics) WHERE id = 1;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_topic_slugs_topic;
+DROP TABLE IF EXISTS topic_slugs;
+DROP INDEX IF EXISTS idx_topics_slug;
+ALTER TABLE topics DROP COLUMN slug;
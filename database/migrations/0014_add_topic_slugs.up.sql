@@ -0,0 +1,15 @@
+-- Slugs are generated in Go, so existing topics are left NULL here and
+-- filled in by BackfillTopicSlugs when the server starts.
+ALTER TABLE topics ADD COLUMN slug TEXT DEFAULT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_topics_slug ON topics(slug);
+
+-- Slugs a topic used before it was renamed, kept so that old links redirect.
+CREATE TABLE IF NOT EXISTS topic_slugs (
+    slug TEXT PRIMARY KEY,
+    topic_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topic_slugs_topic ON topic_slugs(topic_id);
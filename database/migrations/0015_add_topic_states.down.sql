@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_topics_pinned;
+ALTER TABLE topics DROP COLUMN unarchived_at;
+ALTER TABLE topics DROP COLUMN archived_at;
+ALTER TABLE topics DROP COLUMN pinned_at;
+ALTER TABLE topics DROP COLUMN locked_at;
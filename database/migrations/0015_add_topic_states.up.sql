@@ -0,0 +1,9 @@
+ALTER TABLE topics ADD COLUMN locked_at DATETIME DEFAULT NULL;
+ALTER TABLE topics ADD COLUMN pinned_at DATETIME DEFAULT NULL;
+ALTER TABLE topics ADD COLUMN archived_at DATETIME DEFAULT NULL;
+
+-- When a moderator last unarchived the topic. It counts as activity, so the
+-- topic is not archived again before another full period has passed.
+ALTER TABLE topics ADD COLUMN unarchived_at DATETIME DEFAULT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_topics_pinned ON topics(pinned_at) WHERE pinned_at IS NOT NULL;
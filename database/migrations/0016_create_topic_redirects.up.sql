@@ -0,0 +1,11 @@
+-- Topics that were merged into another, kept so that links to them
+-- redirect. topic_id no longer exists in topics, and merging a topic that
+-- others were merged into points their redirects at the new target.
+CREATE TABLE IF NOT EXISTS topic_redirects (
+    topic_id INTEGER PRIMARY KEY,
+    target_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (target_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topic_redirects_target ON topic_redirects(target_id);
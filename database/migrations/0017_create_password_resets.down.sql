@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN reset_code TEXT DEFAULT NULL;
+DROP TABLE IF EXISTS password_resets;
@@ -0,0 +1,13 @@
+-- Password reset tokens replace users.reset_code, which held a short code in
+-- plain text. Only a hash of each token is stored, and a user has at most
+-- one outstanding token.
+CREATE TABLE IF NOT EXISTS password_resets (
+    user_id INTEGER PRIMARY KEY,
+    token_hash TEXT UNIQUE NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE users DROP COLUMN reset_code;
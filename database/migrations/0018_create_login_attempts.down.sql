@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS login_throttles;
+DROP INDEX IF EXISTS idx_login_attempts_user;
+DROP TABLE IF EXISTS login_attempts;
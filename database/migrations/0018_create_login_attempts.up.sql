@@ -0,0 +1,25 @@
+-- Every login attempt, kept as an audit trail. user_id is NULL when the
+-- username did not belong to anyone.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER DEFAULT NULL,
+    username TEXT NOT NULL,
+    success BOOLEAN NOT NULL,
+    ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id, id);
+
+-- Recent failed logins per username ('user') and per client IP ('ip'), and
+-- how long each is locked out for.
+CREATE TABLE IF NOT EXISTS login_throttles (
+    scope TEXT NOT NULL,
+    key TEXT NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at DATETIME NOT NULL,
+    locked_until DATETIME DEFAULT NULL,
+    PRIMARY KEY (scope, key)
+);
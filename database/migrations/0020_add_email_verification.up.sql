@@ -0,0 +1,17 @@
+-- Addresses that were in use before verification existed are taken as
+-- verified, so those accounts can keep posting.
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME DEFAULT NULL;
+UPDATE users SET email_verified_at = CURRENT_TIMESTAMP;
+
+-- Outstanding email verification tokens, hashed. email is the address the
+-- token proves: the user's own after signing up, or the one they asked to
+-- change to, which only replaces theirs once verified. A user has at most
+-- one outstanding token.
+CREATE TABLE IF NOT EXISTS email_verifications (
+    user_id INTEGER PRIMARY KEY,
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,324 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+const (
+	ReactionLike    = "like"
+	ReactionDislike = "dislike"
+)
+
+// AllowedReactions is the set of reactions users may leave on a message in
+// addition to like and dislike. Replace it before serving requests to change
+// which reactions are offered.
+var AllowedReactions = []string{"heart", "laugh", "celebrate", "confused"}
+
+// IsAllowedReaction reports whether reaction is like, dislike, or one of
+// AllowedReactions.
+func IsAllowedReaction(reaction string) bool {
+	if reaction == ReactionLike || reaction == ReactionDislike {
+		return true
+	}
+	for _, allowed := range AllowedReactions {
+		if reaction == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SQLiteStore) LikeMessage(ctx context.Context, messageID int, username string) error {
+	return s.AddReaction(ctx, messageID, username, ReactionLike)
+}
+
+func (s *SQLiteStore) DislikeMessage(ctx context.Context, messageID int, username string) error {
+	return s.AddReaction(ctx, messageID, username, ReactionDislike)
+}
+
+// AddReaction records username's reaction on a message. Like and dislike are
+// mutually exclusive, so adding one replaces the other. messages.likes is kept
+// at the number of likes minus the number of dislikes.
+func (s *SQLiteStore) AddReaction(ctx context.Context, messageID int, username, reaction string) error {
+	if !IsAllowedReaction(reaction) {
+		return ErrUnknownReaction
+	}
+
+	userID, err := s.lookupReactor(ctx, messageID, username)
+	if err != nil {
+		return err
+	}
+
+	var topicID int
+	var totals *models.MessageReactions
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		archived, err := messageArchived(ctx, tx, messageID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		var opposite string
+		switch reaction {
+		case ReactionLike:
+			opposite = ReactionDislike
+		case ReactionDislike:
+			opposite = ReactionLike
+		}
+		if opposite != "" {
+			_, err = tx.ExecContext(ctx, "DELETE FROM message_reactions WHERE user_id = ? AND message_id = ? AND reaction = ?", userID, messageID, opposite)
+			if err != nil {
+				log.Printf("error removing %s from message ID %d: %v", opposite, messageID, err)
+				return fmt.Errorf("could not remove opposite reaction: %w", err)
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, "INSERT INTO message_reactions (user_id, message_id, reaction) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", userID, messageID, reaction)
+		if err != nil {
+			log.Printf("error adding reaction to message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not add reaction: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			log.Printf("error checking rows affected: %v", err)
+			return fmt.Errorf("could not verify reaction: %w", err)
+		}
+		if rowsAffected == 0 {
+			return ErrReactionExists
+		}
+
+		err = updateMessageLikes(ctx, tx, messageID)
+		if err != nil {
+			return err
+		}
+
+		topicID, totals, err = s.reactionTotals(ctx, tx, messageID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s added to message ID %d by %s", reaction, messageID, username)
+	if totals != nil {
+		s.publish(topicID, EventMessageReactions, totals)
+	}
+	return nil
+}
+
+// RemoveReaction deletes username's reaction from a message.
+func (s *SQLiteStore) RemoveReaction(ctx context.Context, messageID int, username, reaction string) error {
+	userID, err := s.lookupReactor(ctx, messageID, username)
+	if err != nil {
+		return err
+	}
+
+	var topicID int
+	var totals *models.MessageReactions
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		archived, err := messageArchived(ctx, tx, messageID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		result, err := tx.ExecContext(ctx, "DELETE FROM message_reactions WHERE user_id = ? AND message_id = ? AND reaction = ?", userID, messageID, reaction)
+		if err != nil {
+			log.Printf("error removing reaction from message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not remove reaction: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			log.Printf("error checking rows affected: %v", err)
+			return fmt.Errorf("could not verify reaction removal: %w", err)
+		}
+		if rowsAffected == 0 {
+			return ErrReactionNotFound
+		}
+
+		err = updateMessageLikes(ctx, tx, messageID)
+		if err != nil {
+			return err
+		}
+
+		topicID, totals, err = s.reactionTotals(ctx, tx, messageID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if totals != nil {
+		s.publish(topicID, EventMessageReactions, totals)
+	}
+	return nil
+}
+
+// GetMessageReactions lists who reacted to a message and how, oldest first.
+func (s *SQLiteStore) GetMessageReactions(ctx context.Context, messageID int) ([]models.Reaction, error) {
+	err := s.messageExists(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT u.id, u.username, r.reaction, r.created_at
+						FROM message_reactions r JOIN users u ON u.id = r.user_id
+						WHERE r.message_id = ?
+						ORDER BY r.created_at, u.username`, messageID)
+	if err != nil {
+		log.Printf("error fetching reactions for message ID %d: %v", messageID, err)
+		return nil, fmt.Errorf("could not fetch reactions: %w", err)
+	}
+	defer rows.Close()
+
+	reactions := []models.Reaction{}
+	for rows.Next() {
+		var reaction models.Reaction
+		if err := rows.Scan(&reaction.UserID, &reaction.Username, &reaction.Reaction, &reaction.CreatedAt); err != nil {
+			log.Printf("error scanning reaction row: %v", err)
+			return nil, fmt.Errorf("could not scan reaction row: %w", err)
+		}
+		reactions = append(reactions, reaction)
+	}
+
+	return reactions, nil
+}
+
+// reactionCountsByTopic returns the per-reaction counts of every message in
+// a topic, keyed by message ID.
+func (s *SQLiteStore) reactionCountsByTopic(ctx context.Context, topicID int) (map[int]map[string]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT r.message_id, r.reaction, COUNT(*)
+						FROM message_reactions r JOIN messages m ON m.id = r.message_id
+						WHERE m.topic_id = ?
+						GROUP BY r.message_id, r.reaction`, topicID)
+	if err != nil {
+		log.Printf("error counting reactions for topic ID %d: %v", topicID, err)
+		return nil, fmt.Errorf("could not count reactions: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]map[string]int)
+	for rows.Next() {
+		var messageID int
+		var reaction string
+		var count int
+
+		if err := rows.Scan(&messageID, &reaction, &count); err != nil {
+			log.Printf("error scanning reaction count row: %v", err)
+			return nil, fmt.Errorf("could not scan reaction count row: %w", err)
+		}
+
+		if counts[messageID] == nil {
+			counts[messageID] = make(map[string]int)
+		}
+		counts[messageID][reaction] = count
+	}
+
+	return counts, nil
+}
+
+func (s *SQLiteStore) lookupReactor(ctx context.Context, messageID int, username string) (int, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		log.Printf("error fetching user ID: %v", err)
+		return 0, fmt.Errorf("could not fetch user ID: %w", err)
+	}
+
+	err = s.messageExists(ctx, messageID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+func (s *SQLiteStore) messageExists(ctx context.Context, messageID int) error {
+	var id int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM messages WHERE id = ?", messageID).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrMessageNotFound
+		}
+		log.Printf("error fetching message ID %d: %v", messageID, err)
+		return fmt.Errorf("could not fetch message: %w", err)
+	}
+	return nil
+}
+
+func updateMessageLikes(ctx context.Context, tx *sql.Tx, messageID int) error {
+	_, err := tx.ExecContext(ctx, `UPDATE messages SET likes = (
+						SELECT COALESCE(SUM(CASE reaction WHEN 'like' THEN 1 WHEN 'dislike' THEN -1 ELSE 0 END), 0)
+						FROM message_reactions WHERE message_id = ?)
+					WHERE id = ?`, messageID, messageID)
+	if err != nil {
+		log.Printf("error updating likes for message ID %d: %v", messageID, err)
+		return fmt.Errorf("could not update likes: %w", err)
+	}
+	return nil
+}
+
+// reactionTotals loads what an EventMessageReactions event reports about a
+// message. It returns a nil payload without querying when nothing is
+// listening for events.
+func (s *SQLiteStore) reactionTotals(ctx context.Context, tx *sql.Tx, messageID int) (int, *models.MessageReactions, error) {
+	if s.publisher == nil {
+		return 0, nil, nil
+	}
+
+	var topicID int
+	var likes sql.NullInt64
+	err := tx.QueryRowContext(ctx, "SELECT topic_id, likes FROM messages WHERE id = ?", messageID).Scan(&topicID, &likes)
+	if err != nil {
+		log.Printf("error fetching likes for message ID %d: %v", messageID, err)
+		return 0, nil, fmt.Errorf("could not fetch likes: %w", err)
+	}
+
+	reactions, err := reactionCounts(ctx, tx, messageID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	totals := &models.MessageReactions{MessageID: messageID, Likes: int(likes.Int64), Reactions: reactions}
+	return topicID, totals, nil
+}
+
+// reactionCounts returns how many of each reaction a message has.
+func reactionCounts(ctx context.Context, q querier, messageID int) (map[string]int, error) {
+	rows, err := q.QueryContext(ctx, "SELECT reaction, COUNT(*) FROM message_reactions WHERE message_id = ? GROUP BY reaction", messageID)
+	if err != nil {
+		log.Printf("error counting reactions for message ID %d: %v", messageID, err)
+		return nil, fmt.Errorf("could not count reactions: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var reaction string
+		var count int
+		if err := rows.Scan(&reaction, &count); err != nil {
+			log.Printf("error scanning reaction count row: %v", err)
+			return nil, fmt.Errorf("could not scan reaction count row: %w", err)
+		}
+		counts[reaction] = count
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading reaction counts: %v", err)
+		return nil, fmt.Errorf("could not read reaction counts: %w", err)
+	}
+	return counts, nil
+}
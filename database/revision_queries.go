@@ -0,0 +1,167 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// GetMessage returns a single message with its reaction counts.
+func (s *SQLiteStore) GetMessage(ctx context.Context, messageID int) (*models.Message, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+messageColumns+" FROM messages WHERE id = ?", messageID)
+	msg, err := scanMessage(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMessageNotFound
+		}
+		log.Printf("error fetching message ID %d: %v", messageID, err)
+		return nil, fmt.Errorf("could not fetch message: %w", err)
+	}
+
+	msg.Reactions, err = reactionCounts(ctx, s.db, messageID)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// EditMessage replaces a message's text on behalf of editor and returns the
+// updated message. The text it replaces is kept in message_revisions. Saving
+// the same text again changes nothing, and neither deleted messages nor
+// messages in archived topics can be edited.
+func (s *SQLiteStore) EditMessage(ctx context.Context, messageID int, editor, message string) (*models.Message, error) {
+	var edited *models.Message
+	var changed bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var editorID int
+		err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", editor).Scan(&editorID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			log.Printf("error fetching editor_id: %v", err)
+			return fmt.Errorf("could not fetch editor_id: %w", err)
+		}
+
+		var current sql.NullString
+		var deletedAt sql.NullTime
+		var topicID int
+		err = tx.QueryRowContext(ctx, "SELECT message, deleted_at, topic_id FROM messages WHERE id = ?", messageID).Scan(&current, &deletedAt, &topicID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMessageNotFound
+			}
+			log.Printf("error fetching message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not fetch message: %w", err)
+		}
+		if deletedAt.Valid {
+			return ErrMessageDeleted
+		}
+
+		_, archived, err := topicState(ctx, tx, topicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		if current.String != message {
+			changed = true
+
+			_, err = tx.ExecContext(ctx, "INSERT INTO message_revisions (message_id, message, editor_id) VALUES (?, ?, ?)", messageID, current, editorID)
+			if err != nil {
+				log.Printf("error saving revision of message ID %d: %v", messageID, err)
+				return fmt.Errorf("could not save revision: %w", err)
+			}
+
+			_, err = tx.ExecContext(ctx, "UPDATE messages SET message = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ?", message, messageID)
+			if err != nil {
+				log.Printf("error updating message ID %d: %v", messageID, err)
+				return fmt.Errorf("could not update message: %w", err)
+			}
+		}
+
+		edited, err = scanMessage(tx.QueryRowContext(ctx, "SELECT "+messageColumns+" FROM messages WHERE id = ?", messageID))
+		if err != nil {
+			log.Printf("error fetching edited message ID %d: %v", messageID, err)
+			return fmt.Errorf("could not fetch edited message: %w", err)
+		}
+
+		edited.Reactions, err = reactionCounts(ctx, tx, messageID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		log.Printf("message ID %d edited by %s", messageID, editor)
+		s.publish(edited.TopicID, EventMessageEdited, edited)
+	}
+	return edited, nil
+}
+
+// GetMessageRevisions returns every version of a message's text, oldest
+// first. The last one is the current text. A deleted message has no history
+// left, only its tombstone.
+func (s *SQLiteStore) GetMessageRevisions(ctx context.Context, messageID int) ([]models.MessageRevision, error) {
+	var original models.MessageRevision
+	var message sql.NullString
+	var authorID sql.NullInt64
+	var deletedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT message, user_id, timestamp, deleted_at FROM messages WHERE id = ?", messageID).
+		Scan(&message, &authorID, &original.EditedAt, &deletedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMessageNotFound
+		}
+		log.Printf("error fetching message ID %d: %v", messageID, err)
+		return nil, fmt.Errorf("could not fetch message: %w", err)
+	}
+	original.Version = 1
+	original.EditorID = int(authorID.Int64)
+
+	rows, err := s.db.QueryContext(ctx, "SELECT message, editor_id, edited_at FROM message_revisions WHERE message_id = ? ORDER BY id", messageID)
+	if err != nil {
+		log.Printf("error fetching revisions of message ID %d: %v", messageID, err)
+		return nil, fmt.Errorf("could not fetch revisions: %w", err)
+	}
+	defer rows.Close()
+
+	// Each revision row holds the text an edit replaced, along with who made
+	// that edit and when. The replaced text belongs to the version before
+	// the edit, and the editor and time to the version after it.
+	revisions := []models.MessageRevision{original}
+	for rows.Next() {
+		var previous sql.NullString
+		var editorID sql.NullInt64
+		var editedAt time.Time
+		if err := rows.Scan(&previous, &editorID, &editedAt); err != nil {
+			log.Printf("error scanning revision row: %v", err)
+			return nil, fmt.Errorf("could not scan revision row: %w", err)
+		}
+
+		last := &revisions[len(revisions)-1]
+		last.Message = previous.String
+		revisions = append(revisions, models.MessageRevision{
+			Version:  last.Version + 1,
+			EditorID: int(editorID.Int64),
+			EditedAt: editedAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading revision rows: %v", err)
+		return nil, fmt.Errorf("could not read revisions: %w", err)
+	}
+
+	revisions[len(revisions)-1].Message = message.String
+	if deletedAt.Valid {
+		revisions[len(revisions)-1].Message = models.MessageTombstone
+	}
+	return revisions, nil
+}
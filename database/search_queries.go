@@ -0,0 +1,234 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+const (
+	SearchTypeTopic   = "topic"
+	SearchTypeMessage = "message"
+
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+
+	// searchTimeFormat matches how SQLite's CURRENT_TIMESTAMP stores dates,
+	// so date filters compare correctly against the stored text.
+	searchTimeFormat = "2006-01-02 15:04:05"
+
+	// The FTS5 highlight functions wrap matches in these control characters.
+	// They are swapped for <mark> tags after the rest of the snippet has been
+	// HTML escaped.
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// SearchQuery describes a full-text search over topic titles and messages.
+type SearchQuery struct {
+	// Text is what the user typed. Words must all match, "quoted words"
+	// match as a phrase and a trailing * matches any word with that prefix.
+	Text string
+	// Type restricts hits to SearchTypeTopic or SearchTypeMessage. Empty
+	// searches both.
+	Type string
+	// Author keeps only hits written by this username.
+	Author string
+	// TopicID keeps only this topic and its messages.
+	TopicID int
+	// Since and Until bound when the hit was created. Since is inclusive,
+	// Until exclusive, and the zero time leaves that end open.
+	Since time.Time
+	Until time.Time
+	// Limit caps how many hits are returned.
+	Limit int
+}
+
+// ftsQuery turns text into an FTS5 match expression. Every term is quoted so
+// that FTS5 operators and column filters in user input are matched as plain
+// words rather than interpreted.
+func ftsQuery(text string) (string, error) {
+	var terms []string
+	addTerm := func(term string, prefix bool) {
+		term = strings.Join(strings.FieldsFunc(term, func(r rune) bool {
+			return r == '"' || unicode.IsSpace(r)
+		}), " ")
+		if term == "" {
+			return
+		}
+		quoted := `"` + term + `"`
+		if prefix {
+			quoted += "*"
+		}
+		terms = append(terms, quoted)
+	}
+
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		var term string
+		if strings.HasPrefix(rest, `"`) {
+			phrase, after, closed := strings.Cut(rest[1:], `"`)
+			if !closed {
+				after = ""
+			}
+			term, rest = phrase, after
+			if strings.HasPrefix(rest, "*") {
+				addTerm(term, true)
+				rest = rest[1:]
+			} else {
+				addTerm(term, false)
+			}
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			term, rest = rest[:end], rest[end:]
+			prefix := strings.HasSuffix(term, "*")
+			addTerm(strings.TrimRight(term, "*"), prefix)
+		}
+		rest = strings.TrimSpace(rest)
+	}
+
+	if len(terms) == 0 {
+		return "", ErrEmptySearch
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// Search runs a full-text search over topic titles and message text and
+// returns the best matching hits first.
+func (s *SQLiteStore) Search(ctx context.Context, q SearchQuery) ([]models.SearchHit, error) {
+	match, err := ftsQuery(q.Text)
+	if err != nil {
+		return nil, err
+	}
+	if q.Type != "" && q.Type != SearchTypeTopic && q.Type != SearchTypeMessage {
+		return nil, fmt.Errorf("unknown search type %q", q.Type)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	limit = min(limit, MaxSearchLimit)
+
+	var parts []string
+	var args []any
+	if q.Type != SearchTypeMessage {
+		query := `SELECT 'topic', t.id, t.id, t.title, COALESCE(t.slug, ''), COALESCE(u.username, ''),
+						highlight(topics_fts, 0, char(2), char(3)), bm25(topics_fts), t.creation_date
+					FROM topics_fts JOIN topics t ON t.id = topics_fts.rowid
+					LEFT JOIN users u ON u.id = t.creator_id
+					WHERE topics_fts MATCH ?`
+		filters, filterArgs := searchFilters(q, "t.creation_date")
+		parts = append(parts, query+filters)
+		args = append(append(args, match), filterArgs...)
+	}
+	if q.Type != SearchTypeTopic {
+		query := `SELECT 'message', m.id, m.topic_id, t.title, COALESCE(t.slug, ''), COALESCE(u.username, ''),
+						snippet(messages_fts, 0, char(2), char(3), '…', 16), bm25(messages_fts), m.timestamp
+					FROM messages_fts JOIN messages m ON m.id = messages_fts.rowid
+					JOIN topics t ON t.id = m.topic_id
+					LEFT JOIN users u ON u.id = m.user_id
+					WHERE messages_fts MATCH ?`
+		filters, filterArgs := searchFilters(q, "m.timestamp")
+		parts = append(parts, query+filters)
+		args = append(append(args, match), filterArgs...)
+	}
+
+	// bm25 scores are negative, with the best match lowest.
+	query := strings.Join(parts, " UNION ALL ") + " ORDER BY 8, 2 LIMIT ?"
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit)...)
+	if err != nil {
+		log.Printf("error searching for %q: %v", q.Text, err)
+		return nil, fmt.Errorf("could not search: %w", err)
+	}
+	defer rows.Close()
+
+	hits := []models.SearchHit{}
+	for rows.Next() {
+		var hit models.SearchHit
+		var snippet sql.NullString
+		var rank float64
+
+		err := rows.Scan(&hit.Type, &hit.ID, &hit.TopicID, &hit.TopicTitle, &hit.TopicSlug, &hit.Author, &snippet, &rank, &hit.CreatedAt)
+		if err != nil {
+			log.Printf("error scanning search hit: %v", err)
+			return nil, fmt.Errorf("could not scan search hit: %w", err)
+		}
+
+		hit.Snippet = highlightSnippet(snippet.String)
+		hit.Score = -rank
+		hits = append(hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading search hits: %v", err)
+		return nil, fmt.Errorf("could not read search hits: %w", err)
+	}
+
+	return hits, nil
+}
+
+// searchFilters returns the AND clauses and arguments for the author, topic
+// and date filters of q. created is the column holding the hit's creation
+// time.
+func searchFilters(q SearchQuery, created string) (string, []any) {
+	var clauses []string
+	var args []any
+	if q.Author != "" {
+		clauses = append(clauses, "u.username = ?")
+		args = append(args, q.Author)
+	}
+	if q.TopicID != 0 {
+		clauses = append(clauses, "t.id = ?")
+		args = append(args, q.TopicID)
+	}
+	if !q.Since.IsZero() {
+		clauses = append(clauses, created+" >= ?")
+		args = append(args, q.Since.UTC().Format(searchTimeFormat))
+	}
+	if !q.Until.IsZero() {
+		clauses = append(clauses, created+" < ?")
+		args = append(args, q.Until.UTC().Format(searchTimeFormat))
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(clauses, " AND "), args
+}
+
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>").Replace(escaped)
+}
+
+// RebuildSearchIndex regenerates the full-text index from the topics and
+// messages tables. The triggers keep it in sync during normal use; this is
+// for databases whose index has drifted or was restored without it.
+func (s *SQLiteStore) RebuildSearchIndex(ctx context.Context) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"topics_fts", "messages_fts"} {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES ('rebuild')", table, table))
+			if err != nil {
+				log.Printf("error rebuilding %s: %v", table, err)
+				return fmt.Errorf("could not rebuild search index: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("search index rebuilt successfully")
+	return nil
+}
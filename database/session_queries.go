@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// SessionTTL is how long a session token stays valid after login.
+const SessionTTL = 30 * 24 * time.Hour
+
+// CreateSession starts a new session for username and returns the opaque
+// token the client must present. Only a hash of the token is stored.
+func (s *SQLiteStore) CreateSession(ctx context.Context, username, userAgent string) (string, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrUserNotFound
+		}
+		log.Printf("error fetching user ID for %s: %v", username, err)
+		return "", fmt.Errorf("could not fetch user ID: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("error generating session token: %v", err)
+		return "", fmt.Errorf("could not generate session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	expiry := fmt.Sprintf("+%d seconds", int(SessionTTL.Seconds()))
+	_, err = s.db.ExecContext(ctx, "INSERT INTO sessions (user_id, token_hash, user_agent, expires_at) VALUES (?, ?, ?, datetime('now', ?))",
+		userID, hashToken(token), userAgent, expiry)
+	if err != nil {
+		log.Printf("error creating session for user %s: %v", username, err)
+		return "", fmt.Errorf("could not create session: %w", err)
+	}
+
+	log.Println("session created for user:", username)
+	return token, nil
+}
+
+// GetSessionUser resolves a session token to the user it belongs to and
+// records the time it was last used. Unknown and expired tokens both
+// return "invalid session".
+func (s *SQLiteStore) GetSessionUser(ctx context.Context, token string) (*models.User, error) {
+	var user models.User
+	err := s.db.QueryRowContext(ctx, `SELECT users.id, users.username, users.email_verified_at IS NOT NULL, users.role, users.creation_date FROM sessions
+						JOIN users ON users.id = sessions.user_id
+						WHERE sessions.token_hash = ? AND sessions.expires_at > datetime('now')`, hashToken(token)).
+		Scan(&user.ID, &user.Username, &user.EmailVerified, &user.Role, &user.CreationDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidSession
+		}
+		log.Printf("error fetching session: %v", err)
+		return nil, fmt.Errorf("could not fetch session: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, "UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		log.Printf("error updating last_used_at for session of user %s: %v", user.Username, err)
+		return nil, fmt.Errorf("could not update session: %w", err)
+	}
+
+	return &user, nil
+}
+
+func (s *SQLiteStore) DeleteSession(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		log.Printf("error deleting session: %v", err)
+		return fmt.Errorf("could not delete session: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserSessions logs a user out everywhere by removing all of their
+// sessions.
+func (s *SQLiteStore) DeleteUserSessions(ctx context.Context, userID int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		log.Printf("error deleting sessions for user ID %d: %v", userID, err)
+		return fmt.Errorf("could not delete sessions: %w", err)
+	}
+
+	log.Printf("all sessions deleted for user ID %d", userID)
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
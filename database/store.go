@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// ErrNotFound is wrapped by every "does not exist" error returned by a Store,
+// so callers that only care about the 404 case can test for it alone.
+var ErrNotFound = errors.New("not found")
+
+var (
+	ErrUserNotFound     = fmt.Errorf("user %w", ErrNotFound)
+	ErrEmailNotFound    = fmt.Errorf("email %w", ErrNotFound)
+	ErrTopicNotFound    = fmt.Errorf("topic %w", ErrNotFound)
+	ErrMessageNotFound  = fmt.Errorf("message %w", ErrNotFound)
+	ErrReactionNotFound = fmt.Errorf("reaction %w", ErrNotFound)
+	ErrTagNotFound      = fmt.Errorf("tag %w", ErrNotFound)
+	ErrCategoryNotFound = fmt.Errorf("category %w", ErrNotFound)
+
+	ErrUserExists          = errors.New("username or email already exists")
+	ErrEmailInUse          = errors.New("email is already in use")
+	ErrUsernameInUse       = errors.New("username is already in use")
+	ErrInvalidUsername     = errors.New("username does not meet requirements")
+	ErrInvalidEmail        = errors.New("email address is not valid")
+	ErrEmailVerified       = errors.New("email address is already verified")
+	ErrInvalidVerification = errors.New("invalid or expired verification token")
+	ErrIncorrectPassword   = errors.New("incorrect current password")
+	ErrInvalidResetCode    = errors.New("invalid reset code")
+	ErrInvalidSession      = errors.New("invalid session")
+	ErrInvalidRole         = errors.New("role must be 'user', 'moderator' or 'admin'")
+	ErrLastAdmin           = errors.New("cannot demote the last admin")
+
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotPending  = errors.New("two-factor enrolment has not been started")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrInvalidChallenge     = errors.New("invalid login challenge")
+	ErrInvalidTwoFactorRole = errors.New("required role must be empty, 'moderator' or 'admin'")
+
+	ErrTopicExists     = errors.New("topic title already exists")
+	ErrTopicLocked     = errors.New("topic is locked")
+	ErrTopicArchived   = errors.New("topic is archived")
+	ErrInvalidState    = errors.New("state must be 'locked', 'pinned' or 'archived'")
+	ErrSameTopic       = errors.New("a topic cannot be merged into itself")
+	ErrInvalidTag      = fmt.Errorf("tags must be 1 to %d characters of a-z, 0-9, '+', '#', '.' or '-'", models.MaxTagLength)
+	ErrTooManyTags     = fmt.Errorf("a topic can have at most %d tags", models.MaxTopicTags)
+	ErrVoteExists      = errors.New("vote already recorded")
+	ErrDifferentTopics = errors.New("messages are not in the same topic")
+	ErrReactionExists  = errors.New("reaction already recorded")
+	ErrUnknownReaction = errors.New("unknown reaction")
+	ErrThreadCycle     = errors.New("a message cannot be a reply to itself or its own replies")
+	ErrThreadTooDeep   = errors.New("thread is nested too deeply")
+	ErrMessageDeleted  = errors.New("message has been deleted")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrEmptySearch     = errors.New("search query has no words to match")
+
+	ErrCategoryExists   = errors.New("category name already exists")
+	ErrCategoryNotEmpty = errors.New("category still has topics or sub-categories")
+	ErrCategoryTooDeep  = errors.New("categories can only be nested one level deep")
+	ErrDefaultCategory  = errors.New("the default category cannot be removed")
+	ErrInvalidParent    = errors.New("parent must be another existing category")
+	ErrInvalidColor     = errors.New("color must be a hex colour such as #1e90ff")
+)
+
+type UserStore interface {
+	AddUser(ctx context.Context, username, email, password string) error
+	GetUser(ctx context.Context, username string) (*models.User, error)
+	GetAllUsers(ctx context.Context, opts ListOptions) ([]models.User, string, error)
+	CheckPassword(ctx context.Context, username, password string) (bool, error)
+	ChangePassword(ctx context.Context, username, currentPassword, newPassword string) error
+	ChangeEmail(ctx context.Context, username, newEmail string) (string, error)
+	CreateEmailVerification(ctx context.Context, username string) (string, string, error)
+	VerifyEmail(ctx context.Context, token string) (string, error)
+	ChangeUsername(ctx context.Context, username, newUsername string) error
+	RemoveUser(ctx context.Context, username string) error
+	SetRole(ctx context.Context, username, role string) error
+	GeneratePasswordResetCode(ctx context.Context, email string) (string, error)
+	ResetPassword(ctx context.Context, email, token, newPassword string) error
+}
+
+type TopicStore interface {
+	AddTopic(ctx context.Context, draft TopicDraft, username string) (*models.Topic, error)
+	RenameTopic(ctx context.Context, topicID int, title string) (*models.Topic, error)
+	SetTopicState(ctx context.Context, topicID int, state string, on bool) (*models.Topic, error)
+	RemoveTopic(ctx context.Context, topicID int) error
+	GetAllTopics(ctx context.Context, opts ListOptions) ([]models.Topic, string, error)
+	GetTopic(ctx context.Context, topicID int) (*models.Topic, error)
+	GetTopicBySlug(ctx context.Context, slug string) (*models.Topic, error)
+	GetMergedTopic(ctx context.Context, topicID int) (*models.Topic, error)
+	CountTopics(ctx context.Context) (int, error)
+	UpVoteTopic(ctx context.Context, topicID int, username string) error
+	DownVoteTopic(ctx context.Context, topicID int, username string) error
+	RetractTopicVote(ctx context.Context, topicID int, username string) error
+	GetTopicVote(ctx context.Context, topicID int, username string) (int, error)
+	SetTopicTags(ctx context.Context, topicID int, tags []string) ([]string, error)
+	MoveTopic(ctx context.Context, topicID, categoryID int) error
+	MergeTopic(ctx context.Context, topicID, targetID int) (*models.Topic, error)
+	SplitTopic(ctx context.Context, messageID int, draft TopicDraft, username string) (*models.Topic, error)
+}
+
+type CategoryStore interface {
+	AddCategory(ctx context.Context, draft CategoryDraft) (*models.Category, error)
+	UpdateCategory(ctx context.Context, id int, draft CategoryDraft) (*models.Category, error)
+	RemoveCategory(ctx context.Context, id int) error
+	GetCategory(ctx context.Context, id int) (*models.Category, error)
+	GetCategories(ctx context.Context) ([]models.Category, error)
+}
+
+type TagStore interface {
+	ListTags(ctx context.Context, prefix string, limit int) ([]models.Tag, error)
+	RenameTag(ctx context.Context, name, newName string) (*models.Tag, error)
+}
+
+type MessageStore interface {
+	AddMessage(ctx context.Context, topicID int, message, username string, parentID int) (*models.Message, error)
+	SetParent(ctx context.Context, parentID, childID int) error
+	GetMessagesByTopic(ctx context.Context, topicID int, opts ListOptions) ([]models.Message, string, error)
+	LikeMessage(ctx context.Context, messageID int, username string) error
+	DislikeMessage(ctx context.Context, messageID int, username string) error
+	AddReaction(ctx context.Context, messageID int, username, reaction string) error
+	RemoveReaction(ctx context.Context, messageID int, username, reaction string) error
+	GetMessageReactions(ctx context.Context, messageID int) ([]models.Reaction, error)
+	GetMessage(ctx context.Context, messageID int) (*models.Message, error)
+	EditMessage(ctx context.Context, messageID int, editor, message string) (*models.Message, error)
+	GetMessageRevisions(ctx context.Context, messageID int) ([]models.MessageRevision, error)
+	DeleteMessage(ctx context.Context, messageID int) error
+	PurgeMessage(ctx context.Context, messageID int) ([]int, error)
+}
+
+type ThreadStore interface {
+	GetThread(ctx context.Context, topicID int, opts ThreadOptions) (*models.Thread, error)
+}
+
+type SearchStore interface {
+	Search(ctx context.Context, q SearchQuery) ([]models.SearchHit, error)
+}
+
+type SessionStore interface {
+	CreateSession(ctx context.Context, username, userAgent string) (string, error)
+	GetSessionUser(ctx context.Context, token string) (*models.User, error)
+	DeleteSession(ctx context.Context, token string) error
+	DeleteUserSessions(ctx context.Context, userID int) error
+}
+
+type LoginStore interface {
+	LoginLockedUntil(ctx context.Context, username, ip string) (time.Time, error)
+	RecordLogin(ctx context.Context, attempt models.LoginAttempt) error
+	UnlockLogin(ctx context.Context, username string) error
+	GetLoginAttempts(ctx context.Context, username string, limit int) ([]models.LoginAttempt, error)
+}
+
+type TwoFactorStore interface {
+	BeginTwoFactor(ctx context.Context, username string) (string, error)
+	ConfirmTwoFactor(ctx context.Context, username, code string) ([]string, error)
+	TwoFactorEnabled(ctx context.Context, username string) (bool, error)
+	VerifyTwoFactor(ctx context.Context, username, code string) error
+	RegenerateRecoveryCodes(ctx context.Context, username string) ([]string, error)
+	DisableTwoFactor(ctx context.Context, username string) error
+	CreateLoginChallenge(ctx context.Context, username string) (string, error)
+	GetLoginChallenge(ctx context.Context, token string) (string, error)
+	DeleteLoginChallenge(ctx context.Context, token string) error
+	GetTwoFactorRole(ctx context.Context) (string, error)
+	SetTwoFactorRole(ctx context.Context, role string) error
+}
+
+// Store is everything the HTTP handlers need from persistence.
+type Store interface {
+	UserStore
+	TopicStore
+	TagStore
+	CategoryStore
+	MessageStore
+	ThreadStore
+	SearchStore
+	SessionStore
+	LoginStore
+	TwoFactorStore
+}
+
+// Kinds of event a Store publishes, each tagged with the topic it happened in.
+const (
+	// EventMessageCreated carries the new models.Message.
+	EventMessageCreated = "message.created"
+	// EventMessageReactions carries models.MessageReactions after a reaction
+	// is added or removed.
+	EventMessageReactions = "message.reactions"
+	// EventMessageEdited carries the edited models.Message.
+	EventMessageEdited = "message.edited"
+	// EventMessageDeleted carries models.MessageDeleted.
+	EventMessageDeleted = "message.deleted"
+	// EventMessagesPurged carries models.MessagesPurged.
+	EventMessagesPurged = "messages.purged"
+	// EventMessageMoved carries models.MessageMoved after SetParent.
+	EventMessageMoved = "message.moved"
+	// EventTopicVoted carries models.TopicScore after a vote changes.
+	EventTopicVoted = "topic.voted"
+	// EventTopicUpdated carries the models.Topic after it is renamed, locked,
+	// pinned or archived, or leaves one of those states.
+	EventTopicUpdated = "topic.updated"
+	// EventTopicMerged carries models.TopicMerged, published to the topic
+	// that no longer exists.
+	EventTopicMerged = "topic.merged"
+	// EventTopicSplit carries models.TopicSplit, published to the topic the
+	// messages were split out of.
+	EventTopicSplit = "topic.split"
+)
+
+// Publisher is told about every change once it has been committed. Publish
+// must not block.
+type Publisher interface {
+	Publish(topicID int, kind string, data any)
+}
+
+// SQLiteStore implements Store on top of a SQLite database that has been
+// brought up to date with MigrateUp.
+type SQLiteStore struct {
+	db          *sql.DB
+	publisher   Publisher
+	loginPolicy LoginPolicy
+}
+
+var _ Store = (*SQLiteStore)(nil)
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db, loginPolicy: DefaultLoginPolicy}
+}
+
+// SetPublisher makes the store report committed changes to p. Call it before
+// the store starts serving requests.
+func (s *SQLiteStore) SetPublisher(p Publisher) {
+	s.publisher = p
+}
+
+func (s *SQLiteStore) publish(topicID int, kind string, data any) {
+	if s.publisher != nil {
+		s.publisher.Publish(topicID, kind, data)
+	}
+}
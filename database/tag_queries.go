@@ -0,0 +1,322 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+const (
+	DefaultTagLimit = 10
+	MaxTagLimit     = 50
+)
+
+// NormalizeTags normalizes each tag with models.NormalizeTag and returns them
+// sorted with duplicates removed. It fails with ErrInvalidTag if any of them
+// is not a valid tag.
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		name, ok := models.NormalizeTag(tag)
+		if !ok {
+			return nil, ErrInvalidTag
+		}
+		normalized = append(normalized, name)
+	}
+
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// topicTags normalizes the tags a topic is to be filed under.
+func topicTags(tags []string) ([]string, error) {
+	normalized, err := NormalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if len(normalized) > models.MaxTopicTags {
+		return nil, ErrTooManyTags
+	}
+	return normalized, nil
+}
+
+// SetTopicTags replaces the tags of a topic and returns them as stored.
+func (s *SQLiteStore) SetTopicTags(ctx context.Context, topicID int, tags []string) ([]string, error) {
+	tags, err := topicTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		_, archived, err := topicState(ctx, tx, topicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		return replaceTopicTags(ctx, tx, topicID, tags)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("tags of topic ID %d set to %v", topicID, tags)
+	return tags, nil
+}
+
+// replaceTopicTags files a topic under exactly the given tags, creating any
+// that do not exist yet, and recounts every tag it gained or lost.
+func replaceTopicTags(ctx context.Context, tx *sql.Tx, topicID int, tags []string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT tag_id FROM topic_tags WHERE topic_id = ?", topicID)
+	if err != nil {
+		log.Printf("error fetching tags of topic ID %d: %v", topicID, err)
+		return fmt.Errorf("could not fetch topic tags: %w", err)
+	}
+	var touched []int
+	for rows.Next() {
+		var tagID int
+		if err := rows.Scan(&tagID); err != nil {
+			rows.Close()
+			log.Printf("error scanning tag ID: %v", err)
+			return fmt.Errorf("could not scan tag ID: %w", err)
+		}
+		touched = append(touched, tagID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading tags of topic ID %d: %v", topicID, err)
+		return fmt.Errorf("could not read topic tags: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM topic_tags WHERE topic_id = ?", topicID)
+	if err != nil {
+		log.Printf("error clearing tags of topic ID %d: %v", topicID, err)
+		return fmt.Errorf("could not clear topic tags: %w", err)
+	}
+
+	for _, name := range tags {
+		_, err = tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING", name)
+		if err != nil {
+			log.Printf("error creating tag '%s': %v", name, err)
+			return fmt.Errorf("could not create tag: %w", err)
+		}
+
+		var tagID int
+		err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", name).Scan(&tagID)
+		if err != nil {
+			log.Printf("error fetching tag '%s': %v", name, err)
+			return fmt.Errorf("could not fetch tag: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO topic_tags (topic_id, tag_id) VALUES (?, ?)", topicID, tagID)
+		if err != nil {
+			log.Printf("error tagging topic ID %d with '%s': %v", topicID, name, err)
+			return fmt.Errorf("could not tag topic: %w", err)
+		}
+		touched = append(touched, tagID)
+	}
+
+	return recountTags(ctx, tx, touched)
+}
+
+// recountTags recomputes topic_count for the given tags from topic_tags.
+func recountTags(ctx context.Context, tx *sql.Tx, tagIDs []int) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+
+	ids, args := inList(tagIDs)
+	_, err := tx.ExecContext(ctx, "UPDATE tags SET topic_count = (SELECT COUNT(*) FROM topic_tags WHERE tag_id = tags.id) WHERE id IN "+ids, args...)
+	if err != nil {
+		log.Printf("error recounting tags: %v", err)
+		return fmt.Errorf("could not recount tags: %w", err)
+	}
+	return nil
+}
+
+// loadTopicTags fills in the Tags of each topic, sorted by name.
+func loadTopicTags(ctx context.Context, q querier, topics []models.Topic) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	index := make(map[int]int, len(topics))
+	topicIDs := make([]int, len(topics))
+	for i, t := range topics {
+		index[t.ID] = i
+		topicIDs[i] = t.ID
+	}
+
+	ids, args := inList(topicIDs)
+	rows, err := q.QueryContext(ctx, `SELECT tt.topic_id, g.name FROM topic_tags tt JOIN tags g ON g.id = tt.tag_id
+					WHERE tt.topic_id IN `+ids+` ORDER BY g.name`, args...)
+	if err != nil {
+		log.Printf("error fetching topic tags: %v", err)
+		return fmt.Errorf("could not fetch topic tags: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var topicID int
+		var name string
+		if err := rows.Scan(&topicID, &name); err != nil {
+			log.Printf("error scanning topic tag row: %v", err)
+			return fmt.Errorf("could not scan topic tag row: %w", err)
+		}
+		t := &topics[index[topicID]]
+		t.Tags = append(t.Tags, name)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading topic tag rows: %v", err)
+		return fmt.Errorf("could not read topic tags: %w", err)
+	}
+	return nil
+}
+
+// topicTagCondition returns the condition matching topics, aliased as t,
+// that carry any of tags, or all of them if all is set.
+func topicTagCondition(tags []string, all bool) (string, []any, error) {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return "", nil, err
+	}
+
+	args := make([]any, len(tags))
+	for i, tag := range tags {
+		args[i] = tag
+	}
+
+	cond := `t.id IN (SELECT tt.topic_id FROM topic_tags tt JOIN tags g ON g.id = tt.tag_id
+					WHERE g.name IN (?` + strings.Repeat(", ?", len(tags)-1) + `)`
+	if all {
+		cond += " GROUP BY tt.topic_id HAVING COUNT(*) = ?"
+		args = append(args, len(tags))
+	}
+	return cond + ")", args, nil
+}
+
+// ListTags returns up to limit tags in use whose names start with prefix,
+// the most used first, for autocompleting tag fields.
+func (s *SQLiteStore) ListTags(ctx context.Context, prefix string, limit int) ([]models.Tag, error) {
+	if limit <= 0 {
+		limit = DefaultTagLimit
+	}
+	limit = min(limit, MaxTagLimit)
+
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(strings.TrimSpace(prefix))) + "%"
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, topic_count FROM tags
+					WHERE topic_count > 0 AND name LIKE ? ESCAPE '\'
+					ORDER BY topic_count DESC, name LIMIT ?`, pattern, limit)
+	if err != nil {
+		log.Printf("error fetching tags: %v", err)
+		return nil, fmt.Errorf("could not fetch tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Topics); err != nil {
+			log.Printf("error scanning tag row: %v", err)
+			return nil, fmt.Errorf("could not scan tag row: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading tag rows: %v", err)
+		return nil, fmt.Errorf("could not read tags: %w", err)
+	}
+
+	return tags, nil
+}
+
+// RenameTag renames a tag. If a tag called newName already exists the two
+// are merged: every topic filed under name moves to newName and name is
+// deleted.
+func (s *SQLiteStore) RenameTag(ctx context.Context, name, newName string) (*models.Tag, error) {
+	name, ok := models.NormalizeTag(name)
+	if !ok {
+		return nil, ErrTagNotFound
+	}
+	newName, ok = models.NormalizeTag(newName)
+	if !ok {
+		return nil, ErrInvalidTag
+	}
+
+	var tag models.Tag
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var tagID int
+		err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", name).Scan(&tagID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrTagNotFound
+			}
+			log.Printf("error fetching tag '%s': %v", name, err)
+			return fmt.Errorf("could not fetch tag: %w", err)
+		}
+
+		var targetID int
+		err = tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", newName).Scan(&targetID)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = tx.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", newName, tagID)
+			if err != nil {
+				log.Printf("error renaming tag '%s': %v", name, err)
+				return fmt.Errorf("could not rename tag: %w", err)
+			}
+			targetID = tagID
+		case err != nil:
+			log.Printf("error fetching tag '%s': %v", newName, err)
+			return fmt.Errorf("could not fetch tag: %w", err)
+		case targetID != tagID:
+			if err := mergeTag(ctx, tx, tagID, targetID); err != nil {
+				return err
+			}
+		}
+
+		err = tx.QueryRowContext(ctx, "SELECT id, name, topic_count FROM tags WHERE id = ?", targetID).Scan(&tag.ID, &tag.Name, &tag.Topics)
+		if err != nil {
+			log.Printf("error fetching tag ID %d: %v", targetID, err)
+			return fmt.Errorf("could not fetch tag: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("tag '%s' renamed to '%s'", name, tag.Name)
+	return &tag, nil
+}
+
+// mergeTag moves every topic filed under tagID to targetID and deletes
+// tagID. Topics that already carry both keep a single link.
+func mergeTag(ctx context.Context, tx *sql.Tx, tagID, targetID int) error {
+	_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO topic_tags (topic_id, tag_id)
+					SELECT topic_id, ? FROM topic_tags WHERE tag_id = ?`, targetID, tagID)
+	if err != nil {
+		log.Printf("error moving topics from tag ID %d to %d: %v", tagID, targetID, err)
+		return fmt.Errorf("could not merge tags: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM topic_tags WHERE tag_id = ?", tagID)
+	if err != nil {
+		log.Printf("error clearing tag ID %d: %v", tagID, err)
+		return fmt.Errorf("could not merge tags: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagID)
+	if err != nil {
+		log.Printf("error deleting tag ID %d: %v", tagID, err)
+		return fmt.Errorf("could not delete merged tag: %w", err)
+	}
+
+	return recountTags(ctx, tx, []int{targetID})
+}
@@ -0,0 +1,340 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+const (
+	// MaxThreadDepth is how deeply replies may nest. Top-level messages are
+	// at depth 0, so a reply at MaxThreadDepth cannot be replied to.
+	MaxThreadDepth = 8
+
+	DefaultThreadDepth = 3
+	DefaultThreadLimit = 20
+	MaxThreadLimit     = 100
+
+	ThreadSortTime  = "time"
+	ThreadSortLikes = "likes"
+)
+
+// ThreadOptions controls how much of a thread GetThread loads.
+type ThreadOptions struct {
+	// Depth is how many levels of replies to load beneath the first level.
+	// Zero loads the first level only.
+	Depth int
+	// Sort orders every level: ThreadSortTime (oldest first, the default) or
+	// ThreadSortLikes (most liked first).
+	Sort string
+	// Limit caps how many messages are returned per level.
+	Limit int
+	// Cursor continues a listing from Thread.NextCursor or a message's
+	// MoreReplies. It carries its own parent and sort order, which win over
+	// Sort.
+	Cursor string
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// threadCursor marks a position in the replies to parent (0 for the top
+// level). An ID of 0 means the start of the list.
+type threadCursor struct {
+	parent int
+	sort   string
+	likes  int
+	id     int
+}
+
+func (c threadCursor) encode() string {
+	raw := fmt.Sprintf("%d.%s.%d.%d", c.parent, c.sort, c.likes, c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeThreadCursor(cursor string) (threadCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return threadCursor{}, ErrInvalidCursor
+	}
+
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 4 || !validThreadSort(parts[1]) {
+		return threadCursor{}, ErrInvalidCursor
+	}
+
+	var nums [3]int
+	for i, part := range []string{parts[0], parts[2], parts[3]} {
+		nums[i], err = strconv.Atoi(part)
+		if err != nil {
+			return threadCursor{}, ErrInvalidCursor
+		}
+	}
+	if nums[0] < 0 || nums[2] < 0 {
+		return threadCursor{}, ErrInvalidCursor
+	}
+
+	return threadCursor{parent: nums[0], sort: parts[1], likes: nums[1], id: nums[2]}, nil
+}
+
+// threadOrders holds the ORDER BY clause for each thread sort.
+var threadOrders = map[string]string{
+	ThreadSortTime:  "id",
+	ThreadSortLikes: "COALESCE(likes, 0) DESC, id",
+}
+
+// after returns a condition matching the messages that come after the
+// cursor position, along with its arguments.
+func (c threadCursor) after() (string, []any) {
+	if c.id == 0 {
+		return "1", nil
+	}
+	if c.sort == ThreadSortLikes {
+		return "(COALESCE(likes, 0) < ? OR (COALESCE(likes, 0) = ? AND id > ?))", []any{c.likes, c.likes, c.id}
+	}
+	return "id > ?", []any{c.id}
+}
+
+func validThreadSort(s string) bool {
+	return s == ThreadSortTime || s == ThreadSortLikes
+}
+
+func sortThreadLevel(level []*models.ThreadMessage, by string) {
+	sort.Slice(level, func(i, j int) bool {
+		if by == ThreadSortLikes && level[i].Likes != level[j].Likes {
+			return level[i].Likes > level[j].Likes
+		}
+		return level[i].ID < level[j].ID
+	})
+}
+
+// GetThread returns a topic's messages as a tree. Without a cursor it starts
+// from the top-level messages; with one it continues the replies the cursor
+// points into.
+func (s *SQLiteStore) GetThread(ctx context.Context, topicID int, opts ThreadOptions) (*models.Thread, error) {
+	start := threadCursor{sort: opts.Sort}
+	if opts.Cursor != "" {
+		var err error
+		start, err = decodeThreadCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if start.sort == "" {
+		start.sort = ThreadSortTime
+	}
+	if !validThreadSort(start.sort) {
+		return nil, fmt.Errorf("unknown thread sort %q", start.sort)
+	}
+
+	depth := min(max(opts.Depth, 0), MaxThreadDepth)
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultThreadLimit
+	}
+	limit = min(limit, MaxThreadLimit)
+
+	var id int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM topics WHERE id = ?", topicID).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTopicNotFound
+		}
+		log.Printf("error fetching topic ID %d: %v", topicID, err)
+		return nil, fmt.Errorf("could not fetch topic: %w", err)
+	}
+
+	thread := &models.Thread{TopicID: topicID}
+	baseDepth := 0
+	var parent sql.NullInt64
+	if start.parent != 0 {
+		var parentTopicID int
+		err := s.db.QueryRowContext(ctx, "SELECT topic_id FROM messages WHERE id = ?", start.parent).Scan(&parentTopicID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("error fetching message ID %d: %v", start.parent, err)
+			return nil, fmt.Errorf("could not fetch message: %w", err)
+		}
+		if err == sql.ErrNoRows || parentTopicID != topicID {
+			return nil, ErrMessageNotFound
+		}
+
+		parentDepth, err := messageDepth(ctx, s.db, start.parent)
+		if err != nil {
+			return nil, err
+		}
+		baseDepth = parentDepth + 1
+
+		parentID := start.parent
+		thread.ParentID = &parentID
+		parent = sql.NullInt64{Int64: int64(parentID), Valid: true}
+	}
+
+	reactions, err := s.reactionCountsByTopic(ctx, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every level is numbered per parent in the order asked for, so the walk
+	// only descends into the limit+1 replies it may return; the extra one
+	// tells buildThreadLevel whether to hand out a cursor for the rest. The
+	// cursor only applies to the level it points into.
+	after, afterArgs := start.after()
+	args := append([]any{topicID, parent}, afterArgs...)
+	args = append(args, parent, limit+1, depth, limit+1)
+	rows, err := s.db.QueryContext(ctx, `WITH RECURSIVE ranked(id, parent_id, position) AS (
+						SELECT id, parent_id, ROW_NUMBER() OVER (PARTITION BY parent_id ORDER BY `+threadOrders[start.sort]+`)
+						FROM messages WHERE topic_id = ? AND (parent_id IS NOT ? OR `+after+`)
+					), thread(id, depth) AS (
+						SELECT id, 0 FROM ranked WHERE parent_id IS ? AND position <= ?
+						UNION ALL
+						SELECT r.id, t.depth + 1 FROM ranked r JOIN thread t ON r.parent_id = t.id
+						WHERE t.depth < ? AND r.position <= ?
+					)
+					SELECT `+messageColumnsAs("m")+`, t.depth,
+						(SELECT COUNT(*) FROM messages r WHERE r.parent_id = m.id)
+					FROM thread t JOIN messages m ON m.id = t.id`, args...)
+	if err != nil {
+		log.Printf("error fetching thread for topic ID %d: %v", topicID, err)
+		return nil, fmt.Errorf("could not fetch thread: %w", err)
+	}
+	defer rows.Close()
+
+	levels := make(map[int][]*models.ThreadMessage)
+	for rows.Next() {
+		var msg models.ThreadMessage
+		var message sql.NullString
+		var likes, userID, parentID sql.NullInt64
+		var editedAt, deletedAt sql.NullTime
+
+		err := rows.Scan(&msg.ID, &message, &msg.Timestamp, &likes, &userID, &parentID, &msg.TopicID, &editedAt, &deletedAt, &msg.Depth, &msg.ReplyCount)
+		if err != nil {
+			log.Printf("error scanning thread row: %v", err)
+			return nil, fmt.Errorf("could not scan thread row: %w", err)
+		}
+
+		msg.Message.Message = message.String
+		msg.Likes = int(likes.Int64)
+		msg.UserID = int(userID.Int64)
+		if editedAt.Valid {
+			msg.EditedAt = &editedAt.Time
+		}
+		if deletedAt.Valid {
+			msg.DeletedAt = &deletedAt.Time
+			msg.Message.Message = models.MessageTombstone
+		}
+		msg.Depth += baseDepth
+		msg.Reactions = reactions[msg.ID]
+		if msg.Reactions == nil {
+			msg.Reactions = map[string]int{}
+		}
+
+		key := 0
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			msg.ParentID = &id
+			key = id
+		}
+		levels[key] = append(levels[key], &msg)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading thread rows: %v", err)
+		return nil, fmt.Errorf("could not read thread: %w", err)
+	}
+
+	thread.Messages, thread.NextCursor = buildThreadLevel(levels, start, limit)
+	return thread, nil
+}
+
+// buildThreadLevel returns up to limit replies to from.parent, which the
+// query has already started at the cursor, each with its own replies
+// attached, and the cursor for the rest of the level if any were left out.
+func buildThreadLevel(levels map[int][]*models.ThreadMessage, from threadCursor, limit int) ([]models.ThreadMessage, string) {
+	level := levels[from.parent]
+	sortThreadLevel(level, from.sort)
+
+	var next string
+	if len(level) > limit {
+		level = level[:limit]
+		last := level[limit-1]
+		next = threadCursor{parent: from.parent, sort: from.sort, likes: last.Likes, id: last.ID}.encode()
+	}
+
+	messages := make([]models.ThreadMessage, 0, len(level))
+	for _, m := range level {
+		msg := *m
+		if _, loaded := levels[msg.ID]; loaded {
+			msg.Replies, msg.MoreReplies = buildThreadLevel(levels, threadCursor{parent: msg.ID, sort: from.sort}, limit)
+		} else {
+			msg.Replies = []models.ThreadMessage{}
+			if msg.ReplyCount > 0 {
+				msg.MoreReplies = threadCursor{parent: msg.ID, sort: from.sort}.encode()
+			}
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, next
+}
+
+// messageDepth returns how many ancestors a message has. The walk stops just
+// past MaxThreadDepth so a cycle left by older data cannot loop forever.
+func messageDepth(ctx context.Context, q querier, messageID int) (int, error) {
+	var depth int
+	err := q.QueryRowContext(ctx, `WITH RECURSIVE ancestors(id, depth) AS (
+						SELECT parent_id, 1 FROM messages WHERE id = ? AND parent_id IS NOT NULL
+						UNION ALL
+						SELECT m.parent_id, a.depth + 1 FROM messages m JOIN ancestors a ON m.id = a.id
+						WHERE m.parent_id IS NOT NULL AND a.depth <= ?
+					)
+					SELECT COALESCE(MAX(depth), 0) FROM ancestors`, messageID, MaxThreadDepth).Scan(&depth)
+	if err != nil {
+		log.Printf("error fetching depth of message ID %d: %v", messageID, err)
+		return 0, fmt.Errorf("could not fetch message depth: %w", err)
+	}
+	return depth, nil
+}
+
+// threadHeight returns how many levels of replies sit beneath a message.
+func threadHeight(ctx context.Context, q querier, messageID int) (int, error) {
+	var height int
+	err := q.QueryRowContext(ctx, `WITH RECURSIVE descendants(id, depth) AS (
+						SELECT id, 0 FROM messages WHERE id = ?
+						UNION ALL
+						SELECT m.id, d.depth + 1 FROM messages m JOIN descendants d ON m.parent_id = d.id
+						WHERE d.depth <= ?
+					)
+					SELECT MAX(depth) FROM descendants`, messageID, MaxThreadDepth).Scan(&height)
+	if err != nil {
+		log.Printf("error fetching replies beneath message ID %d: %v", messageID, err)
+		return 0, fmt.Errorf("could not fetch thread height: %w", err)
+	}
+	return height, nil
+}
+
+// isAncestor reports whether ancestorID is messageID or one of the messages
+// it replies to, directly or further up.
+func isAncestor(ctx context.Context, q querier, ancestorID, messageID int) (bool, error) {
+	var found bool
+	err := q.QueryRowContext(ctx, `WITH RECURSIVE chain(id) AS (
+						SELECT ?
+						UNION
+						SELECT m.parent_id FROM messages m JOIN chain c ON m.id = c.id
+						WHERE m.parent_id IS NOT NULL
+					)
+					SELECT EXISTS (SELECT 1 FROM chain WHERE id = ?)`, messageID, ancestorID).Scan(&found)
+	if err != nil {
+		log.Printf("error walking ancestors of message ID %d: %v", messageID, err)
+		return false, fmt.Errorf("could not check message ancestry: %w", err)
+	}
+	return found, nil
+}
@@ -1,199 +1,797 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
+
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/slug"
 )
 
-func CreateTopicTable(db *sql.DB) error {
-	query := `CREATE TABLE IF NOT EXISTS topics (
-    			id INTEGER PRIMARY KEY AUTOINCREMENT,
-    			title TEXT UNIQUE NOT NULL,
-    			messages INTEGER DEFAULT 0,
-				upvotes INTEGER DEFAULT 0,
-    			creation_date DATETIME DEFAULT CURRENT_TIMESTAMP,
-    			creator_id INTEGER,
-    			FOREIGN KEY (creator_id) REFERENCES users(id)
-			);`
-	_, err := db.Exec(query)
-	if err != nil {
-		log.Fatal("error creating topic table: ", err)
+// TopicDraft is a topic about to be opened. Only Title is required; a
+// CategoryID of 0 opens it in the default category.
+type TopicDraft struct {
+	Title       string
+	Description string
+	Body        string
+	Tags        []string
+	CategoryID  int
+}
+
+// AddTopic opens a topic on behalf of username, gives it a unique slug,
+// files it under the draft's tags and bumps their topics_opened counter in
+// the same transaction. It returns the topic as stored.
+func (s *SQLiteStore) AddTopic(ctx context.Context, draft TopicDraft, username string) (*models.Topic, error) {
+	tags, err := topicTags(draft.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if draft.CategoryID == 0 {
+		draft.CategoryID = models.DefaultCategoryID
+	}
+
+	var topic *models.Topic
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		topicID, err := insertTopic(ctx, tx, draft, tags, username)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET topics_opened = topics_opened + 1 WHERE username = ?", username)
+		if err != nil {
+			log.Printf("error incrementing topics_opened for user %s: %v", username, err)
+			return fmt.Errorf("could not increment topics_opened: %w", err)
+		}
+
+		topic, err = getTopic(ctx, tx, "id = ?", topicID)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	log.Println("topic added successfully:", draft.Title)
+	return topic, nil
 }
 
-func AddTopic(db *sql.DB, title, username string) error {
+// insertTopic opens a topic on behalf of username as described by AddTopic,
+// without bumping their topics_opened counter, and returns its ID. tags must
+// already be normalized and draft.CategoryID filled in.
+func insertTopic(ctx context.Context, tx *sql.Tx, draft TopicDraft, tags []string, username string) (int, error) {
 	var creatorID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&creatorID)
+	err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&creatorID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return errors.New("user not found")
+			return 0, ErrUserNotFound
 		}
 		log.Printf("error fetching creator_id: %v", err)
-		return fmt.Errorf("could not fetch creator_id: %w", err)
+		return 0, fmt.Errorf("could not fetch creator_id: %w", err)
 	}
 
 	var existingTitle string
-	err = db.QueryRow("SELECT title FROM topics WHERE title = ?", title).Scan(&existingTitle)
+	err = tx.QueryRowContext(ctx, "SELECT title FROM topics WHERE title = ?", draft.Title).Scan(&existingTitle)
 	if err == nil {
-		return errors.New("topic title already exists")
+		return 0, ErrTopicExists
 	} else if err != sql.ErrNoRows {
 		log.Printf("error checking if topic exists: %v", err)
-		return fmt.Errorf("could not check if topic exists: %w", err)
+		return 0, fmt.Errorf("could not check if topic exists: %w", err)
+	}
+
+	if _, err := getCategory(ctx, tx, draft.CategoryID); err != nil {
+		return 0, err
 	}
 
-	stmt, err := db.Prepare("INSERT INTO topics (title, creator_id) VALUES (?, ?)")
+	topicSlug, err := uniqueSlug(ctx, tx, 0, draft.Title)
 	if err != nil {
-		log.Printf("error preparing statement: %v", err)
-		return fmt.Errorf("could not prepare statement: %w", err)
+		return 0, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(title, creatorID)
+	res, err := tx.ExecContext(ctx, "INSERT INTO topics (title, slug, description, body, creator_id, category_id) VALUES (?, ?, ?, ?, ?, ?)",
+		draft.Title, topicSlug, draft.Description, draft.Body, creatorID, draft.CategoryID)
 	if err != nil {
 		log.Printf("error executing statement: %v", err)
-		return fmt.Errorf("could not execute statement: %w", err)
+		return 0, fmt.Errorf("could not execute statement: %w", err)
 	}
 
-	_, err = db.Exec("UPDATE users SET topics_opened = topics_opened + 1 WHERE id = ?", creatorID)
+	topicID, err := res.LastInsertId()
 	if err != nil {
-		log.Printf("error incrementing topics_opened for user ID %d: %v", creatorID, err)
-		return fmt.Errorf("could not increment topics_opened: %w", err)
+		log.Printf("error retrieving last insert ID: %v", err)
+		return 0, fmt.Errorf("could not retrieve topic ID: %w", err)
 	}
 
-	log.Println("topic added successfully:", title)
-	return nil
+	if err := replaceTopicTags(ctx, tx, int(topicID), tags); err != nil {
+		return 0, err
+	}
+	if err := recountCategories(ctx, tx, draft.CategoryID); err != nil {
+		return 0, err
+	}
+
+	return int(topicID), nil
 }
 
-func RemoveTopic(db *sql.DB, title string) error {
-	stmt, err := db.Prepare("DELETE FROM topics WHERE title = ?")
+// RenameTopic changes a topic's title and gives it the slug of the new
+// title. The old slug is kept so that GetTopicBySlug still finds the topic
+// under it.
+func (s *SQLiteStore) RenameTopic(ctx context.Context, topicID int, title string) (*models.Topic, error) {
+	var topic *models.Topic
+	var oldTitle string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var oldSlug sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT title, slug FROM topics WHERE id = ?", topicID).Scan(&oldTitle, &oldSlug)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrTopicNotFound
+			}
+			log.Printf("error fetching topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not fetch topic: %w", err)
+		}
+
+		_, archived, err := topicState(ctx, tx, topicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		var existingID int
+		err = tx.QueryRowContext(ctx, "SELECT id FROM topics WHERE title = ?", title).Scan(&existingID)
+		if err == nil && existingID != topicID {
+			return ErrTopicExists
+		} else if err != nil && err != sql.ErrNoRows {
+			log.Printf("error checking if topic exists: %v", err)
+			return fmt.Errorf("could not check if topic exists: %w", err)
+		}
+
+		topicSlug, err := uniqueSlug(ctx, tx, topicID, title)
+		if err != nil {
+			return err
+		}
+
+		if oldSlug.Valid && oldSlug.String != topicSlug {
+			_, err = tx.ExecContext(ctx, "INSERT INTO topic_slugs (slug, topic_id) VALUES (?, ?)", oldSlug.String, topicID)
+			if err != nil {
+				log.Printf("error keeping old slug of topic ID %d: %v", topicID, err)
+				return fmt.Errorf("could not keep old slug: %w", err)
+			}
+		}
+
+		// Renaming a topic back reclaims a slug it used before.
+		_, err = tx.ExecContext(ctx, "DELETE FROM topic_slugs WHERE slug = ?", topicSlug)
+		if err != nil {
+			log.Printf("error reclaiming slug '%s': %v", topicSlug, err)
+			return fmt.Errorf("could not reclaim slug: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET title = ?, slug = ? WHERE id = ?", title, topicSlug, topicID)
+		if err != nil {
+			log.Printf("error renaming topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not rename topic: %w", err)
+		}
+
+		topic, err = getTopic(ctx, tx, "id = ?", topicID)
+		return err
+	})
 	if err != nil {
-		log.Printf("error preparing statement: %v", err)
-		return fmt.Errorf("could not prepare statement: %w", err)
+		return nil, err
 	}
-	defer stmt.Close()
 
-	res, err := stmt.Exec(title)
+	log.Printf("topic '%s' renamed to '%s'", oldTitle, title)
+	s.publish(topic.ID, EventTopicUpdated, topic)
+	return topic, nil
+}
+
+// topicStateColumns holds the column recording when a topic entered each
+// state.
+var topicStateColumns = map[string]string{
+	models.TopicLocked:   "locked_at",
+	models.TopicPinned:   "pinned_at",
+	models.TopicArchived: "archived_at",
+}
+
+// SetTopicState puts a topic in state, one of the models.Topic* states, or
+// takes it out of it. Entering a state the topic is already in keeps the
+// original time. Unarchiving a topic counts as activity, so
+// ArchiveInactiveTopics leaves it alone for another full period.
+func (s *SQLiteStore) SetTopicState(ctx context.Context, topicID int, state string, on bool) (*models.Topic, error) {
+	column, ok := topicStateColumns[state]
+	if !ok {
+		return nil, ErrInvalidState
+	}
+
+	var topic *models.Topic
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if on {
+			_, err = tx.ExecContext(ctx, "UPDATE topics SET "+column+" = COALESCE("+column+", CURRENT_TIMESTAMP) WHERE id = ?", topicID)
+		} else if state == models.TopicArchived {
+			_, err = tx.ExecContext(ctx, `UPDATE topics SET unarchived_at = CASE WHEN archived_at IS NULL THEN unarchived_at ELSE CURRENT_TIMESTAMP END,
+							archived_at = NULL WHERE id = ?`, topicID)
+		} else {
+			_, err = tx.ExecContext(ctx, "UPDATE topics SET "+column+" = NULL WHERE id = ?", topicID)
+		}
+		if err != nil {
+			log.Printf("error setting %s of topic ID %d: %v", column, topicID, err)
+			return fmt.Errorf("could not update topic state: %w", err)
+		}
+
+		topic, err = getTopic(ctx, tx, "id = ?", topicID)
+		return err
+	})
 	if err != nil {
-		log.Printf("error executing statement: %v", err)
-		return fmt.Errorf("could not execute statement: %w", err)
+		return nil, err
+	}
+
+	log.Printf("topic ID %d %s set to %t", topicID, state, on)
+	s.publish(topic.ID, EventTopicUpdated, topic)
+	return topic, nil
+}
+
+// topicActivity is the Unix time of a topic's latest activity, with topics
+// aliased as t: its newest message, its creation or its last unarchiving,
+// whichever came last.
+const topicActivity = `MAX(CAST(strftime('%s', t.creation_date) AS INTEGER),
+				COALESCE(CAST(strftime('%s', (SELECT MAX(m.timestamp) FROM messages m WHERE m.topic_id = t.id)) AS INTEGER), 0),
+				COALESCE(CAST(strftime('%s', t.unarchived_at) AS INTEGER), 0))`
+
+// ArchiveInactiveTopics archives every topic with no activity since before,
+// leaving pinned topics alone, and returns how many it archived. It is run
+// periodically by the server.
+func (s *SQLiteStore) ArchiveInactiveTopics(ctx context.Context, before time.Time) (int, error) {
+	var archived []int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT t.id FROM topics t
+						WHERE t.archived_at IS NULL AND t.pinned_at IS NULL AND `+topicActivity+` < ?`, before.Unix())
+		if err != nil {
+			log.Printf("error fetching inactive topics: %v", err)
+			return fmt.Errorf("could not fetch inactive topics: %w", err)
+		}
+		for rows.Next() {
+			var topicID int
+			if err := rows.Scan(&topicID); err != nil {
+				rows.Close()
+				log.Printf("error scanning topic ID: %v", err)
+				return fmt.Errorf("could not scan topic ID: %w", err)
+			}
+			archived = append(archived, topicID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Printf("error reading inactive topics: %v", err)
+			return fmt.Errorf("could not read inactive topics: %w", err)
+		}
+		if len(archived) == 0 {
+			return nil
+		}
+
+		ids, args := inList(archived)
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET archived_at = CURRENT_TIMESTAMP WHERE id IN "+ids, args...)
+		if err != nil {
+			log.Printf("error archiving inactive topics: %v", err)
+			return fmt.Errorf("could not archive topics: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, topicID := range archived {
+		topic, err := s.GetTopic(ctx, topicID)
+		if err != nil {
+			continue
+		}
+		s.publish(topicID, EventTopicUpdated, topic)
+	}
+	if len(archived) > 0 {
+		log.Printf("archived %d inactive topics", len(archived))
+	}
+	return len(archived), nil
+}
+
+// topicState reports whether a topic is locked and whether it is archived.
+func topicState(ctx context.Context, q querier, topicID int) (locked, archived bool, err error) {
+	err = q.QueryRowContext(ctx, "SELECT locked_at IS NOT NULL, archived_at IS NOT NULL FROM topics WHERE id = ?", topicID).Scan(&locked, &archived)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, false, ErrTopicNotFound
+		}
+		log.Printf("error fetching state of topic ID %d: %v", topicID, err)
+		return false, false, fmt.Errorf("could not fetch topic state: %w", err)
 	}
+	return locked, archived, nil
+}
 
-	rowsAffected, err := res.RowsAffected()
+// messageArchived reports whether the topic a message belongs to is
+// archived.
+func messageArchived(ctx context.Context, q querier, messageID int) (bool, error) {
+	var archived bool
+	err := q.QueryRowContext(ctx, `SELECT t.archived_at IS NOT NULL FROM messages m JOIN topics t ON t.id = m.topic_id
+					WHERE m.id = ?`, messageID).Scan(&archived)
 	if err != nil {
-		log.Printf("error retrieving rows affected: %v", err)
-		return fmt.Errorf("could not retrieve rows affected: %w", err)
+		if err == sql.ErrNoRows {
+			return false, ErrMessageNotFound
+		}
+		log.Printf("error fetching topic state of message ID %d: %v", messageID, err)
+		return false, fmt.Errorf("could not fetch topic state: %w", err)
 	}
+	return archived, nil
+}
 
-	if rowsAffected == 0 {
-		log.Printf("no topic found with title: %s", title)
-		return fmt.Errorf("no topic found with title: %s", title)
+// uniqueSlug returns the slug for title, suffixed with -2, -3 and so on
+// until it is used by no topic other than topicID, either as its current
+// slug or as an old one. Pass 0 for a topic that does not exist yet.
+func uniqueSlug(ctx context.Context, tx *sql.Tx, topicID int, title string) (string, error) {
+	base := slug.Make(title)
+	for n := 1; ; n++ {
+		candidate := slug.WithSuffix(base, n)
+
+		var taken bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM topics WHERE slug = ? AND id != ?)
+						OR EXISTS (SELECT 1 FROM topic_slugs WHERE slug = ? AND topic_id != ?)`,
+			candidate, topicID, candidate, topicID).Scan(&taken)
+		if err != nil {
+			log.Printf("error checking if slug '%s' is taken: %v", candidate, err)
+			return "", fmt.Errorf("could not check slug: %w", err)
+		}
+		if !taken {
+			return candidate, nil
+		}
 	}
+}
 
-	log.Println("topic removed successfully:", title)
+// BackfillTopicSlugs gives a slug to every topic that does not have one yet,
+// which is every topic created before slugs were introduced. It is run at
+// startup, after MigrateUp.
+func (s *SQLiteStore) BackfillTopicSlugs(ctx context.Context) error {
+	var count int
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT id, title FROM topics WHERE slug IS NULL ORDER BY id")
+		if err != nil {
+			log.Printf("error fetching topics without slugs: %v", err)
+			return fmt.Errorf("could not fetch topics without slugs: %w", err)
+		}
+		var topics []models.Topic
+		for rows.Next() {
+			var topic models.Topic
+			if err := rows.Scan(&topic.ID, &topic.Title); err != nil {
+				rows.Close()
+				log.Printf("error scanning topic row: %v", err)
+				return fmt.Errorf("could not scan topic row: %w", err)
+			}
+			topics = append(topics, topic)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Printf("error reading topic rows: %v", err)
+			return fmt.Errorf("could not read topics: %w", err)
+		}
+
+		for _, topic := range topics {
+			topicSlug, err := uniqueSlug(ctx, tx, topic.ID, topic.Title)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE topics SET slug = ? WHERE id = ?", topicSlug, topic.ID)
+			if err != nil {
+				log.Printf("error setting slug of topic ID %d: %v", topic.ID, err)
+				return fmt.Errorf("could not set topic slug: %w", err)
+			}
+		}
+		count = len(topics)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		log.Printf("generated slugs for %d topics", count)
+	}
 	return nil
 }
 
-func UpVoteTopic(db *sql.DB, title, username string) error {
-	stmt, err := db.Prepare("UPDATE topics SET upvotes = upvotes + 1 WHERE title = ?")
+// RemoveTopic deletes a topic and takes it off the counts of its tags and
+// category.
+func (s *SQLiteStore) RemoveTopic(ctx context.Context, topicID int) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var categoryID int
+		err := tx.QueryRowContext(ctx, "SELECT category_id FROM topics WHERE id = ?", topicID).Scan(&categoryID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				log.Printf("no topic found with ID: %d", topicID)
+				return ErrTopicNotFound
+			}
+			log.Printf("error fetching topic ID: %v", err)
+			return fmt.Errorf("could not fetch topic ID: %w", err)
+		}
+
+		if err := replaceTopicTags(ctx, tx, topicID, nil); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM topics WHERE id = ?", topicID)
+		if err != nil {
+			log.Printf("error executing statement: %v", err)
+			return fmt.Errorf("could not execute statement: %w", err)
+		}
+
+		return recountCategories(ctx, tx, categoryID)
+	})
 	if err != nil {
-		log.Printf("error preparing statement: %v", err)
-		return fmt.Errorf("could not prepare statement: %w", err)
+		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(title)
+	log.Printf("topic ID %d removed successfully", topicID)
+	return nil
+}
+
+// UpVoteTopic records an upvote by username. A user who has already
+// downvoted the topic switches their vote; upvoting twice is rejected.
+func (s *SQLiteStore) UpVoteTopic(ctx context.Context, topicID int, username string) error {
+	err := s.voteTopic(ctx, topicID, username, 1)
 	if err != nil {
-		log.Printf("error executing statement: %v", err)
-		return fmt.Errorf("could not execute statement: %w", err)
+		return err
 	}
 
-	log.Println("upvote added successfully for topic:", title)
+	log.Printf("upvote added successfully for topic ID %d", topicID)
 	return nil
 }
 
-func DownVoteTopic(db *sql.DB, title, username string) error {
-	stmt, err := db.Prepare("UPDATE topics SET upvotes = upvotes - 1 WHERE title = ?")
+// DownVoteTopic is the downvote counterpart of UpVoteTopic.
+func (s *SQLiteStore) DownVoteTopic(ctx context.Context, topicID int, username string) error {
+	err := s.voteTopic(ctx, topicID, username, -1)
 	if err != nil {
-		log.Printf("error preparing statement: %v", err)
-		return fmt.Errorf("could not prepare statement: %w", err)
+		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(title)
+	log.Printf("downvote added successfully for topic ID %d", topicID)
+	return nil
+}
+
+// RetractTopicVote removes whatever vote username has on the topic.
+func (s *SQLiteStore) RetractTopicVote(ctx context.Context, topicID int, username string) error {
+	err := s.voteTopic(ctx, topicID, username, 0)
 	if err != nil {
-		log.Printf("error executing statement: %v", err)
-		return fmt.Errorf("could not execute statement: %w", err)
+		return err
 	}
 
-	log.Println("downvote added successfully for topic:", title)
+	log.Printf("vote retracted successfully for topic ID %d", topicID)
 	return nil
 }
 
-func GetAllTopics(db *sql.DB) ([]map[string]interface{}, error) {
-	rows, err := db.Query("SELECT id, title, messages, upvotes, creation_date, creator_id FROM topics")
+// GetTopicVote returns username's vote on the topic: 1, -1, or 0 if they
+// have not voted.
+func (s *SQLiteStore) GetTopicVote(ctx context.Context, topicID int, username string) (int, error) {
+	userID, err := s.lookupVoter(ctx, topicID, username)
+	if err != nil {
+		return 0, err
+	}
+
+	var value int
+	err = s.db.QueryRowContext(ctx, "SELECT value FROM topic_votes WHERE user_id = ? AND topic_id = ?", userID, topicID).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		log.Printf("error fetching vote for topic ID %d: %v", topicID, err)
+		return 0, fmt.Errorf("could not fetch vote: %w", err)
+	}
+
+	return value, nil
+}
+
+// lookupVoter returns the ID of username after checking that both they and
+// the topic exist.
+func (s *SQLiteStore) lookupVoter(ctx context.Context, topicID int, username string) (int, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		log.Printf("error fetching user ID: %v", err)
+		return 0, fmt.Errorf("could not fetch user ID: %w", err)
+	}
+
+	var exists bool
+	err = s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM topics WHERE id = ?)", topicID).Scan(&exists)
+	if err != nil {
+		log.Printf("error checking topic ID %d: %v", topicID, err)
+		return 0, fmt.Errorf("could not check topic: %w", err)
+	}
+	if !exists {
+		return 0, ErrTopicNotFound
+	}
+
+	return userID, nil
+}
+
+// voteTopic sets username's vote on the topic to value (1, -1, or 0 to
+// retract) and recomputes topics.upvotes from the ledger in the same
+// transaction.
+func (s *SQLiteStore) voteTopic(ctx context.Context, topicID int, username string, value int) error {
+	userID, err := s.lookupVoter(ctx, topicID, username)
+	if err != nil {
+		return err
+	}
+
+	var upvotes int
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		_, archived, err := topicState(ctx, tx, topicID)
+		if err != nil {
+			return err
+		}
+		if archived {
+			return ErrTopicArchived
+		}
+
+		var current int
+		err = tx.QueryRowContext(ctx, "SELECT value FROM topic_votes WHERE user_id = ? AND topic_id = ?", userID, topicID).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("error fetching current vote: %v", err)
+			return fmt.Errorf("could not fetch current vote: %w", err)
+		}
+
+		if value != 0 && current == value {
+			return ErrVoteExists
+		}
+
+		if value == 0 {
+			_, err = tx.ExecContext(ctx, "DELETE FROM topic_votes WHERE user_id = ? AND topic_id = ?", userID, topicID)
+		} else {
+			_, err = tx.ExecContext(ctx, `INSERT INTO topic_votes (user_id, topic_id, value) VALUES (?, ?, ?)
+							ON CONFLICT (user_id, topic_id) DO UPDATE SET value = excluded.value, created_at = CURRENT_TIMESTAMP`,
+				userID, topicID, value)
+		}
+		if err != nil {
+			log.Printf("error recording vote for topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not record vote: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET upvotes = (SELECT COALESCE(SUM(value), 0) FROM topic_votes WHERE topic_id = ?) WHERE id = ?", topicID, topicID)
+		if err != nil {
+			log.Printf("error updating score for topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not update topic score: %w", err)
+		}
+
+		err = tx.QueryRowContext(ctx, "SELECT COALESCE(upvotes, 0) FROM topics WHERE id = ?", topicID).Scan(&upvotes)
+		if err != nil {
+			log.Printf("error fetching score for topic ID %d: %v", topicID, err)
+			return fmt.Errorf("could not fetch topic score: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publish(topicID, EventTopicVoted, models.TopicScore{TopicID: topicID, Upvotes: upvotes})
+	return nil
+}
+
+// topicSortKeys holds the sort_key expression for each topic listing order.
+var topicSortKeys = map[string]string{
+	SortRecent: "t.id",
+	SortOldest: "t.id",
+	SortTop:    "COALESCE(t.upvotes, 0)",
+	SortActive: "CAST(strftime('%s', COALESCE((SELECT MAX(m.timestamp) FROM messages m WHERE m.topic_id = t.id), t.creation_date)) AS INTEGER)",
+}
+
+// topicFilter returns the WHERE clause restricting a topic listing, with
+// topics aliased as t, to the category and tags opts asks for and to any
+// further conditions in conds.
+func topicFilter(opts ListOptions, conds ...string) (string, []any, error) {
+	var args []any
+
+	if opts.CategoryID != 0 {
+		conds = append(conds, "t.category_id IN (SELECT id FROM categories WHERE id = ? OR parent_id = ?)")
+		args = append(args, opts.CategoryID, opts.CategoryID)
+	}
+
+	if len(opts.Tags) > 0 {
+		cond, tagArgs, err := topicTagCondition(opts.Tags, opts.AllTags)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, tagArgs...)
+	}
+
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// GetAllTopics returns one page of topics in the order opts asks for,
+// along with the cursor for the next page or "" if this is the last one.
+// Pinned topics matching opts head the first page, most recently pinned
+// first and on top of its limit, and are left out of the pages themselves.
+func (s *SQLiteStore) GetAllTopics(ctx context.Context, opts ListOptions) ([]models.Topic, string, error) {
+	start, limit, err := opts.Start()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if opts.CategoryID != 0 {
+		if _, err := getCategory(ctx, s.db, opts.CategoryID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	topics := []models.Topic{}
+	if start.ID == 0 {
+		topics, err = s.pinnedTopics(ctx, opts)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	pinned := len(topics)
+
+	filter, filterArgs, err := topicFilter(opts, "t.pinned_at IS NULL")
+	if err != nil {
+		return nil, "", err
+	}
+
+	query, args := pageQuery("SELECT "+topicColumnsAs("t")+", "+topicSortKeys[start.Sort]+" AS sort_key FROM topics t"+filter, start, limit, filterArgs...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Printf("error fetching topics: %v", err)
-		return nil, fmt.Errorf("could not fetch topics: %w", err)
+		return nil, "", fmt.Errorf("could not fetch topics: %w", err)
 	}
 	defer rows.Close()
 
-	var topics []map[string]interface{}
+	var keys []int64
 	for rows.Next() {
-		var id, messages, upvotes, creatorID sql.NullInt64
-		var title, creationDate string
-
-		if err := rows.Scan(&id, &title, &messages, &upvotes, &creationDate, &creatorID); err != nil {
+		var key int64
+		topic, err := scanTopic(keyedScanner{rows, &key})
+		if err != nil {
 			log.Printf("error scanning topic row: %v", err)
-			return nil, fmt.Errorf("could not scan topic row: %w", err)
+			return nil, "", fmt.Errorf("could not scan topic row: %w", err)
 		}
+		topics = append(topics, *topic)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading topic rows: %v", err)
+		return nil, "", fmt.Errorf("could not read topics: %w", err)
+	}
 
-		topic := map[string]interface{}{
-			"id":            id.Int64,
-			"title":         title,
-			"messages":      messages.Int64,
-			"upvotes":       upvotes.Int64,
-			"creation_date": creationDate,
-			"creator_id":    creatorID.Int64,
-		}
-		topics = append(topics, topic)
+	var next string
+	if len(keys) > limit {
+		topics = topics[:pinned+limit]
+		next = ListCursor{Sort: start.Sort, Key: keys[limit-1], ID: topics[pinned+limit-1].ID}.Encode()
+	}
+
+	if err := loadTopicTags(ctx, s.db, topics); err != nil {
+		return nil, "", err
+	}
+	return topics, next, nil
+}
+
+// pinnedTopics returns the pinned topics matching opts, most recently pinned
+// first, without their tags.
+func (s *SQLiteStore) pinnedTopics(ctx context.Context, opts ListOptions) ([]models.Topic, error) {
+	filter, args, err := topicFilter(opts, "t.pinned_at IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+topicColumnsAs("t")+" FROM topics t"+filter+" ORDER BY t.pinned_at DESC, t.id DESC", args...)
+	if err != nil {
+		log.Printf("error fetching pinned topics: %v", err)
+		return nil, fmt.Errorf("could not fetch pinned topics: %w", err)
 	}
+	defer rows.Close()
 
+	topics := []models.Topic{}
+	for rows.Next() {
+		topic, err := scanTopic(rows)
+		if err != nil {
+			log.Printf("error scanning topic row: %v", err)
+			return nil, fmt.Errorf("could not scan topic row: %w", err)
+		}
+		topics = append(topics, *topic)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading pinned topics: %v", err)
+		return nil, fmt.Errorf("could not read pinned topics: %w", err)
+	}
 	return topics, nil
 }
 
-func GetTopicByTitle(db *sql.DB, title string) (map[string]interface{}, error) {
-	var id, messages, upvotes, creatorID sql.NullInt64
-	var creationDate string
+// GetTopic returns a topic along with its tags.
+func (s *SQLiteStore) GetTopic(ctx context.Context, topicID int) (*models.Topic, error) {
+	return getTopic(ctx, s.db, "id = ?", topicID)
+}
+
+// GetTopicBySlug returns the topic whose slug is slug, or that used slug
+// before it was renamed. In the latter case the returned topic's Slug
+// differs from the one asked for, which callers can use to redirect to the
+// current one.
+func (s *SQLiteStore) GetTopicBySlug(ctx context.Context, slug string) (*models.Topic, error) {
+	topic, err := getTopic(ctx, s.db, "slug = ?", slug)
+	if err != ErrTopicNotFound {
+		return topic, err
+	}
+	return getTopic(ctx, s.db, "id = (SELECT topic_id FROM topic_slugs WHERE slug = ?)", slug)
+}
 
-	err := db.QueryRow("SELECT id, messages, upvotes, creation_date, creator_id FROM topics WHERE title = ?", title).
-		Scan(&id, &messages, &upvotes, &creationDate, &creatorID)
+// GetMergedTopic returns the topic that topicID was merged into, which
+// callers can use to redirect links to a topic that no longer exists.
+func (s *SQLiteStore) GetMergedTopic(ctx context.Context, topicID int) (*models.Topic, error) {
+	return getTopic(ctx, s.db, "id = (SELECT target_id FROM topic_redirects WHERE topic_id = ?)", topicID)
+}
+
+// getTopic returns the topic matching where, along with its tags.
+func getTopic(ctx context.Context, q querier, where string, args ...any) (*models.Topic, error) {
+	topic, err := scanTopic(q.QueryRowContext(ctx, "SELECT "+topicColumns+" FROM topics WHERE "+where, args...))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("topic with title '%s' not found", title)
+			return nil, ErrTopicNotFound
 		}
-		log.Printf("error fetching topic by title '%s': %v", title, err)
+		log.Printf("error fetching topic: %v", err)
 		return nil, fmt.Errorf("could not fetch topic: %w", err)
 	}
 
-	topic := map[string]interface{}{
-		"id":            id.Int64,
-		"title":         title,
-		"messages":      messages.Int64,
-		"upvotes":       upvotes.Int64,
-		"creation_date": creationDate,
-		"creator_id":    creatorID.Int64,
+	topics := []models.Topic{*topic}
+	if err := loadTopicTags(ctx, q, topics); err != nil {
+		return nil, err
 	}
+	return &topics[0], nil
+}
 
-	return topic, nil
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// topicColumns lists the columns scanTopic expects, in order.
+const topicColumns = "id, title, slug, description, body, category_id, messages, upvotes, creation_date, creator_id, locked_at, pinned_at, archived_at"
+
+// topicColumnsAs is topicColumns qualified with a table alias.
+func topicColumnsAs(alias string) string {
+	return alias + "." + strings.ReplaceAll(topicColumns, ", ", ", "+alias+".")
+}
+
+func scanTopic(row scanner) (*models.Topic, error) {
+	var topic models.Topic
+	var topicSlug sql.NullString
+	var messages, upvotes, creatorID sql.NullInt64
+	var lockedAt, pinnedAt, archivedAt sql.NullTime
+
+	err := row.Scan(&topic.ID, &topic.Title, &topicSlug, &topic.Description, &topic.Body, &topic.CategoryID, &messages, &upvotes, &topic.CreationDate, &creatorID,
+		&lockedAt, &pinnedAt, &archivedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	topic.Slug = topicSlug.String
+	topic.Messages = int(messages.Int64)
+	topic.Upvotes = int(upvotes.Int64)
+	topic.CreatorID = int(creatorID.Int64)
+	topic.Tags = []string{}
+	if lockedAt.Valid {
+		topic.LockedAt = &lockedAt.Time
+	}
+	if pinnedAt.Valid {
+		topic.PinnedAt = &pinnedAt.Time
+	}
+	if archivedAt.Valid {
+		topic.ArchivedAt = &archivedAt.Time
+	}
+	return &topic, nil
 }
 
-func CountTopics(db *sql.DB) (int, error) {
+func (s *SQLiteStore) CountTopics(ctx context.Context) (int, error) {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM topics").Scan(&count)
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM topics").Scan(&count)
 	if err != nil {
 		log.Printf("error counting topics: %v", err)
 		return 0, fmt.Errorf("could not count topics: %w", err)
@@ -0,0 +1,410 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/totp"
+)
+
+const (
+	// RecoveryCodeCount is how many recovery codes a user is given at a time.
+	RecoveryCodeCount = 10
+	// LoginChallengeTTL is how long a user has to give their second factor
+	// after the password check.
+	LoginChallengeTTL = 5 * time.Minute
+)
+
+// settingTwoFactorRole is the settings key of the least privileged role
+// that must use two-factor authentication.
+const settingTwoFactorRole = "two_factor_role"
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes returns RecoveryCodeCount new recovery codes, each
+// ten characters split by a dash so they are easy to copy by hand.
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("could not generate recovery code: %w", err)
+		}
+		code := recoveryEncoding.EncodeToString(raw)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode returns code the way it is hashed, ignoring case,
+// dashes and spaces.
+func NormalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// IsTOTPCode reports whether code looks like a code from an authenticator
+// app rather than a recovery code.
+func IsTOTPCode(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// BeginTwoFactor starts two-factor enrolment for username and returns the
+// new TOTP secret. Any earlier enrolment that was never confirmed is
+// replaced; it fails with ErrTwoFactorEnabled if one was.
+func (s *SQLiteStore) BeginTwoFactor(ctx context.Context, username string) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("error generating TOTP secret: %v", err)
+		return "", err
+	}
+
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		var userID int
+		var confirmed bool
+		err := tx.QueryRowContext(ctx, `SELECT users.id, user_totp.confirmed_at IS NOT NULL FROM users
+						LEFT JOIN user_totp ON user_totp.user_id = users.id
+						WHERE users.username = ?`, username).Scan(&userID, &confirmed)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			log.Printf("error fetching two-factor state for %s: %v", username, err)
+			return fmt.Errorf("could not fetch two-factor state: %w", err)
+		}
+		if confirmed {
+			return ErrTwoFactorEnabled
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_totp (user_id, secret) VALUES (?, ?)
+						ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret,
+						last_counter = 0, created_at = CURRENT_TIMESTAMP`, userID, secret)
+		if err != nil {
+			log.Printf("error storing TOTP secret for %s: %v", username, err)
+			return fmt.Errorf("could not store TOTP secret: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("two-factor enrolment started for user:", username)
+	return secret, nil
+}
+
+// ConfirmTwoFactor turns on two-factor authentication for username once
+// code shows their app holds the pending secret, and returns their first
+// set of recovery codes. Only hashes of the codes are stored.
+func (s *SQLiteStore) ConfirmTwoFactor(ctx context.Context, username, code string) ([]string, error) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		log.Printf("error generating recovery codes: %v", err)
+		return nil, err
+	}
+
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		userID, err := userIDByName(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+
+		var secret string
+		var confirmed bool
+		err = tx.QueryRowContext(ctx, "SELECT secret, confirmed_at IS NOT NULL FROM user_totp WHERE user_id = ?", userID).
+			Scan(&secret, &confirmed)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrTwoFactorNotPending
+			}
+			log.Printf("error fetching TOTP secret for %s: %v", username, err)
+			return fmt.Errorf("could not fetch TOTP secret: %w", err)
+		}
+		if confirmed {
+			return ErrTwoFactorEnabled
+		}
+
+		counter, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE user_totp SET confirmed_at = CURRENT_TIMESTAMP, last_counter = ? WHERE user_id = ?", counter, userID)
+		if err != nil {
+			log.Printf("error confirming two-factor for %s: %v", username, err)
+			return fmt.Errorf("could not confirm two-factor authentication: %w", err)
+		}
+		return replaceRecoveryCodes(ctx, tx, userID, codes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("two-factor authentication enabled for user:", username)
+	return codes, nil
+}
+
+// TwoFactorEnabled reports whether username has confirmed two-factor
+// authentication. Unknown users do not have it.
+func (s *SQLiteStore) TwoFactorEnabled(ctx context.Context, username string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM user_totp JOIN users ON users.id = user_totp.user_id
+						WHERE users.username = ? AND user_totp.confirmed_at IS NOT NULL)`, username).Scan(&enabled)
+	if err != nil {
+		log.Printf("error fetching two-factor state for %s: %v", username, err)
+		return false, fmt.Errorf("could not fetch two-factor state: %w", err)
+	}
+	return enabled, nil
+}
+
+// VerifyTwoFactor checks a second factor for username: either a code from
+// their app, which is refused if it or a later one has been used before,
+// or one of their recovery codes, which is used up.
+func (s *SQLiteStore) VerifyTwoFactor(ctx context.Context, username, code string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		userID, secret, lastCounter, err := confirmedTOTP(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+
+		if IsTOTPCode(code) {
+			counter, ok := totp.Validate(secret, code, time.Now())
+			if !ok || counter <= lastCounter {
+				return ErrInvalidTwoFactorCode
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE user_totp SET last_counter = ? WHERE user_id = ?", counter, userID)
+			if err != nil {
+				log.Printf("error recording TOTP use for %s: %v", username, err)
+				return fmt.Errorf("could not record TOTP use: %w", err)
+			}
+			return nil
+		}
+
+		res, err := tx.ExecContext(ctx, `UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+						WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`, userID, hashToken(NormalizeRecoveryCode(code)))
+		if err != nil {
+			log.Printf("error using recovery code for %s: %v", username, err)
+			return fmt.Errorf("could not use recovery code: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+		log.Println("recovery code used by user:", username)
+		return nil
+	})
+}
+
+// RegenerateRecoveryCodes replaces all of username's recovery codes, used
+// or not, with a new set.
+func (s *SQLiteStore) RegenerateRecoveryCodes(ctx context.Context, username string) ([]string, error) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		log.Printf("error generating recovery codes: %v", err)
+		return nil, err
+	}
+
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		userID, _, _, err := confirmedTOTP(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(ctx, tx, userID, codes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("recovery codes regenerated for user:", username)
+	return codes, nil
+}
+
+// DisableTwoFactor turns off two-factor authentication for username and
+// forgets their secret, recovery codes and pending logins.
+func (s *SQLiteStore) DisableTwoFactor(ctx context.Context, username string) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		userID, _, _, err := confirmedTOTP(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range []string{"user_totp", "recovery_codes", "login_challenges"} {
+			_, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = ?", userID)
+			if err != nil {
+				log.Printf("error deleting from %s for %s: %v", table, username, err)
+				return fmt.Errorf("could not disable two-factor authentication: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("two-factor authentication disabled for user:", username)
+	return nil
+}
+
+// confirmedTOTP returns the ID, TOTP secret and last used counter of a user
+// who has two-factor authentication turned on.
+func confirmedTOTP(ctx context.Context, tx *sql.Tx, username string) (userID int, secret string, lastCounter int64, err error) {
+	userID, err = userIDByName(ctx, tx, username)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT secret, last_counter FROM user_totp WHERE user_id = ? AND confirmed_at IS NOT NULL", userID).
+		Scan(&secret, &lastCounter)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, "", 0, ErrTwoFactorNotEnabled
+		}
+		log.Printf("error fetching TOTP secret for %s: %v", username, err)
+		return 0, "", 0, fmt.Errorf("could not fetch TOTP secret: %w", err)
+	}
+	return userID, secret, lastCounter, nil
+}
+
+func userIDByName(ctx context.Context, tx *sql.Tx, username string) (int, error) {
+	var userID int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		log.Printf("error fetching user ID for %s: %v", username, err)
+		return 0, fmt.Errorf("could not fetch user ID: %w", err)
+	}
+	return userID, nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codes []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		log.Printf("error deleting recovery codes for user ID %d: %v", userID, err)
+		return fmt.Errorf("could not delete recovery codes: %w", err)
+	}
+
+	for _, code := range codes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(NormalizeRecoveryCode(code)))
+		if err != nil {
+			log.Printf("error storing recovery code for user ID %d: %v", userID, err)
+			return fmt.Errorf("could not store recovery code: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateLoginChallenge records that username has passed the password check
+// and returns the token they must present with their second factor. Only a
+// hash of the token is stored.
+func (s *SQLiteStore) CreateLoginChallenge(ctx context.Context, username string) (string, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrUserNotFound
+		}
+		log.Printf("error fetching user ID for %s: %v", username, err)
+		return "", fmt.Errorf("could not fetch user ID: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("error generating login challenge: %v", err)
+		return "", fmt.Errorf("could not generate login challenge: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM login_challenges WHERE expires_at <= datetime('now')")
+	if err != nil {
+		log.Printf("error deleting expired login challenges: %v", err)
+		return "", fmt.Errorf("could not delete expired login challenges: %w", err)
+	}
+
+	expiry := fmt.Sprintf("+%d seconds", int(LoginChallengeTTL.Seconds()))
+	_, err = s.db.ExecContext(ctx, "INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES (?, ?, datetime('now', ?))",
+		hashToken(token), userID, expiry)
+	if err != nil {
+		log.Printf("error creating login challenge for %s: %v", username, err)
+		return "", fmt.Errorf("could not create login challenge: %w", err)
+	}
+	return token, nil
+}
+
+// GetLoginChallenge returns the username a login challenge was issued to.
+// Unknown and expired tokens both return ErrInvalidChallenge.
+func (s *SQLiteStore) GetLoginChallenge(ctx context.Context, token string) (string, error) {
+	var username string
+	err := s.db.QueryRowContext(ctx, `SELECT users.username FROM login_challenges
+						JOIN users ON users.id = login_challenges.user_id
+						WHERE login_challenges.token_hash = ? AND login_challenges.expires_at > datetime('now')`, hashToken(token)).
+		Scan(&username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrInvalidChallenge
+		}
+		log.Printf("error fetching login challenge: %v", err)
+		return "", fmt.Errorf("could not fetch login challenge: %w", err)
+	}
+	return username, nil
+}
+
+func (s *SQLiteStore) DeleteLoginChallenge(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_challenges WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		log.Printf("error deleting login challenge: %v", err)
+		return fmt.Errorf("could not delete login challenge: %w", err)
+	}
+	return nil
+}
+
+// GetTwoFactorRole returns the least privileged role that must use
+// two-factor authentication, or "" if nobody has to.
+func (s *SQLiteStore) GetTwoFactorRole(ctx context.Context) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM settings WHERE key = ?", settingTwoFactorRole).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("error fetching two-factor role: %v", err)
+		return "", fmt.Errorf("could not fetch two-factor role: %w", err)
+	}
+	return role, nil
+}
+
+// SetTwoFactorRole makes two-factor authentication required for role and
+// every more privileged one. An empty role makes it optional for everyone.
+func (s *SQLiteStore) SetTwoFactorRole(ctx context.Context, role string) error {
+	if role != "" && role != models.RoleModerator && role != models.RoleAdmin {
+		return ErrInvalidTwoFactorRole
+	}
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO settings (key, value) VALUES (?, ?)
+					ON CONFLICT(key) DO UPDATE SET value = excluded.value`, settingTwoFactorRole, role)
+	if err != nil {
+		log.Printf("error setting two-factor role: %v", err)
+		return fmt.Errorf("could not set two-factor role: %w", err)
+	}
+
+	log.Printf("two-factor authentication required for role: %q", role)
+	return nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// sqliteBusy is SQLITE_BUSY. Extended codes such as SQLITE_BUSY_SNAPSHOT
+	// share it in their low byte.
+	sqliteBusy = 5
+
+	maxTxAttempts = 3
+	txRetryDelay  = 20 * time.Millisecond
+)
+
+// withTx runs fn inside a transaction, committing if it returns nil and
+// rolling back otherwise. If SQLite reports the database as busy the whole
+// transaction is retried a few times before giving up. fn must only use tx;
+// going back to s.db while the transaction is open can block forever.
+func (s *SQLiteStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 1; attempt <= maxTxAttempts; attempt++ {
+		err = s.runTx(ctx, fn)
+		if err == nil || !isBusyError(err) {
+			return err
+		}
+
+		log.Printf("database busy, retrying transaction (attempt %d of %d): %v", attempt, maxTxAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * txRetryDelay):
+		}
+	}
+	return err
+}
+
+func (s *SQLiteStore) runTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("error starting transaction: %v", err)
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("error committing transaction: %v", err)
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
+
+// isBusyError reports whether err, or any error it wraps, is SQLITE_BUSY.
+func isBusyError(err error) bool {
+	var coded interface{ Code() int }
+	return errors.As(err, &coded) && coded.Code()&0xff == sqliteBusy
+}
@@ -1,39 +1,62 @@
 package database
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
-	"errors"
+	"encoding/base64"
 	"fmt"
 	"log"
-	"math/rand/v2"
+	"net/mail"
 	"regexp"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dDogge/Brainwave/models"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func CreateUserTable(db *sql.DB) error {
-	query := `CREATE TABLE IF NOT EXISTS users (
-    			id INTEGER PRIMARY KEY AUTOINCREMENT,
-    			username TEXT UNIQUE NOT NULL,
-    			password TEXT NOT NULL,
-				email TEXT NOT NULL,
-				reset_code TEXT DEFAULT NULL,
-    			topics_opened INTEGER DEFAULT 0,
-    			messages_sent INTEGER DEFAULT 0,
-    			creation_date DATETIME DEFAULT CURRENT_TIMESTAMP
-			);`
-	_, err := db.Exec(query)
-	if err != nil {
-		log.Fatal("error creating user table: ", err)
-		return err
+const (
+	// PasswordResetTTL is how long a password reset token stays valid.
+	PasswordResetTTL = time.Hour
+
+	// MaxResetAttempts is how many wrong tokens may be tried against an
+	// email before its outstanding token is thrown away.
+	MaxResetAttempts = 5
+)
+
+var validUsername = regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
+
+// IsValidUsername reports whether username is 3-20 letters, digits or
+// underscores.
+func IsValidUsername(username string) bool {
+	return validUsername.MatchString(username)
+}
+
+// MaxEmailLength is the longest email address accepted, as SMTP allows.
+const MaxEmailLength = 254
+
+// IsValidEmail reports whether email is a bare address such as
+// alice@example.com, without a display name or angle brackets.
+func IsValidEmail(email string) bool {
+	if len(email) > MaxEmailLength {
+		return false
 	}
-	return nil
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return false
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	return domain != "" && !strings.ContainsAny(domain, "[]")
 }
 
-func AddUser(db *sql.DB, username, email, password string) error {
-	const ErrUserExists = "username or email already exists"
+// AddUser adds a user whose email address is not yet verified; see
+// CreateEmailVerification.
+func (s *SQLiteStore) AddUser(ctx context.Context, username, email, password string) error {
+	if !IsValidEmail(email) {
+		return ErrInvalidEmail
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -41,18 +64,18 @@ func AddUser(db *sql.DB, username, email, password string) error {
 		return fmt.Errorf("could not hash password: %w", err)
 	}
 
-	stmt, err := db.Prepare("INSERT INTO users (username, email, password) VALUES (?, ?, ?)")
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO users (username, email, password) VALUES (?, ?, ?)")
 	if err != nil {
 		log.Printf("error preparing statement: %v", err)
 		return fmt.Errorf("could not prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(username, email, hashedPassword)
+	_, err = stmt.ExecContext(ctx, username, email, hashedPassword)
 	if err != nil {
 		if isUniqueConstraintError(err) {
 			log.Printf("unique constraint violation for username or email: %v", err)
-			return errors.New(ErrUserExists)
+			return ErrUserExists
 		}
 		log.Printf("error executing statement: %v", err)
 		return fmt.Errorf("could not execute statement: %w", err)
@@ -62,9 +85,25 @@ func AddUser(db *sql.DB, username, email, password string) error {
 	return nil
 }
 
-func CheckPassword(db *sql.DB, username, password string) (bool, error) {
+func (s *SQLiteStore) GetUser(ctx context.Context, username string) (*models.User, error) {
+	var user models.User
+	err := s.db.QueryRowContext(ctx, `SELECT id, username, email, email_verified_at IS NOT NULL, role, topics_opened, messages_sent, creation_date
+					FROM users WHERE username = ?`, username).
+		Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role, &user.TopicsOpened, &user.MessagesSent, &user.CreationDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		log.Printf("error fetching user %s: %v", username, err)
+		return nil, fmt.Errorf("could not fetch user: %w", err)
+	}
+
+	return &user, nil
+}
+
+func (s *SQLiteStore) CheckPassword(ctx context.Context, username, password string) (bool, error) {
 	var hashedPassword string
-	err := db.QueryRow("SELECT password FROM users WHERE username = ?", username).Scan(&hashedPassword)
+	err := s.db.QueryRowContext(ctx, "SELECT password FROM users WHERE username = ?", username).Scan(&hashedPassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Printf("user not found: %s", username)
@@ -83,13 +122,13 @@ func CheckPassword(db *sql.DB, username, password string) (bool, error) {
 	return true, nil
 }
 
-func ChangePassword(db *sql.DB, username, currentPassword, newPassword string) error {
+func (s *SQLiteStore) ChangePassword(ctx context.Context, username, currentPassword, newPassword string) error {
 	var hashedPassword string
-	err := db.QueryRow("SELECT password FROM users WHERE username = ?", username).Scan(&hashedPassword)
+	err := s.db.QueryRowContext(ctx, "SELECT password FROM users WHERE username = ?", username).Scan(&hashedPassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Printf("user not found: %s", username)
-			return errors.New("user not found")
+			return ErrUserNotFound
 		}
 		log.Printf("error fetching password for user %s: %v", username, err)
 		return fmt.Errorf("could not fetch password: %w", err)
@@ -98,7 +137,7 @@ func ChangePassword(db *sql.DB, username, currentPassword, newPassword string) e
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(currentPassword))
 	if err != nil {
 		log.Printf("incorrect current password for user %s: %v", username, err)
-		return errors.New("incorrect current password")
+		return ErrIncorrectPassword
 	}
 
 	hashedNewPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
@@ -107,7 +146,7 @@ func ChangePassword(db *sql.DB, username, currentPassword, newPassword string) e
 		return fmt.Errorf("could not hash new password: %w", err)
 	}
 
-	_, err = db.Exec("UPDATE users SET password = ? WHERE username = ?", hashedNewPassword, username)
+	_, err = s.db.ExecContext(ctx, "UPDATE users SET password = ? WHERE username = ?", hashedNewPassword, username)
 	if err != nil {
 		log.Printf("error updating password for user %s: %v", username, err)
 		return fmt.Errorf("could not update password: %w", err)
@@ -117,50 +156,61 @@ func ChangePassword(db *sql.DB, username, currentPassword, newPassword string) e
 	return nil
 }
 
-func ChangeEmail(db *sql.DB, username, newEmail string) error {
+// ChangeEmail asks to change username's email address to newEmail and
+// returns the token that proves the new address is theirs. The address
+// only changes once the token is given to VerifyEmail.
+func (s *SQLiteStore) ChangeEmail(ctx context.Context, username, newEmail string) (string, error) {
+	if !IsValidEmail(newEmail) {
+		return "", ErrInvalidEmail
+	}
+
 	var existingUser string
-	err := db.QueryRow("SELECT username FROM users WHERE email = ?", newEmail).Scan(&existingUser)
+	err := s.db.QueryRowContext(ctx, "SELECT username FROM users WHERE email = ?", newEmail).Scan(&existingUser)
 	if err == nil {
-		return errors.New("email is already in use")
+		log.Printf("email already in use: %s", newEmail)
+		return "", ErrEmailInUse
 	} else if err != sql.ErrNoRows {
-		return fmt.Errorf("could not check for existing email: %w", err)
+		return "", fmt.Errorf("could not check for existing email: %w", err)
 	}
 
-	if err == nil {
-		log.Printf("email already in use: %s", newEmail)
-		return errors.New("email is already in use")
+	var userID int
+	err = s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrUserNotFound
+		}
+		log.Printf("error fetching user ID for %s: %v", username, err)
+		return "", fmt.Errorf("could not fetch user ID: %w", err)
 	}
 
-	_, err = db.Exec("UPDATE users SET email = ? WHERE username = ?", newEmail, username)
+	token, err := s.issueEmailVerification(ctx, userID, newEmail)
 	if err != nil {
-		log.Printf("error updating email for user %s: %v", username, err)
-		return fmt.Errorf("could not update email: %w", err)
+		return "", err
 	}
 
-	log.Println("email updated successfully for user:", username)
-	return nil
+	log.Println("email change requested for user:", username)
+	return token, nil
 }
 
-func ChangeUsername(db *sql.DB, username, newUsername string) error {
+func (s *SQLiteStore) ChangeUsername(ctx context.Context, username, newUsername string) error {
 	var existingUser string
-	err := db.QueryRow("SELECT username FROM users WHERE username = ?", newUsername).Scan(&existingUser)
+	err := s.db.QueryRowContext(ctx, "SELECT username FROM users WHERE username = ?", newUsername).Scan(&existingUser)
 	if err != nil && err != sql.ErrNoRows {
 		log.Printf("error checking for existing username %s: %v", newUsername, err)
 		return fmt.Errorf("could not check for existing username: %w", err)
 	}
 
-	if err == nil { // Om inget fel uppstod, betyder det att användarnamnet finns
+	if err == nil {
 		log.Printf("username already in use: %s", newUsername)
-		return errors.New("username is already in use")
+		return ErrUsernameInUse
 	}
 
-	validUsername := regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
-	if !validUsername.MatchString(newUsername) {
+	if !IsValidUsername(newUsername) {
 		log.Printf("invalid username format: %s", newUsername)
-		return errors.New("username does not meet requirements")
+		return ErrInvalidUsername
 	}
 
-	_, err = db.Exec("UPDATE users SET username = ? WHERE username = ?", newUsername, username)
+	_, err = s.db.ExecContext(ctx, "UPDATE users SET username = ? WHERE username = ?", newUsername, username)
 	if err != nil {
 		log.Printf("error updating username for user %s: %v", username, err)
 		return fmt.Errorf("could not update username: %w", err)
@@ -170,44 +220,134 @@ func ChangeUsername(db *sql.DB, username, newUsername string) error {
 	return nil
 }
 
-func RemoveUser(db *sql.DB, username string) error {
-	var userID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("user not found: %s", username)
-			return fmt.Errorf("user not found")
+// RemoveUser deletes a user. Their topics, messages and edits stay but lose
+// their author, their votes and reactions are taken back out of the scores, and
+// their sessions end. Everything happens in one transaction.
+func (s *SQLiteStore) RemoveUser(ctx context.Context, username string) error {
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var userID int
+		err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				log.Printf("user not found: %s", username)
+				return ErrUserNotFound
+			}
+			log.Printf("error fetching user ID: %v", err)
+			return fmt.Errorf("could not fetch user ID: %w", err)
 		}
-		log.Printf("error fetching user ID: %v", err)
-		return fmt.Errorf("could not fetch user ID: %w", err)
-	}
 
-	_, err = db.Exec("UPDATE topics SET creator_id = NULL WHERE creator_id = ?", userID)
-	if err != nil {
-		log.Printf("error setting creator_id to NULL in topics: %v", err)
-		return fmt.Errorf("could not set creator_id to NULL in topics: %w", err)
-	}
+		_, err = tx.ExecContext(ctx, "UPDATE topics SET creator_id = NULL WHERE creator_id = ?", userID)
+		if err != nil {
+			log.Printf("error setting creator_id to NULL in topics: %v", err)
+			return fmt.Errorf("could not set creator_id to NULL in topics: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE messages SET user_id = NULL WHERE user_id = ?", userID)
+		if err != nil {
+			log.Printf("error setting user_id to NULL in messages: %v", err)
+			return fmt.Errorf("could not set user_id to NULL in messages: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE message_revisions SET editor_id = NULL WHERE editor_id = ?", userID)
+		if err != nil {
+			log.Printf("error setting editor_id to NULL in message_revisions: %v", err)
+			return fmt.Errorf("could not set editor_id to NULL in message_revisions: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE topics SET upvotes = upvotes - (SELECT value FROM topic_votes WHERE topic_id = topics.id AND user_id = ?)
+						WHERE id IN (SELECT topic_id FROM topic_votes WHERE user_id = ?)`, userID, userID)
+		if err != nil {
+			log.Printf("error removing votes from topic scores: %v", err)
+			return fmt.Errorf("could not remove votes from topic scores: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM topic_votes WHERE user_id = ?", userID)
+		if err != nil {
+			log.Printf("error deleting votes for user ID %d: %v", userID, err)
+			return fmt.Errorf("could not delete votes: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET likes = likes - (
+							SELECT COALESCE(SUM(CASE reaction WHEN 'like' THEN 1 WHEN 'dislike' THEN -1 ELSE 0 END), 0)
+							FROM message_reactions WHERE message_id = messages.id AND user_id = ?)
+						WHERE id IN (SELECT message_id FROM message_reactions WHERE user_id = ?)`, userID, userID)
+		if err != nil {
+			log.Printf("error removing reactions from message likes: %v", err)
+			return fmt.Errorf("could not remove reactions from message likes: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM message_reactions WHERE user_id = ?", userID)
+		if err != nil {
+			log.Printf("error deleting reactions for user ID %d: %v", userID, err)
+			return fmt.Errorf("could not delete reactions: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID)
+		if err != nil {
+			log.Printf("error deleting sessions for user ID %d: %v", userID, err)
+			return fmt.Errorf("could not delete sessions: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", userID)
+		if err != nil {
+			log.Printf("error executing statement: %v", err)
+			return fmt.Errorf("could not execute statement: %w", err)
+		}
 
-	_, err = db.Exec("UPDATE messages SET user_id = NULL WHERE user_id = ?", userID)
+		return nil
+	})
 	if err != nil {
-		log.Printf("error setting user_id to NULL in messages: %v", err)
-		return fmt.Errorf("could not set user_id to NULL in messages: %w", err)
+		return err
 	}
 
-	stmt, err := db.Prepare("DELETE FROM users WHERE username = ?")
-	if err != nil {
-		log.Printf("error preparing statement: %v", err)
-		return fmt.Errorf("could not prepare statement: %w", err)
+	log.Println("user removed successfully:", username)
+	return nil
+}
+
+// SetRole gives username a new role. Demoting the only remaining admin is
+// refused so the forum always has someone who can manage roles.
+func (s *SQLiteStore) SetRole(ctx context.Context, username, role string) error {
+	if !models.ValidRole(role) {
+		return ErrInvalidRole
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(username)
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var userID int
+		var current string
+		err := tx.QueryRowContext(ctx, "SELECT id, role FROM users WHERE username = ?", username).Scan(&userID, &current)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			log.Printf("error fetching role for user %s: %v", username, err)
+			return fmt.Errorf("could not fetch role: %w", err)
+		}
+
+		if current == models.RoleAdmin && role != models.RoleAdmin {
+			var admins int
+			err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE role = ?", models.RoleAdmin).Scan(&admins)
+			if err != nil {
+				log.Printf("error counting admins: %v", err)
+				return fmt.Errorf("could not count admins: %w", err)
+			}
+			if admins <= 1 {
+				return ErrLastAdmin
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET role = ? WHERE id = ?", role, userID)
+		if err != nil {
+			log.Printf("error updating role for user %s: %v", username, err)
+			return fmt.Errorf("could not update role: %w", err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		log.Printf("error executing statement: %v", err)
-		return fmt.Errorf("could not execute statement: %w", err)
+		return err
 	}
 
-	log.Println("user removed successfully:", username)
+	log.Printf("role of user %s set to %s", username, role)
 	return nil
 }
 
@@ -215,88 +355,171 @@ func isUniqueConstraintError(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
 }
 
-func GeneratePasswordResetCode(db *sql.DB, email string) (string, error) {
+// GeneratePasswordResetCode issues a password reset token for the user with
+// the given email and returns it, replacing any token issued before. Only a
+// hash of the token is stored, and it expires after PasswordResetTTL.
+func (s *SQLiteStore) GeneratePasswordResetCode(ctx context.Context, email string) (string, error) {
 	var userID int
-	err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = ?", email).Scan(&userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", errors.New("email not found")
+			return "", ErrEmailNotFound
 		}
 		log.Printf("error fetching user ID for email %s: %v", email, err)
 		return "", fmt.Errorf("could not fetch user ID: %w", err)
 	}
 
-	var code int = rand.IntN(900000) + 100000
-	var resetCode string = strconv.Itoa(code)
-	_, err = db.Exec("UPDATE users SET reset_code = ? WHERE id = ?", resetCode, userID)
-	if err != nil {
-		log.Printf("error creating password reset code for user ID %d: %v", userID, err)
-		return "", fmt.Errorf("could not create password reset code: %w", err)
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("error generating password reset token: %v", err)
+		return "", fmt.Errorf("could not generate password reset token: %w", err)
 	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
 
-	return resetCode, nil
-}
-
-func ResetPassword(db *sql.DB, email, resetCode, newPassword string) error {
-	var userID int
-	err := db.QueryRow("SELECT id from users WHERE reset_code = ?", resetCode).Scan(&userID)
+	expiry := fmt.Sprintf("+%d seconds", int(PasswordResetTTL.Seconds()))
+	_, err = s.db.ExecContext(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, datetime('now', ?))
+					ON CONFLICT(user_id) DO UPDATE SET token_hash = excluded.token_hash, attempts = 0,
+					created_at = CURRENT_TIMESTAMP, expires_at = excluded.expires_at`,
+		userID, hashToken(token), expiry)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return errors.New("invalid reset code")
-		}
-		log.Printf("error fetching user ID for reset code %s: %v", resetCode, err)
-		return fmt.Errorf("could not fetch user ID: %w", err)
+		log.Printf("error creating password reset token for user ID %d: %v", userID, err)
+		return "", fmt.Errorf("could not create password reset token: %w", err)
 	}
 
+	return token, nil
+}
+
+// ResetPassword sets a new password for the user with the given email if
+// token is the reset token last issued to them. The token is used up on
+// success, after it expires, and after MaxResetAttempts wrong guesses, and
+// all of the user's sessions are ended with the old password.
+func (s *SQLiteStore) ResetPassword(ctx context.Context, email, token, newPassword string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		log.Printf("error hashing new password: %v", err)
 		return fmt.Errorf("could not hash new password: %w", err)
 	}
 
-	_, err = db.Exec("UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID)
+	// Failed attempts are committed rather than rolled back, so they count
+	// towards the limit.
+	invalid := false
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		var userID, attempts int
+		var tokenHash string
+		var expired bool
+		err := tx.QueryRowContext(ctx, `SELECT users.id, password_resets.token_hash, password_resets.attempts,
+						password_resets.expires_at <= datetime('now')
+						FROM users JOIN password_resets ON password_resets.user_id = users.id
+						WHERE users.email = ?`, email).Scan(&userID, &tokenHash, &attempts, &expired)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				invalid = true
+				return nil
+			}
+			log.Printf("error fetching password reset token for email %s: %v", email, err)
+			return fmt.Errorf("could not fetch password reset token: %w", err)
+		}
+
+		if expired {
+			invalid = true
+			return deletePasswordReset(ctx, tx, userID)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashToken(token))) != 1 {
+			invalid = true
+			if attempts+1 >= MaxResetAttempts {
+				return deletePasswordReset(ctx, tx, userID)
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE password_resets SET attempts = attempts + 1 WHERE user_id = ?", userID)
+			if err != nil {
+				log.Printf("error recording password reset attempt for user ID %d: %v", userID, err)
+				return fmt.Errorf("could not record password reset attempt: %w", err)
+			}
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID)
+		if err != nil {
+			log.Printf("error updating password for user ID %d: %v", userID, err)
+			return fmt.Errorf("could not update password: %w", err)
+		}
+
+		if err := deletePasswordReset(ctx, tx, userID); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID)
+		if err != nil {
+			log.Printf("error deleting sessions for user ID %d: %v", userID, err)
+			return fmt.Errorf("could not delete sessions: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("error updating password for user ID %d: %v", userID, err)
-		return fmt.Errorf("could not update password: %w", err)
+		return err
+	}
+	if invalid {
+		return ErrInvalidResetCode
 	}
 
-	_, err = db.Exec("UPDATE users SET reset_code = NULL WHERE id = ?", userID)
+	log.Println("password reset successfully for email:", email)
+	return nil
+}
+
+func deletePasswordReset(ctx context.Context, tx *sql.Tx, userID int) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = ?", userID)
 	if err != nil {
-		log.Printf("error deleting password reset code for user ID %d: %v", userID, err)
-		return fmt.Errorf("could not delete password reset code: %w", err)
+		log.Printf("error deleting password reset token for user ID %d: %v", userID, err)
+		return fmt.Errorf("could not delete password reset token: %w", err)
 	}
-
 	return nil
 }
 
-func GetAllUsers(db *sql.DB) ([]map[string]interface{}, error) {
-	rows, err := db.Query("SELECT id, username, email, topics_opened, messages_sent, creation_date FROM users")
+// userSortKeys holds the sort_key expression for each user listing order.
+var userSortKeys = map[string]string{
+	SortRecent: "u.id",
+	SortOldest: "u.id",
+	SortTop:    "COALESCE(u.messages_sent, 0)",
+	SortActive: "CAST(strftime('%s', COALESCE((SELECT MAX(m.timestamp) FROM messages m WHERE m.user_id = u.id), u.creation_date)) AS INTEGER)",
+}
+
+// GetAllUsers returns one page of users in the order opts asks for, along
+// with the cursor for the next page or "" if this is the last one.
+func (s *SQLiteStore) GetAllUsers(ctx context.Context, opts ListOptions) ([]models.User, string, error) {
+	start, limit, err := opts.Start()
+	if err != nil {
+		return nil, "", err
+	}
+
+	query, args := pageQuery("SELECT u.id, u.username, u.email, u.email_verified_at IS NOT NULL, u.role, u.topics_opened, u.messages_sent, u.creation_date, "+userSortKeys[start.Sort]+" AS sort_key FROM users u", start, limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Printf("error fetching all users: %v", err)
-		return nil, fmt.Errorf("could not fetch users: %w", err)
+		return nil, "", fmt.Errorf("could not fetch users: %w", err)
 	}
 	defer rows.Close()
 
-	var users []map[string]interface{}
+	users := []models.User{}
+	var keys []int64
 	for rows.Next() {
-		var id, topicsOpened, messagesSent sql.NullInt64
-		var username, email, creationDate string
-
-		if err := rows.Scan(&id, &username, &email, &topicsOpened, &messagesSent, &creationDate); err != nil {
+		var user models.User
+		var key int64
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.Role, &user.TopicsOpened, &user.MessagesSent, &user.CreationDate, &key); err != nil {
 			log.Printf("error scanning user row: %v", err)
-			return nil, fmt.Errorf("could not scan user row: %w", err)
-		}
-
-		user := map[string]interface{}{
-			"id":            id.Int64,
-			"username":      username,
-			"email":         email,
-			"topics_opened": topicsOpened.Int64,
-			"messages_sent": messagesSent.Int64,
-			"creation_date": creationDate,
+			return nil, "", fmt.Errorf("could not scan user row: %w", err)
 		}
 		users = append(users, user)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading user rows: %v", err)
+		return nil, "", fmt.Errorf("could not read users: %w", err)
 	}
 
-	return users, nil
+	var next string
+	if len(users) > limit {
+		users = users[:limit]
+		next = ListCursor{Sort: start.Sort, Key: keys[limit-1], ID: users[limit-1].ID}.Encode()
+	}
+	return users, next, nil
 }
@@ -0,0 +1,122 @@
+// Package diff compares two texts word by word, for showing what an edit
+// changed.
+package diff
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kinds of change.
+const (
+	Equal  = "equal"
+	Insert = "insert"
+	Delete = "delete"
+)
+
+// MaxCells bounds the size of the comparison table. Texts that would need a
+// bigger one are reported as wholly replaced rather than compared.
+const MaxCells = 4_000_000
+
+// Change is a run of text that is the same in both versions, or only in the
+// old one (Delete) or the new one (Insert).
+type Change struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// tokens splits text into words and the whitespace between them, so that
+// joining the changes back together reproduces either text exactly.
+var tokens = regexp.MustCompile(`\s+|\S+`)
+
+// Words returns the changes that turn from into to. Runs of the same kind
+// are merged, and whitespace counts as a word of its own.
+func Words(from, to string) []Change {
+	a := tokens.FindAllString(from, -1)
+	b := tokens.FindAllString(to, -1)
+
+	var changes []Change
+	add := func(op, text string) {
+		if n := len(changes); n > 0 && changes[n-1].Op == op {
+			changes[n-1].Text += text
+			return
+		}
+		changes = append(changes, Change{Op: op, Text: text})
+	}
+
+	// Common prefix and suffix need no table.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	if prefix > 0 {
+		add(Equal, strings.Join(a[:prefix], ""))
+	}
+	for _, c := range middle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		add(c.Op, c.Text)
+	}
+	if suffix > 0 {
+		add(Equal, strings.Join(a[len(a)-suffix:], ""))
+	}
+
+	if changes == nil {
+		changes = []Change{}
+	}
+	return changes
+}
+
+// middle diffs a and b using their longest common subsequence.
+func middle(a, b []string) []Change {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if len(a) == 0 || len(b) == 0 || (len(a)+1)*(len(b)+1) > MaxCells {
+		var changes []Change
+		if len(a) > 0 {
+			changes = append(changes, Change{Delete, strings.Join(a, "")})
+		}
+		if len(b) > 0 {
+			changes = append(changes, Change{Insert, strings.Join(b, "")})
+		}
+		return changes
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var changes []Change
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			changes = append(changes, Change{Equal, a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			changes = append(changes, Change{Insert, b[j]})
+			j++
+		default:
+			changes = append(changes, Change{Delete, a[i]})
+			i++
+		}
+	}
+	return changes
+}
@@ -0,0 +1,59 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"Unchanged", "same text", "same text", "=[same text]"},
+		{"Both empty", "", "", ""},
+		{"Word replaced", "the quick fox", "the slow fox", "=[the ] -[quick] +[slow] =[ fox]"},
+		{"Words added", "hello", "hello there world", "=[hello] +[ there world]"},
+		{"Words removed", "a b c d", "a d", "=[a ] -[b c ] =[d]"},
+		{"Everything new", "", "new", "+[new]"},
+		{"Everything gone", "old", "", "-[old]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := Words(tt.from, tt.to)
+
+			var got []string
+			var from, to strings.Builder
+			for _, c := range changes {
+				sign := map[string]string{Equal: "=", Insert: "+", Delete: "-"}[c.Op]
+				got = append(got, fmt.Sprintf("%s[%s]", sign, c.Text))
+				if c.Op != Insert {
+					from.WriteString(c.Text)
+				}
+				if c.Op != Delete {
+					to.WriteString(c.Text)
+				}
+			}
+
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, strings.Join(got, " "))
+			}
+			if from.String() != tt.from || to.String() != tt.to {
+				t.Errorf("changes do not rebuild the texts: %q, %q", from.String(), to.String())
+			}
+		})
+	}
+}
+
+func TestWordsFallsBackForHugeTexts(t *testing.T) {
+	a := strings.Repeat("a ", 1500)
+	b := strings.Repeat("b ", 1500)
+
+	changes := Words(a+"x", b+"y")
+	if len(changes) != 2 || changes[0].Op != Delete || changes[1].Op != Insert {
+		t.Fatalf("expected a single delete and insert, got %d changes", len(changes))
+	}
+}
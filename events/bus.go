@@ -0,0 +1,150 @@
+// Package events fans out changes to a topic to everyone watching it. Events
+// are numbered in publish order and the most recent ones are kept in a
+// bounded buffer so a client that reconnects can pick up where it left off.
+package events
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+const (
+	DefaultReplaySize = 256
+	DefaultQueueSize  = 64
+)
+
+// Event is one change to a topic. Data holds the JSON encoded payload.
+type Event struct {
+	ID      uint64
+	TopicID int
+	Type    string
+	Data    []byte
+}
+
+// Subscription receives a topic's events on C. C is closed when the
+// subscription is closed or when the subscriber falls so far behind that its
+// queue fills up; either way the subscriber should stop listening.
+type Subscription struct {
+	C <-chan Event
+
+	// Complete is false when the subscription was asked to resume after an
+	// event that is no longer in the replay buffer, so some events were
+	// missed and the subscriber should reload the topic.
+	Complete bool
+
+	bus     *Bus
+	topicID int
+	ch      chan Event
+}
+
+// Close stops the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.remove(s)
+}
+
+// Bus is an in-process publish/subscribe hub keyed by topic ID. Publish never
+// blocks on subscribers.
+type Bus struct {
+	mu        sync.Mutex
+	nextID    uint64
+	replay    []Event
+	start     int
+	queueSize int
+	subs      map[int]map[*Subscription]struct{}
+}
+
+// NewBus returns a bus that remembers the last replaySize events and lets
+// each subscriber fall at most queueSize events behind.
+func NewBus(replaySize, queueSize int) *Bus {
+	return &Bus{
+		nextID:    1,
+		replay:    make([]Event, 0, max(replaySize, 1)),
+		queueSize: max(queueSize, 1),
+		subs:      make(map[int]map[*Subscription]struct{}),
+	}
+}
+
+// Publish encodes data as JSON and delivers it to the topic's subscribers.
+// A subscriber whose queue is full is dropped instead of waited for.
+func (b *Bus) Publish(topicID int, kind string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("error encoding %s event for topic ID %d: %v", kind, topicID, err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := Event{ID: b.nextID, TopicID: topicID, Type: kind, Data: payload}
+	b.nextID++
+
+	if len(b.replay) < cap(b.replay) {
+		b.replay = append(b.replay, event)
+	} else {
+		b.replay[b.start] = event
+		b.start = (b.start + 1) % len(b.replay)
+	}
+
+	for sub := range b.subs[topicID] {
+		select {
+		case sub.ch <- event:
+		default:
+			log.Printf("dropping slow subscriber to topic ID %d", topicID)
+			b.remove(sub)
+		}
+	}
+}
+
+// Subscribe starts listening to a topic. If lastEventID is not zero, the
+// buffered events for the topic that came after it are queued first.
+func (b *Bus) Subscribe(topicID int, lastEventID uint64) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []Event
+	complete := true
+	if lastEventID != 0 {
+		oldest := b.nextID
+		if len(b.replay) > 0 {
+			oldest = b.replay[b.start].ID
+		}
+		// An ID we have not handed out yet comes from before a restart.
+		complete = lastEventID+1 >= oldest && lastEventID < b.nextID
+
+		for i := range b.replay {
+			event := b.replay[(b.start+i)%len(b.replay)]
+			if event.ID > lastEventID && event.TopicID == topicID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, b.queueSize+len(missed))
+	for _, event := range missed {
+		ch <- event
+	}
+
+	sub := &Subscription{C: ch, Complete: complete, bus: b, topicID: topicID, ch: ch}
+	if b.subs[topicID] == nil {
+		b.subs[topicID] = make(map[*Subscription]struct{})
+	}
+	b.subs[topicID][sub] = struct{}{}
+	return sub
+}
+
+// remove unregisters sub and closes its channel. b.mu must be held.
+func (b *Bus) remove(sub *Subscription) {
+	subs := b.subs[sub.topicID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subs, sub.topicID)
+	}
+	close(sub.ch)
+}
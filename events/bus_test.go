@@ -0,0 +1,117 @@
+package events
+
+import "testing"
+
+// drain returns the events already queued on sub without waiting for more.
+func drain(sub *Subscription) []Event {
+	var got []Event
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return got
+			}
+			got = append(got, event)
+		default:
+			return got
+		}
+	}
+}
+
+func TestPublishReachesTopicSubscribers(t *testing.T) {
+	bus := NewBus(8, 8)
+
+	sub := bus.Subscribe(1, 0)
+	defer sub.Close()
+	other := bus.Subscribe(2, 0)
+	defer other.Close()
+
+	bus.Publish(1, "message.created", map[string]string{"message": "hi"})
+
+	got := drain(sub)
+	if len(got) != 1 || got[0].ID != 1 || got[0].Type != "message.created" || string(got[0].Data) != `{"message":"hi"}` {
+		t.Fatalf("unexpected events: %+v", got)
+	}
+	if len(drain(other)) != 0 {
+		t.Error("expected events for topic 1 to stay out of topic 2")
+	}
+}
+
+func TestSubscribeReplaysAfterLastEventID(t *testing.T) {
+	bus := NewBus(8, 8)
+	for i := 0; i < 3; i++ {
+		bus.Publish(1, "message.created", i)
+		bus.Publish(2, "message.created", i)
+	}
+
+	// Topic 1 got IDs 1, 3 and 5.
+	sub := bus.Subscribe(1, 2)
+	defer sub.Close()
+
+	if !sub.Complete {
+		t.Error("expected a complete replay")
+	}
+	got := drain(sub)
+	if len(got) != 2 || got[0].ID != 3 || got[1].ID != 5 {
+		t.Fatalf("expected topic 1 events after ID 2, got %+v", got)
+	}
+}
+
+func TestSubscribeReportsEvictedEvents(t *testing.T) {
+	bus := NewBus(2, 8)
+	for i := 0; i < 5; i++ {
+		bus.Publish(1, "message.created", i)
+	}
+
+	tests := []struct {
+		lastEventID uint64
+		complete    bool
+		replayed    int
+	}{
+		{0, true, 0},
+		{2, false, 2},
+		{3, true, 2},
+		{5, true, 0},
+		{99, false, 0},
+	}
+	for _, tt := range tests {
+		sub := bus.Subscribe(1, tt.lastEventID)
+		if sub.Complete != tt.complete {
+			t.Errorf("after ID %d: expected complete=%v, got %v", tt.lastEventID, tt.complete, sub.Complete)
+		}
+		if got := len(drain(sub)); got != tt.replayed {
+			t.Errorf("after ID %d: expected %d replayed events, got %d", tt.lastEventID, tt.replayed, got)
+		}
+		sub.Close()
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus := NewBus(8, 2)
+
+	slow := bus.Subscribe(1, 0)
+	fast := bus.Subscribe(1, 0)
+	defer fast.Close()
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(1, "message.created", i)
+		drain(fast)
+	}
+
+	got := drain(slow)
+	if len(got) != 2 {
+		t.Fatalf("expected the slow subscriber to keep its 2 queued events, got %d", len(got))
+	}
+	if _, ok := <-slow.C; ok {
+		t.Error("expected the slow subscriber's channel to be closed")
+	}
+
+	bus.Publish(1, "message.created", 3)
+	if got := drain(fast); len(got) != 1 || got[0].ID != 4 {
+		t.Errorf("expected the fast subscriber to keep receiving, got %+v", got)
+	}
+
+	// Closing a dropped subscription must not panic.
+	slow.Close()
+	slow.Close()
+}
@@ -2,7 +2,10 @@ module github.com/dDogge/Brainwave
 
 go 1.23.2
 
-require modernc.org/sqlite v1.33.1
+require (
+	github.com/gorilla/websocket v1.5.3
+	modernc.org/sqlite v1.33.1
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+)
+
+// SessionCookieName is the cookie the login handler stores the session token in.
+const SessionCookieName = "brainwave_session"
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	// heldRoleContextKey carries the role of a user EnforceTwoFactor has
+	// held back to the rights of a plain user.
+	heldRoleContextKey
+)
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	Message string `json:"message"`
+	Token   string `json:"token,omitempty"`
+	// Challenge is set instead of Token when the user must finish logging
+	// in with a second factor.
+	Challenge         string `json:"challenge,omitempty"`
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+type LoginAttemptsResponse struct {
+	Attempts []models.LoginAttempt `json:"attempts"`
+}
+
+// ContextWithUser returns a copy of ctx carrying user as the authenticated user.
+func ContextWithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// CurrentUser returns the authenticated user attached by RequireAuth.
+func CurrentUser(r *http.Request) (*models.User, bool) {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	return user, ok && user != nil
+}
+
+// sessionToken extracts the session token from the Authorization header,
+// falling back to the session cookie.
+func sessionToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := r.Cookie(SessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// RequireAuth rejects requests without a valid session and otherwise stores
+// the session's user in the request context.
+func RequireAuth(sessions database.SessionStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := sessionToken(r)
+		if token == "" {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := sessions.GetSessionUser(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, database.ErrInvalidSession) {
+				http.Error(w, "invalid or expired session", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "failed to verify session", http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithUser(r.Context(), user)))
+	})
+}
+
+// OptionalAuth stores the session's user in the request context when the
+// request carries a valid session, and otherwise lets it through anonymously.
+func OptionalAuth(sessions database.SessionStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := sessionToken(r); token != "" {
+			user, err := sessions.GetSessionUser(r.Context(), token)
+			if err == nil {
+				r = r.WithContext(ContextWithUser(r.Context(), user))
+			} else if !errors.Is(err, database.ErrInvalidSession) {
+				http.Error(w, "failed to verify session", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address r came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLogin checks username and password on behalf of the client making r
+// and records the outcome. While the username or the client's IP is locked
+// out the password is not checked at all and lockedUntil says when the
+// lockout ends. A right password for a user with two-factor authentication
+// sets secondFactor and is not recorded, since the login is not over until
+// the second factor is checked too.
+func checkLogin(r *http.Request, users database.UserStore, logins database.LoginStore, twoFactor database.TwoFactorStore, username, password string) (valid, secondFactor bool, lockedUntil time.Time, err error) {
+	ip := clientIP(r)
+	lockedUntil, err = logins.LoginLockedUntil(r.Context(), username, ip)
+	if err != nil || !lockedUntil.IsZero() {
+		return false, false, lockedUntil, err
+	}
+
+	valid, err = users.CheckPassword(r.Context(), username, password)
+	if err != nil {
+		return false, false, time.Time{}, err
+	}
+
+	if valid {
+		secondFactor, err = twoFactor.TwoFactorEnabled(r.Context(), username)
+		if err != nil || secondFactor {
+			return valid, secondFactor, time.Time{}, err
+		}
+	}
+
+	err = logins.RecordLogin(r.Context(), models.LoginAttempt{
+		Username:  username,
+		Success:   valid,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	})
+	return valid, false, time.Time{}, err
+}
+
+// writeLockedOut tells the client to wait until the lockout ends.
+func writeLockedOut(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(time.Until(until)), 1)))
+	http.Error(w, "too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+func writeLoginError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(LoginResponse{Error: message})
+}
+
+// startSession creates a session for username and sets the session cookie.
+func startSession(w http.ResponseWriter, r *http.Request, sessions database.SessionStore, username string) (string, error) {
+	token, err := sessions.CreateSession(r.Context(), username, r.UserAgent())
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(database.SessionTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+// LoginHandler starts a session for a user who gives the right password.
+// Repeated failures lock out the username and the client's IP for a while,
+// as the store's login policy says. Users with two-factor authentication
+// get a challenge instead of a session, to finish with
+// LoginTwoFactorHandler.
+func LoginHandler(users database.UserStore, sessions database.SessionStore, logins database.LoginStore, twoFactor database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reqBody LoginRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Username == "" || reqBody.Password == "" {
+			http.Error(w, "both username and password are required", http.StatusBadRequest)
+			return
+		}
+
+		valid, secondFactor, lockedUntil, err := checkLogin(r, users, logins, twoFactor, reqBody.Username, reqBody.Password)
+		if err != nil {
+			http.Error(w, "error checking password", http.StatusInternalServerError)
+			return
+		}
+
+		if !lockedUntil.IsZero() {
+			writeLockedOut(w, lockedUntil)
+			return
+		}
+
+		if !valid {
+			writeLoginError(w, "invalid username or password")
+			return
+		}
+
+		if secondFactor {
+			challenge, err := twoFactor.CreateLoginChallenge(r.Context(), reqBody.Username)
+			if err != nil {
+				http.Error(w, "failed to create login challenge", http.StatusInternalServerError)
+				return
+			}
+
+			resp := LoginResponse{
+				Message:           "two-factor code required",
+				Challenge:         challenge,
+				TwoFactorRequired: true,
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		token, err := startSession(w, r, sessions, reqBody.Username)
+		if err != nil {
+			log.Printf("error creating session for %s: %v", reqBody.Username, err)
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+			return
+		}
+
+		resp := LoginResponse{
+			Message: "logged in successfully",
+			Token:   token,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func LogoutHandler(store database.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := sessionToken(r)
+		if token == "" {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		err := store.DeleteSession(r.Context(), token)
+		if err != nil {
+			http.Error(w, "failed to log out", http.StatusInternalServerError)
+			return
+		}
+
+		clearSessionCookie(w)
+
+		resp := map[string]string{
+			"message": "logged out successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func LogoutEverywhereHandler(store database.SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		err := store.DeleteUserSessions(r.Context(), user.ID)
+		if err != nil {
+			http.Error(w, "failed to log out", http.StatusInternalServerError)
+			return
+		}
+
+		clearSessionCookie(w)
+
+		resp := map[string]string{
+			"message": "logged out of all sessions",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// UnlockLoginHandler lifts the lockout on the username in the path after too
+// many failed logins. It is meant to be mounted behind
+// RequireRole(models.RoleAdmin).
+func UnlockLoginHandler(store database.LoginStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.PathValue("username")
+		if username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.UnlockLogin(r.Context(), username)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to unlock user", http.StatusInternalServerError)
+			return
+		}
+
+		resp := map[string]string{
+			"message": "user unlocked successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// GetLoginAttemptsHandler lists the most recent login attempts on the
+// account in the path, newest first. It is meant to be mounted behind
+// RequireRole(models.RoleAdmin).
+func GetLoginAttemptsHandler(store database.LoginStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.PathValue("username")
+		if username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+
+		limit := database.DefaultLoginLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > database.MaxLoginLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", database.MaxLoginLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		attempts, err := store.GetLoginAttempts(r.Context(), username, limit)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, "failed to fetch login attempts", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(LoginAttemptsResponse{Attempts: attempts}); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
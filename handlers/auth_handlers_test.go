@@ -0,0 +1,414 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+)
+
+var ctx = context.Background()
+
+// asUser attaches username to the request context the same way RequireAuth
+// does. Unknown usernames get ID 0 so handlers can be tested against users
+// that have been removed.
+func asUser(t *testing.T, users database.UserStore, req *http.Request, username string) *http.Request {
+	t.Helper()
+
+	user := &models.User{Username: username}
+	found, err := users.GetUser(ctx, username)
+	if err == nil {
+		user.ID = found.ID
+		user.Role = found.Role
+	} else if !errors.Is(err, database.ErrUserNotFound) {
+		t.Fatalf("failed to look up user %s: %v", username, err)
+	}
+
+	return req.WithContext(handlers.ContextWithUser(req.Context(), user))
+}
+
+// setupAuthDB returns a migrated SQLite database with one user, testuser,
+// and a store on top of it. The auth tests inspect the sessions table
+// directly, so they use SQLite rather than memstore.
+func setupAuthDB(t *testing.T) (*sql.DB, *database.SQLiteStore) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+
+	_, err = database.MigrateUp(db)
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	store := database.NewSQLiteStore(db)
+	err = store.AddUser(ctx, "testuser", "testuser@test.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to add test user: %v", err)
+	}
+
+	return db, store
+}
+
+func TestLoginHandler(t *testing.T) {
+	db, store := setupAuthDB(t)
+	defer db.Close()
+
+	handler := handlers.LoginHandler(store, store, store, store)
+
+	makeRequest := func(reqBody handlers.LoginRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(reqBody)
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+		req.Header.Set("User-Agent", "login-test")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Successful_login", func(t *testing.T) {
+		rr := makeRequest(handlers.LoginRequest{Username: "testuser", Password: "password123"})
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var resp handlers.LoginResponse
+		err := json.NewDecoder(rr.Body).Decode(&resp)
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if resp.Token == "" {
+			t.Fatal("expected a session token, got empty string")
+		}
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != handlers.SessionCookieName || cookies[0].Value != resp.Token {
+			t.Errorf("expected session cookie carrying the token, got %v", cookies)
+		}
+
+		var userAgent, tokenHash string
+		err = db.QueryRow("SELECT user_agent, token_hash FROM sessions").Scan(&userAgent, &tokenHash)
+		if err != nil {
+			t.Fatalf("failed to fetch session: %v", err)
+		}
+		if userAgent != "login-test" {
+			t.Errorf("expected user agent 'login-test', got %q", userAgent)
+		}
+		if tokenHash == resp.Token {
+			t.Error("expected session token to be stored hashed")
+		}
+	})
+
+	t.Run("Wrong_password", func(t *testing.T) {
+		rr := makeRequest(handlers.LoginRequest{Username: "testuser", Password: "wrong"})
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+
+		var resp handlers.LoginResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if resp.Token != "" {
+			t.Error("expected no token for a failed login")
+		}
+	})
+
+	t.Run("Missing_fields", func(t *testing.T) {
+		rr := makeRequest(handlers.LoginRequest{Username: "testuser"})
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	db, store := setupAuthDB(t)
+	defer db.Close()
+
+	store.SetLoginPolicy(database.LoginPolicy{
+		UserThreshold: 2,
+		IPThreshold:   4,
+		BaseLockout:   time.Minute,
+		MaxLockout:    time.Hour,
+		FailureWindow: 15 * time.Minute,
+	})
+	handler := handlers.LoginHandler(store, store, store, store)
+
+	login := func(username, password, ip string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(handlers.LoginRequest{Username: username, Password: password})
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+		req.RemoteAddr = ip + ":5555"
+		req.Header.Set("User-Agent", "lockout-test")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := login("testuser", "wrong", "10.0.0.1"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+
+	rr := login("testuser", "password123", "10.0.0.2")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the right password to be refused while locked out, got %d", rr.Code)
+	}
+	if retry, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 60 {
+		t.Errorf("expected Retry-After of at most a minute, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	t.Run("Audit_trail", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users/testuser/logins", nil)
+		req.SetPathValue("username", "testuser")
+		rr := httptest.NewRecorder()
+		handlers.GetLoginAttemptsHandler(store).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var resp handlers.LoginAttemptsResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		// The refused attempt never got as far as checking the password.
+		if len(resp.Attempts) != 2 {
+			t.Fatalf("expected 2 recorded attempts, got %+v", resp.Attempts)
+		}
+		for _, attempt := range resp.Attempts {
+			if attempt.Success || attempt.IP != "10.0.0.1" || attempt.UserAgent != "lockout-test" {
+				t.Errorf("unexpected attempt: %+v", attempt)
+			}
+		}
+	})
+
+	t.Run("Unlock", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/users/testuser/unlock", nil)
+		req.SetPathValue("username", "testuser")
+		rr := httptest.NewRecorder()
+		handlers.UnlockLoginHandler(store).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := login("testuser", "password123", "10.0.0.2"); rr.Code != http.StatusOK {
+			t.Errorf("expected login to work after unlocking, got %d", rr.Code)
+		}
+	})
+
+	t.Run("IP_lockout", func(t *testing.T) {
+		for _, username := range []string{"guess1", "guess2", "guess3", "guess4"} {
+			login(username, "wrong", "10.0.0.9")
+		}
+
+		if rr := login("testuser", "password123", "10.0.0.9"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected logins from the locked out IP to be refused, got %d", rr.Code)
+		}
+		if rr := login("testuser", "password123", "10.0.0.3"); rr.Code != http.StatusOK {
+			t.Errorf("expected logins from other IPs to work, got %d", rr.Code)
+		}
+	})
+}
+
+func TestLoginAdminHandlers(t *testing.T) {
+	db, store := setupAuthDB(t)
+	defer db.Close()
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		method   string
+		username string
+		query    string
+		wantCode int
+	}{
+		{"Unlock_unknown_user", handlers.UnlockLoginHandler(store), http.MethodPost, "nobody", "", http.StatusNotFound},
+		{"Unlock_wrong_method", handlers.UnlockLoginHandler(store), http.MethodGet, "testuser", "", http.StatusMethodNotAllowed},
+		{"Logins_unknown_user", handlers.GetLoginAttemptsHandler(store), http.MethodGet, "nobody", "", http.StatusNotFound},
+		{"Logins_invalid_limit", handlers.GetLoginAttemptsHandler(store), http.MethodGet, "testuser", "?limit=0", http.StatusBadRequest},
+		{"Logins_limit_too_large", handlers.GetLoginAttemptsHandler(store), http.MethodGet, "testuser", "?limit=1000", http.StatusBadRequest},
+		{"Logins_empty", handlers.GetLoginAttemptsHandler(store), http.MethodGet, "testuser", "?limit=5", http.StatusOK},
+		{"Logins_wrong_method", handlers.GetLoginAttemptsHandler(store), http.MethodPost, "testuser", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/users/"+tt.username+"/logins"+tt.query, nil)
+			req.SetPathValue("username", tt.username)
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	db, store := setupAuthDB(t)
+	defer db.Close()
+
+	token, err := store.CreateSession(ctx, "testuser", "test")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	handler := handlers.RequireAuth(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := handlers.CurrentUser(r)
+		if !ok {
+			t.Error("expected a user in the request context")
+			return
+		}
+		w.Write([]byte(user.Username))
+	}))
+
+	t.Run("Bearer_token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != "testuser" {
+			t.Errorf("expected 200 'testuser', got %d %q", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Cookie", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: handlers.SessionCookieName, Value: token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != "testuser" {
+			t.Errorf("expected 200 'testuser', got %d %q", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Missing_token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("Invalid_token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer not-a-real-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+
+		if rr.Body.String() != "invalid or expired session\n" {
+			t.Errorf("expected response 'invalid or expired session', got %q", rr.Body.String())
+		}
+	})
+
+	t.Run("Expired_token", func(t *testing.T) {
+		expired, err := store.CreateSession(ctx, "testuser", "expired")
+		if err != nil {
+			t.Fatalf("failed to create session: %v", err)
+		}
+		_, err = db.Exec("UPDATE sessions SET expires_at = datetime('now', '-1 minute') WHERE user_agent = 'expired'")
+		if err != nil {
+			t.Fatalf("failed to expire session: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+expired)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+}
+
+func TestLogoutHandlers(t *testing.T) {
+	db, store := setupAuthDB(t)
+	defer db.Close()
+
+	first, err := store.CreateSession(ctx, "testuser", "first")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	second, err := store.CreateSession(ctx, "testuser", "second")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	third, err := store.CreateSession(ctx, "testuser", "third")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	sessionValid := func(token string) bool {
+		_, err := store.GetSessionUser(ctx, token)
+		return err == nil
+	}
+
+	t.Run("Logout", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+first)
+		rr := httptest.NewRecorder()
+		handlers.LogoutHandler(store).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if sessionValid(first) {
+			t.Error("expected logged out session to be invalid")
+		}
+		if !sessionValid(second) {
+			t.Error("expected other sessions to stay valid")
+		}
+	})
+
+	t.Run("Logout_everywhere", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout-all", nil)
+		req.Header.Set("Authorization", "Bearer "+second)
+		rr := httptest.NewRecorder()
+		handlers.RequireAuth(store, handlers.LogoutEverywhereHandler(store)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if sessionValid(second) || sessionValid(third) {
+			t.Error("expected every session to be invalid")
+		}
+	})
+
+	t.Run("Logout_without_token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		rr := httptest.NewRecorder()
+		handlers.LogoutHandler(store).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+}
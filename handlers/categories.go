@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+)
+
+type CategoryRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Color       string `json:"color"`
+	ParentID    int    `json:"parent_id"`
+	Position    int    `json:"position"`
+	TopicRole   string `json:"topic_role"`
+}
+
+type CategoryListResponse struct {
+	Categories []models.Category `json:"categories"`
+}
+
+type MoveTopicRequest struct {
+	CategoryID int `json:"category_id"`
+}
+
+func (c CategoryRequest) draft() database.CategoryDraft {
+	return database.CategoryDraft{
+		Name:        c.Name,
+		Description: c.Description,
+		Color:       c.Color,
+		ParentID:    c.ParentID,
+		Position:    c.Position,
+		TopicRole:   c.TopicRole,
+	}
+}
+
+// GetCategoriesHandler lists the top-level categories in order, each with
+// its sub-categories.
+func GetCategoriesHandler(store database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		categories, err := store.GetCategories(r.Context())
+		if err != nil {
+			http.Error(w, "failed to fetch categories", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(CategoryListResponse{Categories: categories}); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func GetCategoryHandler(store database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "invalid category_id", http.StatusBadRequest)
+			return
+		}
+
+		category, err := store.GetCategory(r.Context(), id)
+		if err != nil {
+			writeCategoryError(w, err, "failed to fetch category")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(category); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func AddCategoryHandler(store database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reqBody CategoryRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Name == "" {
+			http.Error(w, "name field is required", http.StatusBadRequest)
+			return
+		}
+
+		category, err := store.AddCategory(r.Context(), reqBody.draft())
+		if err != nil {
+			writeCategoryError(w, err, "failed to add category")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(category)
+	}
+}
+
+// UpdateCategoryHandler replaces every editable field of a category, so
+// fields left out of the request are reset to their defaults.
+func UpdateCategoryHandler(store database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "invalid category_id", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody CategoryRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Name == "" {
+			http.Error(w, "name field is required", http.StatusBadRequest)
+			return
+		}
+
+		category, err := store.UpdateCategory(r.Context(), id, reqBody.draft())
+		if err != nil {
+			writeCategoryError(w, err, "failed to update category")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(category)
+	}
+}
+
+func RemoveCategoryHandler(store database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "invalid category_id", http.StatusBadRequest)
+			return
+		}
+
+		err := store.RemoveCategory(r.Context(), id)
+		if err != nil {
+			writeCategoryError(w, err, "failed to remove category")
+			return
+		}
+
+		resp := map[string]string{
+			"message": "category removed successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// MoveTopicHandler files a topic under another category. The caller must
+// also hold the role the target category requires for opening topics.
+func MoveTopicHandler(store database.TopicStore, categories database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody MoveTopicRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.CategoryID <= 0 {
+			http.Error(w, "category_id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+
+		category, err := categories.GetCategory(r.Context(), reqBody.CategoryID)
+		if err != nil {
+			writeCategoryError(w, err, "failed to move topic")
+			return
+		}
+
+		if !canOpenTopics(user, category) {
+			http.Error(w, fmt.Sprintf("opening topics in this category requires the %s role", category.TopicRole), http.StatusForbidden)
+			return
+		}
+
+		err = store.MoveTopic(r.Context(), topicID, reqBody.CategoryID)
+		if err != nil {
+			writeCategoryError(w, err, "failed to move topic")
+			return
+		}
+
+		resp := map[string]string{
+			"message": "topic moved successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// writeCategoryError maps the errors returned by the category queries to
+// HTTP responses, falling back to fallback with a 500.
+func writeCategoryError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrInvalidRole), errors.Is(err, database.ErrInvalidColor),
+		errors.Is(err, database.ErrInvalidParent), errors.Is(err, database.ErrCategoryTooDeep):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, database.ErrCategoryExists), errors.Is(err, database.ErrCategoryNotEmpty),
+		errors.Is(err, database.ErrDefaultCategory):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
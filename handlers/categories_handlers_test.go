@@ -0,0 +1,197 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dDogge/Brainwave/database/memstore"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+)
+
+func TestCategoryHandlers(t *testing.T) {
+	store := memstore.New()
+
+	for _, name := range []string{"member", "moderator"} {
+		if err := store.AddUser(ctx, name, name+"@example.com", "password123"); err != nil {
+			t.Fatalf("failed to add user %s: %v", name, err)
+		}
+	}
+	if err := store.SetRole(ctx, "moderator", models.RoleModerator); err != nil {
+		t.Fatalf("failed to set role: %v", err)
+	}
+
+	do := func(handler http.HandlerFunc, method, target, body, username string, pathValues ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(pathValues); i += 2 {
+			req.SetPathValue(pathValues[i], pathValues[i+1])
+		}
+		if username != "" {
+			req = asUser(t, store, req, username)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	addCategory := func(body string) models.Category {
+		t.Helper()
+		rr := do(handlers.AddCategoryHandler(store), http.MethodPost, "/categories", body, "")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("failed to add category %s: %d %s", body, rr.Code, rr.Body.String())
+		}
+		var category models.Category
+		if err := json.NewDecoder(rr.Body).Decode(&category); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return category
+	}
+
+	news := addCategory(`{"name":"Announcements","color":"#ff8800","position":-1,"topic_role":"moderator"}`)
+	help := addCategory(`{"name":"Help","description":"Ask away"}`)
+	setup := addCategory(`{"name":"Setup","parent_id":` + strconv.Itoa(help.ID) + `}`)
+
+	t.Run("Invalid_categories", func(t *testing.T) {
+		tests := []struct {
+			body string
+			code int
+		}{
+			{`{"name":""}`, http.StatusBadRequest},
+			{`{"name":"Help"}`, http.StatusConflict},
+			{`{"name":"Colours","color":"orange"}`, http.StatusBadRequest},
+			{`{"name":"Deep","parent_id":` + strconv.Itoa(setup.ID) + `}`, http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			if rr := do(handlers.AddCategoryHandler(store), http.MethodPost, "/categories", tt.body, ""); rr.Code != tt.code {
+				t.Errorf("%s: expected status %d, got %d", tt.body, tt.code, rr.Code)
+			}
+		}
+	})
+
+	var installFails *models.Topic
+	t.Run("Announcement_board", func(t *testing.T) {
+		body := `{"title":"Release day","category_id":` + strconv.Itoa(news.ID) + `}`
+		if rr := do(handlers.AddTopicHandler(store, store), http.MethodPost, "/topics", body, "member"); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if rr := do(handlers.AddTopicHandler(store, store), http.MethodPost, "/topics", body, "moderator"); rr.Code != http.StatusCreated {
+			t.Errorf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		if rr := do(handlers.AddTopicHandler(store, store), http.MethodPost, "/topics", `{"title":"Nowhere","category_id":999}`, "member"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		body = `{"title":"Install fails","category_id":` + strconv.Itoa(setup.ID) + `}`
+		rr := do(handlers.AddTopicHandler(store, store), http.MethodPost, "/topics", body, "member")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		var resp handlers.TopicResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		installFails = resp.Topic
+	})
+
+	t.Run("Category_tree", func(t *testing.T) {
+		rr := do(handlers.GetCategoriesHandler(store), http.MethodGet, "/categories", "", "")
+		var resp handlers.CategoryListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		var names []string
+		for _, c := range resp.Categories {
+			names = append(names, c.Name)
+			for _, child := range c.Children {
+				names = append(names, "-"+child.Name)
+			}
+		}
+		if got := strings.Join(names, " "); got != "Announcements General Help -Setup" {
+			t.Errorf("unexpected category tree: %s", got)
+		}
+		if resp.Categories[0].Topics != 1 || resp.Categories[2].Children[0].Topics != 1 {
+			t.Errorf("unexpected topic counts: %+v", resp.Categories)
+		}
+	})
+
+	t.Run("Category_topics", func(t *testing.T) {
+		list := func(id string) *httptest.ResponseRecorder {
+			return do(handlers.GetAllTopicsHandler(store), http.MethodGet, "/categories/"+id+"/topics", "", "", "id", id)
+		}
+
+		rr := list(strconv.Itoa(help.ID))
+		var resp handlers.TopicListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(resp.Topics) != 1 || resp.Topics[0].Title != "Install fails" {
+			t.Errorf("expected Help to list its sub-category's topic, got %+v", resp.Topics)
+		}
+
+		if rr := list("999"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if rr := list("abc"); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("Move_topic", func(t *testing.T) {
+		move := func(body, username string) *httptest.ResponseRecorder {
+			ref := installFails.Ref()
+			return do(handlers.MoveTopicHandler(store, store), http.MethodPut, "/topics/"+ref+"/category", body, username, "topic", ref)
+		}
+
+		if rr := move(`{"category_id":999}`, "moderator"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if rr := move(`{"category_id":0}`, "moderator"); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if rr := move(`{"category_id":`+strconv.Itoa(help.ID)+`}`, "moderator"); rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		topic, err := store.GetTopic(ctx, installFails.ID)
+		if err != nil {
+			t.Fatalf("failed to fetch topic: %v", err)
+		}
+		if topic.CategoryID != help.ID {
+			t.Errorf("expected the topic to be in Help, got category %d", topic.CategoryID)
+		}
+	})
+
+	t.Run("Update_and_remove", func(t *testing.T) {
+		id := strconv.Itoa(setup.ID)
+		rr := do(handlers.UpdateCategoryHandler(store), http.MethodPut, "/categories/"+id, `{"name":"Installation","color":"#00aa00"}`, "", "id", id)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var category models.Category
+		if err := json.NewDecoder(rr.Body).Decode(&category); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if category.Name != "Installation" || category.ParentID != 0 || category.Color != "#00aa00" {
+			t.Errorf("unexpected updated category: %+v", category)
+		}
+
+		helpID := strconv.Itoa(help.ID)
+		if rr := do(handlers.RemoveCategoryHandler(store), http.MethodDelete, "/categories/"+helpID, "", "", "id", helpID); rr.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if rr := do(handlers.RemoveCategoryHandler(store), http.MethodDelete, "/categories/1", "", "", "id", "1"); rr.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if rr := do(handlers.RemoveCategoryHandler(store), http.MethodDelete, "/categories/"+id, "", "", "id", id); rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		if rr := do(handlers.GetCategoryHandler(store), http.MethodGet, "/categories/"+id, "", "", "id", id); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/events"
+)
+
+// eventsHeartbeat is how often an idle event stream sends a comment line so
+// proxies do not time the connection out.
+const eventsHeartbeat = 15 * time.Second
+
+// TopicEventsHandler streams a topic's events as Server-Sent Events. Each
+// event carries its bus ID, so a reconnecting EventSource resumes through
+// the Last-Event-ID header. If the events in between have already left the
+// replay buffer, the stream starts with a "reset" event telling the client
+// to reload the topic instead. Unknown topics get a 404 rather than a stream
+// that never sends anything.
+func TopicEventsHandler(store database.TopicStore, bus *events.Bus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := store.GetTopic(r.Context(), topicID); err != nil {
+			writeTopicError(w, err, "failed to fetch topic")
+			return
+		}
+
+		var lastEventID uint64
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			lastEventID = id
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		sub := bus.Subscribe(topicID, lastEventID)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		if !sub.Complete {
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		} else {
+			fmt.Fprint(w, ": connected\n\n")
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case event, ok := <-sub.C:
+				if !ok {
+					// Dropped for falling behind; the client will reconnect
+					// and resume from its last event.
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+			}
+			flusher.Flush()
+		}
+	}
+}
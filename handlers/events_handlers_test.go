@@ -0,0 +1,145 @@
+package handlers_test
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
+	"github.com/dDogge/Brainwave/events"
+	"github.com/dDogge/Brainwave/handlers"
+)
+
+// readEvent reads the next event block from an SSE stream, skipping comment
+// lines, and returns its fields.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+
+	fields := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ": ")
+		fields[name] = value
+	}
+}
+
+func TestTopicEventsHandler(t *testing.T) {
+	store := memstore.New()
+	if err := store.AddUser(ctx, "listener", "listener@example.com", "password123"); err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Live topic"}, "listener")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	bus := events.NewBus(4, 8)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /topics/{topic}/events", handlers.TopicEventsHandler(store, bus))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	open := func(topicID int, lastEventID string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/topics/%d/events", server.URL, topicID), nil)
+		if err != nil {
+			t.Fatalf("failed to build request: %v", err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to open event stream: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("Live events", func(t *testing.T) {
+		resp := open(topic.ID, "")
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		stream := bufio.NewReader(resp.Body)
+
+		// The connected comment is flushed once the subscription exists.
+		if line, err := stream.ReadString('\n'); err != nil || line != ": connected\n" {
+			t.Fatalf("expected the connected comment, got %q (%v)", line, err)
+		}
+
+		bus.Publish(topic.ID+1, "message.created", map[string]int{"id": 99})
+		bus.Publish(topic.ID, "message.created", map[string]int{"id": 1})
+
+		event := readEvent(t, stream)
+		if event["id"] != "2" || event["event"] != "message.created" || event["data"] != `{"id":1}` {
+			t.Errorf("unexpected event: %v", event)
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		bus.Publish(topic.ID, "topic.voted", map[string]int{"upvotes": 1})
+
+		resp := open(topic.ID, "2")
+		defer resp.Body.Close()
+
+		event := readEvent(t, bufio.NewReader(resp.Body))
+		if event["id"] != "3" || event["event"] != "topic.voted" {
+			t.Errorf("expected the missed vote to be replayed, got %v", event)
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			bus.Publish(topic.ID+2, "message.created", i)
+		}
+
+		resp := open(topic.ID, "1")
+		defer resp.Body.Close()
+
+		event := readEvent(t, bufio.NewReader(resp.Body))
+		if event["event"] != "reset" {
+			t.Errorf("expected a reset event, got %v", event)
+		}
+	})
+
+	t.Run("Bad requests", func(t *testing.T) {
+		resp := open(topic.ID, "latest")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for a bad Last-Event-ID, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp = open(0, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %d for a bad topic ID, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp = open(topic.ID+100, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d for an unknown topic, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
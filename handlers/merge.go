@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+)
+
+type MergeTopicRequest struct {
+	TargetID int `json:"target_id"`
+}
+
+type SplitTopicRequest struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Body        string   `json:"body"`
+	Tags        []string `json:"tags"`
+	CategoryID  int      `json:"category_id"`
+}
+
+// MergeTopicHandler merges the topic in the path into the one given by
+// target_id and responds with the target. Links to the merged topic
+// redirect to the target afterwards. It is meant to be mounted behind
+// RequireRole(models.RoleModerator).
+func MergeTopicHandler(store database.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody MergeTopicRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.TargetID <= 0 {
+			http.Error(w, "target_id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+
+		target, err := store.MergeTopic(r.Context(), topicID, reqBody.TargetID)
+		if err != nil {
+			writeTopicError(w, err, "failed to merge topic")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", topicURL(target))
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(TopicResponse{Message: "topic merged successfully", Topic: target})
+	}
+}
+
+// SplitTopicHandler moves the message in the path and its replies into a
+// new topic opened by the caller, in the category given by category_id or
+// else in the category of the topic they came from. It is meant to be
+// mounted behind RequireRole(models.RoleModerator); the caller must also
+// hold the role the target category requires for opening topics.
+func SplitTopicHandler(store database.TopicStore, categories database.CategoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody SplitTopicRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Title == "" {
+			http.Error(w, "title field is required", http.StatusBadRequest)
+			return
+		}
+
+		if utf8.RuneCountInString(reqBody.Description) > models.MaxDescriptionLength {
+			http.Error(w, fmt.Sprintf("description must be at most %d characters", models.MaxDescriptionLength), http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.CategoryID != 0 {
+			category, err := categories.GetCategory(r.Context(), reqBody.CategoryID)
+			if err != nil {
+				writeCategoryError(w, err, "failed to split topic")
+				return
+			}
+
+			if !canOpenTopics(user, category) {
+				http.Error(w, fmt.Sprintf("opening topics in this category requires the %s role", category.TopicRole), http.StatusForbidden)
+				return
+			}
+		}
+
+		draft := database.TopicDraft{
+			Title:       reqBody.Title,
+			Description: reqBody.Description,
+			Body:        reqBody.Body,
+			Tags:        reqBody.Tags,
+			CategoryID:  reqBody.CategoryID,
+		}
+		topic, err := store.SplitTopic(r.Context(), messageID, draft, user.Username)
+		if err != nil {
+			writeTopicError(w, err, "failed to split topic")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", topicURL(topic))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(TopicResponse{Message: "topic split successfully", Topic: topic})
+	}
+}
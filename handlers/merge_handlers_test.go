@@ -0,0 +1,207 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+)
+
+func TestMergeTopicHandler(t *testing.T) {
+	store := memstore.New()
+
+	if err := store.AddUser(ctx, "moduser", "moduser@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add moduser: %v", err)
+	}
+
+	source, err := store.AddTopic(ctx, database.TopicDraft{Title: "Duplicate"}, "moduser")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	target, err := store.AddTopic(ctx, database.TopicDraft{Title: "Original"}, "moduser")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	if _, err := store.AddMessage(ctx, source.ID, "Same question here", "moduser", 0); err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+
+	merge := func(ref, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/topics/"+ref+"/merge", strings.NewReader(body))
+		req.SetPathValue("topic", ref)
+		w := httptest.NewRecorder()
+		handlers.MergeTopicHandler(store).ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		ref      string
+		body     string
+		wantCode int
+	}{
+		{"Invalid_topic", "duplicate", `{"target_id":2}`, http.StatusBadRequest},
+		{"Invalid_JSON", source.Ref(), `{`, http.StatusBadRequest},
+		{"Missing_target", source.Ref(), `{}`, http.StatusBadRequest},
+		{"Into_itself", source.Ref(), `{"target_id":` + strconv.Itoa(source.ID) + `}`, http.StatusBadRequest},
+		{"Unknown_target", source.Ref(), `{"target_id":999999}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := merge(tt.ref, tt.body); w.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Merges", func(t *testing.T) {
+		w := merge(source.Ref(), `{"target_id":`+strconv.Itoa(target.ID)+`}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		var resp handlers.TopicResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Topic == nil || resp.Topic.ID != target.ID || resp.Topic.Messages != 1 {
+			t.Fatalf("expected the target with the moved message, got %+v", resp.Topic)
+		}
+		if want := "/api/v1/topics/" + target.Ref(); w.Header().Get("Location") != want {
+			t.Errorf("expected Location %q, got %q", want, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Redirects", func(t *testing.T) {
+		for _, ref := range []string{source.Ref(), strconv.Itoa(source.ID), source.Slug} {
+			req := httptest.NewRequest(http.MethodGet, "/topics/"+ref, nil)
+			req.SetPathValue("topic", ref)
+			w := httptest.NewRecorder()
+			handlers.GetTopicHandler(store).ServeHTTP(w, req)
+
+			if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/api/v1/topics/"+target.Ref() {
+				t.Errorf("expected %q to redirect to the target, got %d %q", ref, w.Code, w.Header().Get("Location"))
+			}
+		}
+	})
+
+	t.Run("Archived_target", func(t *testing.T) {
+		other, err := store.AddTopic(ctx, database.TopicDraft{Title: "Another duplicate"}, "moduser")
+		if err != nil {
+			t.Fatalf("failed to add topic: %v", err)
+		}
+		if _, err := store.SetTopicState(ctx, target.ID, models.TopicArchived, true); err != nil {
+			t.Fatalf("failed to archive topic: %v", err)
+		}
+
+		if w := merge(other.Ref(), `{"target_id":`+strconv.Itoa(target.ID)+`}`); w.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Wrong_method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/topics/"+target.Ref()+"/merge", nil)
+		w := httptest.NewRecorder()
+		handlers.MergeTopicHandler(store).ServeHTTP(w, req)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+		}
+	})
+}
+
+func TestSplitTopicHandler(t *testing.T) {
+	store := memstore.New()
+
+	if err := store.AddUser(ctx, "moduser", "moduser@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add moduser: %v", err)
+	}
+	if err := store.SetRole(ctx, "moduser", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moduser a moderator: %v", err)
+	}
+	staff, err := store.AddCategory(ctx, database.CategoryDraft{Name: "Staff", TopicRole: models.RoleAdmin})
+	if err != nil {
+		t.Fatalf("failed to add category: %v", err)
+	}
+
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Coffee"}, "moduser")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	root, err := store.AddMessage(ctx, topic.ID, "Espresso or filter?", "moduser", 0)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+	branch, err := store.AddMessage(ctx, topic.ID, "What about cold brew?", "moduser", root.ID)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+	if _, err := store.AddMessage(ctx, topic.ID, "Twelve hours", "moduser", branch.ID); err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+
+	split := func(caller, id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/messages/"+id+"/split", strings.NewReader(body))
+		req.SetPathValue("id", id)
+		if caller != "" {
+			req = asUser(t, store, req, caller)
+		}
+		w := httptest.NewRecorder()
+		handlers.SplitTopicHandler(store, store).ServeHTTP(w, req)
+		return w
+	}
+
+	branchID := strconv.Itoa(branch.ID)
+	tests := []struct {
+		name     string
+		caller   string
+		id       string
+		body     string
+		wantCode int
+	}{
+		{"Unauthenticated", "", branchID, `{"title":"Cold brew"}`, http.StatusUnauthorized},
+		{"Invalid_message", "moduser", "abc", `{"title":"Cold brew"}`, http.StatusBadRequest},
+		{"Missing_title", "moduser", branchID, `{"title":""}`, http.StatusBadRequest},
+		{"Invalid_tag", "moduser", branchID, `{"title":"Cold brew","tags":["no tags!"]}`, http.StatusBadRequest},
+		{"Title_taken", "moduser", branchID, `{"title":"Coffee"}`, http.StatusConflict},
+		{"Unknown_message", "moduser", "999999", `{"title":"Cold brew"}`, http.StatusNotFound},
+		{"Unknown_category", "moduser", branchID, `{"title":"Cold brew","category_id":999999}`, http.StatusNotFound},
+		{"Category_role", "moduser", branchID, `{"title":"Cold brew","category_id":` + strconv.Itoa(staff.ID) + `}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := split(tt.caller, tt.id, tt.body); w.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Splits", func(t *testing.T) {
+		w := split("moduser", branchID, `{"title":"Cold brew","tags":["coffee"]}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+
+		var resp handlers.TopicResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Topic == nil || resp.Topic.Title != "Cold brew" || resp.Topic.Messages != 2 {
+			t.Fatalf("expected the new topic with the split messages, got %+v", resp.Topic)
+		}
+		if want := "/api/v1/topics/" + resp.Topic.Ref(); w.Header().Get("Location") != want {
+			t.Errorf("expected Location %q, got %q", want, w.Header().Get("Location"))
+		}
+
+		left, err := store.GetTopic(ctx, topic.ID)
+		if err != nil || left.Messages != 1 {
+			t.Errorf("expected one message left behind, got %+v, %v", left, err)
+		}
+	})
+}
@@ -1,26 +1,53 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
 )
 
-func AddMessageHandler(db *sql.DB) http.HandlerFunc {
+type AddMessageResponse struct {
+	Message string          `json:"message"`
+	Created *models.Message `json:"created"`
+}
+
+type PurgeMessageResponse struct {
+	Message string `json:"message"`
+	Purged  []int  `json:"purged"`
+}
+
+type MessageListResponse struct {
+	Messages   []models.Message `json:"messages"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+func AddMessageHandler(store database.MessageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
 		var reqBody struct {
-			Topic    string `json:"topic"`
 			Message  string `json:"message"`
-			Username string `json:"username"`
+			ParentID int    `json:"parent_id"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -29,25 +56,25 @@ func AddMessageHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if reqBody.Topic == "" || reqBody.Message == "" || reqBody.Username == "" {
-			http.Error(w, "all fields (topic, message, username) are required", http.StatusBadRequest)
+		if reqBody.Message == "" {
+			http.Error(w, "message field is required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.AddMessage(db, reqBody.Topic, reqBody.Message, reqBody.Username)
+		if reqBody.ParentID < 0 {
+			http.Error(w, "invalid parent_id", http.StatusBadRequest)
+			return
+		}
+
+		created, err := store.AddMessage(r.Context(), topicID, reqBody.Message, user.Username, reqBody.ParentID)
 		if err != nil {
-			if err.Error() == "user not found" {
-				http.Error(w, "user not found", http.StatusNotFound)
-			} else if err.Error() == "topic not found" {
-				http.Error(w, "topic not found", http.StatusNotFound)
-			} else {
-				http.Error(w, "failed to add message", http.StatusInternalServerError)
-			}
+			writeThreadError(w, err, "failed to add message")
 			return
 		}
 
-		resp := map[string]string{
-			"message": "message added successfully",
+		resp := AddMessageResponse{
+			Message: "message added successfully",
+			Created: created,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -56,16 +83,21 @@ func AddMessageHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func SetParentHandler(db *sql.DB) http.HandlerFunc {
+func SetParentHandler(store database.MessageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		childID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "invalid message id", http.StatusBadRequest)
+			return
+		}
+
 		var reqBody struct {
 			ParentID int `json:"parent_id"`
-			ChildID  int `json:"child_id"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -74,22 +106,14 @@ func SetParentHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if reqBody.ParentID == 0 || reqBody.ChildID == 0 {
-			http.Error(w, "both parent_id and child_id are required", http.StatusBadRequest)
+		if reqBody.ParentID == 0 {
+			http.Error(w, "parent_id is required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.SetParent(db, reqBody.ParentID, reqBody.ChildID)
+		err = store.SetParent(r.Context(), reqBody.ParentID, childID)
 		if err != nil {
-			if err.Error() == fmt.Sprintf("parent message with ID %d not found", reqBody.ParentID) {
-				http.Error(w, fmt.Sprintf("parent message with ID %d not found", reqBody.ParentID), http.StatusNotFound)
-			} else if err.Error() == fmt.Sprintf("child message with ID %d not found", reqBody.ChildID) {
-				http.Error(w, fmt.Sprintf("child message with ID %d not found", reqBody.ChildID), http.StatusNotFound)
-			} else if err.Error() == fmt.Sprintf("messages are not in the same topic: parentID=%d, childID=%d", reqBody.ParentID, reqBody.ChildID) {
-				http.Error(w, fmt.Sprintf("messages are not in the same topic: parentID=%d, childID=%d", reqBody.ParentID, reqBody.ChildID), http.StatusBadRequest)
-			} else {
-				http.Error(w, "failed to set parent", http.StatusInternalServerError)
-			}
+			writeThreadError(w, err, "failed to set parent")
 			return
 		}
 
@@ -103,65 +127,224 @@ func SetParentHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetMessagesByTopicHandler(db *sql.DB) http.HandlerFunc {
+// DeleteMessageHandler replaces a message with a tombstone, keeping its
+// replies in place. Only its author or a moderator may delete it.
+func DeleteMessageHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		msg, err := store.GetMessage(r.Context(), messageID)
+		if err != nil {
+			writeDeleteError(w, err, "failed to delete message")
+			return
+		}
+
+		if !canModerate(user, msg.UserID) {
+			http.Error(w, "only the message's author or a moderator may delete it", http.StatusForbidden)
+			return
+		}
+
+		err = store.DeleteMessage(r.Context(), messageID)
+		if err != nil {
+			writeDeleteError(w, err, "failed to delete message")
+			return
+		}
+
+		resp := map[string]string{
+			"message": "message deleted successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// PurgeMessageHandler hard-deletes a message and all of its replies. It is
+// meant to be mounted behind RequireRole(models.RoleModerator).
+func PurgeMessageHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		purged, err := store.PurgeMessage(r.Context(), messageID)
+		if err != nil {
+			writeDeleteError(w, err, "failed to purge message")
+			return
+		}
+
+		resp := PurgeMessageResponse{
+			Message: "message purged successfully",
+			Purged:  purged,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// GetMessagesByTopicHandler lists a topic's messages a page at a time, oldest
+// first unless the sort query parameter says otherwise.
+func GetMessagesByTopicHandler(store database.MessageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		topicIDStr := r.URL.Query().Get("topic_id")
-		if topicIDStr == "" {
+		if r.PathValue("topic") == "" {
 			http.Error(w, "topic_id is required", http.StatusBadRequest)
 			return
 		}
 
-		topicID, err := strconv.Atoi(topicIDStr)
-		if err != nil {
+		topicID, ok := pathTopicID(r)
+		if !ok {
 			http.Error(w, "invalid topic_id", http.StatusBadRequest)
 			return
 		}
 
-		messages, err := database.GetMessagesByTopic(db, topicID)
+		opts, err := listOptions(r, database.SortOldest)
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		messages, next, err := store.GetMessagesByTopic(r.Context(), topicID, opts)
+		if err != nil {
+			if errors.Is(err, database.ErrInvalidCursor) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "failed to fetch messages", http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(messages); err != nil {
+		if err := json.NewEncoder(w).Encode(MessageListResponse{Messages: messages, NextCursor: next}); err != nil {
 			http.Error(w, "failed to encode response", http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
-func LikeMessageHandler(db *sql.DB) http.HandlerFunc {
+// GetThreadHandler returns a topic's messages as a nested tree. The depth,
+// sort, limit and cursor query parameters map onto database.ThreadOptions.
+func GetThreadHandler(store database.ThreadStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+		if r.Method != http.MethodGet {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reqBody struct {
-			MessageID int `json:"message_id"`
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
 		}
 
-		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		query := r.URL.Query()
+		opts := database.ThreadOptions{
+			Depth:  database.DefaultThreadDepth,
+			Sort:   database.ThreadSortTime,
+			Limit:  database.DefaultThreadLimit,
+			Cursor: query.Get("cursor"),
+		}
+
+		if v := query.Get("depth"); v != "" {
+			depth, err := strconv.Atoi(v)
+			if err != nil || depth < 0 || depth > database.MaxThreadDepth {
+				http.Error(w, fmt.Sprintf("depth must be between 0 and %d", database.MaxThreadDepth), http.StatusBadRequest)
+				return
+			}
+			opts.Depth = depth
+		}
+
+		if v := query.Get("sort"); v != "" {
+			if v != database.ThreadSortTime && v != database.ThreadSortLikes {
+				http.Error(w, "sort must be 'time' or 'likes'", http.StatusBadRequest)
+				return
+			}
+			opts.Sort = v
+		}
+
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > database.MaxThreadLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", database.MaxThreadLimit), http.StatusBadRequest)
+				return
+			}
+			opts.Limit = limit
+		}
+
+		thread, err := store.GetThread(r.Context(), topicID, opts)
 		if err != nil {
-			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			switch {
+			case errors.Is(err, database.ErrNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, database.ErrInvalidCursor):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, "failed to fetch thread", http.StatusInternalServerError)
+			}
 			return
 		}
 
-		if reqBody.MessageID == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(thread); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func LikeMessageHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
 			http.Error(w, "message_id is required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.LikeMessage(db, reqBody.MessageID)
+		err := store.LikeMessage(r.Context(), messageID, user.Username)
 		if err != nil {
-			http.Error(w, "failed to like message", http.StatusInternalServerError)
+			writeReactionError(w, err, "failed to like message")
 			return
 		}
 
@@ -175,15 +358,62 @@ func LikeMessageHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func DislikeMessageHandler(db *sql.DB) http.HandlerFunc {
+func DislikeMessageHandler(store database.MessageStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.DislikeMessage(r.Context(), messageID, user.Username)
+		if err != nil {
+			writeReactionError(w, err, "failed to dislike message")
+			return
+		}
+
+		resp := map[string]string{
+			"message": "dislike added successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func AddReactionHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
 		var reqBody struct {
-			MessageID int `json:"message_id"`
+			Reaction string `json:"reaction"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -192,19 +422,60 @@ func DislikeMessageHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if reqBody.MessageID == 0 {
+		if reqBody.Reaction == "" {
+			http.Error(w, "reaction field is required", http.StatusBadRequest)
+			return
+		}
+
+		err = store.AddReaction(r.Context(), messageID, user.Username, reqBody.Reaction)
+		if err != nil {
+			writeReactionError(w, err, "failed to add reaction")
+			return
+		}
+
+		resp := map[string]string{
+			"message": "reaction added successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func RemoveReactionHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
 			http.Error(w, "message_id is required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.DislikeMessage(db, reqBody.MessageID)
+		reaction := r.PathValue("reaction")
+		if reaction == "" {
+			http.Error(w, "reaction is required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.RemoveReaction(r.Context(), messageID, user.Username, reaction)
 		if err != nil {
-			http.Error(w, "failed to dislike message", http.StatusInternalServerError)
+			writeReactionError(w, err, "failed to remove reaction")
 			return
 		}
 
 		resp := map[string]string{
-			"message": "dislike added successfully",
+			"message": "reaction removed successfully",
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -212,3 +483,78 @@ func DislikeMessageHandler(db *sql.DB) http.HandlerFunc {
 		json.NewEncoder(w).Encode(resp)
 	}
 }
+
+func GetMessageReactionsHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		reactions, err := store.GetMessageReactions(r.Context(), messageID)
+		if err != nil {
+			writeReactionError(w, err, "failed to fetch reactions")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(reactions); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// writeThreadError maps the errors returned when placing a message in a
+// thread to HTTP responses, falling back to fallback with a 500.
+func writeThreadError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrDifferentTopics),
+		errors.Is(err, database.ErrThreadCycle),
+		errors.Is(err, database.ErrThreadTooDeep):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, database.ErrTopicLocked), errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// writeDeleteError maps the errors returned when deleting or purging a
+// message to HTTP responses, falling back to fallback with a 500.
+func writeDeleteError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrMessageDeleted):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// writeReactionError maps the errors returned by the reaction queries to
+// HTTP responses, falling back to fallback with a 500.
+func writeReactionError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrUnknownReaction):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, database.ErrReactionExists), errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
@@ -7,65 +7,69 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
 	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
 )
 
-func TestAddMessageHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
+// findMessageID returns the ID of the message with the given text in topic.
+func findMessageID(t *testing.T, store *memstore.Store, topicID int, message string) int {
+	t.Helper()
 
-	err = database.CreateUserTable(db)
+	messages, _, err := store.GetMessagesByTopic(ctx, topicID, database.ListOptions{Limit: database.MaxListLimit})
 	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
+		t.Fatalf("failed to fetch messages: %v", err)
 	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topic table: %v", err)
+	for _, msg := range messages {
+		if msg.Message == message {
+			return msg.ID
+		}
 	}
 
-	err = database.CreateMessageTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup message table: %v", err)
-	}
+	t.Fatalf("message %q not found in topic ID %d", message, topicID)
+	return 0
+}
+
+func TestAddMessageHandler(t *testing.T) {
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
 	topicTitle := "Test Topic"
 
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	err = database.AddMessage(db, topicTitle, "bla bla", username)
+	_, err = store.AddMessage(ctx, topic.ID, "bla bla", username, 0)
 	if err != nil {
 		t.Fatalf("failed to add test message: %v", err)
 	}
 
-	handler := handlers.AddMessageHandler(db)
+	handler := handlers.AddMessageHandler(store)
 
 	makeRequest := func(reqBody struct {
-		Topic    string `json:"topic"`
+		Topic    string `json:"-"`
 		Message  string `json:"message"`
-		Username string `json:"username"`
+		Username string `json:"-"`
 	}) *httptest.ResponseRecorder {
 		body, _ := json.Marshal(reqBody)
-		req, _ := http.NewRequest(http.MethodPost, "/add-message", bytes.NewBuffer(body))
+		req, _ := http.NewRequest(http.MethodPost, "/topics/"+reqBody.Topic+"/messages", bytes.NewBuffer(body))
 		req.Header.Set("Content-Type", "application/json")
+		req.SetPathValue("topic", reqBody.Topic)
+		req = asUser(t, store, req, reqBody.Username)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 		return rr
@@ -73,11 +77,11 @@ func TestAddMessageHandler(t *testing.T) {
 
 	t.Run("Successfully_Add_Message", func(t *testing.T) {
 		reqBody := struct {
-			Topic    string `json:"topic"`
+			Topic    string `json:"-"`
 			Message  string `json:"message"`
-			Username string `json:"username"`
+			Username string `json:"-"`
 		}{
-			Topic:    topicTitle,
+			Topic:    topic.Ref(),
 			Message:  "This is a test message",
 			Username: username,
 		}
@@ -88,24 +92,27 @@ func TestAddMessageHandler(t *testing.T) {
 			t.Errorf("expected status %d, got %d", http.StatusCreated, rr.Code)
 		}
 
-		var resp map[string]string
+		var resp handlers.AddMessageResponse
 		err := json.NewDecoder(rr.Body).Decode(&resp)
 		if err != nil {
 			t.Fatalf("failed to decode response: %v", err)
 		}
 
-		if resp["message"] != "message added successfully" {
-			t.Errorf("expected response 'message added successfully', got %s", resp["message"])
+		if resp.Message != "message added successfully" {
+			t.Errorf("expected response 'message added successfully', got %s", resp.Message)
+		}
+		if resp.Created == nil || resp.Created.ID == 0 || resp.Created.Message != reqBody.Message {
+			t.Errorf("expected the created message in the response, got %+v", resp.Created)
 		}
 	})
 
 	t.Run("User_Not_Found", func(t *testing.T) {
 		reqBody := struct {
-			Topic    string `json:"topic"`
+			Topic    string `json:"-"`
 			Message  string `json:"message"`
-			Username string `json:"username"`
+			Username string `json:"-"`
 		}{
-			Topic:    topicTitle,
+			Topic:    topic.Ref(),
 			Message:  "This is a test message",
 			Username: "nonexistentuser",
 		}
@@ -124,11 +131,11 @@ func TestAddMessageHandler(t *testing.T) {
 
 	t.Run("Topic_Not_Found", func(t *testing.T) {
 		reqBody := struct {
-			Topic    string `json:"topic"`
+			Topic    string `json:"-"`
 			Message  string `json:"message"`
-			Username string `json:"username"`
+			Username string `json:"-"`
 		}{
-			Topic:    "Nonexistent Topic",
+			Topic:    "999999",
 			Message:  "This is a test message",
 			Username: username,
 		}
@@ -147,13 +154,13 @@ func TestAddMessageHandler(t *testing.T) {
 
 	t.Run("Missing_Fields", func(t *testing.T) {
 		reqBody := struct {
-			Topic    string `json:"topic"`
+			Topic    string `json:"-"`
 			Message  string `json:"message"`
-			Username string `json:"username"`
+			Username string `json:"-"`
 		}{
-			Topic:    "",
+			Topic:    topic.Ref(),
 			Message:  "",
-			Username: "",
+			Username: username,
 		}
 
 		rr := makeRequest(reqBody)
@@ -163,13 +170,38 @@ func TestAddMessageHandler(t *testing.T) {
 		}
 
 		body := rr.Body.String()
-		if body != "all fields (topic, message, username) are required\n" {
-			t.Errorf("expected response 'all fields (topic, message, username) are required', got %s", body)
+		if body != "message field is required\n" {
+			t.Errorf("expected response 'message field is required', got %s", body)
+		}
+	})
+
+	t.Run("Invalid_Topic", func(t *testing.T) {
+		reqBody := struct {
+			Topic    string `json:"-"`
+			Message  string `json:"message"`
+			Username string `json:"-"`
+		}{
+			Topic:    "Test Topic",
+			Message:  "This is a test message",
+			Username: username,
+		}
+
+		rr := makeRequest(reqBody)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		body := rr.Body.String()
+		if body != "invalid topic_id\n" {
+			t.Errorf("expected response 'invalid topic_id', got %s", body)
 		}
 	})
 
 	t.Run("Invalid_JSON", func(t *testing.T) {
-		req, _ := http.NewRequest(http.MethodPost, "/add-message", bytes.NewBuffer([]byte("invalid-json")))
+		req, _ := http.NewRequest(http.MethodPost, "/topics/"+topic.Ref()+"/messages", bytes.NewBuffer([]byte("invalid-json")))
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 
@@ -184,35 +216,16 @@ func TestAddMessageHandler(t *testing.T) {
 }
 
 func TestSetParentHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to create topics table: %v", err)
-	}
-
-	err = database.CreateMessageTable(db)
-	if err != nil {
-		t.Fatalf("failed to create messages table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
-	err = database.AddUser(db, username, "testuser@test.com", "password123")
+	err := store.AddUser(ctx, username, "testuser@test.com", "password123")
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
@@ -220,30 +233,24 @@ func TestSetParentHandler(t *testing.T) {
 	parentMessage := "This is a parent message."
 	childMessage := "This is a child message."
 
-	err = database.AddMessage(db, topicTitle, parentMessage, username)
+	_, err = store.AddMessage(ctx, topic.ID, parentMessage, username, 0)
 	if err != nil {
 		t.Fatalf("failed to add parent message: %v", err)
 	}
-	err = database.AddMessage(db, topicTitle, childMessage, username)
+	_, err = store.AddMessage(ctx, topic.ID, childMessage, username, 0)
 	if err != nil {
 		t.Fatalf("failed to add child message: %v", err)
 	}
 
-	var parentID, childID int
-	err = db.QueryRow("SELECT id FROM messages WHERE message = ?", parentMessage).Scan(&parentID)
-	if err != nil {
-		t.Fatalf("failed to get parent message ID: %v", err)
-	}
-	err = db.QueryRow("SELECT id FROM messages WHERE message = ?", childMessage).Scan(&childID)
-	if err != nil {
-		t.Fatalf("failed to get child message ID: %v", err)
-	}
+	parentID := findMessageID(t, store, topic.ID, parentMessage)
+	childID := findMessageID(t, store, topic.ID, childMessage)
 
-	handler := handlers.SetParentHandler(db)
+	handler := handlers.SetParentHandler(store)
 
 	t.Run("Successfully_Set_Parent", func(t *testing.T) {
-		reqBody := fmt.Sprintf(`{"parent_id": %d, "child_id": %d}`, parentID, childID)
-		req := httptest.NewRequest(http.MethodPost, "/set-parent", strings.NewReader(reqBody))
+		reqBody := fmt.Sprintf(`{"parent_id": %d}`, parentID)
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/parent", childID), strings.NewReader(reqBody))
+		req.SetPathValue("id", strconv.Itoa(childID))
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -262,60 +269,232 @@ func TestSetParentHandler(t *testing.T) {
 			t.Errorf("expected message 'parent set successfully', got '%s'", resp["message"])
 		}
 	})
+
+	t.Run("Reject_Cycle", func(t *testing.T) {
+		reqBody := fmt.Sprintf(`{"parent_id": %d}`, childID)
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/parent", parentID), strings.NewReader(reqBody))
+		req.SetPathValue("id", strconv.Itoa(parentID))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+		if w.Body.String() != database.ErrThreadCycle.Error()+"\n" {
+			t.Errorf("unexpected response: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Invalid_Message_ID", func(t *testing.T) {
+		reqBody := fmt.Sprintf(`{"parent_id": %d}`, parentID)
+		req := httptest.NewRequest(http.MethodPost, "/messages/abc/parent", strings.NewReader(reqBody))
+		req.SetPathValue("id", "abc")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest || w.Body.String() != "invalid message id\n" {
+			t.Errorf("expected 400 'invalid message id', got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Missing_Parent_ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/parent", childID), strings.NewReader(`{}`))
+		req.SetPathValue("id", strconv.Itoa(childID))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest || w.Body.String() != "parent_id is required\n" {
+			t.Errorf("expected 400 'parent_id is required', got %d: %s", w.Code, w.Body.String())
+		}
+	})
 }
 
-func TestGetMessagesByTopicHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
+func TestAddReplyHandler(t *testing.T) {
+	store := memstore.New()
+
+	username := "testuser"
+	topicTitle := "Replies"
+
+	err := store.AddUser(ctx, username, "testuser@test.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to add test user: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
+		t.Fatalf("failed to add test topic: %v", err)
 	}
-	defer db.Close()
+	elsewhere, err := store.AddTopic(ctx, database.TopicDraft{Title: "Elsewhere"}, username)
+	if err != nil {
+		t.Fatalf("failed to add test topic: %v", err)
+	}
+	parent, err := store.AddMessage(ctx, topic.ID, "parent", username, 0)
+	if err != nil {
+		t.Fatalf("failed to add parent message: %v", err)
+	}
+
+	handler := handlers.AddMessageHandler(store)
 
-	err = database.CreateUserTable(db)
+	makeRequest := func(topic *models.Topic, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/topics/"+topic.Ref()+"/messages", strings.NewReader(body))
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Reply", func(t *testing.T) {
+		rr := makeRequest(topic, fmt.Sprintf(`{"message":"reply","parent_id":%d}`, parent.ID))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+
+		var resp handlers.AddMessageResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Created.ParentID == nil || *resp.Created.ParentID != parent.ID {
+			t.Errorf("expected reply to parent %d, got %v", parent.ID, resp.Created.ParentID)
+		}
+	})
+
+	t.Run("Parent_Not_Found", func(t *testing.T) {
+		rr := makeRequest(topic, `{"message":"reply","parent_id":9999}`)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if rr.Body.String() != "parent message with ID 9999 not found\n" {
+			t.Errorf("unexpected response: %s", rr.Body.String())
+		}
+	})
+
+	t.Run("Parent_In_Other_Topic", func(t *testing.T) {
+		rr := makeRequest(elsewhere, fmt.Sprintf(`{"message":"reply","parent_id":%d}`, parent.ID))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("Invalid_Parent_ID", func(t *testing.T) {
+		rr := makeRequest(topic, `{"message":"reply","parent_id":-1}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestGetThreadHandler(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
 	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
+		t.Fatalf("failed to open in-memory database: %v", err)
 	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
 
-	err = database.CreateTopicTable(db)
+	_, err = database.MigrateUp(db)
 	if err != nil {
-		t.Fatalf("failed to create topics table: %v", err)
+		t.Fatalf("failed to migrate database: %v", err)
 	}
+	store := database.NewSQLiteStore(db)
+
+	username := "testuser"
+	topicTitle := "Test Topic"
 
-	err = database.CreateMessageTable(db)
+	err = store.AddUser(ctx, username, "testuser@test.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to add test user: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
-		t.Fatalf("failed to create messages table: %v", err)
+		t.Fatalf("failed to add test topic: %v", err)
+	}
+	root, err := store.AddMessage(ctx, topic.ID, "root", username, 0)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+	_, err = store.AddMessage(ctx, topic.ID, "reply", username, root.ID)
+	if err != nil {
+		t.Fatalf("failed to add reply: %v", err)
+	}
+
+	handler := handlers.GetThreadHandler(store)
+
+	makeRequest := func(topicID, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/topics/"+topicID+"/thread?"+query, nil)
+		req.SetPathValue("topic", topicID)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Nested", func(t *testing.T) {
+		rr := makeRequest(strconv.Itoa(root.TopicID), "depth=1&sort=likes")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var thread models.Thread
+		if err := json.NewDecoder(rr.Body).Decode(&thread); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(thread.Messages) != 1 || len(thread.Messages[0].Replies) != 1 {
+			t.Fatalf("expected one message with one reply, got %+v", thread.Messages)
+		}
+		if thread.Messages[0].Replies[0].Message.Message != "reply" {
+			t.Errorf("expected the reply to be nested, got %+v", thread.Messages[0].Replies[0])
+		}
+	})
+
+	t.Run("Topic_Not_Found", func(t *testing.T) {
+		rr := makeRequest("9999", "")
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	for _, query := range []string{"depth=-1", "depth=99", "sort=random", "limit=0", "cursor=bogus"} {
+		t.Run("Bad_Query_"+query, func(t *testing.T) {
+			rr := makeRequest(strconv.Itoa(root.TopicID), query)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+		})
 	}
+}
+
+func TestGetMessagesByTopicHandler(t *testing.T) {
+	store := memstore.New()
 
 	username := "testuser"
-	err = database.AddUser(db, username, "testuser@test.com", "password123")
+	err := store.AddUser(ctx, username, "testuser@test.com", "password123")
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, "testuser")
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, "testuser")
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	var topicID int
-	err = db.QueryRow("SELECT id FROM topics WHERE title = ?", topicTitle).Scan(&topicID)
-	if err != nil {
-		t.Fatalf("failed to fetch topic ID: %v", err)
-	}
+	topicID := topic.ID
 
 	messages := []string{"Message 1", "Message 2", "Message 3"}
 	for _, msg := range messages {
-		err = database.AddMessage(db, topicTitle, msg, "testuser")
+		_, err = store.AddMessage(ctx, topic.ID, msg, "testuser", 0)
 		if err != nil {
 			t.Fatalf("failed to add message '%s': %v", msg, err)
 		}
 	}
 
-	handler := handlers.GetMessagesByTopicHandler(db)
+	handler := handlers.GetMessagesByTopicHandler(store)
 
 	t.Run("Valid Request", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/messages?topic_id=%d", topicID), nil)
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics/%d/messages", topicID), nil)
+		req.SetPathValue("topic", strconv.Itoa(topicID))
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -324,11 +503,18 @@ func TestGetMessagesByTopicHandler(t *testing.T) {
 			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
 		}
 
-		var response []map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
+		var body struct {
+			Messages   []map[string]interface{} `json:"messages"`
+			NextCursor string                   `json:"next_cursor"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&body)
 		if err != nil {
 			t.Fatalf("failed to decode response: %v", err)
 		}
+		response := body.Messages
+		if body.NextCursor != "" {
+			t.Errorf("expected no next_cursor, got %q", body.NextCursor)
+		}
 
 		expectedMessages := []map[string]interface{}{
 			{"id": int64(1), "message": "Message 1", "likes": int64(0), "user_id": int64(1), "parent_id": nil},
@@ -368,8 +554,63 @@ func TestGetMessagesByTopicHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Paged", func(t *testing.T) {
+		list := func(query string) handlers.MessageListResponse {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics/%d/messages?%s", topicID, query), nil)
+			req.SetPathValue("topic", strconv.Itoa(topicID))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var page handlers.MessageListResponse
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			return page
+		}
+
+		first := list("sort=recent&limit=2")
+		if len(first.Messages) != 2 || first.Messages[0].Message != "Message 3" || first.Messages[1].Message != "Message 2" {
+			t.Fatalf("unexpected first page: %+v", first.Messages)
+		}
+		if first.NextCursor == "" {
+			t.Fatal("expected a next_cursor on the first page")
+		}
+
+		_, err := store.AddMessage(ctx, topic.ID, "Message 4", "testuser", 0)
+		if err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+
+		second := list("limit=2&cursor=" + first.NextCursor)
+		if len(second.Messages) != 1 || second.Messages[0].Message != "Message 1" {
+			t.Fatalf("unexpected second page: %+v", second.Messages)
+		}
+		if second.NextCursor != "" {
+			t.Errorf("expected no next_cursor on the last page, got %q", second.NextCursor)
+		}
+	})
+
+	t.Run("Invalid Paging", func(t *testing.T) {
+		for _, query := range []string{"sort=likes", "limit=0", "limit=abc", "cursor=not-a-cursor"} {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/topics/%d/messages?%s", topicID, query), nil)
+			req.SetPathValue("topic", strconv.Itoa(topicID))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
 	t.Run("Missing Topic ID", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+		req := httptest.NewRequest(http.MethodGet, "/topics//messages", nil)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -385,7 +626,8 @@ func TestGetMessagesByTopicHandler(t *testing.T) {
 	})
 
 	t.Run("Invalid Topic ID", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/messages?topic_id=invalid", nil)
+		req := httptest.NewRequest(http.MethodGet, "/topics/invalid/messages", nil)
+		req.SetPathValue("topic", "invalid")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -401,7 +643,8 @@ func TestGetMessagesByTopicHandler(t *testing.T) {
 	})
 
 	t.Run("Non-Existent Topic", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/messages?topic_id=9999", nil)
+		req := httptest.NewRequest(http.MethodGet, "/topics/9999/messages", nil)
+		req.SetPathValue("topic", "9999")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -410,19 +653,20 @@ func TestGetMessagesByTopicHandler(t *testing.T) {
 			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
 		}
 
-		var response []string
+		var response handlers.MessageListResponse
 		err := json.NewDecoder(w.Body).Decode(&response)
 		if err != nil {
 			t.Fatalf("failed to decode response: %v", err)
 		}
 
-		if len(response) != 0 {
-			t.Errorf("expected empty response, got %v", response)
+		if len(response.Messages) != 0 {
+			t.Errorf("expected empty response, got %v", response.Messages)
 		}
 	})
 
 	t.Run("Invalid Method", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodPost, "/messages?topic_id=1", nil)
+		req := httptest.NewRequest(http.MethodPost, "/topics/1/messages", nil)
+		req.SetPathValue("topic", "1")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -439,56 +683,34 @@ func TestGetMessagesByTopicHandler(t *testing.T) {
 }
 
 func TestLikeMessageHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to create topics table: %v", err)
-	}
-
-	err = database.CreateMessageTable(db)
-	if err != nil {
-		t.Fatalf("failed to create messages table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
-	err = database.AddUser(db, username, "testuser@test.com", "password123")
+	err := store.AddUser(ctx, username, "testuser@test.com", "password123")
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
 	messageContent := "Test Message"
-	err = database.AddMessage(db, topicTitle, messageContent, username)
+	_, err = store.AddMessage(ctx, topic.ID, messageContent, username, 0)
 	if err != nil {
 		t.Fatalf("failed to add test message: %v", err)
 	}
 
-	var messageID int
-	err = db.QueryRow("SELECT id FROM messages WHERE message = ?", messageContent).Scan(&messageID)
-	if err != nil {
-		t.Fatalf("failed to fetch message ID: %v", err)
-	}
+	messageID := findMessageID(t, store, topic.ID, messageContent)
 
-	handler := handlers.LikeMessageHandler(db)
+	handler := handlers.LikeMessageHandler(store)
 
 	t.Run("Valid Like", func(t *testing.T) {
-		reqBody := fmt.Sprintf(`{"message_id": %d}`, messageID)
-		req := httptest.NewRequest(http.MethodPost, "/like", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/like", messageID), nil)
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -509,8 +731,51 @@ func TestLikeMessageHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Double Like", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/like", messageID), nil)
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/like", messageID), nil)
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Unknown Message", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/messages/9999/like", nil)
+		req.SetPathValue("id", "9999")
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+
+		expectedMessage := "message not found\n"
+		if w.Body.String() != expectedMessage {
+			t.Errorf("expected response '%s', got '%s'", expectedMessage, w.Body.String())
+		}
+	})
+
 	t.Run("Invalid Method", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/like", nil)
+		req := httptest.NewRequest(http.MethodGet, "/messages/1/like", nil)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -527,56 +792,34 @@ func TestLikeMessageHandler(t *testing.T) {
 }
 
 func TestDislikeMessageHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to create topics table: %v", err)
-	}
-
-	err = database.CreateMessageTable(db)
-	if err != nil {
-		t.Fatalf("failed to create messages table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
-	err = database.AddUser(db, username, "testuser@test.com", "password123")
+	err := store.AddUser(ctx, username, "testuser@test.com", "password123")
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
 	messageContent := "Test Message"
-	err = database.AddMessage(db, topicTitle, messageContent, username)
+	_, err = store.AddMessage(ctx, topic.ID, messageContent, username, 0)
 	if err != nil {
 		t.Fatalf("failed to add test message: %v", err)
 	}
 
-	var messageID int
-	err = db.QueryRow("SELECT id FROM messages WHERE message = ?", messageContent).Scan(&messageID)
-	if err != nil {
-		t.Fatalf("failed to fetch message ID: %v", err)
-	}
+	messageID := findMessageID(t, store, topic.ID, messageContent)
 
-	handler := handlers.DislikeMessageHandler(db)
+	handler := handlers.DislikeMessageHandler(store)
 
 	t.Run("Valid Dislike", func(t *testing.T) {
-		reqBody := fmt.Sprintf(`{"message_id": %d}`, messageID)
-		req := httptest.NewRequest(http.MethodPost, "/dislike", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/dislike", messageID), nil)
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -597,8 +840,26 @@ func TestDislikeMessageHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Unknown Message", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/messages/9999/dislike", nil)
+		req.SetPathValue("id", "9999")
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+
+		expectedMessage := "message not found\n"
+		if w.Body.String() != expectedMessage {
+			t.Errorf("expected response '%s', got '%s'", expectedMessage, w.Body.String())
+		}
+	})
+
 	t.Run("Invalid Method", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/dislike", nil)
+		req := httptest.NewRequest(http.MethodGet, "/messages/1/dislike", nil)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -613,3 +874,230 @@ func TestDislikeMessageHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestReactionHandlers(t *testing.T) {
+	store := memstore.New()
+
+	username := "testuser"
+	err := store.AddUser(ctx, username, "testuser@test.com", "password123")
+	if err != nil {
+		t.Fatalf("failed to add test user: %v", err)
+	}
+
+	topicTitle := "Test Topic"
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("failed to add test topic: %v", err)
+	}
+
+	messageContent := "Test Message"
+	_, err = store.AddMessage(ctx, topic.ID, messageContent, username, 0)
+	if err != nil {
+		t.Fatalf("failed to add test message: %v", err)
+	}
+
+	messageID := findMessageID(t, store, topic.ID, messageContent)
+
+	addReaction := func(t *testing.T, reaction string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"reaction":%q}`, reaction)
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/reactions", messageID), strings.NewReader(body))
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+		handlers.AddReactionHandler(store).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Add_reaction", func(t *testing.T) {
+		w := addReaction(t, "heart")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Unknown_reaction", func(t *testing.T) {
+		w := addReaction(t, "shrug")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+
+		if w.Body.String() != "unknown reaction\n" {
+			t.Errorf("expected response 'unknown reaction', got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("List_reactions", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/messages/%d/reactions", messageID), nil)
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		w := httptest.NewRecorder()
+		handlers.GetMessageReactionsHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		var reactions []map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&reactions); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if len(reactions) != 1 || reactions[0]["username"] != username || reactions[0]["reaction"] != "heart" {
+			t.Errorf("expected a single heart from %s, got %v", username, reactions)
+		}
+	})
+
+	t.Run("Remove_reaction", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/messages/%d/reactions/heart", messageID), nil)
+		req.SetPathValue("id", strconv.Itoa(messageID))
+		req.SetPathValue("reaction", "heart")
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+		handlers.RemoveReactionHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		handlers.RemoveReactionHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d for a missing reaction, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("Unknown_message", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/messages/9999/reactions", nil)
+		req.SetPathValue("id", "9999")
+		w := httptest.NewRecorder()
+		handlers.GetMessageReactionsHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
+
+func TestDeleteMessageHandler(t *testing.T) {
+	store := memstore.New()
+
+	for _, name := range []string{"author", "stranger", "moderator"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password123"); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+	}
+	if err := store.SetRole(ctx, "moderator", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moderator a moderator: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Deletions"}, "author")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	first, err := store.AddMessage(ctx, topic.ID, "first", "author", 0)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+	second, err := store.AddMessage(ctx, topic.ID, "second", "author", 0)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+
+	handler := handlers.DeleteMessageHandler(store)
+
+	tests := []struct {
+		name     string
+		caller   string
+		id       int
+		wantCode int
+		wantBody string
+	}{
+		{"Someone_else", "stranger", first.ID, http.StatusForbidden, "only the message's author or a moderator may delete it\n"},
+		{"Unauthenticated", "", first.ID, http.StatusUnauthorized, "authentication required\n"},
+		{"Author_deletes", "author", first.ID, http.StatusOK, ""},
+		{"Already_deleted", "author", first.ID, http.StatusGone, "message has been deleted\n"},
+		{"Moderator_deletes", "moderator", second.ID, http.StatusOK, ""},
+		{"Unknown_message", "author", 9999, http.StatusNotFound, "message not found\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/messages/%d", tt.id), nil)
+			req.SetPathValue("id", strconv.Itoa(tt.id))
+			if tt.caller != "" {
+				req = asUser(t, store, req, tt.caller)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, rr.Code, rr.Body.String())
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("expected response %q, got %q", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	msg, err := store.GetMessage(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("failed to fetch deleted message: %v", err)
+	}
+	if msg.Message != models.MessageTombstone || msg.DeletedAt == nil {
+		t.Errorf("expected a tombstone, got %+v", msg)
+	}
+	topic, err = store.GetTopic(ctx, topic.ID)
+	if err != nil {
+		t.Fatalf("failed to fetch topic: %v", err)
+	}
+	if topic.Messages != 0 {
+		t.Errorf("expected deleted messages to leave the topic's count, got %d", topic.Messages)
+	}
+}
+
+func TestPurgeMessageHandler(t *testing.T) {
+	store := memstore.New()
+
+	if err := store.AddUser(ctx, "moderator", "moderator@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	if err := store.SetRole(ctx, "moderator", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moderator a moderator: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Purges"}, "moderator")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	root, err := store.AddMessage(ctx, topic.ID, "root", "moderator", 0)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+	reply, err := store.AddMessage(ctx, topic.ID, "reply", "moderator", root.ID)
+	if err != nil {
+		t.Fatalf("failed to add reply: %v", err)
+	}
+
+	handler := handlers.PurgeMessageHandler(store)
+	purge := func(id int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/purge", id), nil)
+		req.SetPathValue("id", strconv.Itoa(id))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := purge(root.ID)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var resp handlers.PurgeMessageResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if fmt.Sprint(resp.Purged) != fmt.Sprint([]int{root.ID, reply.ID}) {
+		t.Errorf("expected root and reply to be purged, got %v", resp.Purged)
+	}
+
+	if rr := purge(root.ID); rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
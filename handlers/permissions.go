@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// RequireRole rejects requests whose user does not hold role or a more
+// privileged one. It must run inside RequireAuth, and inside
+// EnforceTwoFactor where that is used.
+func RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !user.HasRole(role) {
+			if missingTwoFactor(r, role) {
+				http.Error(w, "two-factor authentication is required for your role", http.StatusForbidden)
+				return
+			}
+			http.Error(w, "insufficient permissions", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireVerifiedEmail rejects requests from users who have not verified
+// their email address. It must run inside RequireAuth.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !user.EmailVerified {
+			http.Error(w, "verify your email address before posting", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canModerate reports whether user may change or remove something owned by
+// ownerID: either it is theirs or they are a moderator.
+func canModerate(user *models.User, ownerID int) bool {
+	return (ownerID != 0 && user.ID == ownerID) || user.HasRole(models.RoleModerator)
+}
+
+// isAdmin reports whether the request was made by a signed-in admin.
+func isAdmin(r *http.Request) bool {
+	user, ok := CurrentUser(r)
+	return ok && user.HasRole(models.RoleAdmin)
+}
+
+// canOpenTopics reports whether user may open topics in category. Categories
+// open to users admit anyone who is signed in.
+func canOpenTopics(user *models.User, category *models.Category) bool {
+	return category.TopicRole == models.RoleUser || user.HasRole(category.TopicRole)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dDogge/Brainwave/ratelimit"
+)
+
+// NewAccountAge is how old an account must be before it is held to the
+// regular limits of a RateLimitPolicy rather than its NewUser ones.
+const NewAccountAge = 24 * time.Hour
+
+// RateLimitPolicy is how often one route may be used. Every request takes
+// a token from the client's IP bucket and, when signed in, from the user's
+// bucket as well; it is refused if either is empty, and then costs neither.
+// A zero limit leaves that bucket out.
+type RateLimitPolicy struct {
+	// Name keeps the route's buckets apart from other routes'.
+	Name    string
+	User    ratelimit.Limit
+	NewUser ratelimit.Limit
+	IP      ratelimit.Limit
+}
+
+// Rate limits for the routes that create content.
+var (
+	TopicRateLimit = RateLimitPolicy{
+		Name:    "topics",
+		User:    ratelimit.Limit{Burst: 1, Per: time.Minute},
+		NewUser: ratelimit.Limit{Burst: 1, Per: 10 * time.Minute},
+		IP:      ratelimit.Limit{Burst: 5, Per: time.Minute},
+	}
+	MessageRateLimit = RateLimitPolicy{
+		Name:    "messages",
+		User:    ratelimit.Limit{Burst: 10, Per: time.Minute},
+		NewUser: ratelimit.Limit{Burst: 3, Per: time.Minute},
+		IP:      ratelimit.Limit{Burst: 30, Per: time.Minute},
+	}
+	ReactionRateLimit = RateLimitPolicy{
+		Name:    "reactions",
+		User:    ratelimit.Limit{Burst: 30, Per: time.Minute},
+		NewUser: ratelimit.Limit{Burst: 10, Per: time.Minute},
+		IP:      ratelimit.Limit{Burst: 90, Per: time.Minute},
+	}
+)
+
+// RateLimit refuses requests with a 429 once the client has used up its
+// tokens under policy. Every response carries RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers for the tightest bucket,
+// and refusals a Retry-After as well. It should run inside RequireAuth so
+// the user is known. If the backend fails the request is let through.
+func RateLimit(backend ratelimit.Backend, policy RateLimitPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type take struct {
+			key   string
+			limit ratelimit.Limit
+		}
+		takes := []take{{policy.Name + ":ip:" + clientIP(r), policy.IP}}
+		if user, ok := CurrentUser(r); ok {
+			limit := policy.User
+			if !user.CreationDate.IsZero() && time.Since(user.CreationDate) < NewAccountAge && !policy.NewUser.Unlimited() {
+				limit = policy.NewUser
+			}
+			takes = append(takes, take{fmt.Sprintf("%s:user:%d", policy.Name, user.ID), limit})
+		}
+
+		var tightest *ratelimit.Result
+		var taken []take
+		for _, t := range takes {
+			if t.limit.Unlimited() {
+				continue
+			}
+
+			result, err := backend.Take(r.Context(), t.key, t.limit)
+			if err != nil {
+				log.Printf("error checking rate limit %s: %v", t.key, err)
+				continue
+			}
+
+			if tightest == nil || !result.Allowed || (tightest.Allowed && result.Remaining < tightest.Remaining) {
+				tightest = &result
+			}
+			if !result.Allowed {
+				// Hand back what the earlier buckets gave, so a refused
+				// request does not count against them.
+				for _, t := range taken {
+					if err := backend.Refund(r.Context(), t.key, t.limit); err != nil {
+						log.Printf("error refunding rate limit %s: %v", t.key, err)
+					}
+				}
+				break
+			}
+			taken = append(taken, t)
+		}
+
+		if tightest != nil {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+
+			if !tightest.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(tightest.RetryAfter), 1)))
+				http.Error(w, "rate limit exceeded, try again later", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,157 @@
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/ratelimit"
+)
+
+// brokenBackend fails every take.
+type brokenBackend struct{}
+
+func (brokenBackend) Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("backend unavailable")
+}
+
+func (brokenBackend) Refund(ctx context.Context, key string, limit ratelimit.Limit) error {
+	return errors.New("backend unavailable")
+}
+
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	send := func(h http.Handler, user *models.User, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/topics", nil)
+		req.RemoteAddr = ip + ":4000"
+		if user != nil {
+			req = req.WithContext(handlers.ContextWithUser(req.Context(), user))
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	alice := &models.User{ID: 1, Username: "alice", CreationDate: old}
+	bob := &models.User{ID: 2, Username: "bob", CreationDate: old}
+	newcomer := &models.User{ID: 3, Username: "newcomer", CreationDate: time.Now()}
+
+	t.Run("Per_user", func(t *testing.T) {
+		h := handlers.RateLimit(ratelimit.NewMemoryBackend(), handlers.RateLimitPolicy{
+			Name: "test",
+			User: ratelimit.Limit{Burst: 2, Per: time.Minute},
+		}, ok)
+
+		for want := 1; want >= 0; want-- {
+			rr := send(h, alice, "10.0.0.1")
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("expected status %d, got %d", http.StatusCreated, rr.Code)
+			}
+			if rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != strconv.Itoa(want) {
+				t.Errorf("unexpected RateLimit headers: %v", rr.Header())
+			}
+		}
+
+		// Changing IP does not help.
+		rr := send(h, alice, "10.0.0.2")
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if rr.Header().Get("Retry-After") != "30" || rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("RateLimit-Reset") != "60" {
+			t.Errorf("unexpected headers on a refusal: %v", rr.Header())
+		}
+
+		if rr := send(h, bob, "10.0.0.1"); rr.Code != http.StatusCreated {
+			t.Errorf("expected other users to have their own bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Per_IP", func(t *testing.T) {
+		h := handlers.RateLimit(ratelimit.NewMemoryBackend(), handlers.RateLimitPolicy{
+			Name: "test",
+			User: ratelimit.Limit{Burst: 10, Per: time.Minute},
+			IP:   ratelimit.Limit{Burst: 2, Per: time.Minute},
+		}, ok)
+
+		send(h, alice, "10.0.0.1")
+		rr := send(h, bob, "10.0.0.1")
+		if rr.Code != http.StatusCreated || rr.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("expected the tighter IP bucket in the headers, got %d %v", rr.Code, rr.Header())
+		}
+
+		if rr := send(h, nil, "10.0.0.1"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected the IP to be limited, got %d", rr.Code)
+		}
+		if rr := send(h, nil, "10.0.0.2"); rr.Code != http.StatusCreated {
+			t.Errorf("expected other IPs to have their own bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Refused_by_user", func(t *testing.T) {
+		h := handlers.RateLimit(ratelimit.NewMemoryBackend(), handlers.RateLimitPolicy{
+			Name: "test",
+			User: ratelimit.Limit{Burst: 1, Per: time.Minute},
+			IP:   ratelimit.Limit{Burst: 2, Per: time.Minute},
+		}, ok)
+
+		send(h, alice, "10.0.0.1")
+		if rr := send(h, alice, "10.0.0.1"); rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected the user to be limited, got %d", rr.Code)
+		}
+
+		// The refused request gave its IP token back.
+		rr := send(h, bob, "10.0.0.1")
+		if rr.Code != http.StatusCreated || rr.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("expected the IP bucket to be charged only once, got %d %v", rr.Code, rr.Header())
+		}
+	})
+
+	t.Run("New_accounts", func(t *testing.T) {
+		h := handlers.RateLimit(ratelimit.NewMemoryBackend(), handlers.RateLimitPolicy{
+			Name:    "test",
+			User:    ratelimit.Limit{Burst: 3, Per: time.Minute},
+			NewUser: ratelimit.Limit{Burst: 1, Per: time.Minute},
+		}, ok)
+
+		send(h, newcomer, "10.0.0.1")
+		if rr := send(h, newcomer, "10.0.0.1"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected accounts under a day old to get the stricter limit, got %d", rr.Code)
+		}
+
+		send(h, alice, "10.0.0.1")
+		if rr := send(h, alice, "10.0.0.1"); rr.Code != http.StatusCreated {
+			t.Errorf("expected older accounts to get the regular limit, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Routes_kept_apart", func(t *testing.T) {
+		backend := ratelimit.NewMemoryBackend()
+		limit := ratelimit.Limit{Burst: 1, Per: time.Minute}
+		topics := handlers.RateLimit(backend, handlers.RateLimitPolicy{Name: "topics", User: limit}, ok)
+		messages := handlers.RateLimit(backend, handlers.RateLimitPolicy{Name: "messages", User: limit}, ok)
+
+		send(topics, alice, "10.0.0.1")
+		if rr := send(messages, alice, "10.0.0.1"); rr.Code != http.StatusCreated {
+			t.Errorf("expected each route to have its own buckets, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Backend_failure", func(t *testing.T) {
+		h := handlers.RateLimit(brokenBackend{}, handlers.TopicRateLimit, ok)
+
+		rr := send(h, alice, "10.0.0.1")
+		if rr.Code != http.StatusCreated || rr.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("expected requests to go through unlimited, got %d %v", rr.Code, rr.Header())
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/diff"
+	"github.com/dDogge/Brainwave/models"
+)
+
+type EditMessageResponse struct {
+	Message string          `json:"message"`
+	Edited  *models.Message `json:"edited"`
+}
+
+type MessageRevisionsResponse struct {
+	MessageID int                      `json:"message_id"`
+	Revisions []models.MessageRevision `json:"revisions"`
+}
+
+type RevisionDiffResponse struct {
+	MessageID int           `json:"message_id"`
+	From      int           `json:"from"`
+	To        int           `json:"to"`
+	Changes   []diff.Change `json:"changes"`
+}
+
+// EditMessageHandler replaces a message's text. Only its author or a
+// moderator may edit it; the previous text is kept as a revision.
+func EditMessageHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody struct {
+			Message string `json:"message"`
+		}
+
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Message == "" {
+			http.Error(w, "message field is required", http.StatusBadRequest)
+			return
+		}
+
+		msg, err := store.GetMessage(r.Context(), messageID)
+		if err != nil {
+			writeRevisionError(w, err, "failed to edit message")
+			return
+		}
+
+		if !canModerate(user, msg.UserID) {
+			http.Error(w, "only the message's author or a moderator may edit it", http.StatusForbidden)
+			return
+		}
+
+		edited, err := store.EditMessage(r.Context(), messageID, user.Username, reqBody.Message)
+		if err != nil {
+			writeRevisionError(w, err, "failed to edit message")
+			return
+		}
+
+		resp := EditMessageResponse{
+			Message: "message edited successfully",
+			Edited:  edited,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// GetMessageRevisionsHandler lists every version of a message's text,
+// oldest first.
+func GetMessageRevisionsHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		revisions, err := store.GetMessageRevisions(r.Context(), messageID)
+		if err != nil {
+			writeRevisionError(w, err, "failed to fetch revisions")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(MessageRevisionsResponse{MessageID: messageID, Revisions: revisions})
+	}
+}
+
+// DiffMessageRevisionsHandler compares two versions of a message word by
+// word. The versions come from the from and to query parameters; to
+// defaults to the current text and from to the version before to.
+func DiffMessageRevisionsHandler(store database.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		messageID, ok := pathID(r, "id")
+		if !ok {
+			http.Error(w, "message_id is required", http.StatusBadRequest)
+			return
+		}
+
+		revisions, err := store.GetMessageRevisions(r.Context(), messageID)
+		if err != nil {
+			writeRevisionError(w, err, "failed to fetch revisions")
+			return
+		}
+
+		latest := len(revisions)
+		version := func(name string, fallback int) (int, bool) {
+			v := r.URL.Query().Get(name)
+			if v == "" {
+				return fallback, true
+			}
+			n, err := strconv.Atoi(v)
+			return n, err == nil && n >= 1 && n <= latest
+		}
+
+		to, ok := version("to", latest)
+		if !ok {
+			http.Error(w, fmt.Sprintf("to must be a version between 1 and %d", latest), http.StatusBadRequest)
+			return
+		}
+		from, ok := version("from", max(to-1, 1))
+		if !ok {
+			http.Error(w, fmt.Sprintf("from must be a version between 1 and %d", latest), http.StatusBadRequest)
+			return
+		}
+
+		resp := RevisionDiffResponse{
+			MessageID: messageID,
+			From:      from,
+			To:        to,
+			Changes:   diff.Words(revisions[from-1].Message, revisions[to-1].Message),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// writeRevisionError maps the errors returned when editing a message or
+// reading its revisions to HTTP responses, falling back to fallback with a
+// 500.
+func writeRevisionError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrMessageDeleted):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
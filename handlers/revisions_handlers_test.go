@@ -0,0 +1,157 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
+	"github.com/dDogge/Brainwave/diff"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+)
+
+func TestEditMessageHandler(t *testing.T) {
+	store := memstore.New()
+
+	for _, name := range []string{"author", "stranger", "moderator"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password123"); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+	}
+	if err := store.SetRole(ctx, "moderator", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moderator a moderator: %v", err)
+	}
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Edits"}, "author")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	msg, err := store.AddMessage(ctx, topic.ID, "original text", "author", 0)
+	if err != nil {
+		t.Fatalf("failed to add message: %v", err)
+	}
+
+	handler := handlers.EditMessageHandler(store)
+	edit := func(caller string, id int, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/messages/%d", id), strings.NewReader(body))
+		req.SetPathValue("id", fmt.Sprint(id))
+		if caller != "" {
+			req = asUser(t, store, req, caller)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Author_edits", func(t *testing.T) {
+		rr := edit("author", msg.ID, `{"message":"fixed text"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var resp handlers.EditMessageResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Edited.Message != "fixed text" || resp.Edited.EditedAt == nil {
+			t.Errorf("unexpected edited message: %+v", resp.Edited)
+		}
+	})
+
+	t.Run("Moderator_edits", func(t *testing.T) {
+		rr := edit("moderator", msg.ID, `{"message":"moderated text"}`)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+	})
+
+	tests := []struct {
+		name     string
+		caller   string
+		id       int
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"Someone_else", "stranger", msg.ID, `{"message":"vandalism"}`, http.StatusForbidden, "only the message's author or a moderator may edit it\n"},
+		{"Unauthenticated", "", msg.ID, `{"message":"anon"}`, http.StatusUnauthorized, "authentication required\n"},
+		{"Empty_message", "author", msg.ID, `{"message":""}`, http.StatusBadRequest, "message field is required\n"},
+		{"Invalid_JSON", "author", msg.ID, `{`, http.StatusBadRequest, "invalid JSON format\n"},
+		{"Unknown_message", "author", 9999, `{"message":"x"}`, http.StatusNotFound, "message not found\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := edit(tt.caller, tt.id, tt.body)
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, rr.Code)
+			}
+			if rr.Body.String() != tt.wantBody {
+				t.Errorf("expected response %q, got %q", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	t.Run("Revisions", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/messages/%d/revisions", msg.ID), nil)
+		req.SetPathValue("id", fmt.Sprint(msg.ID))
+		rr := httptest.NewRecorder()
+		handlers.GetMessageRevisionsHandler(store).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		var resp handlers.MessageRevisionsResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		var texts []string
+		for _, r := range resp.Revisions {
+			texts = append(texts, r.Message)
+		}
+		if strings.Join(texts, "|") != "original text|fixed text|moderated text" {
+			t.Errorf("unexpected revisions: %v", texts)
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		diffTests := []struct {
+			query    string
+			wantCode int
+			from, to int
+			changes  []diff.Change
+		}{
+			{"", http.StatusOK, 2, 3, []diff.Change{{Op: diff.Delete, Text: "fixed"}, {Op: diff.Insert, Text: "moderated"}, {Op: diff.Equal, Text: " text"}}},
+			{"?from=1&to=2", http.StatusOK, 1, 2, []diff.Change{{Op: diff.Delete, Text: "original"}, {Op: diff.Insert, Text: "fixed"}, {Op: diff.Equal, Text: " text"}}},
+			{"?to=1", http.StatusOK, 1, 1, []diff.Change{{Op: diff.Equal, Text: "original text"}}},
+			{"?to=4", http.StatusBadRequest, 0, 0, nil},
+			{"?from=0", http.StatusBadRequest, 0, 0, nil},
+		}
+		for _, tt := range diffTests {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/messages/%d/revisions/diff%s", msg.ID, tt.query), nil)
+			req.SetPathValue("id", fmt.Sprint(msg.ID))
+			rr := httptest.NewRecorder()
+			handlers.DiffMessageRevisionsHandler(store).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("%s: expected status %d, got %d", tt.query, tt.wantCode, rr.Code)
+				continue
+			}
+			if tt.wantCode != http.StatusOK {
+				continue
+			}
+
+			var resp handlers.RevisionDiffResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.From != tt.from || resp.To != tt.to || fmt.Sprint(resp.Changes) != fmt.Sprint(tt.changes) {
+				t.Errorf("%s: unexpected diff %+v", tt.query, resp)
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/events"
+	"github.com/dDogge/Brainwave/mail"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/presence"
+	"github.com/dDogge/Brainwave/ratelimit"
+)
+
+const apiPrefix = "/api/v1"
+
+// RegisterRoutes mounts every API handler on mux under the /api/v1 prefix.
+// Topics are addressed as /topics/{id}-{slug}, where only the ID matters;
+// see GetTopicHandler for how other forms are redirected.
+// Routes that act on behalf of a user are wrapped in RequireAuth, and those
+// reserved for moderators or admins in RequireRole as well. Topic event
+// streams are served from bus, which the store should be publishing to, and
+// the presence socket from hub. Password reset and email verification codes
+// are delivered by mailer. Routes that create content are rate limited with
+// buckets kept in limiter, and refused to users whose email address is not
+// verified.
+// Signed-in requests pass through EnforceTwoFactor, so moderators and admins
+// who must use two-factor authentication cannot act as such without it.
+func RegisterRoutes(mux *http.ServeMux, store database.Store, bus *events.Bus, hub *presence.Hub, mailer mail.Mailer, limiter ratelimit.Backend) {
+	authed := func(h http.HandlerFunc) http.Handler {
+		return RequireAuth(store, EnforceTwoFactor(store, h))
+	}
+	moderator := func(h http.HandlerFunc) http.Handler {
+		return RequireAuth(store, EnforceTwoFactor(store, RequireRole(models.RoleModerator, h)))
+	}
+	admin := func(h http.HandlerFunc) http.Handler {
+		return RequireAuth(store, EnforceTwoFactor(store, RequireRole(models.RoleAdmin, h)))
+	}
+	limited := func(policy RateLimitPolicy, h http.HandlerFunc) http.Handler {
+		return RequireAuth(store, EnforceTwoFactor(store, RateLimit(limiter, policy, h)))
+	}
+	posting := func(policy RateLimitPolicy, h http.HandlerFunc) http.Handler {
+		return RequireAuth(store, EnforceTwoFactor(store, RequireVerifiedEmail(RateLimit(limiter, policy, h))))
+	}
+
+	mux.HandleFunc("POST "+apiPrefix+"/users", CreateUserHandler(store, mailer))
+	mux.Handle("GET "+apiPrefix+"/users", OptionalAuth(store, EnforceTwoFactor(store, GetAllUsersHandler(store))))
+	mux.Handle("PUT "+apiPrefix+"/users/{username}/role", admin(SetRoleHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/users/{username}/unlock", admin(UnlockLoginHandler(store)))
+	mux.Handle("GET "+apiPrefix+"/users/{username}/logins", admin(GetLoginAttemptsHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/users/{username}/2fa", admin(ResetTwoFactorHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/users/me", authed(RemoveUserHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/users/me/password", authed(ChangePasswordHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/users/me/email", authed(ChangeEmailHandler(store, mailer)))
+	mux.Handle("POST "+apiPrefix+"/users/me/username", authed(ChangeUsernameHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/users/me/2fa", authed(BeginTwoFactorHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/users/me/2fa", authed(DisableTwoFactorHandler(store, store)))
+	mux.Handle("POST "+apiPrefix+"/users/me/2fa/confirm", authed(ConfirmTwoFactorHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/users/me/2fa/recovery-codes", authed(RegenerateRecoveryCodesHandler(store, store)))
+
+	mux.HandleFunc("POST "+apiPrefix+"/auth/check-password", CheckPasswordHandler(store, store, store))
+	mux.HandleFunc("POST "+apiPrefix+"/auth/login", LoginHandler(store, store, store, store))
+	mux.HandleFunc("POST "+apiPrefix+"/auth/login/2fa", LoginTwoFactorHandler(store, store, store))
+	mux.HandleFunc("POST "+apiPrefix+"/auth/logout", LogoutHandler(store))
+	mux.Handle("POST "+apiPrefix+"/auth/logout-all", authed(LogoutEverywhereHandler(store)))
+	mux.HandleFunc("POST "+apiPrefix+"/password-reset", GeneratePasswordResetCodeHandler(store, mailer))
+	mux.HandleFunc("POST "+apiPrefix+"/password-reset/confirm", ResetPasswordHandler(store))
+	mux.Handle("POST "+apiPrefix+"/email-verification", authed(ResendVerificationHandler(store, mailer)))
+	mux.HandleFunc("POST "+apiPrefix+"/email-verification/confirm", VerifyEmailHandler(store))
+
+	mux.HandleFunc("GET "+apiPrefix+"/topics", GetAllTopicsHandler(store))
+	mux.Handle("POST "+apiPrefix+"/topics", posting(TopicRateLimit, AddTopicHandler(store, store)))
+	mux.HandleFunc("GET "+apiPrefix+"/topics/count", CountTopicsHandler(store))
+	mux.HandleFunc("GET "+apiPrefix+"/topics/{topic}", GetTopicHandler(store))
+	mux.Handle("PATCH "+apiPrefix+"/topics/{topic}", authed(RenameTopicHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/topics/{topic}", authed(RemoveTopicHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/topics/{topic}/upvote", authed(UpVoteTopicHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/topics/{topic}/downvote", authed(DownVoteTopicHandler(store)))
+	mux.Handle("GET "+apiPrefix+"/topics/{topic}/vote", authed(GetTopicVoteHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/topics/{topic}/vote", authed(RetractTopicVoteHandler(store)))
+	mux.Handle("PUT "+apiPrefix+"/topics/{topic}/tags", authed(SetTopicTagsHandler(store)))
+	mux.Handle("PUT "+apiPrefix+"/topics/{topic}/category", moderator(MoveTopicHandler(store, store)))
+	mux.Handle("PUT "+apiPrefix+"/topics/{topic}/lock", moderator(SetTopicStateHandler(store, models.TopicLocked)))
+	mux.Handle("DELETE "+apiPrefix+"/topics/{topic}/lock", moderator(SetTopicStateHandler(store, models.TopicLocked)))
+	mux.Handle("PUT "+apiPrefix+"/topics/{topic}/pin", moderator(SetTopicStateHandler(store, models.TopicPinned)))
+	mux.Handle("DELETE "+apiPrefix+"/topics/{topic}/pin", moderator(SetTopicStateHandler(store, models.TopicPinned)))
+	mux.Handle("PUT "+apiPrefix+"/topics/{topic}/archive", moderator(SetTopicStateHandler(store, models.TopicArchived)))
+	mux.Handle("DELETE "+apiPrefix+"/topics/{topic}/archive", moderator(SetTopicStateHandler(store, models.TopicArchived)))
+	mux.Handle("POST "+apiPrefix+"/topics/{topic}/merge", moderator(MergeTopicHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/topics/{topic}/messages", posting(MessageRateLimit, AddMessageHandler(store)))
+	mux.HandleFunc("GET "+apiPrefix+"/topics/{topic}/messages", GetMessagesByTopicHandler(store))
+	mux.HandleFunc("GET "+apiPrefix+"/topics/{topic}/thread", GetThreadHandler(store))
+	mux.HandleFunc("GET "+apiPrefix+"/topics/{topic}/events", TopicEventsHandler(store, bus))
+
+	mux.HandleFunc("GET "+apiPrefix+"/categories", GetCategoriesHandler(store))
+	mux.Handle("POST "+apiPrefix+"/categories", admin(AddCategoryHandler(store)))
+	mux.HandleFunc("GET "+apiPrefix+"/categories/{id}", GetCategoryHandler(store))
+	mux.Handle("PUT "+apiPrefix+"/categories/{id}", admin(UpdateCategoryHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/categories/{id}", admin(RemoveCategoryHandler(store)))
+	mux.HandleFunc("GET "+apiPrefix+"/categories/{id}/topics", GetAllTopicsHandler(store))
+
+	mux.HandleFunc("GET "+apiPrefix+"/tags", ListTagsHandler(store))
+	mux.Handle("PUT "+apiPrefix+"/tags/{name}", admin(RenameTagHandler(store)))
+
+	mux.Handle("PATCH "+apiPrefix+"/messages/{id}", posting(MessageRateLimit, EditMessageHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/messages/{id}", authed(DeleteMessageHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/messages/{id}/purge", moderator(PurgeMessageHandler(store)))
+	mux.HandleFunc("GET "+apiPrefix+"/messages/{id}/revisions", GetMessageRevisionsHandler(store))
+	mux.HandleFunc("GET "+apiPrefix+"/messages/{id}/revisions/diff", DiffMessageRevisionsHandler(store))
+	mux.Handle("POST "+apiPrefix+"/messages/{id}/parent", moderator(SetParentHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/messages/{id}/split", moderator(SplitTopicHandler(store, store)))
+	mux.Handle("POST "+apiPrefix+"/messages/{id}/like", limited(ReactionRateLimit, LikeMessageHandler(store)))
+	mux.Handle("POST "+apiPrefix+"/messages/{id}/dislike", limited(ReactionRateLimit, DislikeMessageHandler(store)))
+	mux.HandleFunc("GET "+apiPrefix+"/messages/{id}/reactions", GetMessageReactionsHandler(store))
+	mux.Handle("POST "+apiPrefix+"/messages/{id}/reactions", limited(ReactionRateLimit, AddReactionHandler(store)))
+	mux.Handle("DELETE "+apiPrefix+"/messages/{id}/reactions/{reaction}", authed(RemoveReactionHandler(store)))
+
+	mux.HandleFunc("GET "+apiPrefix+"/search", SearchHandler(store))
+
+	mux.Handle("GET "+apiPrefix+"/settings/two-factor", admin(GetTwoFactorPolicyHandler(store)))
+	mux.Handle("PUT "+apiPrefix+"/settings/two-factor", admin(SetTwoFactorPolicyHandler(store)))
+
+	mux.Handle("GET "+apiPrefix+"/ws", authed(PresenceSocketHandler(hub)))
+}
+
+// pathID parses the named path wildcard as a positive integer ID.
+func pathID(r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// topicRef splits a topic path segment such as "42-hello-world" into the
+// topic ID and slug. The ID alone identifies the topic, so "42" names it
+// too. A segment that does not start with an ID is returned whole as a
+// slug, with an ID of 0.
+func topicRef(ref string) (int, string) {
+	prefix, slug, _ := strings.Cut(ref, "-")
+	id, err := strconv.Atoi(prefix)
+	if err != nil || id <= 0 {
+		return 0, ref
+	}
+	return id, slug
+}
+
+// pathTopicID reads the topic ID from the {topic} path wildcard, ignoring
+// the slug after it.
+func pathTopicID(r *http.Request) (int, bool) {
+	id, _ := topicRef(r.PathValue("topic"))
+	return id, id > 0
+}
+
+// topicURL is the canonical API path of a topic.
+func topicURL(topic *models.Topic) string {
+	return apiPrefix + "/topics/" + url.PathEscape(topic.Ref())
+}
+
+// listOptions reads the sort, limit and cursor query parameters shared by the
+// listing endpoints. Without a sort parameter the listing uses defaultSort.
+func listOptions(r *http.Request, defaultSort string) (database.ListOptions, error) {
+	query := r.URL.Query()
+	opts := database.ListOptions{
+		Sort:   defaultSort,
+		Limit:  database.DefaultListLimit,
+		Cursor: query.Get("cursor"),
+	}
+
+	if v := query.Get("sort"); v != "" {
+		if !database.ValidListSort(v) {
+			return opts, fmt.Errorf("sort must be '%s', '%s', '%s' or '%s'", database.SortRecent, database.SortOldest, database.SortTop, database.SortActive)
+		}
+		opts.Sort = v
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > database.MaxListLimit {
+			return opts, fmt.Errorf("limit must be between 1 and %d", database.MaxListLimit)
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,378 @@
+package handlers_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/events"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/mail"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/presence"
+	"github.com/dDogge/Brainwave/ratelimit"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = database.MigrateUp(db)
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+
+	bus := events.NewBus(events.DefaultReplaySize, events.DefaultQueueSize)
+	store := database.NewSQLiteStore(db)
+	store.SetPublisher(bus)
+
+	mux := http.NewServeMux()
+	mailer := &mail.MemoryMailer{}
+	handlers.RegisterRoutes(mux, store, bus, presence.NewHub(presence.DefaultQueueSize), mailer, ratelimit.NewMemoryBackend())
+
+	var token string
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Create_user", func(t *testing.T) {
+		rr := do(http.MethodPost, "/api/v1/users", `{"username":"routeuser","email":"route@test.com","password":"password123"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Create_topic_requires_login", func(t *testing.T) {
+		rr := do(http.MethodPost, "/api/v1/topics", `{"title":"Routed Topic"}`)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		rr := do(http.MethodPost, "/api/v1/auth/login", `{"username":"routeuser","password":"password123"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var resp handlers.LoginResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		token = resp.Token
+	})
+
+	t.Run("Verify_email", func(t *testing.T) {
+		rr := do(http.MethodPost, "/api/v1/topics", `{"title":"Routed Topic"}`)
+		if rr.Code != http.StatusForbidden || rr.Body.String() != "verify your email address before posting\n" {
+			t.Fatalf("expected an unverified user to be refused, got %d %q", rr.Code, rr.Body.String())
+		}
+
+		sent := mailer.Messages()
+		if len(sent) != 1 || sent[0].To != "route@test.com" {
+			t.Fatalf("expected a verification code to route@test.com, got %+v", sent)
+		}
+		body, _ := json.Marshal(map[string]string{"token": mailedCode(sent[0])})
+		rr = do(http.MethodPost, "/api/v1/email-verification/confirm", string(body))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodPost, "/api/v1/email-verification", "")
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected resending to a verified address to conflict, got %d", rr.Code)
+		}
+	})
+
+	var topicID int
+	t.Run("Create_topic", func(t *testing.T) {
+		rr := do(http.MethodPost, "/api/v1/topics", `{"title":"Routed Topic"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+
+		var resp handlers.TopicResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		topicID = resp.Topic.ID
+		if want := fmt.Sprintf("/api/v1/topics/%d-routed-topic", topicID); rr.Header().Get("Location") != want {
+			t.Errorf("expected Location %q, got %q", want, rr.Header().Get("Location"))
+		}
+
+		// routeuser's account is new, so they may open one topic every
+		// ten minutes.
+		rr = do(http.MethodPost, "/api/v1/topics", `{"title":"Another Routed Topic"}`)
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("expected a second topic to be rate limited, got %d %v", rr.Code, rr.Header())
+		}
+	})
+
+	t.Run("Get_topic_by_slug", func(t *testing.T) {
+		rr := do(http.MethodGet, fmt.Sprintf("/api/v1/topics/%d-routed-topic", topicID), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var topic map[string]interface{}
+		if err := json.NewDecoder(rr.Body).Decode(&topic); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if topic["title"] != "Routed Topic" {
+			t.Errorf("expected title 'Routed Topic', got %v", topic["title"])
+		}
+
+		rr = do(http.MethodGet, "/api/v1/topics/routed-topic", "")
+		if rr.Code != http.StatusMovedPermanently {
+			t.Errorf("expected status %d, got %d", http.StatusMovedPermanently, rr.Code)
+		}
+	})
+
+	t.Run("Rename_topic", func(t *testing.T) {
+		rr := do(http.MethodPatch, fmt.Sprintf("/api/v1/topics/%d", topicID), `{"title":"Routed Topic, renamed"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodGet, fmt.Sprintf("/api/v1/topics/%d-routed-topic", topicID), "")
+		if want := fmt.Sprintf("/api/v1/topics/%d-routed-topic-renamed", topicID); rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != want {
+			t.Errorf("expected a redirect to %q, got %d %q", want, rr.Code, rr.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Count_is_not_a_title", func(t *testing.T) {
+		rr := do(http.MethodGet, "/api/v1/topics/count", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var resp map[string]int
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp["total_topics"] != 1 {
+			t.Errorf("expected total_topics 1, got %d", resp["total_topics"])
+		}
+	})
+
+	t.Run("Post_and_list_messages", func(t *testing.T) {
+		rr := do(http.MethodPost, fmt.Sprintf("/api/v1/topics/%d-routed-topic/messages", topicID), `{"message":"hello"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodGet, fmt.Sprintf("/api/v1/topics/%d/messages", topicID), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var list struct {
+			Messages []map[string]interface{} `json:"messages"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		messages := list.Messages
+		if len(messages) != 1 || messages[0]["message"] != "hello" {
+			t.Fatalf("unexpected messages: %v", messages)
+		}
+
+		messageID := int(messages[0]["id"].(float64))
+		rr = do(http.MethodPost, fmt.Sprintf("/api/v1/messages/%d/like", messageID), "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = do(http.MethodPatch, fmt.Sprintf("/api/v1/messages/%d", messageID), `{"message":"hello again"}`)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodGet, fmt.Sprintf("/api/v1/messages/%d/revisions/diff", messageID), "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodGet, fmt.Sprintf("/api/v1/topics/%d/thread", topicID), "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Vote_on_topic", func(t *testing.T) {
+		sub := bus.Subscribe(topicID, 0)
+		defer sub.Close()
+
+		rr := do(http.MethodPost, fmt.Sprintf("/api/v1/topics/%d/upvote", topicID), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		select {
+		case event := <-sub.C:
+			if event.Type != database.EventTopicVoted {
+				t.Errorf("expected a %s event, got %s", database.EventTopicVoted, event.Type)
+			}
+		default:
+			t.Error("expected the vote to be published")
+		}
+
+		rr = do(http.MethodGet, fmt.Sprintf("/api/v1/topics/%d/vote", topicID), "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var resp map[string]int
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp["vote"] != 1 {
+			t.Errorf("expected vote 1, got %d", resp["vote"])
+		}
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		rr := do(http.MethodPut, "/api/v1/users/routeuser/role", `{"role":"admin"}`)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr = do(http.MethodPost, "/api/v1/messages/1/parent", `{"parent_id":1}`)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected moving messages to need a moderator, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPost, "/api/v1/messages/1/purge", "")
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected purging messages to need a moderator, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPut, fmt.Sprintf("/api/v1/topics/%d/lock", topicID), "")
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected locking topics to need a moderator, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPost, fmt.Sprintf("/api/v1/topics/%d/merge", topicID), `{"target_id":1}`)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected merging topics to need a moderator, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPost, "/api/v1/messages/1/split", `{"title":"Split"}`)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected splitting topics to need a moderator, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPut, "/api/v1/tags/go", `{"name":"golang"}`)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected renaming tags to need an admin, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPost, "/api/v1/categories", `{"name":"Staff"}`)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected adding categories to need an admin, got %d", rr.Code)
+		}
+
+		rr = do(http.MethodPost, "/api/v1/users/routeuser/unlock", "")
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected unlocking users to need an admin, got %d", rr.Code)
+		}
+
+		if err := store.SetRole(context.Background(), "routeuser", models.RoleAdmin); err != nil {
+			t.Fatalf("failed to make routeuser an admin: %v", err)
+		}
+
+		rr = do(http.MethodGet, "/api/v1/users", "")
+		var list handlers.UserListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(list.Users) != 1 || list.Users[0].Email != "route@test.com" || list.Users[0].Role != models.RoleAdmin {
+			t.Errorf("expected the admin to see their email and role, got %+v", list.Users)
+		}
+
+		rr = do(http.MethodPut, "/api/v1/users/routeuser/role", `{"role":"user"}`)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d: %s", http.StatusConflict, rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodGet, "/api/v1/users/routeuser/logins", "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected the admin to see login attempts, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		rr = do(http.MethodPut, "/api/v1/settings/two-factor", `{"required_role":"moderator"}`)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected an admin without two-factor to be stopped from requiring it, got %d", rr.Code)
+		}
+
+		if err := store.SetTwoFactorRole(context.Background(), models.RoleModerator); err != nil {
+			t.Fatalf("failed to require two-factor: %v", err)
+		}
+		rr = do(http.MethodGet, "/api/v1/users/routeuser/logins", "")
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "two-factor") {
+			t.Errorf("expected an admin without two-factor to be refused, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if err := store.SetTwoFactorRole(context.Background(), ""); err != nil {
+			t.Fatalf("failed to reset two-factor role: %v", err)
+		}
+	})
+
+	t.Run("Topic_events", func(t *testing.T) {
+		// The stream ends as soon as its opening comment is flushed.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/topics/%d/events", topicID), nil).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(cancelOnFlush{rr, cancel}, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("expected an event stream, got %q", ct)
+		}
+	})
+
+	t.Run("Wrong_method", func(t *testing.T) {
+		rr := do(http.MethodPut, "/api/v1/topics", "")
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, rr.Code)
+		}
+	})
+
+	t.Run("Unknown_route", func(t *testing.T) {
+		rr := do(http.MethodGet, "/api/v1/nothing-here", "")
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+// cancelOnFlush is a recorder that cancels the request once the handler
+// flushes, so a streaming handler returns after its first write.
+type cancelOnFlush struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancelOnFlush) Flush() {
+	w.ResponseRecorder.Flush()
+	w.cancel()
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+)
+
+type SearchResponse struct {
+	Query string             `json:"query"`
+	Hits  []models.SearchHit `json:"hits"`
+}
+
+// SearchHandler runs a full-text search over topics and messages. q holds
+// the search text; type, author, topic, from, to and limit narrow it down.
+// topic takes a topic ID, on its own or as {id}-{slug}.
+// from and to take a date (YYYY-MM-DD, with to covering that whole day) or
+// an RFC 3339 timestamp.
+func SearchHandler(store database.SearchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		q := database.SearchQuery{
+			Text:   query.Get("q"),
+			Type:   query.Get("type"),
+			Author: query.Get("author"),
+			Limit:  database.DefaultSearchLimit,
+		}
+
+		if q.Text == "" {
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		}
+
+		if q.Type != "" && q.Type != database.SearchTypeTopic && q.Type != database.SearchTypeMessage {
+			http.Error(w, "type must be 'topic' or 'message'", http.StatusBadRequest)
+			return
+		}
+
+		if v := query.Get("topic"); v != "" {
+			id, _ := topicRef(v)
+			if id == 0 {
+				http.Error(w, "invalid topic", http.StatusBadRequest)
+				return
+			}
+			q.TopicID = id
+		}
+
+		var err error
+		if v := query.Get("from"); v != "" {
+			q.Since, err = parseSearchDate(v, false)
+			if err != nil {
+				http.Error(w, "invalid from date", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("to"); v != "" {
+			q.Until, err = parseSearchDate(v, true)
+			if err != nil {
+				http.Error(w, "invalid to date", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > database.MaxSearchLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", database.MaxSearchLimit), http.StatusBadRequest)
+				return
+			}
+			q.Limit = limit
+		}
+
+		hits, err := store.Search(r.Context(), q)
+		if err != nil {
+			if errors.Is(err, database.ErrEmptySearch) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to search", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(SearchResponse{Query: q.Text, Hits: hits}); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// parseSearchDate reads a YYYY-MM-DD date or an RFC 3339 timestamp. A bare
+// date used as an upper bound is moved to the start of the next day so the
+// whole day is included.
+func parseSearchDate(v string, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		if upper {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
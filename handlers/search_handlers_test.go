@@ -0,0 +1,117 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/handlers"
+)
+
+func TestSearchHandler(t *testing.T) {
+	db, store := setupAuthDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Brewing"}, "testuser")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	for _, msg := range []string{"Cold brew takes twelve hours", "Espresso needs fine grounds"} {
+		_, err = store.AddMessage(ctx, topic.ID, msg, "testuser", 0)
+		if err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+	}
+
+	handler := handlers.SearchHandler(store)
+
+	search := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/search?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Ranked hits with snippets", func(t *testing.T) {
+		w := search(url.Values{"q": {`"cold brew"`}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		var response handlers.SearchResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if response.Query != `"cold brew"` || len(response.Hits) != 1 {
+			t.Fatalf("unexpected response: %+v", response)
+		}
+
+		hit := response.Hits[0]
+		if hit.Type != "message" || hit.TopicTitle != "Brewing" || hit.TopicSlug != "brewing" || hit.Author != "testuser" {
+			t.Errorf("unexpected hit: %+v", hit)
+		}
+		if hit.Snippet != "<mark>Cold brew</mark> takes twelve hours" {
+			t.Errorf("unexpected snippet %q", hit.Snippet)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		tests := []struct {
+			params url.Values
+			want   int
+		}{
+			{url.Values{"q": {"brew*"}}, 2},
+			{url.Values{"q": {"brew*"}, "type": {"topic"}}, 1},
+			{url.Values{"q": {"brew*"}, "author": {"nobody"}}, 0},
+			{url.Values{"q": {"brew*"}, "topic": {topic.Ref()}, "limit": {"1"}}, 1},
+			{url.Values{"q": {"brew*"}, "topic": {strconv.Itoa(topic.ID)}}, 2},
+			{url.Values{"q": {"brew*"}, "topic": {"999999"}}, 0},
+			{url.Values{"q": {"brew*"}, "from": {"2000-01-01"}, "to": {"2999-12-31"}}, 2},
+			{url.Values{"q": {"brew*"}, "to": {"2000-01-01T00:00:00Z"}}, 0},
+		}
+		for _, tt := range tests {
+			w := search(tt.params)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status %d, got %d: %s", tt.params.Encode(), http.StatusOK, w.Code, w.Body.String())
+			}
+			var response handlers.SearchResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(response.Hits) != tt.want {
+				t.Errorf("%s: expected %d hits, got %d", tt.params.Encode(), tt.want, len(response.Hits))
+			}
+		}
+	})
+
+	t.Run("Bad requests", func(t *testing.T) {
+		for _, params := range []url.Values{
+			{},
+			{"q": {`""`}},
+			{"q": {"brew"}, "type": {"user"}},
+			{"q": {"brew"}, "from": {"yesterday"}},
+			{"q": {"brew"}, "to": {"31/12/2024"}},
+			{"q": {"brew"}, "limit": {"0"}},
+			{"q": {"brew"}, "topic": {"Brewing"}},
+		} {
+			if w := search(params); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d, got %d", params.Encode(), http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	t.Run("Invalid Method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/search?q=brew", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+		}
+	})
+}
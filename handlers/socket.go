@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dDogge/Brainwave/presence"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	socketWriteWait      = 10 * time.Second
+	socketPongWait       = 60 * time.Second
+	socketPingPeriod     = socketPongWait * 9 / 10
+	socketMaxMessageSize = 4096
+)
+
+// The default origin check rejects cross-site pages, which matters because
+// browsers send the session cookie along with the upgrade request.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// PresenceSocketHandler upgrades to a WebSocket that speaks the presence
+// protocol. Clients send JSON messages of the form
+// {"type": "subscribe", "topic_id": 1}, with types subscribe, unsubscribe,
+// typing.start, typing.stop and ping. The server answers ping with pong,
+// reports problems with {"type": "error", "error": "..."} and sends a
+// presence message listing who is there whenever a watched topic changes.
+func PresenceSocketHandler(hub *presence.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already written the error response.
+			log.Printf("error upgrading connection for %s: %v", user.Username, err)
+			return
+		}
+
+		client := hub.Join(user)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			writeSocket(conn, client)
+		}()
+
+		readSocket(conn, client)
+		client.Close()
+		<-done
+	}
+}
+
+// readSocket handles the client's messages until the connection fails or
+// goes quiet for longer than socketPongWait.
+func readSocket(conn *websocket.Conn, client *presence.Client) {
+	conn.SetReadLimit(socketMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("error reading from socket: %v", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(socketPongWait))
+
+		var msg presence.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			client.Reply(presence.Message{Type: presence.TypeError, Error: "invalid JSON format"})
+			continue
+		}
+
+		switch msg.Type {
+		case presence.TypeSubscribe:
+			err = client.Watch(msg.TopicID)
+		case presence.TypeUnsubscribe:
+			err = client.Unwatch(msg.TopicID)
+		case presence.TypeTypingStart:
+			err = client.SetTyping(msg.TopicID, true)
+		case presence.TypeTypingStop:
+			err = client.SetTyping(msg.TopicID, false)
+		case presence.TypePing:
+			client.Reply(presence.Message{Type: presence.TypePong})
+		default:
+			err = errors.New("unknown message type")
+		}
+
+		if errors.Is(err, presence.ErrClientClosed) {
+			return
+		}
+		if err != nil {
+			client.Reply(presence.Message{Type: presence.TypeError, TopicID: msg.TopicID, Error: err.Error()})
+		}
+	}
+}
+
+// writeSocket sends the client's queued messages and keeps the connection
+// alive with pings. It closes the connection when the client's queue is
+// closed or a write fails, which in turn stops readSocket.
+func writeSocket(conn *websocket.Conn, client *presence.Client) {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-client.Send():
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
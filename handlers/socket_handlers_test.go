@@ -0,0 +1,155 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/presence"
+	"github.com/gorilla/websocket"
+)
+
+// headerUser stands in for RequireAuth, taking the user from the X-User header
+// so each test connection can pick who it is.
+func headerUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := r.Header.Get("X-User"); name != "" {
+			id, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+			r = r.WithContext(handlers.ContextWithUser(r.Context(), &models.User{ID: id, Username: name}))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestPresenceSocketHandler(t *testing.T) {
+	hub := presence.NewHub(presence.DefaultQueueSize)
+	server := httptest.NewServer(headerUser(handlers.PresenceSocketHandler(hub)))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(id int, name string) *websocket.Conn {
+		t.Helper()
+		header := http.Header{"X-User": {name}, "X-User-Id": {strconv.Itoa(id)}}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatalf("failed to dial as %s: %v", name, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	send := func(conn *websocket.Conn, msg presence.Message) {
+		t.Helper()
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatalf("failed to send %+v: %v", msg, err)
+		}
+	}
+	receive := func(conn *websocket.Conn) presence.PresenceMessage {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg presence.PresenceMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		return msg
+	}
+	usernames := func(members []presence.Member) string {
+		var names []string
+		for _, m := range members {
+			name := m.Username
+			if m.Typing {
+				name += "*"
+			}
+			names = append(names, name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			t.Fatal("expected the upgrade to fail")
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %v", resp)
+		}
+	})
+
+	alice := dial(1, "alice")
+	bob := dial(2, "bob")
+
+	t.Run("Subscribe", func(t *testing.T) {
+		send(alice, presence.Message{Type: presence.TypeSubscribe, TopicID: 1})
+		if msg := receive(alice); msg.Type != presence.TypePresence || msg.TopicID != 1 || usernames(msg.Members) != "alice" {
+			t.Fatalf("unexpected presence: %+v", msg)
+		}
+
+		send(bob, presence.Message{Type: presence.TypeSubscribe, TopicID: 1})
+		if msg := receive(bob); usernames(msg.Members) != "alice,bob" {
+			t.Errorf("expected bob to see alice,bob, got %s", usernames(msg.Members))
+		}
+		if msg := receive(alice); usernames(msg.Members) != "alice,bob" {
+			t.Errorf("expected alice to see alice,bob, got %s", usernames(msg.Members))
+		}
+	})
+
+	t.Run("Typing", func(t *testing.T) {
+		send(bob, presence.Message{Type: presence.TypeTypingStart, TopicID: 1})
+		if msg := receive(alice); usernames(msg.Members) != "alice,bob*" {
+			t.Errorf("expected bob to be typing, got %s", usernames(msg.Members))
+		}
+		receive(bob)
+
+		send(bob, presence.Message{Type: presence.TypeTypingStop, TopicID: 1})
+		if msg := receive(alice); usernames(msg.Members) != "alice,bob" {
+			t.Errorf("expected bob to stop typing, got %s", usernames(msg.Members))
+		}
+		receive(bob)
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		send(alice, presence.Message{Type: presence.TypePing})
+		if msg := receive(alice); msg.Type != presence.TypePong {
+			t.Errorf("expected pong, got %+v", msg)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			raw  string
+			want string
+		}{
+			{"Invalid JSON", `{`, "invalid JSON format"},
+			{"Unknown type", `{"type":"dance"}`, "unknown message type"},
+			{"Typing without subscribing", `{"type":"typing.start","topic_id":2}`, presence.ErrNotWatching.Error()},
+			{"Invalid topic", `{"type":"subscribe","topic_id":0}`, presence.ErrInvalidTopic.Error()},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if err := alice.WriteMessage(websocket.TextMessage, []byte(tt.raw)); err != nil {
+					t.Fatalf("failed to send: %v", err)
+				}
+				alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+				var msg presence.Message
+				if err := alice.ReadJSON(&msg); err != nil {
+					t.Fatalf("failed to read reply: %v", err)
+				}
+				if msg.Type != presence.TypeError || msg.Error != tt.want {
+					t.Errorf("expected error %q, got %+v", tt.want, msg)
+				}
+			})
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		bob.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		if msg := receive(alice); usernames(msg.Members) != "alice" {
+			t.Errorf("expected bob to leave when disconnecting, got %s", usernames(msg.Members))
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+)
+
+type TopicTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type TopicTagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+type TagListResponse struct {
+	Tags []models.Tag `json:"tags"`
+}
+
+type RenameTagRequest struct {
+	Name string `json:"name"`
+}
+
+// SetTopicTagsHandler replaces the tags of a topic. Only the topic's creator
+// or a moderator may retag it.
+func SetTopicTagsHandler(store database.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody TopicTagsRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		topic, err := store.GetTopic(r.Context(), topicID)
+		if err != nil {
+			writeTagError(w, err, "failed to set tags")
+			return
+		}
+
+		if !canModerate(user, topic.CreatorID) {
+			http.Error(w, "only the topic's creator or a moderator may change its tags", http.StatusForbidden)
+			return
+		}
+
+		tags, err := store.SetTopicTags(r.Context(), topicID, reqBody.Tags)
+		if err != nil {
+			writeTagError(w, err, "failed to set tags")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(TopicTagsResponse{Tags: tags})
+	}
+}
+
+// ListTagsHandler autocompletes tag names: it lists the tags in use that
+// start with the prefix query parameter, the most used first.
+func ListTagsHandler(store database.TagStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		limit := database.DefaultTagLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > database.MaxTagLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", database.MaxTagLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		tags, err := store.ListTags(r.Context(), r.URL.Query().Get("prefix"), limit)
+		if err != nil {
+			http.Error(w, "failed to fetch tags", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(TagListResponse{Tags: tags}); err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// RenameTagHandler renames a tag, merging it into the tag of the new name if
+// that one already exists. It is meant for admins cleaning up near-duplicate
+// tags.
+func RenameTagHandler(store database.TagStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reqBody RenameTagRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Name == "" {
+			http.Error(w, "name field is required", http.StatusBadRequest)
+			return
+		}
+
+		tag, err := store.RenameTag(r.Context(), r.PathValue("name"), reqBody.Name)
+		if err != nil {
+			writeTagError(w, err, "failed to rename tag")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(tag)
+	}
+}
+
+// writeTagError maps the errors returned by the tag queries to HTTP
+// responses, falling back to fallback with a 500.
+func writeTagError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrInvalidTag), errors.Is(err, database.ErrTooManyTags):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
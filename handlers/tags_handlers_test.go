@@ -0,0 +1,212 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dDogge/Brainwave/database/memstore"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+)
+
+func TestTopicTagHandlers(t *testing.T) {
+	store := memstore.New()
+
+	for _, name := range []string{"author", "stranger", "moderator"} {
+		if err := store.AddUser(ctx, name, name+"@example.com", "password123"); err != nil {
+			t.Fatalf("failed to add user %s: %v", name, err)
+		}
+	}
+	if err := store.SetRole(ctx, "moderator", models.RoleModerator); err != nil {
+		t.Fatalf("failed to set role: %v", err)
+	}
+
+	do := func(handler http.HandlerFunc, method, target, body, username string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if username != "" {
+			req = asUser(t, store, req, username)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	addTopic := handlers.AddTopicHandler(store, store)
+	for _, body := range []string{
+		`{"title":"Go and SQLite","description":"Embedding a database","body":"Which driver?","tags":["Go","sqlite"]}`,
+		`{"title":"Go generics","tags":["go","generics"]}`,
+		`{"title":"Postgres tuning","tags":["postgres"]}`,
+	} {
+		if rr := do(addTopic, http.MethodPost, "/topics", body, "author"); rr.Code != http.StatusCreated {
+			t.Fatalf("failed to add topic %s: %d %s", body, rr.Code, rr.Body.String())
+		}
+	}
+
+	t.Run("Add_topic_validation", func(t *testing.T) {
+		tests := []struct {
+			body string
+			want string
+		}{
+			{`{"title":"Bad tag","tags":["two words"]}`, "tags must be"},
+			{`{"title":"Many tags","tags":["a","b","c","d","e","f"]}`, "at most 5 tags"},
+			{fmt.Sprintf(`{"title":"Long","description":%q}`, strings.Repeat("x", models.MaxDescriptionLength+1)), "description must be at most"},
+		}
+		for _, tt := range tests {
+			rr := do(addTopic, http.MethodPost, "/topics", tt.body, "author")
+			if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tt.want) {
+				t.Errorf("%s: expected 400 mentioning %q, got %d %s", tt.body, tt.want, rr.Code, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("Get_topic", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/topics/1-go-and-sqlite", nil)
+		req.SetPathValue("topic", "1-go-and-sqlite")
+		handlers.GetTopicHandler(store).ServeHTTP(rr, req)
+
+		var topic models.Topic
+		if err := json.NewDecoder(rr.Body).Decode(&topic); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if topic.Description != "Embedding a database" || topic.Body != "Which driver?" || fmt.Sprint(topic.Tags) != "[go sqlite]" {
+			t.Errorf("unexpected topic: %+v", topic)
+		}
+	})
+
+	t.Run("Filter_by_tag", func(t *testing.T) {
+		list := handlers.GetAllTopicsHandler(store)
+		tests := []struct {
+			query string
+			code  int
+			want  string
+		}{
+			{"?tag=go", http.StatusOK, "Go generics, Go and SQLite"},
+			{"?tag=go&tag=sqlite", http.StatusOK, "Go and SQLite"},
+			{"?tag=sqlite&tag=postgres&match=any", http.StatusOK, "Postgres tuning, Go and SQLite"},
+			{"?tag=sqlite&tag=postgres&match=all", http.StatusOK, ""},
+			{"?tag=go&match=some", http.StatusBadRequest, ""},
+			{"?tag=no%20spaces", http.StatusBadRequest, ""},
+		}
+		for _, tt := range tests {
+			rr := do(list, http.MethodGet, "/topics"+tt.query, "", "")
+			if rr.Code != tt.code {
+				t.Errorf("%s: expected status %d, got %d", tt.query, tt.code, rr.Code)
+				continue
+			}
+			if tt.code != http.StatusOK {
+				continue
+			}
+
+			var resp handlers.TopicListResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			var titles []string
+			for _, topic := range resp.Topics {
+				titles = append(titles, topic.Title)
+			}
+			if got := strings.Join(titles, ", "); got != tt.want {
+				t.Errorf("%s: expected %q, got %q", tt.query, tt.want, got)
+			}
+		}
+	})
+
+	t.Run("Set_topic_tags", func(t *testing.T) {
+		setTags := func(ref, body, username string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPut, "/topics/"+ref+"/tags", strings.NewReader(body))
+			req.SetPathValue("topic", ref)
+			req = asUser(t, store, req, username)
+			rr := httptest.NewRecorder()
+			handlers.SetTopicTagsHandler(store).ServeHTTP(rr, req)
+			return rr
+		}
+
+		if rr := setTags("2-go-generics", `{"tags":["go"]}`, "stranger"); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if rr := setTags("999999", `{"tags":["go"]}`, "moderator"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		rr := setTags("2-go-generics", `{"tags":["golang","Generics"]}`, "moderator")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var resp handlers.TopicTagsResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if fmt.Sprint(resp.Tags) != "[generics golang]" {
+			t.Errorf("expected [generics golang], got %v", resp.Tags)
+		}
+	})
+
+	listTags := func(query string) string {
+		t.Helper()
+		rr := do(handlers.ListTagsHandler(store), http.MethodGet, "/tags"+query, "", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		var resp handlers.TagListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		var got []string
+		for _, tag := range resp.Tags {
+			got = append(got, fmt.Sprintf("%s:%d", tag.Name, tag.Topics))
+		}
+		return strings.Join(got, " ")
+	}
+
+	t.Run("Autocomplete", func(t *testing.T) {
+		if got := listTags("?prefix=g"); got != "generics:1 go:1 golang:1" {
+			t.Errorf("unexpected tags: %s", got)
+		}
+		if got := listTags("?prefix=G&limit=1"); got != "generics:1" {
+			t.Errorf("unexpected tags: %s", got)
+		}
+		if rr := do(handlers.ListTagsHandler(store), http.MethodGet, "/tags?limit=0", "", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("Rename_and_merge", func(t *testing.T) {
+		rename := func(name, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPut, "/tags/"+name, strings.NewReader(body))
+			req.SetPathValue("name", name)
+			rr := httptest.NewRecorder()
+			handlers.RenameTagHandler(store).ServeHTTP(rr, req)
+			return rr
+		}
+
+		rr := rename("golang", `{"name":"go"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var tag models.Tag
+		if err := json.NewDecoder(rr.Body).Decode(&tag); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if tag.Name != "go" || tag.Topics != 2 {
+			t.Errorf("unexpected merged tag: %+v", tag)
+		}
+		if got := listTags("?prefix=go"); got != "go:2" {
+			t.Errorf("expected golang to be merged into go, got %s", got)
+		}
+
+		if rr := rename("golang", `{"name":"go"}`); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if rr := rename("go", `{"name":"not valid"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if rr := rename("go", `{}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
@@ -1,25 +1,52 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strings"
+	"unicode/utf8"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
 )
 
-func AddTopicHandler(db *sql.DB) http.HandlerFunc {
+type TopicResponse struct {
+	Message string        `json:"message"`
+	Topic   *models.Topic `json:"topic"`
+}
+
+type RenameTopicRequest struct {
+	Title string `json:"title"`
+}
+
+type TopicListResponse struct {
+	Topics     []models.Topic `json:"topics"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// AddTopicHandler opens a topic in the category given by category_id, or in
+// the default category. Categories can require a role to open topics in
+// them, such as announcement boards reserved for moderators.
+func AddTopicHandler(store database.TopicStore, categories database.CategoryStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
 		var reqBody struct {
-			Title    string `json:"title"`
-			Username string `json:"username"`
+			Title       string   `json:"title"`
+			Description string   `json:"description"`
+			Body        string   `json:"body"`
+			Tags        []string `json:"tags"`
+			CategoryID  int      `json:"category_id"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -28,60 +55,104 @@ func AddTopicHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if reqBody.Title == "" || reqBody.Username == "" {
-			http.Error(w, "both title and username are required", http.StatusBadRequest)
+		if reqBody.Title == "" {
+			http.Error(w, "title field is required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.AddTopic(db, reqBody.Title, reqBody.Username)
+		if utf8.RuneCountInString(reqBody.Description) > models.MaxDescriptionLength {
+			http.Error(w, fmt.Sprintf("description must be at most %d characters", models.MaxDescriptionLength), http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.CategoryID == 0 {
+			reqBody.CategoryID = models.DefaultCategoryID
+		}
+		category, err := categories.GetCategory(r.Context(), reqBody.CategoryID)
 		if err != nil {
-			if err.Error() == "user not found" {
-				http.Error(w, "user not found", http.StatusNotFound)
-			} else if err.Error() == "topic title already exists" {
-				http.Error(w, "topic title already exists", http.StatusConflict)
+			if errors.Is(err, database.ErrCategoryNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
 			} else {
 				http.Error(w, "failed to add topic", http.StatusInternalServerError)
 			}
 			return
 		}
 
-		resp := struct {
-			Message string `json:"message"`
-		}{
+		if !canOpenTopics(user, category) {
+			http.Error(w, fmt.Sprintf("opening topics in this category requires the %s role", category.TopicRole), http.StatusForbidden)
+			return
+		}
+
+		draft := database.TopicDraft{
+			Title:       reqBody.Title,
+			Description: reqBody.Description,
+			Body:        reqBody.Body,
+			Tags:        reqBody.Tags,
+			CategoryID:  reqBody.CategoryID,
+		}
+		topic, err := store.AddTopic(r.Context(), draft, user.Username)
+		if err != nil {
+			if errors.Is(err, database.ErrUserNotFound) || errors.Is(err, database.ErrCategoryNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+			} else if errors.Is(err, database.ErrTopicExists) {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else if errors.Is(err, database.ErrInvalidTag) || errors.Is(err, database.ErrTooManyTags) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, "failed to add topic", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		resp := TopicResponse{
 			Message: "topic added successfully",
+			Topic:   topic,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", topicURL(topic))
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(resp)
 	}
 }
 
-func RemoveTopicHandler(db *sql.DB) http.HandlerFunc {
+func RemoveTopicHandler(store database.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reqBody struct {
-			Title string `json:"title"`
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
 		}
 
-		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		topic, err := store.GetTopic(r.Context(), topicID)
 		if err != nil {
-			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			if errors.Is(err, database.ErrTopicNotFound) {
+				http.Error(w, "topic not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "failed to remove topic", http.StatusInternalServerError)
+			}
 			return
 		}
 
-		if reqBody.Title == "" {
-			http.Error(w, "title field is required", http.StatusBadRequest)
+		if !canModerate(user, topic.CreatorID) {
+			http.Error(w, "only the topic's creator or a moderator may remove it", http.StatusForbidden)
 			return
 		}
 
-		err = database.RemoveTopic(db, reqBody.Title)
+		err = store.RemoveTopic(r.Context(), topicID)
 		if err != nil {
-			if strings.Contains(err.Error(), "no topic found with title") {
+			if errors.Is(err, database.ErrTopicNotFound) {
 				http.Error(w, "topic not found", http.StatusNotFound)
 			} else {
 				http.Error(w, "failed to remove topic", http.StatusInternalServerError)
@@ -101,47 +172,68 @@ func RemoveTopicHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func UpVoteTopicHandler(db *sql.DB) http.HandlerFunc {
+func UpVoteTopicHandler(store database.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reqBody struct {
-			Title    string `json:"title"`
-			Username string `json:"username"`
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
 		}
 
-		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		err := store.UpVoteTopic(r.Context(), topicID, user.Username)
 		if err != nil {
-			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			writeVoteError(w, err, "failed to upvote topic")
 			return
 		}
 
-		if reqBody.Title == "" || reqBody.Username == "" {
-			http.Error(w, "all fields (title, username) are required", http.StatusBadRequest)
+		resp := map[string]string{
+			"message": "upvote added successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func DownVoteTopicHandler(store database.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		_, err = database.GetTopicByTitle(db, reqBody.Title)
-		if err != nil {
-			if err.Error() == "topic with title '"+reqBody.Title+"' not found" {
-				http.Error(w, "failed to upvote topic", http.StatusNotFound)
-				return
-			}
-			http.Error(w, "failed to upvote topic", http.StatusInternalServerError)
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
 			return
 		}
 
-		err = database.UpVoteTopic(db, reqBody.Title, reqBody.Username)
+		err := store.DownVoteTopic(r.Context(), topicID, user.Username)
 		if err != nil {
-			http.Error(w, "failed to upvote topic", http.StatusInternalServerError)
+			writeVoteError(w, err, "failed to downvote topic")
 			return
 		}
 
 		resp := map[string]string{
-			"message": "upvote added successfully",
+			"message": "downvote added successfully",
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -150,37 +242,68 @@ func UpVoteTopicHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func DownVoteTopicHandler(db *sql.DB) http.HandlerFunc {
+func RetractTopicVoteHandler(store database.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+		if r.Method != http.MethodDelete {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reqBody struct {
-			Title    string `json:"title"`
-			Username string `json:"username"`
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
 		}
 
-		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		err := store.RetractTopicVote(r.Context(), topicID, user.Username)
 		if err != nil {
-			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			writeVoteError(w, err, "failed to retract vote")
+			return
+		}
+
+		resp := map[string]string{
+			"message": "vote retracted successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func GetTopicVoteHandler(store database.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
 			return
 		}
 
-		if reqBody.Title == "" || reqBody.Username == "" {
-			http.Error(w, "all fields (title, username) are required", http.StatusBadRequest)
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
 			return
 		}
 
-		err = database.DownVoteTopic(db, reqBody.Title, reqBody.Username)
+		vote, err := store.GetTopicVote(r.Context(), topicID, user.Username)
 		if err != nil {
-			http.Error(w, "failed to downvote topic", http.StatusInternalServerError)
+			writeVoteError(w, err, "failed to fetch vote")
 			return
 		}
 
-		resp := map[string]string{
-			"message": "downvote added successfully",
+		resp := map[string]int{
+			"vote": vote,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -189,51 +312,131 @@ func DownVoteTopicHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetAllTopicsHandler(db *sql.DB) http.HandlerFunc {
+// writeVoteError maps the errors returned by the topic vote queries to
+// HTTP responses, falling back to fallback with a 500.
+func writeVoteError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrVoteExists), errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// GetAllTopicsHandler lists topics a page at a time, newest first unless the
+// sort query parameter says otherwise. Each tag query parameter narrows the
+// listing to topics filed under that tag; with several, match=all (the
+// default) keeps topics carrying every one of them and match=any those
+// carrying at least one. Served under /categories/{id}/topics it lists only
+// that category and its sub-categories.
+func GetAllTopicsHandler(store database.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		topics, err := database.GetAllTopics(db)
+		opts, err := listOptions(r, database.SortRecent)
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.PathValue("id") != "" {
+			id, ok := pathID(r, "id")
+			if !ok {
+				http.Error(w, "invalid category_id", http.StatusBadRequest)
+				return
+			}
+			opts.CategoryID = id
+		}
+
+		query := r.URL.Query()
+		opts.Tags = query["tag"]
+		switch query.Get("match") {
+		case "", "all":
+			opts.AllTags = true
+		case "any":
+		default:
+			http.Error(w, "match must be 'all' or 'any'", http.StatusBadRequest)
+			return
+		}
+
+		topics, next, err := store.GetAllTopics(r.Context(), opts)
+		if err != nil {
+			if errors.Is(err, database.ErrInvalidCursor) || errors.Is(err, database.ErrInvalidTag) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, database.ErrCategoryNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
 			http.Error(w, "failed to fetch topics", http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(topics); err != nil {
+		if err := json.NewEncoder(w).Encode(TopicListResponse{Topics: topics, NextCursor: next}); err != nil {
 			http.Error(w, "failed to encode response", http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
-func GetTopicByTitleHandler(db *sql.DB) http.HandlerFunc {
+// GetTopicHandler serves a topic by its {id}-{slug} path segment. A segment
+// with just the ID is served as is. One whose slug is out of date, such as
+// after the topic was renamed, and a bare slug, current or old, are
+// redirected to the topic's canonical URL, as are topics that were merged
+// into another.
+func GetTopicHandler(store database.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		title := r.URL.Query().Get("title")
-		if title == "" {
-			http.Error(w, "topic title is required", http.StatusBadRequest)
-			return
-		}
+		ref := r.PathValue("topic")
+		id, slug := topicRef(ref)
 
-		topic, err := database.GetTopicByTitle(db, title)
+		var topic *models.Topic
+		err := database.ErrTopicNotFound
+		if id != 0 {
+			topic, err = store.GetTopic(r.Context(), id)
+		}
+		if errors.Is(err, database.ErrTopicNotFound) && id != 0 {
+			topic, err = store.GetMergedTopic(r.Context(), id)
+			if err == nil {
+				id = 0
+			}
+		}
+		if errors.Is(err, database.ErrTopicNotFound) && ref != "" {
+			// Slugs may start with a number, as in "2024-roadmap".
+			topic, err = store.GetTopicBySlug(r.Context(), ref)
+			slug = ref
+			id = 0
+		}
 		if err != nil {
-			if err.Error() == fmt.Sprintf("topic with title '%s' not found", title) {
-				http.Error(w, err.Error(), http.StatusNotFound)
+			if errors.Is(err, database.ErrTopicNotFound) {
+				http.Error(w, "topic not found", http.StatusNotFound)
 				return
 			}
 			http.Error(w, "failed to fetch topic", http.StatusInternalServerError)
 			return
 		}
 
+		if id == 0 || slug != "" && slug != topic.Slug {
+			target := topicURL(topic)
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode(topic); err != nil {
@@ -243,14 +446,127 @@ func GetTopicByTitleHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func CountTopicsHandler(db *sql.DB) http.HandlerFunc {
+// RenameTopicHandler changes a topic's title, and with it its slug. Links
+// using the old slug keep working through GetTopicHandler's redirects. Only
+// the topic's creator or a moderator may rename it.
+func RenameTopicHandler(store database.TopicStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody RenameTopicRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Title == "" {
+			http.Error(w, "title field is required", http.StatusBadRequest)
+			return
+		}
+
+		topic, err := store.GetTopic(r.Context(), topicID)
+		if err != nil {
+			writeTopicError(w, err, "failed to rename topic")
+			return
+		}
+
+		if !canModerate(user, topic.CreatorID) {
+			http.Error(w, "only the topic's creator or a moderator may rename it", http.StatusForbidden)
+			return
+		}
+
+		topic, err = store.RenameTopic(r.Context(), topicID, reqBody.Title)
+		if err != nil {
+			writeTopicError(w, err, "failed to rename topic")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", topicURL(topic))
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(TopicResponse{Message: "topic renamed successfully", Topic: topic})
+	}
+}
+
+// SetTopicStateHandler puts a topic in state, one of the models.Topic*
+// states, on PUT and takes it out of it on DELETE. It is meant for
+// moderators.
+func SetTopicStateHandler(store database.TopicStore, state string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if _, ok := CurrentUser(r); !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		topicID, ok := pathTopicID(r)
+		if !ok {
+			http.Error(w, "invalid topic_id", http.StatusBadRequest)
+			return
+		}
+
+		on := r.Method == http.MethodPut
+		topic, err := store.SetTopicState(r.Context(), topicID, state, on)
+		if err != nil {
+			writeTopicError(w, err, "failed to update topic")
+			return
+		}
+
+		message := "topic " + state
+		if !on {
+			message = "topic no longer " + state
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(TopicResponse{Message: message, Topic: topic})
+	}
+}
+
+// writeTopicError maps the errors returned by the topic queries to HTTP
+// responses, falling back to fallback with a 500.
+func writeTopicError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, database.ErrTopicExists), errors.Is(err, database.ErrTopicArchived):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, database.ErrInvalidState), errors.Is(err, database.ErrSameTopic),
+		errors.Is(err, database.ErrInvalidTag), errors.Is(err, database.ErrTooManyTags):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+func CountTopicsHandler(store database.TopicStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		count, err := database.CountTopics(db)
+		count, err := store.CountTopics(r.Context())
 		if err != nil {
 			http.Error(w, "failed to count topics", http.StatusInternalServerError)
 			return
@@ -2,48 +2,37 @@ package handlers_test
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
 	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
 )
 
 func TestAddTopicHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to open in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to create topic table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	handler := handlers.AddTopicHandler(db)
+	handler := handlers.AddTopicHandler(store, store)
 
-	makeRequest := func(reqBody map[string]string) *httptest.ResponseRecorder {
+	makeRequest := func(reqBody map[string]string, username string) *httptest.ResponseRecorder {
 		body, _ := json.Marshal(reqBody)
-		req, _ := http.NewRequest(http.MethodPost, "/add-topic", bytes.NewReader(body))
+		req, _ := http.NewRequest(http.MethodPost, "/topics", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
+		req = asUser(t, store, req, username)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 		return rr
@@ -51,28 +40,34 @@ func TestAddTopicHandler(t *testing.T) {
 
 	t.Run("Successfully_add_topic", func(t *testing.T) {
 		reqBody := map[string]string{
-			"title":    "Test Topic",
-			"username": username,
+			"title": "Test Topic",
 		}
-		rr := makeRequest(reqBody)
+		rr := makeRequest(reqBody, username)
 
 		if rr.Code != http.StatusCreated {
 			t.Errorf("expected status %d, got %d", http.StatusCreated, rr.Code)
 		}
 
-		var resp map[string]string
+		var resp handlers.TopicResponse
 		err := json.NewDecoder(rr.Body).Decode(&resp)
 		if err != nil {
 			t.Fatalf("failed to decode response: %v", err)
 		}
 
-		if resp["message"] != "topic added successfully" {
-			t.Errorf("expected message 'topic added successfully', got %s", resp["message"])
+		if resp.Message != "topic added successfully" {
+			t.Errorf("expected message 'topic added successfully', got %s", resp.Message)
+		}
+		if resp.Topic == nil || resp.Topic.Slug != "test-topic" {
+			t.Fatalf("expected the created topic in the response, got %+v", resp.Topic)
+		}
+		if want := "/api/v1/topics/" + resp.Topic.Ref(); rr.Header().Get("Location") != want {
+			t.Errorf("expected Location %q, got %q", want, rr.Header().Get("Location"))
 		}
 	})
 
 	t.Run("Invalid_JSON", func(t *testing.T) {
-		req, _ := http.NewRequest(http.MethodPost, "/add-topic", bytes.NewBuffer([]byte("invalid-json")))
+		req, _ := http.NewRequest(http.MethodPost, "/topics", bytes.NewBuffer([]byte("invalid-json")))
+		req = asUser(t, store, req, username)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 
@@ -90,24 +85,23 @@ func TestAddTopicHandler(t *testing.T) {
 		reqBody := map[string]string{
 			"title": "",
 		}
-		rr := makeRequest(reqBody)
+		rr := makeRequest(reqBody, username)
 
 		if rr.Code != http.StatusBadRequest {
 			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
 		}
 
 		body := rr.Body.String()
-		if body != "both title and username are required\n" {
-			t.Errorf("expected response 'both title and username are required', got %s", body)
+		if body != "title field is required\n" {
+			t.Errorf("expected response 'title field is required', got %s", body)
 		}
 	})
 
 	t.Run("User_not_found", func(t *testing.T) {
 		reqBody := map[string]string{
-			"title":    "Test Topic",
-			"username": "nonexistentuser",
+			"title": "Test Topic",
 		}
-		rr := makeRequest(reqBody)
+		rr := makeRequest(reqBody, "nonexistentuser")
 
 		if rr.Code != http.StatusNotFound {
 			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
@@ -120,8 +114,9 @@ func TestAddTopicHandler(t *testing.T) {
 	})
 
 	t.Run("Topic_title_already_exists", func(t *testing.T) {
-		reqBody := `{"title":"Test Topic 2", "username":"testuser"}`
-		req := httptest.NewRequest(http.MethodPost, "/add-topic", strings.NewReader(reqBody))
+		reqBody := `{"title":"Test Topic 2"}`
+		req := httptest.NewRequest(http.MethodPost, "/topics", strings.NewReader(reqBody))
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -130,7 +125,8 @@ func TestAddTopicHandler(t *testing.T) {
 			t.Errorf("expected status %d, got %d", http.StatusCreated, w.Code)
 		}
 
-		req = httptest.NewRequest(http.MethodPost, "/add-topic", strings.NewReader(reqBody))
+		req = httptest.NewRequest(http.MethodPost, "/topics", strings.NewReader(reqBody))
+		req = asUser(t, store, req, username)
 		w = httptest.NewRecorder()
 		handler.ServeHTTP(w, req)
 
@@ -144,44 +140,76 @@ func TestAddTopicHandler(t *testing.T) {
 			t.Errorf("expected response body '%s', got '%s'", expectedBody, body)
 		}
 	})
-}
 
-func TestRemoveTopicHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
+	t.Run("Unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/topics", strings.NewReader(`{"title":"Anonymous Topic"}`))
+		w := httptest.NewRecorder()
 
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
+		handler.ServeHTTP(w, req)
 
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topics table: %v", err)
-	}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+
+		body := w.Body.String()
+		if body != "authentication required\n" {
+			t.Errorf("expected response 'authentication required', got %s", body)
+		}
+	})
+}
+
+func TestRemoveTopicHandler(t *testing.T) {
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@test.com"
 	password := "password123"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
+	for _, name := range []string{"otheruser", "moduser"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", password); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+	}
+	if err := store.SetRole(ctx, "moduser", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moduser a moderator: %v", err)
+	}
+
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
+	if err != nil {
+		t.Fatalf("failed to add test topic: %v", err)
+	}
+	moderated, err := store.AddTopic(ctx, database.TopicDraft{Title: "Moderated Topic"}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	handler := handlers.RemoveTopicHandler(db)
+	handler := handlers.RemoveTopicHandler(store)
+
+	t.Run("Not_the_creator", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/1-test-topic", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, "otheruser")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected status %d, got %d", http.StatusForbidden, w.Code)
+		}
+		if _, err := store.GetTopic(ctx, topic.ID); err != nil {
+			t.Errorf("expected the topic to survive, got %v", err)
+		}
+	})
 
 	t.Run("Successfully_remove_topic", func(t *testing.T) {
-		reqBody := `{"title":"Test Topic"}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-topic", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodDelete, "/topics/1-test-topic", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -203,43 +231,52 @@ func TestRemoveTopicHandler(t *testing.T) {
 		}
 	})
 
-	t.Run("Topic_not_found", func(t *testing.T) {
-		reqBody := `{"title":"Nonexistent Topic"}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-topic", strings.NewReader(reqBody))
+	t.Run("Moderator_removes_topic", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/"+moderated.Ref(), nil)
+		req.SetPathValue("topic", moderated.Ref())
+		req = asUser(t, store, req, "moduser")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
 
-		if w.Code != http.StatusNotFound {
-			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
 		}
+	})
 
-		body := w.Body.String()
-		if body != "topic not found\n" {
-			t.Errorf("expected response 'topic not found', got '%s'", body)
+	t.Run("Unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/1-test-topic", nil)
+		req.SetPathValue("topic", topic.Ref())
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
 		}
 	})
 
-	t.Run("Missing_fields", func(t *testing.T) {
-		reqBody := `{}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-topic", strings.NewReader(reqBody))
+	t.Run("Topic_not_found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/999999", nil)
+		req.SetPathValue("topic", "999999")
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
 
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
 		}
 
 		body := w.Body.String()
-		if body != "title field is required\n" {
-			t.Errorf("expected response 'title field is required', got '%s'", body)
+		if body != "topic not found\n" {
+			t.Errorf("expected response 'topic not found', got '%s'", body)
 		}
 	})
 
-	t.Run("Invalid_JSON", func(t *testing.T) {
-		reqBody := `{"title":}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-topic", strings.NewReader(reqBody))
+	t.Run("Missing_fields", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/", nil)
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -249,13 +286,13 @@ func TestRemoveTopicHandler(t *testing.T) {
 		}
 
 		body := w.Body.String()
-		if body != "invalid JSON format\n" {
-			t.Errorf("expected response 'invalid JSON format', got '%s'", body)
+		if body != "invalid topic_id\n" {
+			t.Errorf("expected response 'invalid topic_id', got '%s'", body)
 		}
 	})
 
 	t.Run("Invalid_Method", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/remove-topic", nil)
+		req := httptest.NewRequest(http.MethodGet, "/topics/1-test-topic", nil)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -272,41 +309,28 @@ func TestRemoveTopicHandler(t *testing.T) {
 }
 
 func TestUpVoteTopicHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to create topic table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	handler := handlers.UpVoteTopicHandler(db)
+	handler := handlers.UpVoteTopicHandler(store)
 
 	t.Run("Successful Upvote", func(t *testing.T) {
-		reqBody := `{"title":"Test Topic", "username":"testuser"}`
-		req := httptest.NewRequest(http.MethodPost, "/upvote-topic", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodPost, "/topics/1-test-topic/upvote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -326,27 +350,47 @@ func TestUpVoteTopicHandler(t *testing.T) {
 		}
 	})
 
-	t.Run("Missing Fields", func(t *testing.T) {
-		reqBody := `{}`
-		req := httptest.NewRequest(http.MethodPost, "/upvote-topic", strings.NewReader(reqBody))
+	t.Run("Double Upvote", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/topics/1-test-topic/upvote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
 
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
 		}
 
 		body := w.Body.String()
-		expectedBody := "all fields (title, username) are required\n"
+		expectedBody := "vote already recorded\n"
 		if body != expectedBody {
 			t.Errorf("expected response '%s', got '%s'", expectedBody, body)
 		}
 	})
 
-	t.Run("Invalid JSON", func(t *testing.T) {
-		reqBody := `{"title":"Test Topic", "username"}`
-		req := httptest.NewRequest(http.MethodPost, "/upvote-topic", strings.NewReader(reqBody))
+	t.Run("Unknown Topic", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/topics/999999/upvote", nil)
+		req.SetPathValue("topic", "999999")
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+
+		body := w.Body.String()
+		expectedBody := "topic not found\n"
+		if body != expectedBody {
+			t.Errorf("expected response '%s', got '%s'", expectedBody, body)
+		}
+	})
+
+	t.Run("Missing Fields", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/topics//upvote", nil)
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -356,14 +400,14 @@ func TestUpVoteTopicHandler(t *testing.T) {
 		}
 
 		body := w.Body.String()
-		expectedBody := "invalid JSON format\n"
+		expectedBody := "invalid topic_id\n"
 		if body != expectedBody {
 			t.Errorf("expected response '%s', got '%s'", expectedBody, body)
 		}
 	})
 
 	t.Run("Invalid Method", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodGet, "/upvote-topic", nil)
+		req := httptest.NewRequest(http.MethodGet, "/topics/1-test-topic/upvote", nil)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -381,42 +425,29 @@ func TestUpVoteTopicHandler(t *testing.T) {
 }
 
 func TestDownVoteTopicHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topics table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
 	topicTitle := "Test Topic"
 
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	handler := handlers.DownVoteTopicHandler(db)
+	handler := handlers.DownVoteTopicHandler(store)
 
 	t.Run("Successfully_downvote", func(t *testing.T) {
-		reqBody := `{"title":"Test Topic", "username":"testuser"}`
-		req := httptest.NewRequest(http.MethodPost, "/downvote-topic", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodPost, "/topics/1-test-topic/downvote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -436,26 +467,22 @@ func TestDownVoteTopicHandler(t *testing.T) {
 		}
 	})
 
-	t.Run("Invalid_JSON", func(t *testing.T) {
-		reqBody := `{"title":, "username":}`
-		req := httptest.NewRequest(http.MethodPost, "/downvote-topic", strings.NewReader(reqBody))
+	t.Run("Double_downvote", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/topics/1-test-topic/downvote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
 
-		if w.Code != http.StatusBadRequest {
-			t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
-		}
-
-		body := w.Body.String()
-		if body != "invalid JSON format\n" {
-			t.Errorf("expected response 'invalid JSON format', got '%s'", body)
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
 		}
 	})
 
 	t.Run("Missing_fields", func(t *testing.T) {
-		reqBody := `{}`
-		req := httptest.NewRequest(http.MethodPost, "/downvote-topic", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodPost, "/topics//downvote", nil)
+		req = asUser(t, store, req, username)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -465,182 +492,563 @@ func TestDownVoteTopicHandler(t *testing.T) {
 		}
 
 		body := w.Body.String()
-		if body != "all fields (title, username) are required\n" {
-			t.Errorf("expected response 'all fields (title, username) are required', got '%s'", body)
+		if body != "invalid topic_id\n" {
+			t.Errorf("expected response 'invalid topic_id', got '%s'", body)
 		}
 	})
 }
 
-func TestGetAllTopicsHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
+func TestTopicVoteHandlers(t *testing.T) {
+	store := memstore.New()
+
+	username := "testuser"
+	topicTitle := "Test Topic"
+
+	err := store.AddUser(ctx, username, "testuser@example.com", "password123")
 	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
+		t.Fatalf("failed to add test user: %v", err)
 	}
-	defer db.Close()
 
-	err = database.CreateUserTable(db)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
+		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topics table: %v", err)
+	getVote := func(t *testing.T) int {
+		req := httptest.NewRequest(http.MethodGet, "/topics/1-test-topic/vote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handlers.GetTopicVoteHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		var resp map[string]int
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp["vote"]
 	}
 
+	t.Run("No_vote", func(t *testing.T) {
+		if vote := getVote(t); vote != 0 {
+			t.Errorf("expected vote 0, got %d", vote)
+		}
+	})
+
+	t.Run("After_upvote", func(t *testing.T) {
+		err := store.UpVoteTopic(ctx, topic.ID, username)
+		if err != nil {
+			t.Fatalf("failed to upvote topic: %v", err)
+		}
+
+		if vote := getVote(t); vote != 1 {
+			t.Errorf("expected vote 1, got %d", vote)
+		}
+	})
+
+	t.Run("Retract", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/1-test-topic/vote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handlers.RetractTopicVoteHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		if vote := getVote(t); vote != 0 {
+			t.Errorf("expected vote 0 after retracting, got %d", vote)
+		}
+
+		updated, err := store.GetTopic(ctx, topic.ID)
+		if err != nil {
+			t.Fatalf("failed to fetch topic: %v", err)
+		}
+		if updated.Upvotes != 0 {
+			t.Errorf("expected upvotes 0 after retracting, got %v", updated.Upvotes)
+		}
+	})
+
+	t.Run("Unknown_topic", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/topics/Nope/vote", nil)
+		req.SetPathValue("topic", "999999")
+		req = asUser(t, store, req, username)
+		w := httptest.NewRecorder()
+
+		handlers.GetTopicVoteHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/topics/1-test-topic/vote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		w := httptest.NewRecorder()
+
+		handlers.RetractTopicVoteHandler(store).ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
+
+func TestGetAllTopicsHandler(t *testing.T) {
+	store := memstore.New()
+
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
 
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	err = database.AddTopic(db, "Test Topic 1", username)
+	first, err := store.AddTopic(ctx, database.TopicDraft{Title: "Test Topic 1"}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic 1: %v", err)
 	}
-	err = database.AddTopic(db, "Test Topic 2", username)
+	_, err = store.AddTopic(ctx, database.TopicDraft{Title: "Test Topic 2"}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic 2: %v", err)
 	}
 
-	handler := handlers.GetAllTopicsHandler(db)
+	handler := handlers.GetAllTopicsHandler(store)
 
-	req := httptest.NewRequest(http.MethodGet, "/topics", nil)
-	w := httptest.NewRecorder()
+	list := func(query string) handlers.TopicListResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/topics?"+query, nil)
+		w := httptest.NewRecorder()
 
-	handler.ServeHTTP(w, req)
+		handler.ServeHTTP(w, req)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
-	}
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
 
-	var topics []map[string]interface{}
-	err = json.NewDecoder(w.Body).Decode(&topics)
-	if err != nil {
-		t.Fatalf("failed to decode response body: %v", err)
+		var page handlers.TopicListResponse
+		err := json.NewDecoder(w.Body).Decode(&page)
+		if err != nil {
+			t.Fatalf("failed to decode response body: %v", err)
+		}
+		return page
 	}
 
+	topics := list("sort=oldest").Topics
 	if len(topics) != 2 {
-		t.Errorf("expected 2 topics, got %d", len(topics))
+		t.Fatalf("expected 2 topics, got %d", len(topics))
 	}
-
-	if topics[0]["title"] != "Test Topic 1" || topics[1]["title"] != "Test Topic 2" {
+	if topics[0].Title != "Test Topic 1" || topics[1].Title != "Test Topic 2" {
 		t.Errorf("unexpected topics found: %v", topics)
 	}
-}
 
-func TestGetTopicByTitleHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
+	topics = list("").Topics
+	if len(topics) != 2 || topics[0].Title != "Test Topic 2" {
+		t.Errorf("expected newest topic first by default, got %v", topics)
 	}
-	defer db.Close()
 
-	err = database.CreateUserTable(db)
+	err = store.UpVoteTopic(ctx, first.ID, username)
 	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
+		t.Fatalf("failed to upvote topic: %v", err)
 	}
 
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topics table: %v", err)
+	page := list("sort=top&limit=1")
+	if len(page.Topics) != 1 || page.Topics[0].Title != "Test Topic 1" || page.NextCursor == "" {
+		t.Fatalf("unexpected first page of top topics: %+v", page)
+	}
+	page = list("limit=1&cursor=" + page.NextCursor)
+	if len(page.Topics) != 1 || page.Topics[0].Title != "Test Topic 2" || page.NextCursor != "" {
+		t.Fatalf("unexpected second page of top topics: %+v", page)
 	}
 
+	req := httptest.NewRequest(http.MethodGet, "/topics?sort=likes", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for unknown sort, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestGetTopicHandler(t *testing.T) {
+	store := memstore.New()
+
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
 
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
 	topicTitle := "Test Topic"
-	err = database.AddTopic(db, topicTitle, username)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: topicTitle}, username)
 	if err != nil {
 		t.Fatalf("failed to add test topic: %v", err)
 	}
 
-	handler := handlers.GetTopicByTitleHandler(db)
+	handler := handlers.GetTopicHandler(store)
 
-	t.Run("TopicFound", func(t *testing.T) {
-		req, _ := http.NewRequest(http.MethodGet, "/get-topic?title=Test%20Topic", nil)
+	get := func(ref, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/topics/"+ref+query, nil)
+		req.SetPathValue("topic", ref)
 		w := httptest.NewRecorder()
-
 		handler.ServeHTTP(w, req)
+		return w
+	}
 
-		if w.Code != http.StatusOK {
-			t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	t.Run("TopicFound", func(t *testing.T) {
+		for _, ref := range []string{topic.Ref(), strconv.Itoa(topic.ID)} {
+			w := get(ref, "")
+
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: expected status %d, got %d", ref, http.StatusOK, w.Code)
+			}
+
+			var topic map[string]interface{}
+			err := json.NewDecoder(w.Body).Decode(&topic)
+			if err != nil {
+				t.Fatalf("failed to decode response body: %v", err)
+			}
+
+			if topic["title"] != topicTitle || topic["slug"] != "test-topic" {
+				t.Errorf("%s: unexpected topic %v", ref, topic)
+			}
 		}
+	})
 
-		var topic map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&topic)
-		if err != nil {
-			t.Fatalf("failed to decode response body: %v", err)
+	t.Run("Redirects", func(t *testing.T) {
+		canonical := "/api/v1/topics/" + topic.Ref()
+		tests := []struct {
+			ref   string
+			query string
+			want  string
+		}{
+			{strconv.Itoa(topic.ID) + "-old-title", "", canonical},
+			{"test-topic", "", canonical},
+			{"test-topic", "?page=2", canonical + "?page=2"},
 		}
-
-		if topic["title"] != topicTitle {
-			t.Errorf("expected topic title %q, got %q", topicTitle, topic["title"])
+		for _, tt := range tests {
+			w := get(tt.ref, tt.query)
+
+			if w.Code != http.StatusMovedPermanently {
+				t.Errorf("%s: expected status %d, got %d", tt.ref, http.StatusMovedPermanently, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("%s: expected redirect to %q, got %q", tt.ref, tt.want, got)
+			}
 		}
 	})
 
 	t.Run("TopicNotFound", func(t *testing.T) {
-		req, _ := http.NewRequest(http.MethodGet, "/get-topic?title=Nonexistent%20Topic", nil)
+		for _, ref := range []string{"999999", "999999-test-topic", "no-such-topic"} {
+			w := get(ref, "")
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s: expected status %d, got %d", ref, http.StatusNotFound, w.Code)
+			}
+
+			body := w.Body.String()
+			expectedBody := "topic not found\n"
+			if body != expectedBody {
+				t.Errorf("%s: expected response body %q, got %q", ref, expectedBody, body)
+			}
+		}
+	})
+}
+
+func TestRenameTopicHandler(t *testing.T) {
+	store := memstore.New()
+
+	for _, name := range []string{"author", "stranger", "moderator"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password123"); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+	}
+	if err := store.SetRole(ctx, "moderator", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moderator a moderator: %v", err)
+	}
+
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Frist post"}, "author")
+	if err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+	if _, err := store.AddTopic(ctx, database.TopicDraft{Title: "Taken"}, "author"); err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+
+	rename := func(caller, ref, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/topics/"+ref, strings.NewReader(body))
+		req.SetPathValue("topic", ref)
+		if caller != "" {
+			req = asUser(t, store, req, caller)
+		}
 		w := httptest.NewRecorder()
+		handlers.RenameTopicHandler(store).ServeHTTP(w, req)
+		return w
+	}
 
-		handler.ServeHTTP(w, req)
+	tests := []struct {
+		name     string
+		caller   string
+		ref      string
+		body     string
+		wantCode int
+	}{
+		{"Unauthenticated", "", topic.Ref(), `{"title":"First post"}`, http.StatusUnauthorized},
+		{"Someone_else", "stranger", topic.Ref(), `{"title":"First post"}`, http.StatusForbidden},
+		{"Missing_title", "author", topic.Ref(), `{"title":""}`, http.StatusBadRequest},
+		{"Title_taken", "author", topic.Ref(), `{"title":"Taken"}`, http.StatusConflict},
+		{"Unknown_topic", "author", "999999", `{"title":"First post"}`, http.StatusNotFound},
+		{"Invalid_topic", "author", "frist-post", `{"title":"First post"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := rename(tt.caller, tt.ref, tt.body); w.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
 
-		if w.Code != http.StatusNotFound {
-			t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	t.Run("Author_renames", func(t *testing.T) {
+		w := rename("author", topic.Ref(), `{"title":"First post"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
 		}
 
-		body := w.Body.String()
-		expectedBody := "topic with title 'Nonexistent Topic' not found\n"
-		if body != expectedBody {
-			t.Errorf("expected response body %q, got %q", expectedBody, body)
+		var resp handlers.TopicResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Topic == nil || resp.Topic.Title != "First post" || resp.Topic.Slug != "first-post" {
+			t.Fatalf("unexpected renamed topic: %+v", resp.Topic)
+		}
+		if want := "/api/v1/topics/" + resp.Topic.Ref(); w.Header().Get("Location") != want {
+			t.Errorf("expected Location %q, got %q", want, w.Header().Get("Location"))
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/topics/frist-post", nil)
+		req.SetPathValue("topic", "frist-post")
+		get := httptest.NewRecorder()
+		handlers.GetTopicHandler(store).ServeHTTP(get, req)
+		if get.Code != http.StatusMovedPermanently || get.Header().Get("Location") != "/api/v1/topics/"+resp.Topic.Ref() {
+			t.Errorf("expected the old slug to redirect, got %d %q", get.Code, get.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Moderator_renames", func(t *testing.T) {
+		if w := rename("moderator", strconv.Itoa(topic.ID), `{"title":"First post, edited"}`); w.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
 		}
 	})
 }
 
-func TestCountTopicsHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
+func TestSetTopicStateHandler(t *testing.T) {
+	store := memstore.New()
+
+	if err := store.AddUser(ctx, "moduser", "moduser@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add moduser: %v", err)
+	}
+	if err := store.SetRole(ctx, "moduser", models.RoleModerator); err != nil {
+		t.Fatalf("failed to make moduser a moderator: %v", err)
 	}
-	defer db.Close()
 
-	err = database.CreateUserTable(db)
+	topic, err := store.AddTopic(ctx, database.TopicDraft{Title: "Rules"}, "moduser")
 	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
+		t.Fatalf("failed to add topic: %v", err)
 	}
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topic table: %v", err)
+	if _, err := store.AddTopic(ctx, database.TopicDraft{Title: "Chatter"}, "moduser"); err != nil {
+		t.Fatalf("failed to add topic: %v", err)
+	}
+
+	set := func(method, state, caller, ref string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/topics/"+ref+"/"+state, nil)
+		req.SetPathValue("topic", ref)
+		if caller != "" {
+			req = asUser(t, store, req, caller)
+		}
+		w := httptest.NewRecorder()
+		handlers.SetTopicStateHandler(store, state).ServeHTTP(w, req)
+		return w
+	}
+
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) handlers.TopicResponse {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var resp handlers.TopicResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	addMessage := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/topics/"+topic.Ref()+"/messages", strings.NewReader(`{"message":"Hello"}`))
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, "moduser")
+		w := httptest.NewRecorder()
+		handlers.AddMessageHandler(store).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Lock", func(t *testing.T) {
+		resp := decode(t, set(http.MethodPut, models.TopicLocked, "moduser", topic.Ref()))
+		if resp.Message != "topic locked" || resp.Topic == nil || resp.Topic.LockedAt == nil {
+			t.Fatalf("expected the topic to be locked, got %+v", resp)
+		}
+
+		w := addMessage()
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "topic is locked") {
+			t.Errorf("expected replies to a locked topic to conflict, got %d: %s", w.Code, w.Body.String())
+		}
+
+		resp = decode(t, set(http.MethodDelete, models.TopicLocked, "moduser", topic.Ref()))
+		if resp.Message != "topic no longer locked" || resp.Topic.LockedAt != nil {
+			t.Fatalf("expected the topic to be unlocked, got %+v", resp)
+		}
+		if w := addMessage(); w.Code != http.StatusCreated {
+			t.Errorf("expected status %d after unlocking, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Pin", func(t *testing.T) {
+		decode(t, set(http.MethodPut, models.TopicPinned, "moduser", topic.Ref()))
+
+		req := httptest.NewRequest(http.MethodGet, "/topics", nil)
+		w := httptest.NewRecorder()
+		handlers.GetAllTopicsHandler(store).ServeHTTP(w, req)
+
+		var list handlers.TopicListResponse
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(list.Topics) != 2 || list.Topics[0].ID != topic.ID || list.Topics[0].PinnedAt == nil {
+			t.Errorf("expected the pinned topic first, got %+v", list.Topics)
+		}
+	})
+
+	t.Run("Archive", func(t *testing.T) {
+		first, err := store.AddMessage(ctx, topic.ID, "First", "moduser", 0)
+		if err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+		second, err := store.AddMessage(ctx, topic.ID, "Second", "moduser", 0)
+		if err != nil {
+			t.Fatalf("failed to add message: %v", err)
+		}
+		if err := store.LikeMessage(ctx, second.ID, "moduser"); err != nil {
+			t.Fatalf("failed to like message: %v", err)
+		}
+
+		decode(t, set(http.MethodPut, models.TopicArchived, "moduser", topic.Ref()))
+
+		messagePath := map[string]string{"id": strconv.Itoa(second.ID)}
+		topicPath := map[string]string{"topic": topic.Ref()}
+		writes := []struct {
+			name    string
+			method  string
+			path    map[string]string
+			body    string
+			handler http.Handler
+		}{
+			{"Like", http.MethodPost, messagePath, "", handlers.LikeMessageHandler(store)},
+			{"React", http.MethodPost, messagePath, `{"reaction":"heart"}`, handlers.AddReactionHandler(store)},
+			{"Unreact", http.MethodDelete, map[string]string{"id": strconv.Itoa(second.ID), "reaction": "like"}, "", handlers.RemoveReactionHandler(store)},
+			{"Delete_message", http.MethodDelete, messagePath, "", handlers.DeleteMessageHandler(store)},
+			{"Set_parent", http.MethodPost, messagePath, `{"parent_id":` + strconv.Itoa(first.ID) + `}`, handlers.SetParentHandler(store)},
+			{"Rename", http.MethodPatch, topicPath, `{"title":"Old rules"}`, handlers.RenameTopicHandler(store)},
+			{"Tags", http.MethodPut, topicPath, `{"tags":["history"]}`, handlers.SetTopicTagsHandler(store)},
+			{"Split", http.MethodPost, messagePath, `{"title":"Split rules"}`, handlers.SplitTopicHandler(store, store)},
+		}
+		for _, write := range writes {
+			req := httptest.NewRequest(write.method, "/", strings.NewReader(write.body))
+			for name, value := range write.path {
+				req.SetPathValue(name, value)
+			}
+			req = asUser(t, store, req, "moduser")
+			w := httptest.NewRecorder()
+			write.handler.ServeHTTP(w, req)
+			if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "topic is archived") {
+				t.Errorf("%s: expected writes to an archived topic to conflict, got %d: %s", write.name, w.Code, w.Body.String())
+			}
+		}
+
+		if w := addMessage(); w.Code != http.StatusConflict {
+			t.Errorf("expected replies to an archived topic to conflict, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/topics/"+topic.Ref()+"/upvote", nil)
+		req.SetPathValue("topic", topic.Ref())
+		req = asUser(t, store, req, "moduser")
+		w := httptest.NewRecorder()
+		handlers.UpVoteTopicHandler(store).ServeHTTP(w, req)
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected votes on an archived topic to conflict, got %d: %s", w.Code, w.Body.String())
+		}
+
+		resp := decode(t, set(http.MethodDelete, models.TopicArchived, "moduser", topic.Ref()))
+		if resp.Topic.ArchivedAt != nil || resp.Topic.PinnedAt == nil {
+			t.Errorf("expected unarchiving to leave the pin alone, got %+v", resp.Topic)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		state    string
+		caller   string
+		ref      string
+		wantCode int
+	}{
+		{"Unauthenticated", http.MethodPut, models.TopicLocked, "", topic.Ref(), http.StatusUnauthorized},
+		{"Invalid_topic", http.MethodPut, models.TopicLocked, "moduser", "rules", http.StatusBadRequest},
+		{"Unknown_topic", http.MethodPut, models.TopicLocked, "moduser", "999999", http.StatusNotFound},
+		{"Unknown_state", http.MethodPut, "hidden", "moduser", topic.Ref(), http.StatusBadRequest},
+		{"Wrong_method", http.MethodPost, models.TopicLocked, "moduser", topic.Ref(), http.StatusMethodNotAllowed},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := set(tt.method, tt.state, tt.caller, tt.ref); w.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCountTopicsHandler(t *testing.T) {
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@example.com"
 	password := "password123"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	err = database.AddTopic(db, "Test Topic 1", username)
+	_, err = store.AddTopic(ctx, database.TopicDraft{Title: "Test Topic 1"}, username)
 	if err != nil {
 		t.Fatalf("failed to add topic: %v", err)
 	}
-	err = database.AddTopic(db, "Test Topic 2", username)
+	_, err = store.AddTopic(ctx, database.TopicDraft{Title: "Test Topic 2"}, username)
 	if err != nil {
 		t.Fatalf("failed to add topic: %v", err)
 	}
 
-	handler := handlers.CountTopicsHandler(db)
+	handler := handlers.CountTopicsHandler(store)
 
-	req := httptest.NewRequest(http.MethodGet, "/count-topics", nil)
+	req := httptest.NewRequest(http.MethodGet, "/topics/count", nil)
 	w := httptest.NewRecorder()
 
 	handler.ServeHTTP(w, req)
@@ -0,0 +1,516 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/totp"
+)
+
+// TwoFactorIssuer is the name authenticator apps show next to the account.
+const TwoFactorIssuer = "Brainwave"
+
+type TwoFactorEnrolmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TwoFactorPolicy struct {
+	RequiredRole string `json:"required_role"`
+}
+
+// EnforceTwoFactor holds users whose role must use two-factor
+// authentication, but who have not turned it on, to the rights of a plain
+// user until they do. RequireRole then tells them why they were refused.
+// It must run inside RequireAuth or OptionalAuth.
+func EnforceTwoFactor(store database.TwoFactorStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := CurrentUser(r)
+		if !ok || user.Role == models.RoleUser {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required, err := twoFactorRequired(r.Context(), store, user)
+		if err != nil {
+			http.Error(w, "failed to check two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		if required {
+			restricted := *user
+			restricted.Role = models.RoleUser
+			ctx := context.WithValue(ContextWithUser(r.Context(), &restricted), heldRoleContextKey, user.Role)
+			r = r.WithContext(ctx)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// twoFactorRequired reports whether user's role must use two-factor
+// authentication and they have not turned it on.
+func twoFactorRequired(ctx context.Context, store database.TwoFactorStore, user *models.User) (bool, error) {
+	role, err := store.GetTwoFactorRole(ctx)
+	if err != nil || role == "" || !user.HasRole(role) {
+		return false, err
+	}
+
+	enabled, err := store.TwoFactorEnabled(ctx, user.Username)
+	return !enabled, err
+}
+
+// missingTwoFactor reports whether the user would hold role if
+// EnforceTwoFactor had not held them back.
+func missingTwoFactor(r *http.Request, role string) bool {
+	held, ok := r.Context().Value(heldRoleContextKey).(string)
+	return ok && (&models.User{Role: held}).HasRole(role)
+}
+
+// verifySecondFactor checks code as username's second factor on behalf of
+// the client making r. Wrong codes count as failed logins, so guessing at
+// codes locks out the username like guessing at passwords does, and while
+// it is locked out the code is not checked and lockedUntil says until when.
+func verifySecondFactor(r *http.Request, logins database.LoginStore, store database.TwoFactorStore, username, code string) (lockedUntil time.Time, err error) {
+	ip := clientIP(r)
+	lockedUntil, err = logins.LoginLockedUntil(r.Context(), username, ip)
+	if err != nil || !lockedUntil.IsZero() {
+		return lockedUntil, err
+	}
+
+	err = store.VerifyTwoFactor(r.Context(), username, code)
+	if errors.Is(err, database.ErrInvalidTwoFactorCode) {
+		recordErr := logins.RecordLogin(r.Context(), models.LoginAttempt{
+			Username:  username,
+			Success:   false,
+			IP:        ip,
+			UserAgent: r.UserAgent(),
+		})
+		if recordErr != nil {
+			return time.Time{}, recordErr
+		}
+	}
+	return time.Time{}, err
+}
+
+// BeginTwoFactorHandler starts two-factor enrolment for the signed-in user
+// and returns the new secret, along with the otpauth URI to show as a QR
+// code. Two-factor authentication is not on until ConfirmTwoFactorHandler
+// has seen a code made from the secret.
+func BeginTwoFactorHandler(store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		secret, err := store.BeginTwoFactor(r.Context(), user.Username)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrTwoFactorEnabled):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, database.ErrUserNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			default:
+				http.Error(w, "failed to start two-factor enrolment", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		resp := TwoFactorEnrolmentResponse{
+			Secret: secret,
+			URI:    totp.URI(TwoFactorIssuer, user.Username, secret),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// ConfirmTwoFactorHandler turns on two-factor authentication once the user
+// sends a code from their app, and returns their recovery codes. This is
+// the only time the codes are shown.
+func ConfirmTwoFactorHandler(store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		var reqBody TwoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Code == "" {
+			http.Error(w, "code is required", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := store.ConfirmTwoFactor(r.Context(), user.Username, reqBody.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrInvalidTwoFactorCode):
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			case errors.Is(err, database.ErrTwoFactorNotPending), errors.Is(err, database.ErrTwoFactorEnabled):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, database.ErrUserNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			default:
+				http.Error(w, "failed to confirm two-factor authentication", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		resp := RecoveryCodesResponse{
+			Message:       "two-factor authentication enabled",
+			RecoveryCodes: codes,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// RegenerateRecoveryCodesHandler replaces the signed-in user's recovery
+// codes after they prove they still have a second factor.
+func RegenerateRecoveryCodesHandler(logins database.LoginStore, store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		var reqBody TwoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Code == "" {
+			http.Error(w, "code is required", http.StatusBadRequest)
+			return
+		}
+
+		if !checkSecondFactor(w, r, logins, store, user.Username, reqBody.Code) {
+			return
+		}
+
+		codes, err := store.RegenerateRecoveryCodes(r.Context(), user.Username)
+		if err != nil {
+			http.Error(w, "failed to regenerate recovery codes", http.StatusInternalServerError)
+			return
+		}
+
+		resp := RecoveryCodesResponse{
+			Message:       "recovery codes regenerated",
+			RecoveryCodes: codes,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// DisableTwoFactorHandler turns off two-factor authentication for the
+// signed-in user after they prove they still have a second factor.
+func DisableTwoFactorHandler(logins database.LoginStore, store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		var reqBody TwoFactorCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Code == "" {
+			http.Error(w, "code is required", http.StatusBadRequest)
+			return
+		}
+
+		if !checkSecondFactor(w, r, logins, store, user.Username, reqBody.Code) {
+			return
+		}
+
+		if err := store.DisableTwoFactor(r.Context(), user.Username); err != nil {
+			http.Error(w, "failed to disable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+
+		resp := map[string]string{
+			"message": "two-factor authentication disabled",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// checkSecondFactor verifies code for a signed-in user and writes the error
+// response if it is not accepted.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, logins database.LoginStore, store database.TwoFactorStore, username, code string) bool {
+	lockedUntil, err := verifySecondFactor(r, logins, store, username, code)
+	if !lockedUntil.IsZero() {
+		writeLockedOut(w, lockedUntil)
+		return false
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrInvalidTwoFactorCode):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, database.ErrTwoFactorNotEnabled):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "failed to verify two-factor code", http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
+
+// ResetTwoFactorHandler turns off two-factor authentication for the user in
+// the path, for someone who has lost both their app and their recovery
+// codes. It is meant to be mounted behind RequireRole(models.RoleAdmin).
+func ResetTwoFactorHandler(store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.PathValue("username")
+		if username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+
+		err := store.DisableTwoFactor(r.Context(), username)
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrUserNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, database.ErrTwoFactorNotEnabled):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, "failed to reset two-factor authentication", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		resp := map[string]string{
+			"message": "two-factor authentication reset",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// LoginTwoFactorHandler finishes a login that LoginHandler answered with a
+// challenge: given the challenge and a code from the user's app, or one of
+// their recovery codes, it starts the session.
+func LoginTwoFactorHandler(sessions database.SessionStore, logins database.LoginStore, store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reqBody TwoFactorLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Challenge == "" || reqBody.Code == "" {
+			http.Error(w, "both challenge and code are required", http.StatusBadRequest)
+			return
+		}
+
+		username, err := store.GetLoginChallenge(r.Context(), reqBody.Challenge)
+		if err != nil {
+			if errors.Is(err, database.ErrInvalidChallenge) {
+				writeLoginError(w, "invalid or expired login challenge")
+				return
+			}
+			http.Error(w, "failed to fetch login challenge", http.StatusInternalServerError)
+			return
+		}
+
+		lockedUntil, err := verifySecondFactor(r, logins, store, username, reqBody.Code)
+		if !lockedUntil.IsZero() {
+			writeLockedOut(w, lockedUntil)
+			return
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, database.ErrInvalidTwoFactorCode):
+				writeLoginError(w, err.Error())
+			case errors.Is(err, database.ErrTwoFactorNotEnabled), errors.Is(err, database.ErrUserNotFound):
+				writeLoginError(w, "invalid or expired login challenge")
+			default:
+				http.Error(w, "failed to verify two-factor code", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := store.DeleteLoginChallenge(r.Context(), reqBody.Challenge); err != nil {
+			http.Error(w, "failed to finish login", http.StatusInternalServerError)
+			return
+		}
+
+		err = logins.RecordLogin(r.Context(), models.LoginAttempt{
+			Username:  username,
+			Success:   true,
+			IP:        clientIP(r),
+			UserAgent: r.UserAgent(),
+		})
+		if err != nil {
+			http.Error(w, "failed to finish login", http.StatusInternalServerError)
+			return
+		}
+
+		token, err := startSession(w, r, sessions, username)
+		if err != nil {
+			log.Printf("error creating session for %s: %v", username, err)
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+			return
+		}
+
+		resp := LoginResponse{
+			Message: "logged in successfully",
+			Token:   token,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// GetTwoFactorPolicyHandler returns the least privileged role that must use
+// two-factor authentication. It is meant to be mounted behind
+// RequireRole(models.RoleAdmin).
+func GetTwoFactorPolicyHandler(store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		role, err := store.GetTwoFactorRole(r.Context())
+		if err != nil {
+			http.Error(w, "failed to fetch two-factor policy", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(TwoFactorPolicy{RequiredRole: role})
+	}
+}
+
+// SetTwoFactorPolicyHandler makes two-factor authentication required for a
+// role and every more privileged one, or for nobody if the role is empty.
+// Admins must turn it on for themselves before requiring it of their own
+// role. It is meant to be mounted behind RequireRole(models.RoleAdmin).
+func SetTwoFactorPolicyHandler(store database.TwoFactorStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		var reqBody TwoFactorPolicy
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.RequiredRole != "" && user.HasRole(reqBody.RequiredRole) {
+			enabled, err := store.TwoFactorEnabled(r.Context(), user.Username)
+			if err != nil {
+				http.Error(w, "failed to check two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			if !enabled {
+				http.Error(w, "enable two-factor authentication before requiring it for your own role", http.StatusConflict)
+				return
+			}
+		}
+
+		err := store.SetTwoFactorRole(r.Context(), reqBody.RequiredRole)
+		if err != nil {
+			if errors.Is(err, database.ErrInvalidTwoFactorRole) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to set two-factor policy", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(reqBody)
+	}
+}
@@ -0,0 +1,364 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/models"
+	"github.com/dDogge/Brainwave/totp"
+)
+
+// enableTwoFactor turns on two-factor authentication for username and
+// returns the secret and recovery codes.
+func enableTwoFactor(t *testing.T, store database.TwoFactorStore, username string) (string, []string) {
+	t.Helper()
+
+	secret, err := store.BeginTwoFactor(ctx, username)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor failed: %v", err)
+	}
+	code, _ := totp.Code(secret, time.Now())
+	codes, err := store.ConfirmTwoFactor(ctx, username, code)
+	if err != nil {
+		t.Fatalf("ConfirmTwoFactor failed: %v", err)
+	}
+	return secret, codes
+}
+
+func jsonRequest(method, path string, body any) *http.Request {
+	data, _ := json.Marshal(body)
+	return httptest.NewRequest(method, path, bytes.NewReader(data))
+}
+
+func TestTwoFactorEnrolment(t *testing.T) {
+	store := memstore.New()
+	if err := store.AddUser(ctx, "alice", "alice@test.com", "password123"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handlers.BeginTwoFactorHandler(store).ServeHTTP(rr, asUser(t, store, httptest.NewRequest(http.MethodPost, "/users/me/2fa", nil), "alice"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var enrolment handlers.TwoFactorEnrolmentResponse
+	if err := json.NewDecoder(rr.Body).Decode(&enrolment); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if enrolment.Secret == "" || !strings.HasPrefix(enrolment.URI, "otpauth://totp/Brainwave:alice?") || !strings.Contains(enrolment.URI, "secret="+enrolment.Secret) {
+		t.Fatalf("unexpected enrolment: %+v", enrolment)
+	}
+
+	confirm := func(code string) *httptest.ResponseRecorder {
+		req := asUser(t, store, jsonRequest(http.MethodPost, "/users/me/2fa/confirm", handlers.TwoFactorCodeRequest{Code: code}), "alice")
+		rr := httptest.NewRecorder()
+		handlers.ConfirmTwoFactorHandler(store).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := confirm("000000"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", rr.Code)
+	}
+	if enabled, _ := store.TwoFactorEnabled(ctx, "alice"); enabled {
+		t.Fatal("expected two-factor to stay off after a wrong code")
+	}
+
+	code, _ := totp.Code(enrolment.Secret, time.Now())
+	rr = confirm(code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var resp handlers.RecoveryCodesResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.RecoveryCodes) != database.RecoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %v", database.RecoveryCodeCount, resp.RecoveryCodes)
+	}
+
+	if rr := confirm(code); rr.Code != http.StatusConflict {
+		t.Errorf("expected confirming twice to conflict, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handlers.BeginTwoFactorHandler(store).ServeHTTP(rr, asUser(t, store, httptest.NewRequest(http.MethodPost, "/users/me/2fa", nil), "alice"))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected enrolling again to conflict, got %d", rr.Code)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	store := memstore.New()
+	store.SetLoginPolicy(database.LoginPolicy{
+		UserThreshold: 3,
+		IPThreshold:   10,
+		BaseLockout:   time.Minute,
+		MaxLockout:    time.Hour,
+		FailureWindow: 15 * time.Minute,
+	})
+	if err := store.AddUser(ctx, "alice", "alice@test.com", "password123"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	_, codes := enableTwoFactor(t, store, "alice")
+
+	login := func() handlers.LoginResponse {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handlers.LoginHandler(store, store, store, store).ServeHTTP(rr, jsonRequest(http.MethodPost, "/auth/login",
+			handlers.LoginRequest{Username: "alice", Password: "password123"}))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if len(rr.Result().Cookies()) != 0 {
+			t.Error("expected no session cookie before the second factor")
+		}
+
+		var resp handlers.LoginResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if !resp.TwoFactorRequired || resp.Challenge == "" || resp.Token != "" {
+			t.Fatalf("expected a challenge and no token, got %+v", resp)
+		}
+		return resp
+	}
+	secondStep := func(challenge, code string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handlers.LoginTwoFactorHandler(store, store, store).ServeHTTP(rr, jsonRequest(http.MethodPost, "/auth/login/2fa",
+			handlers.TwoFactorLoginRequest{Challenge: challenge, Code: code}))
+		return rr
+	}
+
+	challenge := login().Challenge
+
+	if rr := secondStep("bogus", codes[0]); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown challenge to be refused, got %d", rr.Code)
+	}
+	if rr := secondStep(challenge, "000000"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", rr.Code)
+	}
+
+	rr := secondStep(challenge, codes[0])
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var resp handlers.LoginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if user, err := store.GetSessionUser(ctx, resp.Token); err != nil || user.Username != "alice" {
+		t.Fatalf("expected a session for alice, got %v, %v", user, err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != resp.Token {
+		t.Errorf("expected the session cookie, got %v", cookies)
+	}
+
+	if rr := secondStep(challenge, codes[1]); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a challenge to work only once, got %d", rr.Code)
+	}
+	if rr := secondStep(login().Challenge, codes[0]); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a used recovery code to be refused, got %d", rr.Code)
+	}
+
+	// The password step is not a successful login by itself, so it does
+	// not forget failed codes.
+	challenge = login().Challenge
+	for i := 0; i < 2; i++ {
+		if rr := secondStep(challenge, "000000"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+	if rr := secondStep(challenge, codes[1]); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected guessing codes to lock out the username, got %d", rr.Code)
+	}
+
+	attempts, err := store.GetLoginAttempts(ctx, "alice", 0)
+	if err != nil {
+		t.Fatalf("GetLoginAttempts failed: %v", err)
+	}
+	successes := 0
+	for _, attempt := range attempts {
+		if attempt.Success {
+			successes++
+		}
+	}
+	if len(attempts) != 5 || successes != 1 {
+		t.Errorf("expected 4 failed codes and 1 finished login in the audit trail, got %+v", attempts)
+	}
+}
+
+func TestTwoFactorManagement(t *testing.T) {
+	store := memstore.New()
+	for _, name := range []string{"alice", "bob"} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password123"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+	}
+	_, codes := enableTwoFactor(t, store, "alice")
+
+	send := func(h http.HandlerFunc, method, username, code string) *httptest.ResponseRecorder {
+		req := asUser(t, store, jsonRequest(method, "/users/me/2fa", handlers.TwoFactorCodeRequest{Code: code}), username)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	regenerate := handlers.RegenerateRecoveryCodesHandler(store, store)
+	if rr := send(regenerate, http.MethodPost, "alice", "wrong-code"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", rr.Code)
+	}
+	if rr := send(regenerate, http.MethodPost, "bob", "000000"); rr.Code != http.StatusConflict {
+		t.Errorf("expected users without two-factor to conflict, got %d", rr.Code)
+	}
+
+	rr := send(regenerate, http.MethodPost, "alice", codes[0])
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var resp handlers.RecoveryCodesResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	disable := handlers.DisableTwoFactorHandler(store, store)
+	if rr := send(disable, http.MethodDelete, "alice", codes[1]); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected replaced recovery codes to be refused, got %d", rr.Code)
+	}
+	if rr := send(disable, http.MethodDelete, "alice", resp.RecoveryCodes[0]); rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if enabled, _ := store.TwoFactorEnabled(ctx, "alice"); enabled {
+		t.Error("expected two-factor to be off")
+	}
+
+	enableTwoFactor(t, store, "alice")
+	reset := func(username string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/users/"+username+"/2fa", nil)
+		req.SetPathValue("username", username)
+		rr := httptest.NewRecorder()
+		handlers.ResetTwoFactorHandler(store).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := reset("alice"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := reset("alice"); code != http.StatusConflict {
+		t.Errorf("expected resetting twice to conflict, got %d", code)
+	}
+	if code := reset("nobody"); code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestEnforceTwoFactor(t *testing.T) {
+	store := memstore.New()
+	for name, role := range map[string]string{"mod": models.RoleModerator, "plain": models.RoleUser} {
+		if err := store.AddUser(ctx, name, name+"@test.com", "password123"); err != nil {
+			t.Fatalf("AddUser failed: %v", err)
+		}
+		if err := store.SetRole(ctx, name, role); err != nil {
+			t.Fatalf("SetRole failed: %v", err)
+		}
+	}
+
+	var seenRole string
+	h := handlers.EnforceTwoFactor(store, handlers.RequireRole(models.RoleModerator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := handlers.CurrentUser(r)
+		seenRole = user.Role
+	})))
+	send := func(username string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, asUser(t, store, httptest.NewRequest(http.MethodPost, "/", nil), username))
+		return rr
+	}
+
+	if rr := send("mod"); rr.Code != http.StatusOK || seenRole != models.RoleModerator {
+		t.Fatalf("expected moderators to pass while two-factor is optional, got %d", rr.Code)
+	}
+
+	if err := store.SetTwoFactorRole(ctx, models.RoleModerator); err != nil {
+		t.Fatalf("SetTwoFactorRole failed: %v", err)
+	}
+
+	rr := send("mod")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "two-factor authentication is required") {
+		t.Errorf("expected the moderator to be told to turn on two-factor, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = send("plain")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "insufficient permissions") {
+		t.Errorf("expected plain users to lack permission as before, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Handlers that check roles themselves see a plain user.
+	var held string
+	handlers.EnforceTwoFactor(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := handlers.CurrentUser(r)
+		held = user.Role
+	})).ServeHTTP(httptest.NewRecorder(), asUser(t, store, httptest.NewRequest(http.MethodPost, "/", nil), "mod"))
+	if held != models.RoleUser {
+		t.Errorf("expected the moderator to be held to a user's rights, got %q", held)
+	}
+
+	enableTwoFactor(t, store, "mod")
+	if rr := send("mod"); rr.Code != http.StatusOK || seenRole != models.RoleModerator {
+		t.Errorf("expected the moderator to pass with two-factor on, got %d", rr.Code)
+	}
+}
+
+func TestTwoFactorPolicyHandlers(t *testing.T) {
+	store := memstore.New()
+	if err := store.AddUser(ctx, "admin", "admin@test.com", "password123"); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	if err := store.SetRole(ctx, "admin", models.RoleAdmin); err != nil {
+		t.Fatalf("SetRole failed: %v", err)
+	}
+
+	set := func(role string) *httptest.ResponseRecorder {
+		req := asUser(t, store, jsonRequest(http.MethodPut, "/settings/two-factor", handlers.TwoFactorPolicy{RequiredRole: role}), "admin")
+		rr := httptest.NewRecorder()
+		handlers.SetTwoFactorPolicyHandler(store).ServeHTTP(rr, req)
+		return rr
+	}
+	get := func() string {
+		rr := httptest.NewRecorder()
+		handlers.GetTwoFactorPolicyHandler(store).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/settings/two-factor", nil))
+		var policy handlers.TwoFactorPolicy
+		if err := json.NewDecoder(rr.Body).Decode(&policy); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return policy.RequiredRole
+	}
+
+	if rr := set(models.RoleModerator); rr.Code != http.StatusConflict {
+		t.Errorf("expected an admin without two-factor to be stopped, got %d", rr.Code)
+	}
+	if rr := set("owner"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown role to be refused, got %d", rr.Code)
+	}
+
+	enableTwoFactor(t, store, "admin")
+	if rr := set(models.RoleModerator); rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if role := get(); role != models.RoleModerator {
+		t.Errorf("expected %q, got %q", models.RoleModerator, role)
+	}
+
+	if rr := set(""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if role := get(); role != "" {
+		t.Errorf("expected no required role, got %q", role)
+	}
+}
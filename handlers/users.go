@@ -1,13 +1,15 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/mail"
+	"github.com/dDogge/Brainwave/models"
 )
 
 type CheckPasswordRequest struct {
@@ -21,7 +23,6 @@ type CheckPasswordResponse struct {
 }
 
 type ChangePasswordRequest struct {
-	Username        string `json:"username"`
 	CurrentPassword string `json:"current_password"`
 	NewPassword     string `json:"new_password"`
 }
@@ -32,8 +33,7 @@ type ChangePasswordResponse struct {
 }
 
 type ChangeEmailRequest struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
+	Email string `json:"email"`
 }
 
 type ChangeEmailResponse struct {
@@ -41,8 +41,11 @@ type ChangeEmailResponse struct {
 	Error   string `json:"error,omitempty"`
 }
 
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
 type ChangeUsernameRequest struct {
-	Username    string `json:"username"`
 	NewUsername string `json:"new_username"`
 }
 
@@ -57,7 +60,6 @@ type GenerateResetCodeRequest struct {
 
 type GenerateResetCodeResponse struct {
 	Message    string `json:"message"`
-	ResetCode  string `json:"reset_code,omitempty"`
 	StatusCode int    `json:"-"`
 }
 
@@ -72,44 +74,91 @@ type ResetPasswordResponse struct {
 	StatusCode int    `json:"-"`
 }
 
-func CreateUserHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	const ErrUserExists = "username or email already exists"
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
 
-	var reqBody struct {
-		Username string `json:"username"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+type UserListResponse struct {
+	Users      []models.User `json:"users"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
 
-	err := json.NewDecoder(r.Body).Decode(&reqBody)
-	if err != nil {
-		http.Error(w, "invalid input format", http.StatusBadRequest)
-		return
+// verificationMessage is the mail carrying an email verification token to
+// the address it proves.
+func verificationMessage(email, token string) mail.Message {
+	return mail.Message{
+		To:      email,
+		Subject: "Verify your Brainwave email address",
+		Body: fmt.Sprintf("Please confirm that this address belongs to your Brainwave account.\n\n"+
+			"Your verification code is:\n\n    %s\n\n"+
+			"It can be used once within the next %d hours. If you did not ask for this, you can ignore this email.\n",
+			token, int(database.EmailVerificationTTL.Hours())),
 	}
+}
 
-	if reqBody.Username == "" || reqBody.Email == "" || reqBody.Password == "" {
-		http.Error(w, "all fields (username, email, password) are required", http.StatusBadRequest)
-		return
-	}
+// CreateUserHandler signs up a user and mails them a code to verify their
+// email address with. The account is created even if the mail cannot be
+// sent, as the code can be sent again.
+func CreateUserHandler(store database.UserStore, mailer mail.Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reqBody struct {
+			Username string `json:"username"`
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
 
-	err = database.AddUser(db, reqBody.Username, reqBody.Email, reqBody.Password)
-	if err != nil {
-		if err.Error() == ErrUserExists {
-			http.Error(w, ErrUserExists, http.StatusConflict)
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid input format", http.StatusBadRequest)
+			return
+		}
+
+		if reqBody.Username == "" || reqBody.Email == "" || reqBody.Password == "" {
+			http.Error(w, "all fields (username, email, password) are required", http.StatusBadRequest)
+			return
+		}
+
+		err = store.AddUser(r.Context(), reqBody.Username, reqBody.Email, reqBody.Password)
+		if err != nil {
+			if errors.Is(err, database.ErrUserExists) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if errors.Is(err, database.ErrInvalidEmail) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("internal server error: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("internal server error: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
-	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "user created successfully",
-	})
+		message := "user created successfully, a verification code has been sent to your email"
+		email, token, err := store.CreateEmailVerification(r.Context(), reqBody.Username)
+		if err == nil {
+			err = mailer.Send(r.Context(), verificationMessage(email, token))
+		}
+		if err != nil {
+			log.Printf("error mailing email verification code: %v", err)
+			message = "user created successfully, but the verification code could not be sent"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": message,
+		})
+	}
 }
 
-func CheckPasswordHandler(db *sql.DB) http.HandlerFunc {
+// CheckPasswordHandler reports whether a username and password match. It
+// counts towards the same lockouts as logging in.
+func CheckPasswordHandler(store database.UserStore, logins database.LoginStore, twoFactor database.TwoFactorStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
@@ -128,12 +177,17 @@ func CheckPasswordHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		valid, err := database.CheckPassword(db, reqBody.Username, reqBody.Password)
+		valid, _, lockedUntil, err := checkLogin(r, store, logins, twoFactor, reqBody.Username, reqBody.Password)
 		if err != nil {
 			http.Error(w, "error checking password", http.StatusInternalServerError)
 			return
 		}
 
+		if !lockedUntil.IsZero() {
+			writeLockedOut(w, lockedUntil)
+			return
+		}
+
 		if !valid {
 			resp := CheckPasswordResponse{
 				Valid: false,
@@ -153,13 +207,19 @@ func CheckPasswordHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
+func ChangePasswordHandler(store database.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
 		var reqBody ChangePasswordRequest
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
@@ -167,15 +227,15 @@ func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if reqBody.Username == "" || reqBody.CurrentPassword == "" || reqBody.NewPassword == "" {
-			http.Error(w, "all fields (username, current_password, new_password) are required", http.StatusBadRequest)
+		if reqBody.CurrentPassword == "" || reqBody.NewPassword == "" {
+			http.Error(w, "all fields (current_password, new_password) are required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.ChangePassword(db, reqBody.Username, reqBody.CurrentPassword, reqBody.NewPassword)
+		err = store.ChangePassword(r.Context(), user.Username, reqBody.CurrentPassword, reqBody.NewPassword)
 		if err != nil {
 			var statusCode int
-			if err.Error() == "user not found" || err.Error() == "incorrect current password" {
+			if errors.Is(err, database.ErrUserNotFound) || errors.Is(err, database.ErrIncorrectPassword) {
 				statusCode = http.StatusUnauthorized
 			} else {
 				statusCode = http.StatusInternalServerError
@@ -193,13 +253,22 @@ func ChangePasswordHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ChangeEmailHandler(db *sql.DB) http.HandlerFunc {
+// ChangeEmailHandler mails a verification code to the new address, which
+// only replaces the current one once verified, and lets the current address
+// know a change was asked for.
+func ChangeEmailHandler(store database.UserStore, mailer mail.Mailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
 		var reqBody ChangeEmailRequest
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
@@ -207,23 +276,50 @@ func ChangeEmailHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if reqBody.Username == "" || reqBody.Email == "" {
-			http.Error(w, "all fields (username, email) are required", http.StatusBadRequest)
+		if reqBody.Email == "" {
+			http.Error(w, "email field is required", http.StatusBadRequest)
+			return
+		}
+
+		current, err := store.GetUser(r.Context(), user.Username)
+		if err != nil {
+			http.Error(w, "failed to change email", http.StatusInternalServerError)
 			return
 		}
 
-		err = database.ChangeEmail(db, reqBody.Username, reqBody.Email)
+		token, err := store.ChangeEmail(r.Context(), user.Username, reqBody.Email)
 		if err != nil {
-			if err.Error() == "email is already in use" {
+			if errors.Is(err, database.ErrEmailInUse) {
 				http.Error(w, err.Error(), http.StatusConflict)
 				return
 			}
+			if errors.Is(err, database.ErrInvalidEmail) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "failed to change email", http.StatusInternalServerError)
 			return
 		}
 
+		if err := mailer.Send(r.Context(), verificationMessage(reqBody.Email, token)); err != nil {
+			log.Printf("error mailing email verification code: %v", err)
+			http.Error(w, "failed to send confirmation email", http.StatusInternalServerError)
+			return
+		}
+
+		notice := mail.Message{
+			To:      current.Email,
+			Subject: "Your Brainwave email address is changing",
+			Body: fmt.Sprintf("Someone asked to change the email address of the Brainwave account %s to %s.\n\n"+
+				"The change takes effect once the new address is verified. If you did not ask for this, change your password.\n",
+				user.Username, reqBody.Email),
+		}
+		if err := mailer.Send(r.Context(), notice); err != nil {
+			log.Printf("error mailing email change notice: %v", err)
+		}
+
 		resp := ChangeEmailResponse{
-			Message: "email changed successfully",
+			Message: "a verification code has been sent to the new address",
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -231,72 +327,151 @@ func ChangeEmailHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ChangeUsernameHandler(db *sql.DB) http.HandlerFunc {
+// VerifyEmailHandler verifies the address a code was mailed to, switching
+// the user over to it if it was an email change.
+func VerifyEmailHandler(store database.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reqBody ChangeUsernameRequest
+		var reqBody VerifyEmailRequest
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			http.Error(w, "invalid JSON format", http.StatusBadRequest)
 			return
 		}
 
-		if reqBody.Username == "" || reqBody.NewUsername == "" {
-			http.Error(w, "all fields (username, new_username) are required", http.StatusBadRequest)
+		if reqBody.Token == "" {
+			http.Error(w, "token field is required", http.StatusBadRequest)
 			return
 		}
 
-		err = database.ChangeUsername(db, reqBody.Username, reqBody.NewUsername)
+		_, err = store.VerifyEmail(r.Context(), reqBody.Token)
 		if err != nil {
-			if err.Error() == "username is already in use" {
+			if errors.Is(err, database.ErrInvalidVerification) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, database.ErrEmailInUse) {
 				http.Error(w, err.Error(), http.StatusConflict)
 				return
-			} else if err.Error() == "username does not meet requirements" {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			http.Error(w, "failed to verify email", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "email verified successfully",
+		})
+	}
+}
+
+// ResendVerificationHandler mails the signed-in user a new code for their
+// current address, replacing any code or email change outstanding.
+func ResendVerificationHandler(store database.UserStore, mailer mail.Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		email, token, err := store.CreateEmailVerification(r.Context(), user.Username)
+		if err != nil {
+			if errors.Is(err, database.ErrEmailVerified) {
+				http.Error(w, err.Error(), http.StatusConflict)
 				return
 			}
-			http.Error(w, "failed to change username", http.StatusInternalServerError)
+			http.Error(w, "failed to create verification code", http.StatusInternalServerError)
 			return
 		}
 
-		resp := ChangeUsernameResponse{
-			Message: "username changed successfully",
+		if err := mailer.Send(r.Context(), verificationMessage(email, token)); err != nil {
+			log.Printf("error mailing email verification code: %v", err)
+			http.Error(w, "failed to send verification code", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "a verification code has been sent to your email",
+		})
 	}
 }
 
-func RemoveUserHandler(db *sql.DB) http.HandlerFunc {
+func ChangeUsernameHandler(store database.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
+		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reqBody struct {
-			Username string `json:"username"`
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
 		}
 
+		var reqBody ChangeUsernameRequest
 		err := json.NewDecoder(r.Body).Decode(&reqBody)
 		if err != nil {
 			http.Error(w, "invalid JSON format", http.StatusBadRequest)
 			return
 		}
 
-		if reqBody.Username == "" {
-			http.Error(w, "all fields (username) are required", http.StatusBadRequest)
+		if reqBody.NewUsername == "" {
+			http.Error(w, "new_username field is required", http.StatusBadRequest)
+			return
+		}
+
+		err = store.ChangeUsername(r.Context(), user.Username, reqBody.NewUsername)
+		if err != nil {
+			if errors.Is(err, database.ErrUsernameInUse) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if errors.Is(err, database.ErrInvalidUsername) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "failed to change username", http.StatusInternalServerError)
+			return
+		}
+
+		resp := ChangeUsernameResponse{
+			Message: "username changed successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func RemoveUserHandler(store database.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		err = database.RemoveUser(db, reqBody.Username)
+		user, ok := CurrentUser(r)
+		if !ok {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		err := store.RemoveUser(r.Context(), user.Username)
 		if err != nil {
-			if err.Error() == "user not found" {
+			if errors.Is(err, database.ErrUserNotFound) {
 				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
@@ -316,7 +491,10 @@ func RemoveUserHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GeneratePasswordResetCodeHandler(db *sql.DB) http.HandlerFunc {
+// GeneratePasswordResetCodeHandler mails a password reset token to the
+// given email. It answers the same way whether or not the email belongs to
+// anyone, so it cannot be used to find out who has an account.
+func GeneratePasswordResetCodeHandler(store database.UserStore, mailer mail.Mailer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
@@ -335,19 +513,30 @@ func GeneratePasswordResetCodeHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		resetCode, err := database.GeneratePasswordResetCode(db, reqBody.Email)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) || err.Error() == "email not found" {
-				http.Error(w, "email not found", http.StatusNotFound)
-				return
-			}
+		token, err := store.GeneratePasswordResetCode(r.Context(), reqBody.Email)
+		if err != nil && !errors.Is(err, database.ErrEmailNotFound) {
 			http.Error(w, "failed to generate password reset code", http.StatusInternalServerError)
 			return
 		}
 
+		if err == nil {
+			msg := mail.Message{
+				To:      reqBody.Email,
+				Subject: "Reset your Brainwave password",
+				Body: fmt.Sprintf("Someone asked to reset the password of your Brainwave account.\n\n"+
+					"Your reset code is:\n\n    %s\n\n"+
+					"It can be used once within the next %d minutes. If you did not ask for this, you can ignore this email.\n",
+					token, int(database.PasswordResetTTL.Minutes())),
+			}
+			if err := mailer.Send(r.Context(), msg); err != nil {
+				log.Printf("error mailing password reset code: %v", err)
+				http.Error(w, "failed to send password reset code", http.StatusInternalServerError)
+				return
+			}
+		}
+
 		resp := GenerateResetCodeResponse{
-			Message:   "password reset code generated successfully",
-			ResetCode: resetCode,
+			Message: "if the email is registered, a password reset code has been sent to it",
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -356,13 +545,11 @@ func GeneratePasswordResetCodeHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func ResetPasswordHandler(db *sql.DB) http.HandlerFunc {
+func ResetPasswordHandler(store database.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			if r.Method != http.MethodPost {
-				http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
-				return
-			}
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
 		}
 
 		var reqBody ResetPasswordRequest
@@ -377,9 +564,9 @@ func ResetPasswordHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		err = database.ResetPassword(db, reqBody.Email, reqBody.ResetCode, reqBody.NewPassword)
+		err = store.ResetPassword(r.Context(), reqBody.Email, reqBody.ResetCode, reqBody.NewPassword)
 		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) || err.Error() == "invalid reset code" {
+			if errors.Is(err, database.ErrInvalidResetCode) {
 				http.Error(w, "invalid reset code", http.StatusBadRequest)
 				return
 			}
@@ -397,21 +584,86 @@ func ResetPasswordHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetAllUsersHandler(db *sql.DB) http.HandlerFunc {
+// GetAllUsersHandler lists users a page at a time, newest first unless the
+// sort query parameter says otherwise.
+func GetAllUsersHandler(store database.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		users, err := database.GetAllUsers(db)
+		opts, err := listOptions(r, database.SortRecent)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		users, next, err := store.GetAllUsers(r.Context(), opts)
 		if err != nil {
+			if errors.Is(err, database.ErrInvalidCursor) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			http.Error(w, "failed to fetch users", http.StatusInternalServerError)
 			return
 		}
 
+		// Email addresses are only shown to admins.
+		if !isAdmin(r) {
+			for i := range users {
+				users[i].Email = ""
+			}
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(users)
+		json.NewEncoder(w).Encode(UserListResponse{Users: users, NextCursor: next})
+	}
+}
+
+// SetRoleHandler changes another user's role. It is meant to be mounted
+// behind RequireRole(models.RoleAdmin).
+func SetRoleHandler(store database.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.PathValue("username")
+		if username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+
+		var reqBody SetRoleRequest
+		err := json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		err = store.SetRole(r.Context(), username, reqBody.Role)
+		if err != nil {
+			if errors.Is(err, database.ErrInvalidRole) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else if errors.Is(err, database.ErrUserNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+			} else if errors.Is(err, database.ErrLastAdmin) {
+				http.Error(w, err.Error(), http.StatusConflict)
+			} else {
+				http.Error(w, "failed to set role", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		resp := map[string]string{
+			"message": "role updated successfully",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
 	}
 }
@@ -2,8 +2,9 @@ package handlers_test
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,7 +13,10 @@ import (
 	"testing"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/database/memstore"
 	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/mail"
+	"github.com/dDogge/Brainwave/models"
 	_ "modernc.org/sqlite"
 )
 
@@ -27,7 +31,7 @@ type CheckPasswordResponse struct {
 }
 
 type ChangePasswordRequest struct {
-	Username        string `json:"username"`
+	Username        string `json:"-"`
 	CurrentPassword string `json:"current_password"`
 	NewPassword     string `json:"new_password"`
 }
@@ -38,7 +42,7 @@ type ChangePasswordResponse struct {
 }
 
 type ChangeEmailRequest struct {
-	Username string `json:"username"`
+	Username string `json:"-"`
 	Email    string `json:"email"`
 }
 
@@ -58,21 +62,17 @@ type ResetPasswordResponse struct {
 	StatusCode int    `json:"-"`
 }
 
-func TestCreateUserHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
+// mailedCode returns the code from a password reset or email verification
+// mail.
+func mailedCode(msg mail.Message) string {
+	return strings.TrimSpace(strings.Split(msg.Body, "\n\n")[2])
+}
 
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup tables: %v", err)
-	}
+func TestCreateUserHandler(t *testing.T) {
+	store := memstore.New()
+	mailer := &mail.MemoryMailer{}
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handlers.CreateUserHandler(w, r, db)
-	})
+	handler := handlers.CreateUserHandler(store, mailer)
 
 	payload := map[string]string{
 		"username": "testuser",
@@ -94,24 +94,61 @@ func TestCreateUserHandler(t *testing.T) {
 	}
 
 	var respBody map[string]string
-	err = json.NewDecoder(resp.Body).Decode(&respBody)
+	err := json.NewDecoder(resp.Body).Decode(&respBody)
 	if err != nil {
 		t.Fatalf("failed to decode response body: %v", err)
 	}
 
-	if respBody["message"] != "user created successfully" {
-		t.Errorf("expected message 'user created successfully', got '%s'", respBody["message"])
+	if respBody["message"] != "user created successfully, a verification code has been sent to your email" {
+		t.Errorf("unexpected message '%s'", respBody["message"])
 	}
 
-	var username string
-	err = db.QueryRow("SELECT username FROM users WHERE username = ?", "testuser").Scan(&username)
+	user, err := store.GetUser(ctx, "testuser")
 	if err != nil {
-		t.Fatalf("user not found in database: %v", err)
+		t.Fatalf("user not found in store: %v", err)
+	}
+	if user.Username != "testuser" {
+		t.Errorf("expected username 'testuser', got '%s'", user.Username)
+	}
+	if user.EmailVerified {
+		t.Error("expected a new user's email to be unverified")
+	}
+
+	sent := mailer.Messages()
+	if len(sent) != 1 || sent[0].To != "testuser@example.com" {
+		t.Fatalf("expected one message to testuser@example.com, got %+v", sent)
 	}
-	if username != "testuser" {
-		t.Errorf("expected username 'testuser', got '%s'", username)
+	if _, err := store.VerifyEmail(ctx, mailedCode(sent[0])); err != nil {
+		t.Errorf("expected the mailed code to verify the email, got %v", err)
 	}
 
+	t.Run("Invalid_email", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/create-user", strings.NewReader(`{"username":"bademail","email":"bad email","password":"password123"}`))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest || w.Body.String() != "email address is not valid\n" {
+			t.Errorf("expected 400 for an invalid email, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Mail_failure", func(t *testing.T) {
+		handler := handlers.CreateUserHandler(store, failingMailer{})
+
+		req := httptest.NewRequest(http.MethodPost, "/create-user", strings.NewReader(`{"username":"nomail","email":"nomail@example.com","password":"password123"}`))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("expected the user to be created even if mail fails, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "could not be sent") {
+			t.Errorf("expected the response to say the code was not sent, got %s", w.Body.String())
+		}
+	})
+
 	t.Run("Invalid_JSON", func(t *testing.T) {
 		reqBody := `{"username":}` // ogiltig JSON
 		req := httptest.NewRequest(http.MethodPost, "/create-user", strings.NewReader(reqBody))
@@ -168,24 +205,15 @@ func TestCreateUserHandler(t *testing.T) {
 }
 
 func TestCheckPasswordHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
-	}
+	store := memstore.New()
 
 	username, email, password := "testuser", "test@example.com", "password123"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	handler := handlers.CheckPasswordHandler(db)
+	handler := handlers.CheckPasswordHandler(store, store, store)
 
 	makeRequest := func(reqBody CheckPasswordRequest) *httptest.ResponseRecorder {
 		body, _ := json.Marshal(reqBody)
@@ -293,34 +321,40 @@ func TestCheckPasswordHandler(t *testing.T) {
 			t.Errorf("expected response 'invalid request method', got %s", body)
 		}
 	})
+
+	t.Run("LockedOut", func(t *testing.T) {
+		for i := 0; i < database.DefaultLoginPolicy.UserThreshold; i++ {
+			makeRequest(CheckPasswordRequest{Username: username, Password: "wrongpassword"})
+		}
+
+		rr := makeRequest(CheckPasswordRequest{Username: username, Password: password})
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Error("expected a Retry-After header")
+		}
+	})
 }
 
 func TestChangePasswordHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to open in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
 	currentPassword := "oldpassword"
 	newPassword := "newpassword"
-	err = database.AddUser(db, username, "testuser@mail.com", currentPassword)
+	err := store.AddUser(ctx, username, "testuser@mail.com", currentPassword)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	handler := handlers.ChangePasswordHandler(db)
+	handler := handlers.ChangePasswordHandler(store)
 
 	makeRequest := func(payload ChangePasswordRequest) *httptest.ResponseRecorder {
 		body, _ := json.Marshal(payload)
-		req := httptest.NewRequest(http.MethodPost, "/change-password", bytes.NewReader(body))
+		req := httptest.NewRequest(http.MethodPost, "/users/me/password", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
+		req = asUser(t, store, req, payload.Username)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 		return rr
@@ -355,12 +389,12 @@ func TestChangePasswordHandler(t *testing.T) {
 		{
 			name: "Empty fields",
 			payload: ChangePasswordRequest{
-				Username:        "",
+				Username:        username,
 				CurrentPassword: "",
 				NewPassword:     "",
 			},
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   "all fields (username, current_password, new_password) are required",
+			expectedBody:   "all fields (current_password, new_password) are required",
 		},
 		{
 			name: "Non-existent user",
@@ -391,12 +425,13 @@ func TestChangePasswordHandler(t *testing.T) {
 			var rr *httptest.ResponseRecorder
 
 			if tt.name == "Invalid JSON" {
-				req := httptest.NewRequest(http.MethodPost, "/change-password", bytes.NewReader([]byte("invalid-json")))
+				req := httptest.NewRequest(http.MethodPost, "/users/me/password", bytes.NewReader([]byte("invalid-json")))
+				req = asUser(t, store, req, username)
 				req.Header.Set("Content-Type", "application/json")
 				rr = httptest.NewRecorder()
 				handler.ServeHTTP(rr, req)
 			} else if tt.name == "Invalid request method" {
-				req := httptest.NewRequest(http.MethodGet, "/change-password", nil)
+				req := httptest.NewRequest(http.MethodGet, "/users/me/password", nil)
 				rr = httptest.NewRecorder()
 				handler.ServeHTTP(rr, req)
 			} else {
@@ -426,23 +461,15 @@ func TestChangePasswordHandler(t *testing.T) {
 }
 
 func TestChangeEmailHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to open database: %v", err)
-	}
-	defer db.Close()
+	store := memstore.New()
 
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
-
-	err = database.AddUser(db, "testuser", "oldemail@test.com", "password123")
+	err := store.AddUser(ctx, "testuser", "oldemail@test.com", "password123")
 	if err != nil {
 		t.Fatalf("failed to add user: %v", err)
 	}
 
-	handler := handlers.ChangeEmailHandler(db)
+	mailer := &mail.MemoryMailer{}
+	handler := handlers.ChangeEmailHandler(store, mailer)
 
 	t.Run("Successfully email change", func(t *testing.T) {
 		reqBody := ChangeEmailRequest{
@@ -450,7 +477,8 @@ func TestChangeEmailHandler(t *testing.T) {
 			Email:    "newemail@test.com",
 		}
 		body, _ := json.Marshal(reqBody)
-		req := httptest.NewRequest(http.MethodPost, "/change-email", bytes.NewReader(body))
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", bytes.NewReader(body))
+		req = asUser(t, store, req, reqBody.Username)
 		rr := httptest.NewRecorder()
 
 		handler.ServeHTTP(rr, req)
@@ -465,13 +493,58 @@ func TestChangeEmailHandler(t *testing.T) {
 			t.Fatalf("failed to decode response: %v", err)
 		}
 
-		if resp.Message != "email changed successfully" {
+		if resp.Message != "a verification code has been sent to the new address" {
 			t.Errorf("expected success message, got %s", resp.Message)
 		}
+
+		if user, _ := store.GetUser(ctx, "testuser"); user.Email != "oldemail@test.com" {
+			t.Errorf("expected the email to stay unchanged until verified, got %s", user.Email)
+		}
+
+		sent := mailer.Messages()
+		if len(sent) != 2 || sent[0].To != "newemail@test.com" || sent[1].To != "oldemail@test.com" {
+			t.Fatalf("expected a code to the new address and a notice to the old one, got %+v", sent)
+		}
+		if !strings.Contains(sent[1].Body, "newemail@test.com") {
+			t.Errorf("expected the notice to name the new address, got %s", sent[1].Body)
+		}
+
+		if _, err := store.VerifyEmail(ctx, mailedCode(sent[0])); err != nil {
+			t.Fatalf("expected the mailed code to verify the new address, got %v", err)
+		}
+		if user, _ := store.GetUser(ctx, "testuser"); user.Email != "newemail@test.com" || !user.EmailVerified {
+			t.Errorf("expected the verified new email, got %s, %v", user.Email, user.EmailVerified)
+		}
+	})
+
+	t.Run("Invalid email", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", strings.NewReader(`{"email":"not-an-email"}`))
+		req = asUser(t, store, req, "testuser")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Mail failure", func(t *testing.T) {
+		handler := handlers.ChangeEmailHandler(store, failingMailer{})
+
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", strings.NewReader(`{"email":"unsent@test.com"}`))
+		req = asUser(t, store, req, "testuser")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusInternalServerError || rr.Body.String() != "failed to send confirmation email\n" {
+			t.Errorf("expected 500 when the code cannot be sent, got %d %q", rr.Code, rr.Body.String())
+		}
 	})
 
 	t.Run("Email already in use", func(t *testing.T) {
-		err = database.AddUser(db, "otheruser", "newemail@test.com", "password123")
+		err = store.AddUser(ctx, "otheruser", "newemail@test.com", "password123")
 		if err != nil {
 			t.Fatalf("failed to add other user: %v", err)
 		}
@@ -481,7 +554,8 @@ func TestChangeEmailHandler(t *testing.T) {
 			Email:    "newemail@test.com",
 		}
 		body, _ := json.Marshal(reqBody)
-		req := httptest.NewRequest(http.MethodPost, "/change-email", bytes.NewReader(body))
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", bytes.NewReader(body))
+		req = asUser(t, store, req, reqBody.Username)
 		rr := httptest.NewRecorder()
 
 		handler.ServeHTTP(rr, req)
@@ -497,7 +571,8 @@ func TestChangeEmailHandler(t *testing.T) {
 	})
 
 	t.Run("Invalid JSON format", func(t *testing.T) {
-		req := httptest.NewRequest(http.MethodPost, "/change-email", bytes.NewReader([]byte(`{"username": "testuser", "email": "missing_quote}`)))
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", bytes.NewReader([]byte(`{"email": "missing_quote}`)))
+		req = asUser(t, store, req, "testuser")
 		rr := httptest.NewRecorder()
 
 		handler.ServeHTTP(rr, req)
@@ -514,11 +589,12 @@ func TestChangeEmailHandler(t *testing.T) {
 
 	t.Run("Missing fields", func(t *testing.T) {
 		reqBody := ChangeEmailRequest{
-			Username: "",
-			Email:    "newemail@test.com",
+			Username: "testuser",
+			Email:    "",
 		}
 		body, _ := json.Marshal(reqBody)
-		req := httptest.NewRequest(http.MethodPost, "/change-email", bytes.NewReader(body))
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", bytes.NewReader(body))
+		req = asUser(t, store, req, reqBody.Username)
 		rr := httptest.NewRecorder()
 
 		handler.ServeHTTP(rr, req)
@@ -527,23 +603,24 @@ func TestChangeEmailHandler(t *testing.T) {
 			t.Errorf("expected status code 400, got %d", rr.Code)
 		}
 
-		expectedMessage := "all fields (username, email) are required"
+		expectedMessage := "email field is required"
 		if rr.Body.String() != expectedMessage+"\n" {
 			t.Errorf("expected response body %s, got %s", expectedMessage, rr.Body.String())
 		}
 	})
 
 	t.Run("Internal server error", func(t *testing.T) {
-		db.Close()
-
 		reqBody := ChangeEmailRequest{
 			Username: "testuser",
 			Email:    "finalemail@test.com",
 		}
 		body, _ := json.Marshal(reqBody)
-		req := httptest.NewRequest(http.MethodPost, "/change-email", bytes.NewReader(body))
+		req := httptest.NewRequest(http.MethodPost, "/users/me/email", bytes.NewReader(body))
+		req = asUser(t, store, req, reqBody.Username)
 		rr := httptest.NewRecorder()
 
+		store.Close()
+
 		handler.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusInternalServerError {
@@ -557,20 +634,101 @@ func TestChangeEmailHandler(t *testing.T) {
 	})
 }
 
-func TestChangeUsernameHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
+func TestVerifyEmailHandler(t *testing.T) {
+	store := memstore.New()
+
+	if err := store.AddUser(ctx, "testuser", "testuser@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add user: %v", err)
+	}
+	_, token, err := store.CreateEmailVerification(ctx, "testuser")
 	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
+		t.Fatalf("failed to create verification: %v", err)
+	}
+
+	handler := handlers.VerifyEmailHandler(store)
+
+	verify := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/email-verification/confirm", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := verify(fmt.Sprintf(`{"token":%q}`, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if user, _ := store.GetUser(ctx, "testuser"); !user.EmailVerified {
+		t.Error("expected the email to be verified")
+	}
+
+	if rr := verify(fmt.Sprintf(`{"token":%q}`, token)); rr.Code != http.StatusBadRequest || rr.Body.String() != "invalid or expired verification token\n" {
+		t.Errorf("expected a used token to be refused, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := verify(`{}`); rr.Code != http.StatusBadRequest || rr.Body.String() != "token field is required\n" {
+		t.Errorf("expected a missing token to be refused, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := verify(`{"token":}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid JSON to be refused, got %d", rr.Code)
 	}
-	defer db.Close()
 
-	// Setup the database
-	err = database.CreateUserTable(db)
+	token, err = store.ChangeEmail(ctx, "testuser", "taken@test.com")
 	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
+		t.Fatalf("failed to change email: %v", err)
+	}
+	if err := store.AddUser(ctx, "otheruser", "taken@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add other user: %v", err)
+	}
+	if rr := verify(fmt.Sprintf(`{"token":%q}`, token)); rr.Code != http.StatusConflict {
+		t.Errorf("expected a taken address to conflict, got %d", rr.Code)
+	}
+}
+
+func TestResendVerificationHandler(t *testing.T) {
+	store := memstore.New()
+
+	if err := store.AddUser(ctx, "testuser", "testuser@test.com", "password123"); err != nil {
+		t.Fatalf("failed to add user: %v", err)
 	}
 
-	handler := http.HandlerFunc(handlers.ChangeUsernameHandler(db))
+	mailer := &mail.MemoryMailer{}
+	handler := handlers.ResendVerificationHandler(store, mailer)
+
+	resend := func(t *testing.T) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/email-verification", nil)
+		req = asUser(t, store, req, "testuser")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := resend(t); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	sent := mailer.Messages()
+	if len(sent) != 1 || sent[0].To != "testuser@test.com" {
+		t.Fatalf("expected one message to testuser@test.com, got %+v", sent)
+	}
+	if _, err := store.VerifyEmail(ctx, mailedCode(sent[0])); err != nil {
+		t.Fatalf("expected the mailed code to verify the email, got %v", err)
+	}
+
+	if rr := resend(t); rr.Code != http.StatusConflict || rr.Body.String() != "email address is already verified\n" {
+		t.Errorf("expected 409 once verified, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/email-verification", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a user, got %d", rr.Code)
+	}
+}
+
+func TestChangeUsernameHandler(t *testing.T) {
+	store := memstore.New()
+
+	handler := http.HandlerFunc(handlers.ChangeUsernameHandler(store))
 
 	// Seed data
 	username := "testuser"
@@ -580,19 +738,20 @@ func TestChangeUsernameHandler(t *testing.T) {
 	password := "password123"
 
 	// Add test users
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to seed user: %v", err)
 	}
 
-	err = database.AddUser(db, existingUsername, "existinguser@test.com", "password456")
+	err = store.AddUser(ctx, existingUsername, "existinguser@test.com", "password456")
 	if err != nil {
 		t.Fatalf("failed to seed user: %v", err)
 	}
 
 	t.Run("Successfully change username", func(t *testing.T) {
-		reqBody := fmt.Sprintf(`{"username":"%s","new_username":"%s"}`, username, newUsername) // Använd newUsername
-		req := httptest.NewRequest(http.MethodPost, "/change-username", strings.NewReader(reqBody))
+		reqBody := fmt.Sprintf(`{"new_username":"%s"}`, newUsername) // Använd newUsername
+		req := httptest.NewRequest(http.MethodPost, "/users/me/username", strings.NewReader(reqBody))
+		req = asUser(t, store, req, username)
 		req.Header.Set("Content-Type", "application/json")
 
 		w := httptest.NewRecorder()
@@ -613,19 +772,19 @@ func TestChangeUsernameHandler(t *testing.T) {
 		}
 
 		// Kontrollera att användarnamnet faktiskt ändrats i databasen
-		var updatedUsername string
-		err = db.QueryRow("SELECT username FROM users WHERE username = ?", newUsername).Scan(&updatedUsername)
+		updated, err := store.GetUser(ctx, newUsername)
 		if err != nil {
-			t.Errorf("failed to verify updated username: %v", err)
+			t.Fatalf("failed to verify updated username: %v", err)
 		}
-		if updatedUsername != newUsername {
-			t.Errorf("expected username to be updated to '%s', got '%s'", newUsername, updatedUsername)
+		if updated.Username != newUsername {
+			t.Errorf("expected username to be updated to '%s', got '%s'", newUsername, updated.Username)
 		}
 	})
 
 	t.Run("New username already in use", func(t *testing.T) {
-		reqBody := `{"username":"testuser","new_username":"existinguser"}`
-		req := httptest.NewRequest(http.MethodPost, "/change-username", strings.NewReader(reqBody))
+		reqBody := `{"new_username":"existinguser"}`
+		req := httptest.NewRequest(http.MethodPost, "/users/me/username", strings.NewReader(reqBody))
+		req = asUser(t, store, req, "testuser")
 		req.Header.Set("Content-Type", "application/json")
 
 		w := httptest.NewRecorder()
@@ -642,8 +801,9 @@ func TestChangeUsernameHandler(t *testing.T) {
 	})
 
 	t.Run("Invalid new username format", func(t *testing.T) {
-		reqBody := `{"username":"testuser","new_username":"!"}`
-		req := httptest.NewRequest(http.MethodPost, "/change-username", strings.NewReader(reqBody))
+		reqBody := `{"new_username":"!"}`
+		req := httptest.NewRequest(http.MethodPost, "/users/me/username", strings.NewReader(reqBody))
+		req = asUser(t, store, req, "testuser")
 		req.Header.Set("Content-Type", "application/json")
 
 		w := httptest.NewRecorder()
@@ -660,8 +820,9 @@ func TestChangeUsernameHandler(t *testing.T) {
 	})
 
 	t.Run("Missing fields", func(t *testing.T) {
-		reqBody := `{"username":"","new_username":""}`
-		req := httptest.NewRequest(http.MethodPost, "/change-username", strings.NewReader(reqBody))
+		reqBody := `{"new_username":""}`
+		req := httptest.NewRequest(http.MethodPost, "/users/me/username", strings.NewReader(reqBody))
+		req = asUser(t, store, req, "testuser")
 		req.Header.Set("Content-Type", "application/json")
 
 		w := httptest.NewRecorder()
@@ -671,17 +832,18 @@ func TestChangeUsernameHandler(t *testing.T) {
 			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
 		}
 
-		expected := "all fields (username, new_username) are required"
+		expected := "new_username field is required"
 		if strings.TrimSpace(w.Body.String()) != expected {
 			t.Errorf("expected response body '%s', got '%s'", expected, w.Body.String())
 		}
 	})
 
 	t.Run("Internal server error", func(t *testing.T) {
-		db.Close() // Simulate a database failure
+		reqBody := `{"new_username":"newtestuser"}`
+		req := httptest.NewRequest(http.MethodPost, "/users/me/username", strings.NewReader(reqBody))
+		req = asUser(t, store, req, "testuser")
 
-		reqBody := `{"username":"testuser","new_username":"newtestuser"}`
-		req := httptest.NewRequest(http.MethodPost, "/change-username", strings.NewReader(reqBody))
+		store.Close() // Simulate a database failure
 		req.Header.Set("Content-Type", "application/json")
 
 		w := httptest.NewRecorder()
@@ -699,41 +861,22 @@ func TestChangeUsernameHandler(t *testing.T) {
 }
 
 func TestRemoveUserHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
-	}
-
-	err = database.CreateTopicTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup topics table: %v", err)
-	}
-
-	err = database.CreateMessageTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup messages table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@test.com"
 	password := "password123"
 
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to seed user: %v", err)
 	}
 
-	handler := handlers.RemoveUserHandler(db)
+	handler := handlers.RemoveUserHandler(store)
 
 	t.Run("Successfully_remove_user", func(t *testing.T) {
-		reqBody := `{"username":"testuser"}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-user", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodDelete, "/users/me", nil)
+		req = asUser(t, store, req, "testuser")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -757,8 +900,8 @@ func TestRemoveUserHandler(t *testing.T) {
 	})
 
 	t.Run("User_not_found", func(t *testing.T) {
-		reqBody := `{"username":"nonexistent"}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-user", strings.NewReader(reqBody))
+		req := httptest.NewRequest(http.MethodDelete, "/users/me", nil)
+		req = asUser(t, store, req, "nonexistent")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -780,9 +923,8 @@ func TestRemoveUserHandler(t *testing.T) {
 		}
 	})
 
-	t.Run("Invalid_JSON", func(t *testing.T) {
-		reqBody := `{"username":}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-user", strings.NewReader(reqBody))
+	t.Run("Unauthenticated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/users/me", nil)
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
@@ -790,32 +932,8 @@ func TestRemoveUserHandler(t *testing.T) {
 		resp := w.Result()
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusBadRequest {
-			t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
-		}
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			t.Fatalf("failed to read response body: %v", err)
-		}
-
-		if string(body) != "invalid JSON format\n" {
-			t.Errorf("expected response 'invalid JSON format', got %s", string(body))
-		}
-	})
-
-	t.Run("Missing_fields", func(t *testing.T) {
-		reqBody := `{}`
-		req := httptest.NewRequest(http.MethodDelete, "/remove-user", strings.NewReader(reqBody))
-		w := httptest.NewRecorder()
-
-		handler.ServeHTTP(w, req)
-
-		resp := w.Result()
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusBadRequest {
-			t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
 		}
 
 		body, err := io.ReadAll(resp.Body)
@@ -823,37 +941,30 @@ func TestRemoveUserHandler(t *testing.T) {
 			t.Fatalf("failed to read response body: %v", err)
 		}
 
-		if string(body) != "all fields (username) are required\n" {
-			t.Errorf("expected response 'all fields (username) are required', got %s", string(body))
+		if string(body) != "authentication required\n" {
+			t.Errorf("expected response 'authentication required', got %s", string(body))
 		}
 	})
 }
 
 func TestGeneratePasswordResetCodeHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to create in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to setup user table: %v", err)
-	}
+	store := memstore.New()
 
 	email := "testuser@test.com"
 	username := "testuser"
 	password := "password123"
 
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to seed user: %v", err)
 	}
 
-	handler := handlers.GeneratePasswordResetCodeHandler(db)
+	mailer := &mail.MemoryMailer{}
+	handler := handlers.GeneratePasswordResetCodeHandler(store, mailer)
+
+	generate := func(t *testing.T, reqBody string) map[string]string {
+		t.Helper()
 
-	t.Run("Successfully_generate_reset_code", func(t *testing.T) {
-		reqBody := `{"email":"testuser@test.com"}`
 		req := httptest.NewRequest(http.MethodPost, "/generate-reset-code", strings.NewReader(reqBody))
 		w := httptest.NewRecorder()
 
@@ -863,7 +974,7 @@ func TestGeneratePasswordResetCodeHandler(t *testing.T) {
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
 		}
 
 		var responseBody map[string]string
@@ -871,37 +982,54 @@ func TestGeneratePasswordResetCodeHandler(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to decode response: %v", err)
 		}
+		return responseBody
+	}
+
+	t.Run("Successfully_generate_reset_code", func(t *testing.T) {
+		responseBody := generate(t, `{"email":"testuser@test.com"}`)
 
-		if responseBody["message"] != "password reset code generated successfully" {
-			t.Errorf("expected message 'password reset code generated successfully', got %s", responseBody["message"])
+		if responseBody["message"] != "if the email is registered, a password reset code has been sent to it" {
+			t.Errorf("unexpected message, got %s", responseBody["message"])
 		}
 
-		if responseBody["reset_code"] == "" {
-			t.Errorf("expected a reset code, got empty string")
+		if _, ok := responseBody["reset_code"]; ok {
+			t.Errorf("expected the reset code to stay out of the response")
 		}
-	})
 
-	t.Run("Email_not_found", func(t *testing.T) {
-		reqBody := `{"email":"nonexistent@test.com"}`
-		req := httptest.NewRequest(http.MethodPost, "/generate-reset-code", strings.NewReader(reqBody))
-		w := httptest.NewRecorder()
+		sent := mailer.Messages()
+		if len(sent) != 1 || sent[0].To != email {
+			t.Fatalf("expected one message to %s, got %+v", email, sent)
+		}
 
-		handler.ServeHTTP(w, req)
+		code := strings.TrimSpace(strings.Split(sent[0].Body, "\n\n")[2])
+		if err := store.ResetPassword(ctx, email, code, "newpassword"); err != nil {
+			t.Errorf("expected the mailed code to reset the password, got %v", err)
+		}
+	})
 
-		resp := w.Result()
-		defer resp.Body.Close()
+	t.Run("Email_not_found", func(t *testing.T) {
+		before := len(mailer.Messages())
+		responseBody := generate(t, `{"email":"nonexistent@test.com"}`)
 
-		if resp.StatusCode != http.StatusNotFound {
-			t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+		if responseBody["message"] != "if the email is registered, a password reset code has been sent to it" {
+			t.Errorf("expected the same message as for a registered email, got %s", responseBody["message"])
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			t.Fatalf("failed to read response body: %v", err)
+		if len(mailer.Messages()) != before {
+			t.Errorf("expected no mail to be sent to an unknown email")
 		}
+	})
+
+	t.Run("Mail_failure", func(t *testing.T) {
+		handler := handlers.GeneratePasswordResetCodeHandler(store, failingMailer{})
+
+		req := httptest.NewRequest(http.MethodPost, "/generate-reset-code", strings.NewReader(`{"email":"testuser@test.com"}`))
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
 
-		if string(body) != "email not found\n" {
-			t.Errorf("expected response 'email not found', got %s", string(body))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
 		}
 	})
 
@@ -954,33 +1082,30 @@ func TestGeneratePasswordResetCodeHandler(t *testing.T) {
 	})
 }
 
-func TestResetPasswordHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to open in-memory database: %v", err)
-	}
-	defer db.Close()
+// failingMailer fails to send anything.
+type failingMailer struct{}
 
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
+func (failingMailer) Send(ctx context.Context, msg mail.Message) error {
+	return errors.New("mail server unavailable")
+}
+
+func TestResetPasswordHandler(t *testing.T) {
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@mail.com"
 	password := "oldpassword"
-	resetCode := "123456"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	_, err = db.Exec("UPDATE users SET reset_code = ? WHERE email = ?", resetCode, email)
+	resetCode, err := store.GeneratePasswordResetCode(ctx, email)
 	if err != nil {
-		t.Fatalf("failed to update reset code for test user: %v", err)
+		t.Fatalf("failed to generate reset code for test user: %v", err)
 	}
 
-	handler := handlers.ResetPasswordHandler(db)
+	handler := handlers.ResetPasswordHandler(store)
 
 	t.Run("InvalidJSON", func(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodPost, "/reset-password", bytes.NewBuffer([]byte("invalid-json")))
@@ -1038,6 +1163,14 @@ func TestResetPasswordHandler(t *testing.T) {
 		if resp.Message != "password reset successfully" {
 			t.Errorf("expected message 'password reset successfully', got '%s'", resp.Message)
 		}
+
+		req = httptest.NewRequest(http.MethodPost, "/reset-password", bytes.NewReader(body))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a used reset code to be rejected with %d, got %d", http.StatusBadRequest, rr.Code)
+		}
 	})
 
 	t.Run("InvalidResetCode", func(t *testing.T) {
@@ -1110,26 +1243,17 @@ func TestResetPasswordHandler(t *testing.T) {
 }
 
 func TestGetAllUsersHandler(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("failed to open in-memory database: %v", err)
-	}
-	defer db.Close()
-
-	err = database.CreateUserTable(db)
-	if err != nil {
-		t.Fatalf("failed to create user table: %v", err)
-	}
+	store := memstore.New()
 
 	username := "testuser"
 	email := "testuser@mail.com"
 	password := "password123"
-	err = database.AddUser(db, username, email, password)
+	err := store.AddUser(ctx, username, email, password)
 	if err != nil {
 		t.Fatalf("failed to add test user: %v", err)
 	}
 
-	handler := handlers.GetAllUsersHandler(db)
+	handler := handlers.GetAllUsersHandler(store)
 
 	t.Run("SuccessfullyFetchAllUsers", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/get-users", nil)
@@ -1141,11 +1265,14 @@ func TestGetAllUsersHandler(t *testing.T) {
 			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
 		}
 
-		var users []map[string]interface{}
-		err := json.Unmarshal(rr.Body.Bytes(), &users)
+		var body struct {
+			Users []map[string]interface{} `json:"users"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
 		if err != nil {
 			t.Fatalf("failed to unmarshal response: %v", err)
 		}
+		users := body.Users
 
 		if len(users) != 1 {
 			t.Errorf("expected 1 user, got %d", len(users))
@@ -1154,6 +1281,30 @@ func TestGetAllUsersHandler(t *testing.T) {
 		if users[0]["username"] != username {
 			t.Errorf("expected username '%s', got '%s'", username, users[0]["username"])
 		}
+
+		if _, ok := users[0]["email"]; ok {
+			t.Errorf("expected emails to be hidden from anonymous callers, got %v", users[0]["email"])
+		}
+	})
+
+	t.Run("AdminSeesEmails", func(t *testing.T) {
+		if err := store.SetRole(ctx, username, models.RoleAdmin); err != nil {
+			t.Fatalf("failed to make %s an admin: %v", username, err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/get-users", nil)
+		req = asUser(t, store, req, username)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		var body handlers.UserListResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		if len(body.Users) != 1 || body.Users[0].Email != email {
+			t.Errorf("expected the admin to see email %s, got %+v", email, body.Users)
+		}
 	})
 
 	t.Run("InvalidRequestMethod", func(t *testing.T) {
@@ -1173,7 +1324,7 @@ func TestGetAllUsersHandler(t *testing.T) {
 	})
 
 	t.Run("FailedToFetchUsers", func(t *testing.T) {
-		db.Close()
+		store.Close()
 
 		req := httptest.NewRequest(http.MethodGet, "/get-users", nil)
 		rr := httptest.NewRecorder()
@@ -1188,10 +1339,62 @@ func TestGetAllUsersHandler(t *testing.T) {
 		if body != "failed to fetch users\n" {
 			t.Errorf("expected response 'failed to fetch users', got %s", body)
 		}
+	})
+}
 
-		db, err = sql.Open("sqlite", ":memory:")
-		if err != nil {
-			t.Fatalf("failed to open in-memory database after closing: %v", err)
+func TestSetRoleHandler(t *testing.T) {
+	store := memstore.New()
+
+	for _, name := range []string{"adminuser", "testuser"} {
+		if err := store.AddUser(ctx, name, name+"@mail.com", "password123"); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
 		}
-	})
+	}
+	if err := store.SetRole(ctx, "adminuser", models.RoleAdmin); err != nil {
+		t.Fatalf("failed to make adminuser an admin: %v", err)
+	}
+
+	handler := handlers.RequireRole(models.RoleAdmin, handlers.SetRoleHandler(store))
+
+	tests := []struct {
+		name     string
+		caller   string
+		target   string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"PromoteToModerator", "adminuser", "testuser", `{"role":"moderator"}`, http.StatusOK, ""},
+		{"NotAnAdmin", "testuser", "testuser", `{"role":"admin"}`, http.StatusForbidden, "insufficient permissions\n"},
+		{"InvalidRole", "adminuser", "testuser", `{"role":"owner"}`, http.StatusBadRequest, "role must be 'user', 'moderator' or 'admin'\n"},
+		{"UnknownUser", "adminuser", "nobody", `{"role":"moderator"}`, http.StatusNotFound, "user not found\n"},
+		{"LastAdmin", "adminuser", "adminuser", `{"role":"user"}`, http.StatusConflict, "cannot demote the last admin\n"},
+		{"InvalidJSON", "adminuser", "testuser", `{`, http.StatusBadRequest, "invalid JSON format\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/users/"+tt.target+"/role", strings.NewReader(tt.body))
+			req.SetPathValue("username", tt.target)
+			req = asUser(t, store, req, tt.caller)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, rr.Code)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("expected response %q, got %q", tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+
+	user, err := store.GetUser(ctx, "testuser")
+	if err != nil {
+		t.Fatalf("failed to fetch testuser: %v", err)
+	}
+	if user.Role != models.RoleModerator {
+		t.Errorf("expected testuser to be a moderator, got %q", user.Role)
+	}
 }
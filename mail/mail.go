@@ -0,0 +1,203 @@
+// Package mail delivers plain text email. SMTPMailer sends it through a mail
+// server; FileMailer and MemoryMailer keep it locally for development and
+// tests.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidHeader is returned for a recipient or subject that contains a
+// line break, which could otherwise be used to inject headers.
+var ErrInvalidHeader = errors.New("mail: header contains a line break")
+
+// Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPMailer sends messages through an SMTP server, upgrading to TLS when
+// the server offers STARTTLS.
+type SMTPMailer struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+// NewSMTPMailer returns a mailer that sends from the given address through
+// the server at addr (host:port). If username is set it authenticates with
+// PLAIN auth, which net/smtp only allows over TLS or to localhost.
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	return &SMTPMailer{addr: addr, from: from, username: username, password: password}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.addr)
+	if err != nil {
+		return fmt.Errorf("mail: invalid server address %q: %w", m.addr, err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return fmt.Errorf("mail: could not connect to %s: %w", m.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("mail: could not start SMTP session: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("mail: could not start TLS: %w", err)
+		}
+	}
+
+	if m.username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("mail: %s does not support authentication", m.addr)
+		}
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, host)); err != nil {
+			return fmt.Errorf("mail: could not authenticate: %w", err)
+		}
+	}
+
+	if err := client.Mail(m.from); err != nil {
+		return fmt.Errorf("mail: sender rejected: %w", err)
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("mail: recipient rejected: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("mail: could not send message: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("mail: could not send message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mail: could not send message: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// FileMailer writes each message to its own .eml file in Dir instead of
+// sending it, so mail can be read during local development.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("mail: could not create %s: %w", m.Dir, err)
+	}
+
+	f, err := os.CreateTemp(m.Dir, time.Now().Format("20060102-150405")+"-*.eml")
+	if err != nil {
+		return fmt.Errorf("mail: could not create message file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("mail: could not write %s: %w", filepath.Base(f.Name()), err)
+	}
+	return f.Close()
+}
+
+// MemoryMailer keeps every message it is given. It is safe for concurrent
+// use.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	if err := checkHeaders(msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+func checkHeaders(msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return ErrInvalidHeader
+	}
+	return nil
+}
+
+// format renders msg as an RFC 5322 message from the given sender, with
+// CRLF line endings throughout.
+func format(from string, msg Message, date time.Time) ([]byte, error) {
+	if err := checkHeaders(msg); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(from, "\r\n") {
+		return nil, ErrInvalidHeader
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if !strings.HasSuffix(body, "\n") {
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,175 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts a single SMTP session on a local port, without TLS or
+// authentication, and sends what it was given on the returned channel.
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		var lines []string
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO":
+				tp.PrintfLine("250 localhost")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				body, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				lines = append(lines, body...)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				got <- lines
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), got
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, got := fakeSMTP(t)
+
+	mailer := NewSMTPMailer(addr, "brainwave@localhost", "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := mailer.Send(ctx, Message{To: "alice@test.com", Subject: "Réinitialiser", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	var lines []string
+	select {
+	case lines = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never saw the message")
+	}
+
+	session := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"MAIL FROM:<brainwave@localhost>",
+		"RCPT TO:<alice@test.com>",
+		"From: brainwave@localhost",
+		"To: alice@test.com",
+		"Subject: =?utf-8?q?R=C3=A9initialiser?=",
+		"Content-Type: text/plain; charset=utf-8",
+		"line one\nline two",
+	} {
+		if !strings.Contains(session, want) {
+			t.Errorf("expected the session to contain %q, got:\n%s", want, session)
+		}
+	}
+}
+
+func TestSMTPMailerRequiresAuthSupport(t *testing.T) {
+	addr, _ := fakeSMTP(t)
+
+	mailer := NewSMTPMailer(addr, "brainwave@localhost", "user", "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := mailer.Send(ctx, Message{To: "alice@test.com", Subject: "Hi", Body: "Hello"})
+	if err == nil || !strings.Contains(err.Error(), "does not support authentication") {
+		t.Fatalf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer := &FileMailer{Dir: dir, From: "brainwave@localhost"}
+
+	for i := 0; i < 2; i++ {
+		if err := mailer.Send(context.Background(), Message{To: "alice@test.com", Subject: "Hi", Body: "Hello"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 message files, got %v, %v", files, err)
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if !strings.Contains(string(data), "To: alice@test.com\r\n") || !strings.HasSuffix(string(data), "\r\n\r\nHello\r\n") {
+		t.Errorf("unexpected message:\n%s", data)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	var mailer MemoryMailer
+
+	msg := Message{To: "alice@test.com", Subject: "Hi", Body: "Hello"}
+	if err := mailer.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	got := mailer.Messages()
+	if len(got) != 1 || got[0] != msg {
+		t.Fatalf("unexpected messages: %+v", got)
+	}
+
+	got[0].To = "mallory@test.com"
+	if mailer.Messages()[0].To != "alice@test.com" {
+		t.Error("expected Messages to return a copy")
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	mailers := map[string]Mailer{
+		"smtp":   NewSMTPMailer("127.0.0.1:1", "brainwave@localhost", "", ""),
+		"file":   &FileMailer{Dir: t.TempDir()},
+		"memory": &MemoryMailer{},
+	}
+	for name, mailer := range mailers {
+		for _, msg := range []Message{
+			{To: "alice@test.com\r\nBcc: mallory@test.com", Subject: "Hi"},
+			{To: "alice@test.com", Subject: "Hi\nBcc: mallory@test.com"},
+		} {
+			if err := mailer.Send(context.Background(), msg); !errors.Is(err, ErrInvalidHeader) {
+				t.Errorf("%s: expected ErrInvalidHeader for %+v, got %v", name, msg, err)
+			}
+		}
+	}
+}
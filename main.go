@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
+	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/dDogge/Brainwave/database"
+	"github.com/dDogge/Brainwave/events"
+	"github.com/dDogge/Brainwave/handlers"
+	"github.com/dDogge/Brainwave/mail"
+	"github.com/dDogge/Brainwave/presence"
+	"github.com/dDogge/Brainwave/ratelimit"
 	_ "modernc.org/sqlite"
 )
 
@@ -16,33 +26,265 @@ import (
 //go:embed frontend/dist
 var frontend embed.FS
 
+const (
+	// defaultArchiveDays is how long a topic may go without activity before
+	// it is archived, unless BRAINWAVE_ARCHIVE_DAYS says otherwise.
+	defaultArchiveDays = 90
+	// archiveInterval is how often inactive topics are looked for.
+	archiveInterval = time.Hour
+	// defaultMailFrom is the sender of outgoing mail unless
+	// BRAINWAVE_MAIL_FROM says otherwise.
+	defaultMailFrom = "brainwave@localhost"
+	// defaultMailDir is where mail is written when no SMTP server is
+	// configured, unless BRAINWAVE_MAIL_DIR says otherwise.
+	defaultMailDir = "./outbox"
+)
+
 func main() {
+	// Foreign keys are switched on per connection, so the pragma goes in
+	// the DSN for every pooled connection to pick it up.
+	db, err := sql.Open("sqlite", "./brainwave_db.db?_pragma=foreign_keys(1)")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "search" {
+		if err := runSearch(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		if err := runRole(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if _, err := database.MigrateUp(db); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
 	reactFS, err := fs.Sub(frontend, "frontend/dist")
 	if err != nil {
 		log.Fatalf("Failed to create sub filesystem: %v", err)
 	}
 
-	http.Handle("/", http.FileServer(http.FS(reactFS)))
+	bus := events.NewBus(events.DefaultReplaySize, events.DefaultQueueSize)
+	store := database.NewSQLiteStore(db)
+	store.SetPublisher(bus)
 
-	// var err error
-	db, err := sql.Open("sqlite", "./brainwave_db.db")
+	loginPolicy, err := loginPolicyFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	store.SetLoginPolicy(loginPolicy)
+	if err := store.BackfillTopicSlugs(context.Background()); err != nil {
+		log.Fatalf("Failed to generate topic slugs: %v", err)
+	}
 
-	_, err = db.Exec("PRAGMA foreign_keys = ON")
+	archiveDays, err := archiveDaysFromEnv()
 	if err != nil {
-		log.Fatal("Error enabling foreign key support:", err)
+		log.Fatal(err)
 	}
+	if archiveDays > 0 {
+		go archiveInactiveTopics(store, archiveDays)
+	}
+
+	hub := presence.NewHub(presence.DefaultQueueSize)
 
-	database.CreateUserTable(db)
-	database.CreateMessageTable(db)
-	database.CreateTopicTable(db)
+	mux := http.NewServeMux()
+	handlers.RegisterRoutes(mux, store, bus, hub, mailerFromEnv(), ratelimit.NewMemoryBackend())
+	mux.Handle("/", http.FileServer(http.FS(reactFS)))
 
 	port := ":8080"
 	log.Printf("Serving on http://localhost%s\n", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
+	if err := http.ListenAndServe(port, mux); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// runMigrate implements "migrate up", "migrate down [steps]" and
+// "migrate status".
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s migrate up|down [steps]|status", os.Args[0])
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := database.MigrateUp(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migration(s)\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = n
+		}
+		count, err := database.MigrateDown(db, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %d migration(s)\n", count)
+	case "status":
+		statuses, err := database.GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+
+	return nil
+}
+
+// runSearch implements "search rebuild", which brings the database up to
+// date and regenerates the full-text search index from scratch.
+func runSearch(db *sql.DB, args []string) error {
+	if len(args) == 0 || args[0] != "rebuild" {
+		return fmt.Errorf("usage: %s search rebuild", os.Args[0])
+	}
+
+	if _, err := database.MigrateUp(db); err != nil {
+		return err
+	}
+	if err := database.NewSQLiteStore(db).RebuildSearchIndex(context.Background()); err != nil {
+		return err
+	}
+
+	fmt.Println("search index rebuilt")
+	return nil
+}
+
+// runRole implements "role set <username> <role>". It is how the first admin
+// is created, since only admins can change roles over the API.
+func runRole(db *sql.DB, args []string) error {
+	if len(args) != 3 || args[0] != "set" {
+		return fmt.Errorf("usage: %s role set <username> user|moderator|admin", os.Args[0])
+	}
+
+	if _, err := database.MigrateUp(db); err != nil {
+		return err
+	}
+	if err := database.NewSQLiteStore(db).SetRole(context.Background(), args[1], args[2]); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is now %s\n", args[1], args[2])
+	return nil
+}
+
+// archiveDaysFromEnv reads BRAINWAVE_ARCHIVE_DAYS, the number of days
+// without activity after which topics are archived. 0 turns archiving off.
+func archiveDaysFromEnv() (int, error) {
+	value := os.Getenv("BRAINWAVE_ARCHIVE_DAYS")
+	if value == "" {
+		return defaultArchiveDays, nil
+	}
+
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("invalid BRAINWAVE_ARCHIVE_DAYS: %s", value)
+	}
+	return days, nil
+}
+
+// loginPolicyFromEnv starts from database.DefaultLoginPolicy and overrides
+// the failed login thresholds with BRAINWAVE_LOGIN_USER_THRESHOLD and
+// BRAINWAVE_LOGIN_IP_THRESHOLD (0 turns that lockout off) and the lockout
+// lengths with BRAINWAVE_LOGIN_LOCKOUT and BRAINWAVE_LOGIN_MAX_LOCKOUT
+// (durations such as "30s" or "2h").
+func loginPolicyFromEnv() (database.LoginPolicy, error) {
+	policy := database.DefaultLoginPolicy
+
+	for name, threshold := range map[string]*int{
+		"BRAINWAVE_LOGIN_USER_THRESHOLD": &policy.UserThreshold,
+		"BRAINWAVE_LOGIN_IP_THRESHOLD":   &policy.IPThreshold,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return policy, fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*threshold = n
+		}
+	}
+
+	for name, lockout := range map[string]*time.Duration{
+		"BRAINWAVE_LOGIN_LOCKOUT":     &policy.BaseLockout,
+		"BRAINWAVE_LOGIN_MAX_LOCKOUT": &policy.MaxLockout,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return policy, fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*lockout = d
+		}
+	}
+
+	if policy.MaxLockout < policy.BaseLockout {
+		return policy, fmt.Errorf("BRAINWAVE_LOGIN_MAX_LOCKOUT must be at least BRAINWAVE_LOGIN_LOCKOUT")
+	}
+	return policy, nil
+}
+
+// mailerFromEnv sends mail through the SMTP server at BRAINWAVE_SMTP_ADDR
+// (host:port), logging in with BRAINWAVE_SMTP_USERNAME and
+// BRAINWAVE_SMTP_PASSWORD if they are set. Without a server, mail is written
+// to files in BRAINWAVE_MAIL_DIR instead.
+func mailerFromEnv() mail.Mailer {
+	from := os.Getenv("BRAINWAVE_MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	if addr := os.Getenv("BRAINWAVE_SMTP_ADDR"); addr != "" {
+		return mail.NewSMTPMailer(addr, from, os.Getenv("BRAINWAVE_SMTP_USERNAME"), os.Getenv("BRAINWAVE_SMTP_PASSWORD"))
+	}
+
+	dir := os.Getenv("BRAINWAVE_MAIL_DIR")
+	if dir == "" {
+		dir = defaultMailDir
+	}
+	log.Printf("No SMTP server configured, writing mail to %s", dir)
+	return &mail.FileMailer{Dir: dir, From: from}
+}
+
+// archiveInactiveTopics archives topics that have been inactive for the
+// given number of days, once at startup and then every archiveInterval. It
+// never returns.
+func archiveInactiveTopics(store *database.SQLiteStore, days int) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		cutoff := time.Now().AddDate(0, 0, -days)
+		if _, err := store.ArchiveInactiveTopics(context.Background(), cutoff); err != nil {
+			log.Printf("Failed to archive inactive topics: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// DefaultCategoryID is the category topics are opened in when none is given.
+// It always exists.
+const DefaultCategoryID = 1
+
+// Category groups topics. Categories are ordered by Position and then by
+// name, and may hold one level of sub-categories. TopicRole is the least
+// privileged role that may open topics in the category, so an announcement
+// board has it set to RoleModerator.
+type Category struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Color       string     `json:"color"`
+	ParentID    int        `json:"parent_id,omitempty"`
+	Position    int        `json:"position"`
+	TopicRole   string     `json:"topic_role"`
+	Topics      int        `json:"topics"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Children    []Category `json:"children,omitempty"`
+}
+
+// ValidColor reports whether color is empty or a hex colour of the form
+// #rrggbb.
+func ValidColor(color string) bool {
+	if color == "" {
+		return true
+	}
+	if len(color) != 7 || color[0] != '#' {
+		return false
+	}
+	for _, r := range color[1:] {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
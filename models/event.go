@@ -0,0 +1,45 @@
+package models
+
+// MessageReactions is a message's reaction totals after one of them changed.
+type MessageReactions struct {
+	MessageID int            `json:"message_id"`
+	Likes     int            `json:"likes"`
+	Reactions map[string]int `json:"reactions"`
+}
+
+// MessageMoved reports that a message now replies to ParentID.
+type MessageMoved struct {
+	MessageID int `json:"message_id"`
+	ParentID  int `json:"parent_id"`
+}
+
+// MessageDeleted reports that a message was replaced by a tombstone.
+type MessageDeleted struct {
+	MessageID int `json:"message_id"`
+}
+
+// MessagesPurged lists the messages removed along with a purged subtree,
+// the subtree's root first.
+type MessagesPurged struct {
+	MessageIDs []int `json:"message_ids"`
+}
+
+// TopicScore is a topic's score after a vote changed.
+type TopicScore struct {
+	TopicID int `json:"topic_id"`
+	Upvotes int `json:"upvotes"`
+}
+
+// TopicMerged reports that TopicID was merged into Into: its messages now
+// live there and links to it redirect there.
+type TopicMerged struct {
+	TopicID int    `json:"topic_id"`
+	Into    *Topic `json:"into"`
+}
+
+// TopicSplit lists the messages split out of a topic into Topic, the root
+// of the split sub-thread first.
+type TopicSplit struct {
+	MessageIDs []int  `json:"message_ids"`
+	Topic      *Topic `json:"topic"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// LoginAttempt is one entry in the login audit trail.
+type LoginAttempt struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
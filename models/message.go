@@ -2,12 +2,31 @@ package models
 
 import "time"
 
+// MessageTombstone is shown in place of a deleted message's text.
+const MessageTombstone = "[deleted]"
+
+// Message is a post in a topic. A deleted message keeps its place in the
+// reply tree, but its text is replaced by MessageTombstone and DeletedAt is
+// set.
 type Message struct {
-	ID        int       `json:"id"`
-	Message   string    `json:"message"`
-	UserID    int       `json:"user_id"`
-	TopicID   int       `json:"topic_id"`
-	ParentID  *int      `json:"parent_id,omitempty"`
-	Likes     int       `json:"likes"`
-	Timestamp time.Time `json:"timestamp"`
+	ID        int            `json:"id"`
+	Message   string         `json:"message"`
+	UserID    int            `json:"user_id"`
+	TopicID   int            `json:"topic_id"`
+	ParentID  *int           `json:"parent_id"`
+	Likes     int            `json:"likes"`
+	Reactions map[string]int `json:"reactions"`
+	Timestamp time.Time      `json:"timestamp"`
+	EditedAt  *time.Time     `json:"edited_at"`
+	DeletedAt *time.Time     `json:"deleted_at"`
+}
+
+// MessageRevision is one version of a message's text. Version 1 is what was
+// originally posted and every edit adds the next one, so EditorID and
+// EditedAt say who wrote this version and when.
+type MessageRevision struct {
+	Version  int       `json:"version"`
+	Message  string    `json:"message"`
+	EditorID int       `json:"editor_id"`
+	EditedAt time.Time `json:"edited_at"`
 }
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+type Reaction struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Reaction  string    `json:"reaction"`
+	CreatedAt time.Time `json:"created_at"`
+}
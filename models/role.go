@@ -0,0 +1,26 @@
+package models
+
+// Roles a user can hold, from least to most privileged. Each role can do
+// everything the roles before it can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// HasRole reports whether u holds role or a more privileged one.
+func (u *User) HasRole(role string) bool {
+	return roleRank[u.Role] >= roleRank[role] && roleRank[role] > 0
+}
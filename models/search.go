@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SearchHit is one topic or message matching a search. Snippet is HTML
+// escaped, with the matched terms wrapped in <mark> tags.
+type SearchHit struct {
+	Type       string    `json:"type"`
+	ID         int       `json:"id"`
+	TopicID    int       `json:"topic_id"`
+	TopicTitle string    `json:"topic_title"`
+	TopicSlug  string    `json:"topic_slug"`
+	Author     string    `json:"author"`
+	Snippet    string    `json:"snippet"`
+	Score      float64   `json:"score"`
+	CreatedAt  time.Time `json:"created_at"`
+}
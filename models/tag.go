@@ -0,0 +1,38 @@
+package models
+
+import "strings"
+
+const (
+	// MaxTagLength caps the length of a tag name in bytes.
+	MaxTagLength = 32
+	// MaxTopicTags caps how many tags one topic may carry.
+	MaxTopicTags = 5
+)
+
+// Tag is a label topics can be filed under. Topics counts the topics that
+// currently carry it.
+type Tag struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Topics int    `json:"topics"`
+}
+
+// NormalizeTag trims and lowercases name and reports whether the result is a
+// valid tag: 1 to MaxTagLength characters of a-z, 0-9, '+', '#', '.' or
+// '-', starting with a letter or digit.
+func NormalizeTag(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || len(name) > MaxTagLength {
+		return "", false
+	}
+
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case i > 0 && strings.ContainsRune("+#.-", r):
+		default:
+			return "", false
+		}
+	}
+	return name, true
+}
@@ -0,0 +1,19 @@
+package models
+
+// ThreadMessage is a message with the replies that were loaded beneath it.
+// ReplyCount is the number of direct replies, whether loaded or not, and
+// MoreReplies is the cursor for fetching the ones that were left out.
+type ThreadMessage struct {
+	Message
+	Depth       int             `json:"depth"`
+	ReplyCount  int             `json:"reply_count"`
+	Replies     []ThreadMessage `json:"replies"`
+	MoreReplies string          `json:"more_replies,omitempty"`
+}
+
+type Thread struct {
+	TopicID    int             `json:"topic_id"`
+	ParentID   *int            `json:"parent_id"`
+	Messages   []ThreadMessage `json:"messages"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
@@ -1,12 +1,61 @@
 package models
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
+
+// MaxDescriptionLength caps a topic's description, in characters.
+const MaxDescriptionLength = 280
+
+// States a moderator can put a topic in. Each is independent of the others
+// and recorded on the topic as the time it was entered.
+const (
+	// TopicLocked topics take no new messages.
+	TopicLocked = "locked"
+	// TopicPinned topics are listed before all others.
+	TopicPinned = "pinned"
+	// TopicArchived topics are read-only: no new messages, edits or votes.
+	// Topics are also archived automatically once they have been inactive
+	// for long enough.
+	TopicArchived = "archived"
+)
+
+// ValidTopicState reports whether state is one of the topic states.
+func ValidTopicState(state string) bool {
+	switch state {
+	case TopicLocked, TopicPinned, TopicArchived:
+		return true
+	}
+	return false
+}
 
 type Topic struct {
-	ID           int       `json:"id"`
-	Title        string    `json:"title"`
-	CreatorID    int       `json:"creator_id"`
-	Messages     int       `json:"messages"`
-	Upvotes      int       `json:"upvotes"`
-	CreationDate time.Time `json:"creation_date"`
+	ID           int        `json:"id"`
+	Title        string     `json:"title"`
+	Slug         string     `json:"slug"`
+	Description  string     `json:"description"`
+	Body         string     `json:"body"`
+	Tags         []string   `json:"tags"`
+	CategoryID   int        `json:"category_id"`
+	CreatorID    int        `json:"creator_id"`
+	Messages     int        `json:"messages"`
+	Upvotes      int        `json:"upvotes"`
+	CreationDate time.Time  `json:"creation_date"`
+	LockedAt     *time.Time `json:"locked_at"`
+	PinnedAt     *time.Time `json:"pinned_at"`
+	ArchivedAt   *time.Time `json:"archived_at"`
+}
+
+// Closed reports whether the topic takes no new messages, because it is
+// either locked or archived.
+func (t Topic) Closed() bool {
+	return t.LockedAt != nil || t.ArchivedAt != nil
+}
+
+// Ref is how the topic is addressed in URLs: its ID followed by its slug,
+// such as "42-hello-world". The ID alone identifies the topic; the slug is
+// there for people reading the URL.
+func (t Topic) Ref() string {
+	return strconv.Itoa(t.ID) + "-" + t.Slug
 }
@@ -3,12 +3,13 @@ package models
 import "time"
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"-"`
-	Email        string    `json:"email"`
-	ResetCode    *string   `json:"reset_code,omitempty"`
-	TopicsOpened int       `json:"topics_opened"`
-	MessagesSent int       `json:"messages_sent"`
-	CreationDate time.Time `json:"creation_date"`
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	PasswordHash  string    `json:"-"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"email_verified"`
+	Role          string    `json:"role"`
+	TopicsOpened  int       `json:"topics_opened"`
+	MessagesSent  int       `json:"messages_sent"`
+	CreationDate  time.Time `json:"creation_date"`
 }
@@ -0,0 +1,308 @@
+// Package presence tracks which users are looking at a topic and which of
+// them are typing. Every change is sent to the topic's watchers as a full
+// snapshot, so a client never has to reconcile partial updates.
+package presence
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+const (
+	DefaultQueueSize = 32
+
+	// MaxTopicsPerClient caps how many topics one connection may watch.
+	MaxTopicsPerClient = 32
+)
+
+// Message types exchanged with clients.
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeTypingStart = "typing.start"
+	TypeTypingStop  = "typing.stop"
+	TypePing        = "ping"
+	TypePong        = "pong"
+	TypePresence    = "presence"
+	TypeError       = "error"
+)
+
+var (
+	ErrClientClosed  = errors.New("connection is closed")
+	ErrInvalidTopic  = errors.New("topic_id must be a positive integer")
+	ErrTooManyTopics = errors.New("watching too many topics")
+	ErrNotWatching   = errors.New("not watching that topic")
+)
+
+// Member is one user in a topic's presence list. A user with several
+// connections open appears once and counts as typing if any of them is.
+type Member struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+}
+
+// PresenceMessage is sent to every watcher of a topic whenever its members
+// or their typing state change.
+type PresenceMessage struct {
+	Type    string   `json:"type"`
+	TopicID int      `json:"topic_id"`
+	Members []Member `json:"members"`
+}
+
+// Message is what clients send, and what the server sends back for pongs
+// and errors.
+type Message struct {
+	Type    string `json:"type"`
+	TopicID int    `json:"topic_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Client is one connection's view of the hub. Messages for it are queued on
+// Send; the connection's writer is expected to drain it promptly.
+type Client struct {
+	hub  *Hub
+	user models.User
+	send chan []byte
+
+	// The fields below are guarded by hub.mu.
+	topics map[int]bool // topic ID to typing
+	closed bool
+}
+
+// Send is the client's outgoing queue. It is closed when the client is
+// closed, including when the hub drops it for falling behind.
+func (c *Client) Send() <-chan []byte {
+	return c.send
+}
+
+// Hub holds the presence state of every topic.
+type Hub struct {
+	mu        sync.Mutex
+	queueSize int
+	topics    map[int]map[*Client]struct{}
+	// changed holds topics whose watchers have not yet been sent the latest
+	// presence list.
+	changed map[int]struct{}
+}
+
+// NewHub returns a hub whose clients may have queueSize messages waiting
+// before they are dropped.
+func NewHub(queueSize int) *Hub {
+	return &Hub{
+		queueSize: max(queueSize, 1),
+		topics:    make(map[int]map[*Client]struct{}),
+		changed:   make(map[int]struct{}),
+	}
+}
+
+// Join registers a connection for user.
+func (h *Hub) Join(user *models.User) *Client {
+	return &Client{
+		hub:    h,
+		user:   *user,
+		send:   make(chan []byte, h.queueSize),
+		topics: make(map[int]bool),
+	}
+}
+
+// Watch adds the client to a topic's presence list.
+func (c *Client) Watch(topicID int) error {
+	if topicID <= 0 {
+		return ErrInvalidTopic
+	}
+
+	h := c.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+	if _, ok := c.topics[topicID]; ok {
+		return nil
+	}
+	if len(c.topics) >= MaxTopicsPerClient {
+		return ErrTooManyTopics
+	}
+
+	c.topics[topicID] = false
+	if h.topics[topicID] == nil {
+		h.topics[topicID] = make(map[*Client]struct{})
+	}
+	h.topics[topicID][c] = struct{}{}
+	h.changed[topicID] = struct{}{}
+	h.flush()
+	return nil
+}
+
+// Unwatch removes the client from a topic's presence list.
+func (c *Client) Unwatch(topicID int) error {
+	h := c.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+	if _, ok := c.topics[topicID]; !ok {
+		return ErrNotWatching
+	}
+
+	h.leave(c, topicID)
+	h.changed[topicID] = struct{}{}
+	h.flush()
+	return nil
+}
+
+// SetTyping marks whether the client's user is typing in a topic it watches.
+func (c *Client) SetTyping(topicID int, typing bool) error {
+	h := c.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+	current, ok := c.topics[topicID]
+	if !ok {
+		return ErrNotWatching
+	}
+	if current == typing {
+		return nil
+	}
+
+	c.topics[topicID] = typing
+	h.changed[topicID] = struct{}{}
+	h.flush()
+	return nil
+}
+
+// Reply queues a message for this client alone. It reports false if the
+// client has been closed or its queue is full, in which case it is dropped.
+func (c *Client) Reply(msg any) bool {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("error encoding message for %s: %v", c.user.Username, err)
+		return false
+	}
+
+	h := c.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	ok := h.deliver(c, payload)
+	h.flush()
+	return ok
+}
+
+// Close removes the client from every topic it watches and closes its queue.
+// It is safe to call more than once.
+func (c *Client) Close() {
+	h := c.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(c)
+	h.flush()
+}
+
+// Members returns a topic's current presence list, sorted by username.
+func (h *Hub) Members(topicID int) []Member {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.members(topicID)
+}
+
+// members builds a topic's presence list. h.mu must be held.
+func (h *Hub) members(topicID int) []Member {
+	byUser := make(map[int]*Member)
+	for c := range h.topics[topicID] {
+		m := byUser[c.user.ID]
+		if m == nil {
+			m = &Member{UserID: c.user.ID, Username: c.user.Username}
+			byUser[c.user.ID] = m
+		}
+		m.Typing = m.Typing || c.topics[topicID]
+	}
+
+	members := make([]Member, 0, len(byUser))
+	for _, m := range byUser {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	return members
+}
+
+// flush sends the latest presence list of every changed topic. Dropping a
+// slow client while doing so changes more topics, so it repeats until
+// nothing is left. h.mu must be held.
+func (h *Hub) flush() {
+	for len(h.changed) > 0 {
+		for topicID := range h.changed {
+			delete(h.changed, topicID)
+			h.broadcast(topicID)
+			break
+		}
+	}
+}
+
+// broadcast sends the topic's presence list to everyone watching it. h.mu
+// must be held.
+func (h *Hub) broadcast(topicID int) {
+	payload, err := json.Marshal(PresenceMessage{Type: TypePresence, TopicID: topicID, Members: h.members(topicID)})
+	if err != nil {
+		log.Printf("error encoding presence for topic ID %d: %v", topicID, err)
+		return
+	}
+
+	for c := range h.topics[topicID] {
+		h.deliver(c, payload)
+	}
+}
+
+// deliver queues payload for c without blocking, dropping c if its queue is
+// full. h.mu must be held.
+func (h *Hub) deliver(c *Client, payload []byte) bool {
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		log.Printf("dropping slow connection for %s", c.user.Username)
+		h.drop(c)
+		return false
+	}
+}
+
+// drop closes c and marks the topics it watched as changed. h.mu must be
+// held.
+func (h *Hub) drop(c *Client) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+
+	for topicID := range c.topics {
+		h.leave(c, topicID)
+		h.changed[topicID] = struct{}{}
+	}
+}
+
+// leave removes c from a topic without telling anyone. h.mu must be held.
+func (h *Hub) leave(c *Client, topicID int) {
+	delete(c.topics, topicID)
+	delete(h.topics[topicID], c)
+	if len(h.topics[topicID]) == 0 {
+		delete(h.topics, topicID)
+	}
+}
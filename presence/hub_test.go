@@ -0,0 +1,143 @@
+package presence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dDogge/Brainwave/models"
+)
+
+// next decodes the next queued presence message for c without waiting.
+func next(t *testing.T, c *Client) PresenceMessage {
+	t.Helper()
+
+	select {
+	case payload, ok := <-c.Send():
+		if !ok {
+			t.Fatal("expected a message, but the queue is closed")
+		}
+		var msg PresenceMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatalf("failed to decode %s: %v", payload, err)
+		}
+		return msg
+	default:
+		t.Fatal("expected a queued message")
+	}
+	return PresenceMessage{}
+}
+
+func TestPresence(t *testing.T) {
+	hub := NewHub(8)
+	alice := hub.Join(&models.User{ID: 1, Username: "alice"})
+	bob := hub.Join(&models.User{ID: 2, Username: "bob"})
+	bobAgain := hub.Join(&models.User{ID: 2, Username: "bob"})
+
+	if err := alice.Watch(7); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if msg := next(t, alice); msg.Type != TypePresence || msg.TopicID != 7 || len(msg.Members) != 1 {
+		t.Fatalf("unexpected presence: %+v", msg)
+	}
+
+	// Watching twice changes nothing.
+	if err := alice.Watch(7); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if err := bob.Watch(7); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := bobAgain.Watch(7); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := bobAgain.SetTyping(7, true); err != nil {
+		t.Fatalf("SetTyping failed: %v", err)
+	}
+
+	want := []Member{{1, "alice", false}, {2, "bob", true}}
+	if got := hub.Members(7); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected members %v, got %v", want, got)
+	}
+
+	next(t, alice)
+	next(t, alice)
+	if msg := next(t, alice); fmt.Sprint(msg.Members) != fmt.Sprint(want) {
+		t.Errorf("expected alice to see %v, got %v", want, msg.Members)
+	}
+
+	bobAgain.Close()
+	if got := hub.Members(7); fmt.Sprint(got) != fmt.Sprint([]Member{{1, "alice", false}, {2, "bob", false}}) {
+		t.Errorf("expected bob to stay without typing, got %v", got)
+	}
+
+	if err := bob.Unwatch(7); err != nil {
+		t.Fatalf("Unwatch failed: %v", err)
+	}
+	if got := hub.Members(7); len(got) != 1 || got[0].Username != "alice" {
+		t.Errorf("expected only alice to be left, got %v", got)
+	}
+
+	if err := bob.Unwatch(7); !errors.Is(err, ErrNotWatching) {
+		t.Errorf("expected ErrNotWatching, got %v", err)
+	}
+	if err := bob.SetTyping(7, true); !errors.Is(err, ErrNotWatching) {
+		t.Errorf("expected ErrNotWatching, got %v", err)
+	}
+	if err := bob.Watch(0); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("expected ErrInvalidTopic, got %v", err)
+	}
+	if err := bobAgain.Watch(7); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestTopicLimit(t *testing.T) {
+	hub := NewHub(MaxTopicsPerClient + 1)
+	c := hub.Join(&models.User{ID: 1, Username: "alice"})
+
+	for topicID := 1; topicID <= MaxTopicsPerClient; topicID++ {
+		if err := c.Watch(topicID); err != nil {
+			t.Fatalf("Watch(%d) failed: %v", topicID, err)
+		}
+	}
+	if err := c.Watch(MaxTopicsPerClient + 1); !errors.Is(err, ErrTooManyTopics) {
+		t.Errorf("expected ErrTooManyTopics, got %v", err)
+	}
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+	hub := NewHub(2)
+	slow := hub.Join(&models.User{ID: 1, Username: "slow"})
+	fast := hub.Join(&models.User{ID: 2, Username: "fast"})
+
+	if err := slow.Watch(1); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := fast.Watch(1); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	next(t, fast)
+
+	// slow now has two unread messages, so the next one overflows its queue.
+	if err := fast.SetTyping(1, true); err != nil {
+		t.Fatalf("SetTyping failed: %v", err)
+	}
+
+	// fast is told about its own typing and then that slow is gone.
+	next(t, fast)
+	if msg := next(t, fast); len(msg.Members) != 1 || msg.Members[0].Username != "fast" {
+		t.Errorf("expected slow to be dropped from the presence list, got %+v", msg.Members)
+	}
+
+	for range slow.Send() {
+	}
+	if err := slow.Watch(2); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if slow.Reply(Message{Type: TypePong}) {
+		t.Error("expected Reply to a dropped client to fail")
+	}
+}
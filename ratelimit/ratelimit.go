@@ -0,0 +1,148 @@
+// Package ratelimit hands out tokens from named token buckets. Each bucket
+// holds up to Limit.Burst tokens and refills at Limit.Burst per Limit.Per,
+// so a client can act in a short burst and then at a steady pace.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often MemoryBackend forgets buckets that have
+// filled back up.
+const sweepInterval = time.Minute
+
+// Limit is the size and refill rate of a bucket. The zero Limit means no
+// limit at all.
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Unlimited reports whether l limits nothing.
+func (l Limit) Unlimited() bool {
+	return l.Burst <= 0 || l.Per <= 0
+}
+
+// rate is how many tokens the bucket gains per second.
+func (l Limit) rate() float64 {
+	return float64(l.Burst) / l.Per.Seconds()
+}
+
+// Result is the state of a bucket after trying to take a token from it.
+type Result struct {
+	Allowed bool
+	Limit   int
+	// Remaining is how many whole tokens are left.
+	Remaining int
+	// RetryAfter is how long until the next token, or 0 if one is
+	// available now.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Backend keeps the buckets. Take takes a token from the bucket called key,
+// creating it full if it does not exist yet. Refund puts back a token Take
+// handed out, never filling the bucket past its burst, for when another
+// bucket refuses the same request. Both must be safe for concurrent use.
+type Backend interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	Refund(ctx context.Context, key string, limit Limit) error
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// refill adds the tokens earned since the bucket was last touched.
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.rate())
+		b.last = now
+	}
+}
+
+// MemoryBackend keeps buckets in memory, so each server process limits on
+// its own. Buckets that have filled back up are forgotten now and then to
+// keep memory bounded.
+type MemoryBackend struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryBackend) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		m.buckets[key] = b
+	}
+	b.refill(now)
+
+	result := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.rate())
+	return result, nil
+}
+
+func (m *MemoryBackend) Refund(ctx context.Context, key string, limit Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A missing bucket is already full.
+	b, ok := m.buckets[key]
+	if !ok || b.limit != limit {
+		return nil
+	}
+	b.refill(m.now())
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	return nil
+}
+
+// sweep forgets the buckets that are full again, since a missing bucket
+// behaves exactly like a full one.
+func (m *MemoryBackend) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
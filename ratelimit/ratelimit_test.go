@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock is a fake time source tests move forward by hand.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBackend() (*MemoryBackend, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewMemoryBackend()
+	m.now = c.now
+	return m, c
+}
+
+func take(t *testing.T, m *MemoryBackend, key string, limit Limit) Result {
+	t.Helper()
+	result, err := m.Take(context.Background(), key, limit)
+	if err != nil {
+		t.Fatalf("Take failed: %v", err)
+	}
+	return result
+}
+
+func TestTakeBurstThenRefill(t *testing.T) {
+	m, c := newTestBackend()
+	limit := Limit{Burst: 3, Per: time.Minute}
+
+	for want := 2; want >= 0; want-- {
+		result := take(t, m, "alice", limit)
+		if !result.Allowed || result.Remaining != want || result.Limit != 3 {
+			t.Fatalf("expected an allowed take leaving %d, got %+v", want, result)
+		}
+	}
+
+	result := take(t, m, "alice", limit)
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected the empty bucket to refuse, got %+v", result)
+	}
+	if result.RetryAfter != 20*time.Second || result.Reset != time.Minute {
+		t.Errorf("expected a token in 20s and a full bucket in a minute, got %+v", result)
+	}
+
+	if result := take(t, m, "bob", limit); !result.Allowed {
+		t.Errorf("expected other keys to have their own bucket, got %+v", result)
+	}
+
+	c.advance(20 * time.Second)
+	if result := take(t, m, "alice", limit); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("expected one token after 20s, got %+v", result)
+	}
+
+	c.advance(time.Hour)
+	if result := take(t, m, "alice", limit); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("expected the bucket to fill no further than its burst, got %+v", result)
+	}
+}
+
+func TestTakeUnlimited(t *testing.T) {
+	m, _ := newTestBackend()
+
+	for i := 0; i < 100; i++ {
+		if result := take(t, m, "alice", Limit{}); !result.Allowed {
+			t.Fatalf("expected the zero Limit to allow everything, got %+v", result)
+		}
+	}
+	if len(m.buckets) != 0 {
+		t.Errorf("expected no buckets for an unlimited key, got %d", len(m.buckets))
+	}
+}
+
+func TestTakeLimitChange(t *testing.T) {
+	m, _ := newTestBackend()
+
+	take(t, m, "alice", Limit{Burst: 1, Per: time.Minute})
+	if result := take(t, m, "alice", Limit{Burst: 5, Per: time.Minute}); !result.Allowed || result.Remaining != 4 {
+		t.Errorf("expected a new limit to start a new bucket, got %+v", result)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	m, _ := newTestBackend()
+	limit := Limit{Burst: 2, Per: time.Minute}
+
+	take(t, m, "alice", limit)
+	take(t, m, "alice", limit)
+	if err := m.Refund(context.Background(), "alice", limit); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+	if result := take(t, m, "alice", limit); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("expected the refunded token to be taken again, got %+v", result)
+	}
+
+	// Refunds never fill a bucket past its burst.
+	for i := 0; i < 3; i++ {
+		if err := m.Refund(context.Background(), "alice", limit); err != nil {
+			t.Fatalf("Refund failed: %v", err)
+		}
+	}
+	if result := take(t, m, "alice", limit); result.Remaining != 1 {
+		t.Errorf("expected a full bucket of %d, got %+v", limit.Burst, result)
+	}
+
+	if err := m.Refund(context.Background(), "bob", limit); err != nil {
+		t.Errorf("expected refunding a missing bucket to do nothing, got %v", err)
+	}
+}
+
+func TestSweepForgetsFullBuckets(t *testing.T) {
+	m, c := newTestBackend()
+	limit := Limit{Burst: 2, Per: time.Minute}
+
+	take(t, m, "alice", limit)
+	c.advance(sweepInterval / 2)
+	take(t, m, "bob", limit)
+	take(t, m, "bob", limit)
+
+	c.advance(sweepInterval / 2)
+	take(t, m, "carol", limit)
+
+	if _, ok := m.buckets["alice"]; ok {
+		t.Error("expected alice's refilled bucket to be swept")
+	}
+	if _, ok := m.buckets["bob"]; !ok {
+		t.Error("expected bob's bucket to be kept until it refills")
+	}
+}
+
+func TestTakeConcurrent(t *testing.T) {
+	m := NewMemoryBackend()
+	limit := Limit{Burst: 50, Per: time.Hour}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := m.Take(context.Background(), "alice", limit)
+			if err == nil && result.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 50 {
+		t.Errorf("expected exactly 50 takes to be allowed, got %d", allowed)
+	}
+}
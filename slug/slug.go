@@ -0,0 +1,116 @@
+// Package slug turns titles into readable, URL-safe path segments.
+package slug
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MaxLength caps the length of a slug in characters, suffix included.
+const MaxLength = 80
+
+// Fallback is the slug of a title that has nothing left to keep, such as
+// one made only of punctuation.
+const Fallback = "topic"
+
+// transliterations spells out Latin letters with diacritics, Greek and
+// Cyrillic in plain ASCII. Each entry maps every lowercase letter in its
+// first field to its second.
+var transliterations = [][2]string{
+	{"àáâãäåāăą", "a"}, {"æ", "ae"}, {"çćĉċč", "c"}, {"ďđð", "d"},
+	{"èéêëēĕėęě", "e"}, {"ĝğġģ", "g"}, {"ĥħ", "h"}, {"ìíîïĩīĭįı", "i"},
+	{"ĳ", "ij"}, {"ĵ", "j"}, {"ķ", "k"}, {"ĺļľŀł", "l"}, {"ñńņňŉ", "n"},
+	{"ŋ", "ng"}, {"òóôõöøōŏő", "o"}, {"œ", "oe"}, {"ŕŗř", "r"},
+	{"śŝşšș", "s"}, {"ß", "ss"}, {"ţťŧț", "t"}, {"þ", "th"},
+	{"ùúûüũūŭůűų", "u"}, {"ŵ", "w"}, {"ýÿŷ", "y"}, {"źżž", "z"},
+
+	{"αά", "a"}, {"β", "v"}, {"γ", "g"}, {"δ", "d"}, {"εέ", "e"}, {"ζ", "z"},
+	{"ηή", "i"}, {"θ", "th"}, {"ιίϊΐ", "i"}, {"κ", "k"}, {"λ", "l"},
+	{"μ", "m"}, {"ν", "n"}, {"ξ", "x"}, {"οό", "o"}, {"π", "p"}, {"ρ", "r"},
+	{"σς", "s"}, {"τ", "t"}, {"υύϋΰ", "y"}, {"φ", "f"}, {"χ", "ch"},
+	{"ψ", "ps"}, {"ωώ", "o"},
+
+	{"а", "a"}, {"б", "b"}, {"в", "v"}, {"гґ", "g"}, {"д", "d"}, {"еэ", "e"},
+	{"ё", "yo"}, {"ж", "zh"}, {"з", "z"}, {"иі", "i"}, {"йы", "y"},
+	{"к", "k"}, {"л", "l"}, {"м", "m"}, {"н", "n"}, {"о", "o"}, {"п", "p"},
+	{"р", "r"}, {"с", "s"}, {"т", "t"}, {"уў", "u"}, {"ф", "f"}, {"х", "kh"},
+	{"ц", "ts"}, {"ч", "ch"}, {"ш", "sh"}, {"щ", "shch"}, {"ъь", ""},
+	{"ю", "yu"}, {"я", "ya"}, {"ї", "yi"}, {"є", "ye"},
+}
+
+var ascii = make(map[rune]string)
+
+func init() {
+	for _, t := range transliterations {
+		for _, r := range t[0] {
+			ascii[r] = t[1]
+		}
+	}
+}
+
+// Make returns the slug for title: lowercase words joined by hyphens.
+// Letters from the tables above are transliterated to ASCII; letters and
+// digits of other scripts are kept as they are, and everything else
+// separates words. Apostrophes and combining marks are dropped without
+// splitting the word. Slugs longer than MaxLength are cut at a word boundary
+// where possible.
+func Make(title string) string {
+	var b strings.Builder
+	separate := false
+	write := func(s string) {
+		if separate && b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		separate = false
+		b.WriteString(s)
+	}
+
+	for _, r := range strings.ToLower(title) {
+		if s, ok := ascii[r]; ok {
+			write(s)
+			continue
+		}
+
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9',
+			r > unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			write(string(r))
+		case r == '\'' || r == '’' || unicode.Is(unicode.Mn, r):
+		default:
+			separate = true
+		}
+	}
+
+	s := truncate(b.String(), MaxLength)
+	if s == "" {
+		return Fallback
+	}
+	return s
+}
+
+// WithSuffix returns the n-th candidate for a slug that may already be
+// taken: slug itself for n <= 1, and slug-n after that, shortened if needed
+// to stay within MaxLength.
+func WithSuffix(slug string, n int) string {
+	if n <= 1 {
+		return slug
+	}
+	suffix := "-" + strconv.Itoa(n)
+	return truncate(slug, MaxLength-len(suffix)) + suffix
+}
+
+// truncate cuts s to at most max characters, backing up to the last hyphen
+// if that leaves something, and drops any hyphen left at the end.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+
+	cut := string(runes[:max])
+	if i := strings.LastIndexByte(cut, '-'); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, "-")
+}
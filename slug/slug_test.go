@@ -0,0 +1,66 @@
+package slug
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{"Plain words", "Hello World", "hello-world"},
+		{"Punctuation", "Go 1.23: what's new?", "go-1-23-whats-new"},
+		{"Surrounding separators", "  --Hello--  ", "hello"},
+		{"Diacritics", "Crème brûlée à la française", "creme-brulee-a-la-francaise"},
+		{"Ligatures and special letters", "Straße, Æsir, Øresund, Łódź, Þór", "strasse-aesir-oresund-lodz-thor"},
+		{"Combining marks", "Cafe\u0301", "cafe"},
+		{"Greek", "Καλημέρα κόσμε", "kalimera-kosme"},
+		{"Cyrillic", "Привет, мир", "privet-mir"},
+		{"Other scripts kept", "日本語 と Go", "日本語-と-go"},
+		{"Nothing to keep", "?!?", Fallback},
+		{"Empty", "", Fallback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Make(tt.title); got != tt.want {
+				t.Errorf("Make(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeTruncates(t *testing.T) {
+	title := strings.Repeat("word ", 30)
+	got := Make(title)
+	if utf8.RuneCountInString(got) > MaxLength {
+		t.Errorf("expected at most %d characters, got %d: %q", MaxLength, utf8.RuneCountInString(got), got)
+	}
+	if strings.HasSuffix(got, "-") || !strings.HasSuffix(got, "word") {
+		t.Errorf("expected the slug to be cut at a word boundary, got %q", got)
+	}
+
+	long := strings.Repeat("x", 2*MaxLength)
+	if got := Make(long); got != long[:MaxLength] {
+		t.Errorf("expected a single long word to be cut at %d characters, got %q", MaxLength, got)
+	}
+}
+
+func TestWithSuffix(t *testing.T) {
+	if got := WithSuffix("hello", 1); got != "hello" {
+		t.Errorf("expected the first candidate to be the slug itself, got %q", got)
+	}
+	if got := WithSuffix("hello", 3); got != "hello-3" {
+		t.Errorf("expected hello-3, got %q", got)
+	}
+
+	long := Make(strings.Repeat("word ", 30))
+	got := WithSuffix(long, 12)
+	if utf8.RuneCountInString(got) > MaxLength || !strings.HasSuffix(got, "word-12") {
+		t.Errorf("expected a shortened slug ending in -12, got %q", got)
+	}
+}
@@ -0,0 +1,128 @@
+// Package totp generates and checks time-based one-time passwords as
+// described in RFC 6238, with the settings authenticator apps expect:
+// HMAC-SHA1, six digits and a thirty second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits is the length of a code.
+	Digits = 6
+	// Period is how long a code is good for.
+	Period = 30 * time.Second
+	// Skew is how many periods either side of now a code is still accepted
+	// in, to allow for clocks that have drifted a little.
+	Skew = 1
+	// SecretSize is how many random bytes a generated secret has.
+	SecretSize = 20
+)
+
+var ErrInvalidSecret = errors.New("invalid secret")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded without
+// padding as authenticator apps expect.
+func GenerateSecret() (string, error) {
+	b := make([]byte, SecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate secret: %w", err)
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimRight(secret, "="), " ", ""))
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// Counter returns the number of the period t falls in.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return generate(key, Counter(t)), nil
+}
+
+func generate(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
+
+// Validate checks code against secret at time t, allowing Skew periods of
+// drift. It returns the counter of the period the code matched, which
+// callers should remember so a code cannot be used twice, and whether it
+// matched at all.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := decode(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	now := Counter(t)
+	for counter := now - Skew; counter <= now+Skew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(generate(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth URI for secret, which authenticator apps read
+// from a QR code to set up an account named account under issuer.
+func URI(issuer, account, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key from the test vectors of RFC 6238, base32
+// encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The last six digits of the RFC 6238 SHA1 test vectors.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := Code("not base32!", time.Now()); err != ErrInvalidSecret {
+		t.Errorf("expected ErrInvalidSecret, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	code, _ := Code(rfcSecret, now)
+	counter, ok := Validate(rfcSecret, code, now)
+	if !ok || counter != Counter(now) {
+		t.Fatalf("expected the current code to match counter %d, got %d, %v", Counter(now), counter, ok)
+	}
+
+	previous, _ := Code(rfcSecret, now.Add(-Period))
+	if counter, ok := Validate(rfcSecret, previous, now); !ok || counter != Counter(now)-1 {
+		t.Errorf("expected the previous code to be accepted, got %d, %v", counter, ok)
+	}
+
+	stale, _ := Code(rfcSecret, now.Add(-3*Period))
+	if _, ok := Validate(rfcSecret, stale, now); ok {
+		t.Error("expected a code from three periods ago to be refused")
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(rfcSecret, bad, now); ok {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+	if _, ok := Validate("not base32!", code, now); ok {
+		t.Error("expected an invalid secret to match nothing")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret failed: %v", err)
+	}
+	b, _ := GenerateSecret()
+	if a == b {
+		t.Error("expected two secrets to differ")
+	}
+	if key, err := decode(a); err != nil || len(key) != SecretSize {
+		t.Errorf("expected %q to decode to %d bytes, got %d, %v", a, SecretSize, len(key), err)
+	}
+	if _, err := Code(a, time.Now()); err != nil {
+		t.Errorf("expected a generated secret to be usable, got %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Brainwave", "alice smith", rfcSecret))
+	if err != nil {
+		t.Fatalf("failed to parse URI: %v", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Brainwave:alice smith" {
+		t.Errorf("unexpected URI %s", u)
+	}
+
+	q := u.Query()
+	if q.Get("secret") != rfcSecret || q.Get("issuer") != "Brainwave" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected parameters %v", q)
+	}
+}